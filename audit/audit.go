@@ -0,0 +1,95 @@
+// Package audit records administrative actions in an append-only JSON lines file.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry is one recorded action.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`            // Who acted, e.g. "parent"
+	Remote string    `json:"remote,omitempty"` // Address of the API client
+	Action string    `json:"action"`           // e.g. "override.set"
+	Target string    `json:"target,omitempty"` // e.g. the device (User) name
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Log appends entries to a file.
+type Log struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewLog creates a log writing to path; the directory is created on first use.
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Record appends e, filling in the time. Failures are logged, never returned:
+// the audited action has already happened.
+func (l *Log) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		log.Printf("[AUDIT] Failed to create log dir: %v", err)
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("[AUDIT] Failed to open %s: %v", l.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("[AUDIT] Failed to write %s: %v", l.path, err)
+	}
+}
+
+// Recent returns up to n of the latest entries, newest first.
+func (l *Log) Recent(n int) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+		if len(entries) > 2*n {
+			entries = entries[len(entries)-n:]
+		}
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, scanner.Err()
+}
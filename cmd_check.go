@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/registry"
+)
+
+// runCheckConfig parses and validates a config file without starting the server.
+// Usage: adblocker check-config [--config config.yaml] [--strict=false]
+func runCheckConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dataDir := fs.String("data", "data", "Path to data directory for caching")
+	strict := fs.Bool("strict", true, "Treat unknown keys as errors")
+	fs.Parse(args)
+
+	cfgMgr := config.NewManager(*configPath)
+	reg := registry.New(*dataDir)
+	reg.Wait = true
+	cfgMgr.LoadCallback = reg.Apply
+	cfgMgr.Strict = *strict
+	if err := cfgMgr.Load(); err != nil {
+		log.Fatalf("%s: %v", *configPath, err)
+	}
+
+	// Build the matchers too, they catch bad IPs, times and dates
+	if _, err := engine.NewEngine(cfgMgr.Get()); err != nil {
+		log.Fatalf("%s: %v", *configPath, err)
+	}
+
+	fmt.Printf("%s: OK\n", *configPath)
+}
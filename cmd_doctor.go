@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"adblocker/config"
+	"adblocker/registry"
+	"adblocker/server"
+
+	"github.com/miekg/dns"
+)
+
+// doctorTimeout bounds each network check.
+const doctorTimeout = 5 * time.Second
+
+// doctor collects the results of the checks.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) report(name string, err error, detail string) {
+	switch {
+	case err != nil:
+		d.failed = true
+		fmt.Printf("FAIL  %-34s %v\n", name, err)
+	case strings.HasPrefix(detail, "warning: "):
+		fmt.Printf("WARN  %-34s %s\n", name, strings.TrimPrefix(detail, "warning: "))
+	default:
+		fmt.Printf("PASS  %-34s %s\n", name, detail)
+	}
+}
+
+// runDoctor checks the environment the server needs and prints a pass/fail report.
+// Usage: adblocker doctor [--config config.yaml] [--data data] [--domain example.com]
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dataDir := fs.String("data", "data", "Path to data directory for caching")
+	domain := fs.String("domain", "example.com", "Domain to resolve through the upstreams")
+	fs.Parse(args)
+
+	d := &doctor{}
+
+	// 1. Config
+	cfgMgr := config.NewManager(*configPath)
+	reg := registry.New(*dataDir)
+	reg.Wait = true
+	cfgMgr.LoadCallback = reg.Apply
+	err := cfgMgr.Load()
+	d.report("config", err, *configPath)
+	cfg := cfgMgr.Get()
+
+	// 2. Listeners
+	listen := cfg.Server.ListenAddr
+	if listen == "" {
+		listen = ":53"
+	}
+	d.report("listen udp "+listen, checkListen("udp", listen), "bindable")
+	if !cfg.Server.DisableTCP {
+		d.report("listen tcp "+listen, checkListen("tcp", listen), "bindable")
+	}
+	for _, l := range []struct{ name, addr string }{{"dot", cfg.Server.ListenTLS}, {"doh", cfg.Server.ListenHTTPS}} {
+		if l.addr != "" {
+			d.report("listen "+l.name+" "+l.addr, checkListen("tcp", l.addr), "bindable")
+		}
+	}
+	if cfg.Server.ListenTLS != "" || cfg.Server.ListenHTTPS != "" {
+		detail, err := checkCertificate(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		d.report("tls certificate", err, detail)
+	}
+	if cfg.Server.AdminAddr != "" {
+		d.report("admin "+cfg.Server.AdminAddr, checkListen("tcp", cfg.Server.AdminAddr), "bindable")
+	}
+
+	// 3. Upstreams
+	upstreams := slices.Clone(upstreamAddrs(cfg))
+	for _, ug := range cfg.UserGroups {
+		for _, upstream := range ug.Upstream {
+			if !slices.Contains(upstreams, upstream) {
+				upstreams = append(upstreams, upstream)
+			}
+		}
+	}
+	if fb := cfg.Server.Fallback.Upstream; fb != "" {
+		upstreams = append(upstreams, fb)
+	}
+	for _, upstream := range upstreams {
+		for _, c := range upstreamChecks(upstream, cfg.Server.UpstreamTLS[upstream]) {
+			detail, err := c.run(dns.Fqdn(*domain))
+			d.report(fmt.Sprintf("upstream %s (%s)", c.addr, c.transport), err, detail)
+		}
+	}
+
+	// 4. MAC lookup, used to identify users by MAC
+	detail := "readable"
+	if err := server.CheckARP(); err != nil {
+		detail = fmt.Sprintf("warning: %v; users can only be matched by IP", err)
+	}
+	d.report("arp table", nil, detail)
+
+	// 5. Data directory
+	d.report("data dir "+*dataDir, checkWritable(*dataDir), "writable")
+
+	// 6. Clock, which schedules and certificate checks depend on
+	detail, err = checkClock(len(cfg.Schedules) > 0)
+	d.report("clock", err, detail)
+
+	if d.failed {
+		os.Exit(1)
+	}
+}
+
+func checkListen(network, addr string) error {
+	var c io.Closer
+	var err error
+	if network == "udp" {
+		c, err = net.ListenPacket(network, addr)
+	} else {
+		c, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "address already in use") {
+			return fmt.Errorf("%w (is another DNS server or adblocker running?)", err)
+		}
+		return err
+	}
+	return c.Close()
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "doctor.*.tmp")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkClock fails when the clock is obviously unset (no RTC, NTP not yet
+// synced) and warns when schedules would be evaluated in UTC.
+func checkClock(schedules bool) (string, error) {
+	now := time.Now()
+	if now.Year() < 2024 {
+		return "", fmt.Errorf("clock reads %s, is NTP running? Schedules and TLS list downloads need the right time", now.Format(time.RFC3339))
+	}
+	zone, offset := now.Zone()
+	if schedules && offset == 0 && (zone == "UTC" || zone == "GMT") {
+		return "warning: time zone is UTC and schedules are evaluated in it; set TZ if they are meant in local time", nil
+	}
+	return fmt.Sprintf("%s (%s)", now.Format("2006-01-02 15:04:05"), zone), nil
+}
+
+// checkCertificate loads the certificate of the encrypted listeners, failing
+// when it has expired and warning when it expires within two weeks.
+func checkCertificate(certFile, keyFile string) (string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	leaf := cert.Leaf
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		return "", fmt.Errorf("%s expired on %s", certFile, leaf.NotAfter.Format(time.DateOnly))
+	case left < 14*24*time.Hour:
+		return fmt.Sprintf("warning: %s expires on %s", certFile, leaf.NotAfter.Format(time.DateOnly)), nil
+	}
+	return fmt.Sprintf("%s, valid until %s", certFile, leaf.NotAfter.Format(time.DateOnly)), nil
+}
+
+// upstreamCheck resolves a probe domain through one upstream and transport.
+type upstreamCheck struct {
+	addr, transport string
+	run             func(name string) (string, error)
+}
+
+// upstreamChecks returns the checks for an upstream address: UDP and TCP
+// for plain DNS; tls:// and https:// go through the server's own client
+// with the configured TLS options.
+func upstreamChecks(upstream string, opts config.UpstreamTLS) []upstreamCheck {
+	if strings.Contains(upstream, "://") {
+		transport, _, _ := strings.Cut(upstream, "://")
+		return []upstreamCheck{{upstream, transport, func(name string) (string, error) {
+			c, err := server.NewUpstreamClient(upstream, opts)
+			if err != nil {
+				return "", err
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			start := time.Now()
+			resp, _, err := c.Exchange(m)
+			if err != nil {
+				return "", err
+			}
+			return probeDetail(resp, time.Since(start))
+		}}}
+	}
+	return []upstreamCheck{
+		{upstream, "udp", probeWith(&dns.Client{Net: "udp", Timeout: doctorTimeout}, upstream)},
+		{upstream, "tcp", probeWith(&dns.Client{Net: "tcp", Timeout: doctorTimeout}, upstream)},
+	}
+}
+
+func probeWith(c *dns.Client, addr string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		resp, rtt, err := c.Exchange(m, addr)
+		if err != nil {
+			return "", err
+		}
+		return probeDetail(resp, rtt)
+	}
+}
+
+func probeDetail(resp *dns.Msg, rtt time.Duration) (string, error) {
+	// NXDOMAIN still proves the upstream resolves; SERVFAIL or REFUSED does not
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	return fmt.Sprintf("%s, %d records in %v", dns.RcodeToString[resp.Rcode], len(resp.Answer), rtt.Round(time.Millisecond)), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/parser"
+	"adblocker/registry"
+)
+
+// runDumpRules loads the configured rules the way the server does and prints
+// them as parsed, to see what a list line turned into.
+// Usage: adblocker dump-rules [--group ads] [--domain example.com] [--json]
+func runDumpRules(args []string) {
+	fs := flag.NewFlagSet("dump-rules", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dataDir := fs.String("data", "data", "Path to data directory for caching")
+	group := fs.String("group", "", "Rule group to dump (default: all)")
+	domain := fs.String("domain", "", "Only rules matching this domain or a parent")
+	asJSON := fs.Bool("json", false, "Print JSON instead of a table")
+	fs.Parse(args)
+
+	cfgMgr := config.NewManager(*configPath)
+	reg := registry.New(*dataDir)
+	reg.Wait = true
+	cfgMgr.LoadCallback = reg.Apply
+	if err := cfgMgr.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	eng, err := engine.NewEngine(cfgMgr.Get())
+	if err != nil {
+		log.Fatalf("Failed to initialize engine: %v", err)
+	}
+	if err := eng.ReloadRules(parser.NewLoader(*dataDir)); err != nil {
+		log.Fatalf("Failed to load rules: %v", err)
+	}
+
+	rules, err := eng.DumpRules(*group, *domain)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rules)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tSOURCE\tTYPE\tPATTERN\tEXCEPTION\tMODIFIERS\tIP\tTEXT")
+	for _, r := range rules {
+		exception := ""
+		if r.Exception {
+			exception = "@@"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.RuleGroup, r.Source, r.Type, r.Pattern, exception, orDash(r.Modifiers), orDash(r.IP), r.Text)
+	}
+	tw.Flush()
+	log.Printf("%d rules", len(rules))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/export"
+	"adblocker/parser"
+	"adblocker/registry"
+)
+
+// runExport compiles the configured rule groups into a format other resolvers understand.
+// Usage: adblocker export --format rpz|hosts|dnsmasq [--group ads[,other]] [--output file]
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	dataDir := fs.String("data", "data", "Path to data directory for caching")
+	formatName := fs.String("format", "hosts", "Output format: rpz, hosts or dnsmasq")
+	groups := fs.String("group", "", "Comma-separated rule groups to export (default: all)")
+	zone := fs.String("zone", "rpz.adblocker.", "Zone origin for rpz output")
+	output := fs.String("output", "", "Output file (default: stdout)")
+	fs.Parse(args)
+
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	cfgMgr := config.NewManager(*configPath)
+	reg := registry.New(*dataDir)
+	reg.Wait = true
+	cfgMgr.LoadCallback = reg.Apply
+	if err := cfgMgr.Load(); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	cfg := cfgMgr.Get()
+
+	// Select groups
+	var names []string
+	if *groups == "" {
+		for _, rg := range cfg.RuleGroups {
+			names = append(names, rg.Name)
+		}
+	} else {
+		for _, name := range strings.Split(*groups, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+
+	eng, err := engine.NewEngine(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize engine: %v", err)
+	}
+	eng.ReloadRules(parser.NewLoader(*dataDir))
+
+	var rules []*parser.Rule
+	for _, name := range names {
+		groupRules := eng.GroupRules(name)
+		if groupRules == nil {
+			log.Printf("Warning: rule group '%s' is unknown or empty", name)
+		}
+		rules = append(rules, groupRules...)
+	}
+
+	entries, skipped := export.Compile(rules)
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		out = f
+	}
+
+	stats, err := export.Write(out, format, entries, *zone, uint32(time.Now().Unix()))
+	// log.Fatalf skips deferred calls, so the file is closed here; a failed
+	// Close may mean the data never reached the disk
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("closing %s: %w", *output, cerr)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	log.Printf("Exported %d entries (%d rules and %d entries not expressible in %s, %d entries without their subdomains)",
+		stats.Written, skipped, stats.Skipped, format, stats.Approximated)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"adblocker/config"
+)
+
+// runMigrateConfig upgrades a config file to the current schema version and
+// reports keys the schema does not know.
+// Usage: adblocker migrate-config [--config config.yaml] [--output file | --write]
+func runMigrateConfig(args []string) {
+	fs := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to configuration file")
+	output := fs.String("output", "", "Output file (default: stdout)")
+	write := fs.Bool("write", false, "Rewrite the config file in place")
+	fs.Parse(args)
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to read config file: %v", err)
+	}
+
+	out, warnings, err := config.Migrate(data)
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	for _, w := range warnings {
+		log.Printf("Warning: %s", w)
+	}
+
+	switch {
+	case *write:
+		// Keep the original next to the rewritten file
+		if err := os.WriteFile(*configPath+".bak", data, 0o644); err != nil {
+			log.Fatalf("Failed to write backup: %v", err)
+		}
+		if err := os.WriteFile(*configPath, out, 0o644); err != nil {
+			log.Fatalf("Failed to write config file: %v", err)
+		}
+		log.Printf("Migrated %s to version %d (backup in %s.bak)", *configPath, config.CurrentVersion, *configPath)
+	case *output != "":
+		if err := os.WriteFile(*output, out, 0o644); err != nil {
+			log.Fatalf("Failed to write output file: %v", err)
+		}
+		log.Printf("Wrote version %d config to %s", config.CurrentVersion, *output)
+	default:
+		os.Stdout.Write(out)
+	}
+
+	if len(warnings) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runProfile shows or switches the active profile of a running instance through its admin API.
+// Usage: adblocker profile [--admin http://127.0.0.1:8080] [--token TOKEN] [name|default|auto]
+func runProfile(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8080", "Admin API base URL of the running instance")
+	token := fs.String("token", os.Getenv("ADBLOCKER_TOKEN"), "Admin API token, when the instance has tokens (see adblocker token)")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := strings.TrimSuffix(*admin, "/") + "/api/profile"
+
+	var req *http.Request
+	var err error
+	if name := fs.Arg(0); name == "" {
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+	} else {
+		if name == "auto" {
+			name = "" // Back to active_profile and schedules
+		}
+		body, _ := json.Marshal(map[string]string{"name": name})
+		req, err = http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Admin API returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var st struct {
+		Active   string   `json:"active"`
+		Source   string   `json:"source"`
+		Profiles []string `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Fatalf("Invalid response: %v", err)
+	}
+	if st.Active == "" {
+		st.Active = "default"
+	}
+	fmt.Printf("Active profile: %s", st.Active)
+	if st.Source != "" {
+		fmt.Printf(" (%s)", st.Source)
+	}
+	fmt.Printf("\nProfiles: %s\n", strings.Join(st.Profiles, ", "))
+}
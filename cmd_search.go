@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"adblocker/engine"
+)
+
+// runSearch asks a running instance which loaded rules match a domain or substring.
+// Usage: adblocker search [--admin http://127.0.0.1:8080] [--substring] [--limit 100] <query>
+func runSearch(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8080", "Admin API base URL of the running instance")
+	substring := fs.Bool("substring", false, "Match rule text containing the query instead of rules matching the domain")
+	limit := fs.Int("limit", 100, "Maximum number of rules to list (0 for all)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: adblocker search [--admin URL] [--substring] [--limit N] <domain|text>")
+		os.Exit(2)
+	}
+
+	mode := engine.SearchDomain
+	if *substring {
+		mode = engine.SearchSubstring
+	}
+	query := url.Values{"q": {fs.Arg(0)}, "mode": {mode}, "limit": {strconv.Itoa(*limit)}}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(*admin, "/") + "/api/rules/search?" + query.Encode())
+	if err != nil {
+		log.Fatalf("Failed to reach admin API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Admin API returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var res engine.SearchResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		log.Fatalf("Invalid response: %v", err)
+	}
+
+	if len(res.Sources) == 0 {
+		fmt.Printf("No rules match '%s'\n", res.Query)
+		return
+	}
+	fmt.Printf("Sources with rules matching '%s':\n", res.Query)
+	for _, src := range res.Sources {
+		fmt.Printf("  %s / %s: %d blocking, %d exception\n", src.RuleGroup, src.Source, src.Blocks, src.Exceptions)
+	}
+	fmt.Println("Rules:")
+	for _, m := range res.Matches {
+		fmt.Printf("  [%s / %s] %s\n", m.RuleGroup, m.Source, m.Rule)
+	}
+	if res.Truncated {
+		fmt.Printf("  ... (more than %d, use --limit)\n", *limit)
+	}
+	if res.HasException {
+		fmt.Println("An @@ exception exists for this query.")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"adblocker/tokens"
+)
+
+// runToken manages the scoped admin API tokens in the data directory. A
+// running instance picks up changes on the next request.
+// Usage: adblocker token [--data data] list | create NAME stats|pause|admin | revoke NAME
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	dataDir := fs.String("data", "data", "Path to data directory")
+	fs.Parse(args)
+
+	store := tokens.NewStore(filepath.Join(*dataDir, "tokens.json"))
+	switch fs.Arg(0) {
+	case "list", "":
+		list, err := store.List()
+		if err != nil {
+			log.Fatalf("Failed to read tokens: %v", err)
+		}
+		if len(list) == 0 {
+			fmt.Println("No tokens; anyone who can reach the admin API can read it, changes need parent_control.password.")
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCOPE\tCREATED")
+		for _, t := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Name, t.Scope, t.CreatedAt.Format(time.DateTime))
+		}
+		tw.Flush()
+
+	case "create":
+		if fs.NArg() != 3 {
+			log.Fatalf("Usage: adblocker token create NAME stats|pause|admin")
+		}
+		secret, err := store.Create(fs.Arg(1), tokens.Scope(fs.Arg(2)))
+		if err != nil {
+			log.Fatalf("Failed to create token: %v", err)
+		}
+		fmt.Printf("Created token '%s' with scope %s. It is not shown again:\n%s\n", fs.Arg(1), fs.Arg(2), secret)
+
+	case "revoke":
+		if fs.NArg() != 2 {
+			log.Fatalf("Usage: adblocker token revoke NAME")
+		}
+		if err := store.Revoke(fs.Arg(1)); err != nil {
+			log.Fatalf("Failed to revoke token: %v", err)
+		}
+		fmt.Printf("Revoked token '%s'\n", fs.Arg(1))
+
+	default:
+		log.Fatalf("Unknown token command '%s' (want list, create or revoke)", fs.Arg(0))
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BlockingMode is how blocked queries are answered. It is written in YAML
+// as a mode name, "null_ip" (0.0.0.0 and ::, the default), "nxdomain" or
+// "refused", or as {custom_ip: <addr>} with an IPv4 address, an IPv6
+// address or a list of one of each. $dnsrewrite rules are not affected.
+type BlockingMode struct {
+	Mode     string   // "null_ip", "nxdomain", "refused", "custom_ip" or "" for the default
+	CustomIP []string // Addresses of custom_ip
+}
+
+func (b *BlockingMode) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*b = BlockingMode{Mode: value.Value}
+		return nil
+	}
+	var m struct {
+		CustomIP Upstreams `yaml:"custom_ip"` // A single address or a list
+	}
+	if err := value.Decode(&m); err != nil {
+		return err
+	}
+	*b = BlockingMode{Mode: "custom_ip", CustomIP: m.CustomIP}
+	return nil
+}
+
+// MarshalYAML writes the form UnmarshalYAML reads.
+func (b BlockingMode) MarshalYAML() (any, error) {
+	if b.Mode != "custom_ip" {
+		return b.Mode, nil
+	}
+	return map[string]Upstreams{"custom_ip": b.CustomIP}, nil
+}
+
+// IsZero reports whether the default mode applies, for omitempty.
+func (b BlockingMode) IsZero() bool {
+	return b.Mode == ""
+}
+
+// Addrs returns the IPv4 and the IPv6 address of custom_ip, invalid when
+// not given.
+func (b BlockingMode) Addrs() (v4, v6 netip.Addr) {
+	for _, s := range b.CustomIP {
+		ip, err := netip.ParseAddr(s)
+		switch {
+		case err != nil:
+		case ip.Is4() || ip.Is4In6():
+			v4 = ip.Unmap()
+		default:
+			v6 = ip
+		}
+	}
+	return v4, v6
+}
+
+// check returns the problems of b.
+func (b BlockingMode) check() error {
+	switch b.Mode {
+	case "", "null_ip", "nxdomain", "refused":
+		return nil
+	case "custom_ip":
+	default:
+		return fmt.Errorf("must be \"null_ip\", \"nxdomain\", \"refused\" or {custom_ip: <addr>}, got '%s'", b.Mode)
+	}
+	if len(b.CustomIP) == 0 {
+		return errors.New("custom_ip needs an address")
+	}
+	var v4, v6 int
+	for _, s := range b.CustomIP {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return fmt.Errorf("custom_ip: '%s' is not an IP address", s)
+		}
+		if ip.Unmap().Is4() {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	if v4 > 1 || v6 > 1 {
+		return errors.New("custom_ip takes at most one IPv4 and one IPv6 address")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import "slices"
+
+// DoHRuleGroup is the built-in rule group applied to user groups with
+// block_doh. Listing it in exclude_rule_groups exempts single users.
+const DoHRuleGroup = "builtin_doh"
+
+// DoHProviders are the hostnames of well-known public DNS-over-HTTPS
+// resolvers. Blocking them makes browsers set to "secure DNS" fall back to
+// the system resolver, i.e. this server. Subdomains are blocked too.
+var DoHProviders = []string{
+	"dns.google",
+	"dns64.dns.google",
+	"cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.quad9.net",
+	"dns9.quad9.net",
+	"dns10.quad9.net",
+	"dns11.quad9.net",
+	"dns12.quad9.net",
+	"doh.opendns.com",
+	"doh.familyshield.opendns.com",
+	"dns.adguard-dns.com",
+	"family.adguard-dns.com",
+	"unfiltered.adguard-dns.com",
+	"dns.adguard.com",
+	"dns.nextdns.io",
+	"doh.cleanbrowsing.org",
+	"dns.mullvad.net",
+	"doh.mullvad.net",
+	"dns.controld.com",
+	"freedns.controld.com",
+	"doh.dns.sb",
+	"dns.alidns.com",
+	"doh.pub",
+	"doh.360.cn",
+	"dns.twnic.tw",
+	"doh.xfinity.com",
+}
+
+// addBuiltinGroups adds the built-in rule groups that the user groups ask
+// for. A rule group of the same name in the file takes precedence.
+func (c *Config) addBuiltinGroups() {
+	if !slices.ContainsFunc(c.UserGroups, func(ug UserGroup) bool { return ug.BlockDoH }) {
+		return
+	}
+	if slices.ContainsFunc(c.RuleGroups, func(rg RuleGroup) bool { return rg.Name == DoHRuleGroup }) {
+		return
+	}
+	rules := make([]string, len(DoHProviders))
+	for i, host := range DoHProviders {
+		rules[i] = "||" + host + "^"
+	}
+	c.RuleGroups = append(c.RuleGroups, RuleGroup{Name: DoHRuleGroup, Rules: rules})
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNotFound is returned by edits that refer to a missing entry.
+var ErrNotFound = errors.New("not found")
+
+// ErrReadOnly is returned by edits while server.read_only is set.
+var ErrReadOnly = errors.New("read_only is set, change the config file instead")
+
+// Sections of the config file that can be edited at runtime.
+const (
+	SectionUsers      = "users"
+	SectionUserGroups = "user_groups"
+	SectionSchedules  = "schedules"
+)
+
+// Edit changes one top-level section of the config file at runtime. fn edits
+// the config as written in the file (before list references are resolved).
+// The result is validated and handed to apply; only when apply succeeds is
+// the file rewritten and the config made current. Other sections, and the
+// comments in them, are kept as they are.
+func (m *Manager) Edit(section string, fn func(*Config) error, apply func(*Config) error) error {
+	return m.editDocument(func(root *yaml.Node) error {
+		var raw Config
+		if err := root.Decode(&raw); err != nil {
+			return fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if err := fn(&raw); err != nil {
+			return err
+		}
+
+		var value yaml.Node
+		var err error
+		switch section {
+		case SectionUsers:
+			err = value.Encode(raw.Users)
+		case SectionUserGroups:
+			err = value.Encode(raw.UserGroups)
+		case SectionSchedules:
+			err = value.Encode(raw.Schedules)
+		default:
+			return fmt.Errorf("section '%s' cannot be edited", section)
+		}
+		if err != nil {
+			return err
+		}
+		setSection(root, section, &value)
+		return nil
+	}, apply)
+}
+
+// AddRule appends rule to the inline rules of a RuleGroup, unless it is
+// already there, and applies the result like Edit. Only that list is
+// touched, so the rest of the group keeps its layout and comments. It
+// reports whether the rule was added.
+func (m *Manager) AddRule(ruleGroup, rule string, apply func(*Config) error) (bool, error) {
+	added, err := m.ImportRules(ruleGroup, []string{rule}, false, apply)
+	return added > 0, err
+}
+
+// ImportRules adds rules to the inline rules of a RuleGroup like AddRule,
+// skipping those already there. With replace the inline rules become
+// exactly rules instead. It reports how many rules were not there before.
+func (m *Manager) ImportRules(ruleGroup string, rules []string, replace bool, apply func(*Config) error) (int, error) {
+	added := 0
+	err := m.editDocument(func(root *yaml.Node) error {
+		group := findRuleGroup(root, ruleGroup)
+		if group == nil {
+			return fmt.Errorf("rule group '%s': %w", ruleGroup, ErrNotFound)
+		}
+
+		list := mappingValue(group, "rules")
+		if list == nil {
+			list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			group.Content = append(group.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rules"}, list)
+		}
+		existing := make(map[string]bool, len(list.Content))
+		for _, n := range list.Content {
+			existing[n.Value] = true
+		}
+
+		var content []*yaml.Node
+		if !replace {
+			content = list.Content
+		}
+		seen := make(map[string]bool, len(rules))
+		for _, rule := range rules {
+			if seen[rule] || (!replace && existing[rule]) {
+				continue
+			}
+			seen[rule] = true
+			if !existing[rule] {
+				added++
+			}
+			content = append(content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rule})
+		}
+		if !replace && added == 0 || replace && slices.EqualFunc(content, list.Content, func(a, b *yaml.Node) bool { return a.Value == b.Value }) {
+			return errUnchanged
+		}
+		list.Content = content
+		return nil
+	}, apply)
+	if errors.Is(err, errUnchanged) {
+		return 0, nil
+	}
+	return added, err
+}
+
+// errUnchanged stops an edit that would not change the file.
+var errUnchanged = errors.New("unchanged")
+
+// editDocument runs fn on the root mapping of the config file as written,
+// then validates, applies and saves the result.
+func (m *Manager) editDocument(fn func(root *yaml.Node) error, apply func(*Config) error) error {
+	m.editMu.Lock()
+	defer m.editMu.Unlock()
+	if m.Get().Server.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// 1. Decode the file as written
+	data, err := os.ReadFile(m.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	// 2. Apply the change to the document
+	if err := fn(doc.Content[0]); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	// 3. Validate and apply like a reload, then persist
+	cfg, err := m.parseData(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := apply(cfg); err != nil {
+		m.Reject(err)
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	m.mu.Lock()
+	m.written = sum[:]
+	m.mu.Unlock()
+	if err := writeFileAtomic(m.configPath, buf.Bytes()); err != nil {
+		return fmt.Errorf("applied but failed to save config file: %w", err)
+	}
+	m.Set(cfg)
+	return nil
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// findRuleGroup returns the mapping node of the named RuleGroup, or nil.
+func findRuleGroup(root *yaml.Node, name string) *yaml.Node {
+	groups := mappingValue(root, "rule_groups")
+	if groups == nil || groups.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, g := range groups.Content {
+		if n := mappingValue(g, "name"); g.Kind == yaml.MappingNode && n != nil && n.Value == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// setSection replaces the value of a top-level key, appending it when missing.
+func setSection(root *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			// Keep comments attached to the old value
+			value.HeadComment = root.Content[i+1].HeadComment
+			root.Content[i+1] = value
+			return
+		}
+	}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// writeFileAtomic replaces path with data, keeping its permissions.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -1,9 +1,16 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,9 +18,21 @@ import (
 // Manager handles thread-safe configuration access and updates.
 type Manager struct {
 	mu           sync.RWMutex
+	editMu       sync.Mutex // Serializes Edit
+	written      []byte     // Hash of the content last written by Edit, see Watch
 	current      *Config
+	status       Status
 	configPath   string
 	LoadCallback func(*Config) error // Optional callback after load
+	Strict       bool                // Reject unknown keys even without strict: true in the file
+}
+
+// Status reports the outcome of the last config load or reload.
+type Status struct {
+	Path        string    `json:"path"`
+	AppliedAt   time.Time `json:"applied_at,omitzero"`
+	AttemptedAt time.Time `json:"attempted_at,omitzero"`
+	Error       string    `json:"error,omitempty"` // Why the last attempt was rejected; the applied config keeps running
 }
 
 // NewManager creates a new configuration manager.
@@ -21,34 +40,101 @@ func NewManager(path string) *Manager {
 	return &Manager{
 		configPath: path,
 		current:    &Config{}, // Start with empty config
+		status:     Status{Path: path},
 	}
 }
 
-// Load reads the configuration file from disk and updates the current state.
+// Load reads the configuration file from disk and, if it is valid, updates the current state.
 func (m *Manager) Load() error {
+	cfg, err := m.Parse()
+	if err != nil {
+		return err
+	}
+	m.Set(cfg)
+	return nil
+}
+
+// Parse reads and validates the configuration file without applying it.
+// Callers that need to build more state from the result (e.g. the engine)
+// do so first and then call Set, or Reject when that fails.
+func (m *Manager) Parse() (*Config, error) {
+	cfg, err := m.parse()
+	if err != nil {
+		m.Reject(err)
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (m *Manager) parse() (*Config, error) {
 	data, err := os.ReadFile(m.configPath)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	return m.parseData(data)
+}
 
+// parseData decodes, resolves and validates the content of a config file.
+func (m *Manager) parseData(data []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
 	var newConfig Config
-	if err := yaml.Unmarshal(data, &newConfig); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+	if err := doc.Decode(&newConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := checkVersion(&newConfig); err != nil {
+		return nil, err
 	}
 
-	// Basic validation could go here
-
-	m.mu.Lock()
-	m.current = &newConfig
-	m.mu.Unlock()
+	// Typos such as "rulegroups:" would otherwise silently disable a section
+	if newConfig.Strict || m.Strict {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(new(Config)); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("strict parsing: %w", err)
+		}
+	} else if len(doc.Content) > 0 {
+		for _, w := range UnknownKeys(doc.Content[0]) {
+			log.Printf("Warning: %s: %s", m.configPath, w)
+		}
+	}
+	if newConfig.Version < CurrentVersion {
+		log.Printf("Warning: %s has config version %d, run 'adblocker migrate-config' to upgrade to %d", m.configPath, newConfig.Version, CurrentVersion)
+	}
 
 	if m.LoadCallback != nil {
 		if err := m.LoadCallback(&newConfig); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	newConfig.addBuiltinGroups()
+
+	if err := newConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &newConfig, nil
+}
+
+// Set makes cfg the current configuration.
+func (m *Manager) Set(cfg *Config) {
+	now := time.Now()
+	m.mu.Lock()
+	m.current = cfg
+	m.status.AppliedAt = now
+	m.status.AttemptedAt = now
+	m.status.Error = ""
+	m.mu.Unlock()
+}
+
+// Reject records a failed load; the current configuration is kept.
+func (m *Manager) Reject(err error) {
+	m.mu.Lock()
+	m.status.AttemptedAt = time.Now()
+	m.status.Error = err.Error()
+	m.mu.Unlock()
 }
 
 // Get returns the current configuration safely.
@@ -57,3 +143,21 @@ func (m *Manager) Get() *Config {
 	defer m.mu.RUnlock()
 	return m.current
 }
+
+// Status returns the outcome of the last load.
+func (m *Manager) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// Fingerprint identifies the settings of c, so that diagnostics from two
+// points in time or two instances show whether they ran the same config.
+func (c *Config) Fingerprint() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
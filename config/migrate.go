@@ -0,0 +1,210 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the config schema version written by migrate-config.
+// Files without a version are treated as version 0.
+const CurrentVersion = 1
+
+// migrations[i] upgrades the document root from version i to i+1.
+var migrations = []func(root *yaml.Node) error{
+	// 0 -> 1: the layout is unchanged, the file only gains a version field
+	func(root *yaml.Node) error { return nil },
+}
+
+// Migrate upgrades a config file to CurrentVersion, keeping comments and key
+// order. It also reports keys that do not belong to the schema, which
+// yaml.Unmarshal would otherwise ignore.
+func Migrate(data []byte) (out []byte, warnings []string, err error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("config file is not a YAML mapping")
+	}
+	root := doc.Content[0]
+
+	version, err := nodeVersion(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > CurrentVersion {
+		return nil, nil, fmt.Errorf("config version %d is newer than supported version %d", version, CurrentVersion)
+	}
+	for v := version; v < CurrentVersion; v++ {
+		if err := migrations[v](root); err != nil {
+			return nil, nil, fmt.Errorf("migrating from version %d: %w", v, err)
+		}
+	}
+	setVersion(root, CurrentVersion)
+
+	warnings = UnknownKeys(root)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	enc.Close()
+	return buf.Bytes(), warnings, nil
+}
+
+// checkVersion rejects files written for a newer schema.
+func checkVersion(c *Config) error {
+	if c.Version > CurrentVersion {
+		return fmt.Errorf("config version %d is newer than supported version %d", c.Version, CurrentVersion)
+	}
+	return nil
+}
+
+func nodeVersion(root *yaml.Node) (int, error) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "version" {
+			var v int
+			if err := root.Content[i+1].Decode(&v); err != nil {
+				return 0, fmt.Errorf("invalid version: %w", err)
+			}
+			return v, nil
+		}
+	}
+	return 0, nil
+}
+
+// setVersion updates the version key, inserting it first when missing.
+func setVersion(root *yaml.Node, v int) {
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprint(v)}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "version" {
+			root.Content[i+1] = value
+			return
+		}
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+}
+
+// UnknownKeys lists the mapping keys of a config document that no field of
+// Config accepts, with a suggestion when the key looks like a typo.
+func UnknownKeys(root *yaml.Node) []string {
+	var out []string
+	walkKeys(root, reflect.TypeFor[Config](), "", &out)
+	return out
+}
+
+var unmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+
+func walkKeys(node *yaml.Node, t reflect.Type, path string, out *[]string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return // Decodes itself
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			ft, ok := fields[key]
+			if !ok {
+				msg := fmt.Sprintf("line %d: unknown key '%s'", node.Content[i].Line, sub)
+				if s := suggestKey(key, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean '%s'?)", s)
+				}
+				*out = append(*out, msg)
+				continue
+			}
+			walkKeys(node.Content[i+1], ft, sub, out)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			walkKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), out)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			walkKeys(node.Content[i+1], t.Elem(), path+"."+node.Content[i].Value, out)
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of a struct to their field types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggestKey returns the known key that key most likely misspells.
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	norm := func(s string) string { return strings.ReplaceAll(strings.ToLower(s), "_", "") }
+	best, bestDist := "", 3
+	for name := range fields {
+		if norm(name) == norm(key) {
+			return name
+		}
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && best != "" && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
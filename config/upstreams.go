@@ -0,0 +1,41 @@
+package config
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Upstreams is the list of upstream resolvers, tried in order: the next one
+// is asked when the previous fails or answers SERVFAIL. It is written in
+// YAML as a single address or as a list.
+type Upstreams []string
+
+func (u *Upstreams) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*u = nil
+		if value.Value != "" {
+			*u = Upstreams{value.Value}
+		}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*u = list
+	return nil
+}
+
+// MarshalYAML keeps a single upstream a plain address, as it was written
+// before lists were accepted.
+func (u Upstreams) MarshalYAML() (any, error) {
+	if len(u) == 1 {
+		return u[0], nil
+	}
+	return []string(u), nil
+}
+
+func (u Upstreams) String() string {
+	return strings.Join(u, ", ")
+}
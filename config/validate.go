@@ -0,0 +1,327 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"adblocker/parser"
+)
+
+// Validate checks the references and enumerations of a configuration so a
+// broken file is rejected before anything is swapped in. Problems that need
+// the engine (IPs, schedule times, profile dates, rules) are caught when the
+// engine builds its matchers.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	ruleGroups := make(map[string]bool)
+	for i, rg := range c.RuleGroups {
+		if rg.Name == "" {
+			fail("rule_groups[%d]: name is required", i)
+		} else if ruleGroups[rg.Name] {
+			fail("rule group '%s' is defined twice", rg.Name)
+		}
+		ruleGroups[rg.Name] = true
+		if rg.Canary.Percent < 0 || rg.Canary.Percent > 99 || rg.Canary.Soak < 0 {
+			fail("rule group '%s': canary.percent must be 0-99 and canary.soak not negative", rg.Name)
+		}
+		if err := rg.BlockingMode.check(); err != nil {
+			fail("rule group '%s': blocking_mode: %v", rg.Name, err)
+		}
+		for j, src := range rg.Sources {
+			if src.URL == "" && src.Path == "" {
+				fail("rule group '%s': sources[%d] needs url, path or a known list", rg.Name, j)
+			}
+			if _, err := parser.ParseFormat(src.Format); err != nil {
+				fail("rule group '%s': source '%s': %v", rg.Name, src.Name, err)
+			}
+			if v := src.Verify; v != nil {
+				switch {
+				case src.URL == "":
+					fail("rule group '%s': source '%s': verify needs url", rg.Name, src.Name)
+				case v.Minisign == "" && v.PGP == "" && v.SHA256Sums == "":
+					fail("rule group '%s': source '%s': verify needs minisign, pgp or sha256sums", rg.Name, src.Name)
+				case v.Minisign != "" && v.PGP != "" && v.Signature != "":
+					fail("rule group '%s': source '%s': verify.signature is ambiguous with both minisign and pgp", rg.Name, src.Name)
+				}
+			}
+			if len(src.Mirrors) > 0 && src.URL == "" {
+				fail("rule group '%s': source '%s': mirrors need url", rg.Name, src.Name)
+			}
+			switch src.MirrorOrder {
+			case "", parser.MirrorsInOrder, parser.MirrorsByLatency:
+			default:
+				fail("rule group '%s': source '%s': mirror_order must be \"order\" or \"latency\", got '%s'", rg.Name, src.Name, src.MirrorOrder)
+			}
+		}
+		for _, country := range rg.BlockAnswers.Countries {
+			if len(country) != 2 {
+				fail("rule group '%s': block_answers: '%s' is not a two-letter country code", rg.Name, country)
+			}
+		}
+		if len(rg.BlockAnswers.Countries) > 0 && c.GeoIP.CountryDB == "" {
+			fail("rule group '%s': block_answers.countries needs geoip.country_db", rg.Name)
+		}
+		if len(rg.BlockAnswers.ASNs) > 0 && c.GeoIP.ASNDB == "" {
+			fail("rule group '%s': block_answers.asns needs geoip.asn_db", rg.Name)
+		}
+	}
+
+	schedules := make(map[string]bool)
+	for i, s := range c.Schedules {
+		if s.Name == "" {
+			fail("schedules[%d]: name is required", i)
+		} else if schedules[s.Name] {
+			fail("schedule '%s' is defined twice", s.Name)
+		}
+		schedules[s.Name] = true
+		if p := s.Presence; p != nil {
+			if len(p.Ping) == 0 && p.MQTT == nil && p.WebhookToken == "" {
+				fail("schedule '%s': presence needs ping, mqtt or webhook_token", s.Name)
+			}
+			if p.MQTT != nil && (p.MQTT.Broker == "" || p.MQTT.Topic == "") {
+				fail("schedule '%s': presence.mqtt needs broker and topic", s.Name)
+			}
+		}
+	}
+
+	checkPolicies := func(where string, policies []Policy) {
+		for _, p := range policies {
+			if !ruleGroups[p.RuleGroup] {
+				fail("%s: unknown rule group '%s'", where, p.RuleGroup)
+			}
+			if p.Schedule != "" && !schedules[p.Schedule] {
+				fail("%s: unknown schedule '%s'", where, p.Schedule)
+			}
+		}
+	}
+	checkExcludes := func(where string, names []string) {
+		for _, name := range names {
+			if !ruleGroups[name] {
+				fail("%s: unknown rule group '%s' in exclude_rule_groups", where, name)
+			}
+		}
+	}
+
+	userGroups := make(map[string]bool)
+	for i, ug := range c.UserGroups {
+		if ug.Name == "" {
+			fail("user_groups[%d]: name is required", i)
+		} else if userGroups[ug.Name] {
+			fail("user group '%s' is defined twice", ug.Name)
+		}
+		userGroups[ug.Name] = true
+		checkPolicies(fmt.Sprintf("user group '%s'", ug.Name), ug.Policies)
+		checkExcludes(fmt.Sprintf("user group '%s'", ug.Name), ug.ExcludeRuleGroups)
+		for _, upstream := range ug.Upstream {
+			if err := CheckUpstream(upstream); err != nil {
+				fail("user group '%s': upstream: %v", ug.Name, err)
+			}
+		}
+	}
+
+	clientIDs := make(map[string]string)
+	for i, u := range c.Users {
+		where := fmt.Sprintf("users[%d] '%s'", i, u.Name)
+		if u.UserGroup != "" && !userGroups[u.UserGroup] {
+			fail("%s: unknown user group '%s'", where, u.UserGroup)
+		}
+		for _, id := range u.ClientIDs {
+			if !ValidClientID(id) {
+				fail("%s: client ID '%s' must be 1-63 lowercase letters, digits or hyphens", where, id)
+			} else if other, ok := clientIDs[id]; ok {
+				fail("%s: client ID '%s' is already used by '%s'", where, id, other)
+			}
+			clientIDs[id] = u.Name
+		}
+		checkExcludes(where, u.ExcludeRuleGroups)
+	}
+
+	if c.Defaults.UserGroup != "" && !userGroups[c.Defaults.UserGroup] {
+		fail("defaults.user_group: unknown user group '%s'", c.Defaults.UserGroup)
+	}
+	if c.Guests.UserGroup != "" && !userGroups[c.Guests.UserGroup] {
+		fail("guests.user_group: unknown user group '%s'", c.Guests.UserGroup)
+	}
+	for i, rw := range c.Rewrites {
+		if rw.Domain == "" || rw.Answer == "" {
+			fail("rewrites[%d]: domain and answer are required", i)
+		}
+		for _, ug := range rw.UserGroups {
+			if !userGroups[ug] {
+				fail("rewrite '%s': unknown user group '%s'", rw.Domain, ug)
+			}
+		}
+	}
+
+	for _, p := range c.Profiles {
+		for _, ug := range p.UserGroups {
+			checkPolicies(fmt.Sprintf("profile '%s', user group '%s'", p.Name, ug.Name), ug.Policies)
+		}
+		if p.Schedule != "" && !schedules[p.Schedule] {
+			fail("profile '%s': unknown schedule '%s'", p.Name, p.Schedule)
+		}
+	}
+
+	if l := c.RuleLimits; l.PerSource < 0 || l.PerGroup < 0 || l.Total < 0 {
+		fail("rule_limits: limits must not be negative")
+	}
+	if c.ListCache.MaxSize < 0 {
+		fail("list_cache.max_size: must not be negative")
+	}
+
+	switch c.Server.LogFormat {
+	case "", "text", "json":
+	default:
+		fail("server.log_format: must be \"text\" or \"json\", got '%s'", c.Server.LogFormat)
+	}
+	for decision, rate := range c.Server.QueryLogSample {
+		switch decision {
+		case "blocked", "rewritten", "whitelisted", "allowed":
+		default:
+			fail("server.query_log_sample: unknown decision '%s'", decision)
+		}
+		if rate < 0 || rate > 1 {
+			fail("server.query_log_sample.%s: must be between 0 and 1, got %g", decision, rate)
+		}
+	}
+	for _, upstream := range c.Server.Upstream {
+		if err := CheckUpstream(upstream); err != nil {
+			fail("server.upstream: %v", err)
+		}
+	}
+	if code := c.Server.TraceOption; code != 0 && (code < 65001 || code > 65534) {
+		fail("server.trace_option: must be a local use EDNS option code (65001-65534), got %d", code)
+	}
+	switch c.Server.UpstreamMode {
+	case "", "failover", "parallel":
+	default:
+		fail("server.upstream_mode: must be \"failover\" or \"parallel\", got '%s'", c.Server.UpstreamMode)
+	}
+	if fb := c.Server.Fallback; fb.Upstream != "" {
+		if err := CheckUpstream(fb.Upstream); err != nil {
+			fail("server.fallback.upstream: %v", err)
+		}
+	}
+	if c.Server.ListenTLS != "" || c.Server.ListenHTTPS != "" {
+		if c.Server.TLSCertFile == "" || c.Server.TLSKeyFile == "" {
+			fail("server: listen_tls and listen_https need tls_cert_file and tls_key_file")
+		}
+	}
+	if err := c.Server.BlockingMode.check(); err != nil {
+		fail("server.blocking_mode: %v", err)
+	}
+	if zt := c.Server.ZoneTransfer; zt.ListenAddr != "" && len(zt.AllowFrom) == 0 && zt.TSIGSecret == "" {
+		fail("server.zone_transfer: allow_from or tsig_secret is required, the zone holds the whole block list")
+	}
+	switch c.Server.BlockDNSSEC {
+	case "", "unsigned", "nxdomain":
+	default:
+		fail("server.block_dnssec: must be \"unsigned\" or \"nxdomain\", got '%s'", c.Server.BlockDNSSEC)
+	}
+	switch ln := c.Server.LocalNames; ln.Mode {
+	case "", "upstream", "nxdomain", "mdns":
+	case "forward":
+		if err := CheckUpstream(ln.Forward); err != nil {
+			fail("server.local_names.forward: %v", err)
+		}
+	default:
+		fail("server.local_names.mode: must be \"upstream\", \"nxdomain\", \"forward\" or \"mdns\", got '%s'", ln.Mode)
+	}
+	for zone, policy := range c.Server.SpecialUse {
+		if strings.Trim(zone, ".") == "" || strings.ContainsAny(zone, " \t/:") {
+			fail("server.special_use: invalid zone '%s'", zone)
+		}
+		switch policy {
+		case "loopback", "nxdomain", "upstream":
+		default:
+			fail("server.special_use.%s: must be \"loopback\", \"nxdomain\" or \"upstream\", got '%s'", zone, policy)
+		}
+	}
+	for _, p := range c.Server.TrustedProxies {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			if _, err := netip.ParseAddr(p); err != nil {
+				fail("server.trusted_proxies: '%s' is not an address or CIDR", p)
+			}
+		}
+	}
+	for _, p := range c.Server.TraceClients {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			if _, err := netip.ParseAddr(p); err != nil {
+				fail("server.trace_clients: '%s' is not an address or CIDR", p)
+			}
+		}
+	}
+	for addr, opts := range c.Server.UpstreamTLS {
+		if !strings.HasPrefix(addr, "tls://") && !strings.HasPrefix(addr, "https://") {
+			fail("server.upstream_tls: '%s' is not a tls:// or https:// upstream", addr)
+		}
+		switch opts.MinVersion {
+		case "", "1.2", "1.3":
+		default:
+			fail("server.upstream_tls '%s': min_version must be \"1.2\" or \"1.3\", got '%s'", addr, opts.MinVersion)
+		}
+		for _, pin := range opts.SPKIPins {
+			if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+				fail("server.upstream_tls '%s': spki_pins: '%s' is not a base64 SHA-256 hash", addr, pin)
+			}
+		}
+	}
+	if fb := c.Server.Fallback; fb != (FallbackConfig{}) {
+		switch fb.Policy {
+		case "", "on_error", "on_timeout", "never":
+		default:
+			fail("server.fallback.policy: must be \"on_error\", \"on_timeout\" or \"never\", got '%s'", fb.Policy)
+		}
+		if fb.Upstream == "" {
+			fail("server.fallback.upstream is required")
+		} else if slices.ContainsFunc(c.Server.Upstream, EncryptedUpstream) && !EncryptedUpstream(fb.Upstream) && !fb.AllowPlaintext {
+			fail("server.fallback: plaintext upstream '%s' behind encrypted '%s' needs allow_plaintext: true", fb.Upstream, c.Server.Upstream)
+		}
+		if fb.RetryAfter < 0 {
+			fail("server.fallback.retry_after: must not be negative")
+		}
+	}
+	switch c.Server.InvalidClient {
+	case "", "default", "refuse":
+	default:
+		fail("server.invalid_client: must be \"default\" or \"refuse\", got '%s'", c.Server.InvalidClient)
+	}
+	switch c.StatsReset.Period {
+	case "":
+	case "daily":
+	case "weekly":
+		if c.StatsReset.Day < 0 || c.StatsReset.Day > 7 {
+			fail("stats_reset.day: weekly needs a weekday from 1 (Monday) to 7 (Sunday), got %d", c.StatsReset.Day)
+		}
+	case "monthly":
+		if c.StatsReset.Day < 0 || c.StatsReset.Day > 28 {
+			fail("stats_reset.day: monthly needs a day from 1 to 28, got %d", c.StatsReset.Day)
+		}
+	default:
+		fail("stats_reset.period: must be \"daily\", \"weekly\" or \"monthly\", got '%s'", c.StatsReset.Period)
+	}
+	switch c.Server.Standby.Action {
+	case "", "drop", "refuse":
+	default:
+		fail("server.standby.action: must be \"drop\" or \"refuse\", got '%s'", c.Server.Standby.Action)
+	}
+	if e := c.Server.ECS; e.IPv4Prefix < 0 || e.IPv4Prefix > 32 || e.IPv6Prefix < 0 || e.IPv6Prefix > 128 {
+		fail("server.ecs: ipv4_prefix must be 0-32 and ipv6_prefix 0-128")
+	}
+	switch c.Server.Concurrency.Overflow {
+	case "", "servfail", "queue":
+	default:
+		fail("server.concurrency.overflow: must be \"servfail\" or \"queue\", got '%s'", c.Server.Concurrency.Overflow)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce lets an editor finish saving, which takes several file
+// system events, before the file is read.
+const watchDebounce = 300 * time.Millisecond
+
+// Watch calls onChange whenever the content of the config file changes:
+// moments after a file system notification, and otherwise on the next poll
+// every interval, which also covers file systems without notifications.
+// Content is hashed rather than relying on modification times, since Kubernetes
+// ConfigMap volumes are updated through an atomic symlink swap.
+// The returned function stops the watcher.
+func (m *Manager) Watch(interval time.Duration, onChange func()) (stop func()) {
+	done := make(chan struct{})
+	last := m.fileHash()
+	events := m.notify(done) // nil, never ready, without notifications
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-events:
+				settled = time.After(watchDebounce)
+				continue
+			case <-settled:
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			settled = nil
+
+			hash := m.fileHash()
+			if hash == nil || string(hash) == string(last) {
+				continue
+			}
+			last = hash
+			if m.isOwnWrite(hash) {
+				continue // Written by Edit, already applied
+			}
+			log.Printf("Config file %s changed", m.configPath)
+			onChange()
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// notify reports file system events in the directory of the config file
+// until done is closed. The directory is watched rather than the file, as
+// editors and Kubernetes replace the file instead of writing to it. Returns
+// nil when notifications are unavailable, e.g. over the inotify limit.
+func (m *Manager) notify(done <-chan struct{}) <-chan struct{} {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Warning: cannot watch %s, checking for changes by polling: %v", m.configPath, err)
+		return nil
+	}
+	if err := w.Add(filepath.Dir(m.configPath)); err != nil {
+		w.Close()
+		log.Printf("Warning: cannot watch %s, checking for changes by polling: %v", m.configPath, err)
+		return nil
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-w.Events:
+				select {
+				case events <- struct{}{}:
+				default: // A check is already due
+				}
+			case err := <-w.Errors:
+				log.Printf("Warning: watching %s: %v", m.configPath, err)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Path returns the path of the managed config file.
+func (m *Manager) Path() string {
+	return m.configPath
+}
+
+// isOwnWrite reports whether hash is the content last written by Edit.
+func (m *Manager) isOwnWrite(hash []byte) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return string(hash) == string(m.written)
+}
+
+func (m *Manager) fileHash() []byte {
+	data, err := os.ReadFile(m.configPath)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/server"
+	"adblocker/stats"
+)
+
+// diagnosticStateTimeout bounds collecting the state of a dump.
+const diagnosticStateTimeout = 5 * time.Second
+
+// diagnostics writes dumps of the process state to the data directory, so
+// that bug reports about hangs or stale answers come with what the server
+// was doing and which state it held.
+type diagnostics struct {
+	dataDir string
+	started time.Time
+	cfgMgr  *config.Manager
+	eng     *engine.Engine
+	srv     *server.Server
+}
+
+// diagnosticState is the state part of a dump; goroutine stacks follow it.
+type diagnosticState struct {
+	Time              time.Time                        `json:"time"`
+	Uptime            string                           `json:"uptime"`
+	GoVersion         string                           `json:"go_version"`
+	Goroutines        int                              `json:"goroutines"`
+	HeapAllocBytes    uint64                           `json:"heap_alloc_bytes"`
+	ConfigFingerprint string                           `json:"config_fingerprint"` // See config.Config.Fingerprint
+	Config            config.Status                    `json:"config"`
+	RulesLoadedAt     time.Time                        `json:"rules_loaded_at,omitzero"`
+	Reload            engine.ReloadProgress            `json:"reload"`
+	Upstreams         []string                         `json:"upstreams"`
+	UpstreamLatency   []server.UpstreamLatency         `json:"upstream_latency"`
+	Privacy           server.PrivacyReport             `json:"privacy"` // Includes whether the fallback is engaged
+	Caches            map[string]server.CacheStats     `json:"caches"`
+	Standby           server.StandbyStatus             `json:"standby"`
+	StatsReset        server.StatsResetStatus          `json:"stats_reset"`
+	Profile           engine.ProfileStatus             `json:"profile"`
+	Overrides         []engine.DeviceOverride          `json:"overrides"`
+	Guests            []engine.Guest                   `json:"guests"`
+	Canaries          []engine.CanaryStatus            `json:"canaries"`
+	Stats             map[stats.Interval][]stats.Point `json:"stats"`
+}
+
+// state collects the current state.
+func (d *diagnostics) state() diagnosticState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	now := time.Now()
+	return diagnosticState{
+		Time:              now,
+		Uptime:            now.Sub(d.started).Round(time.Second).String(),
+		GoVersion:         runtime.Version(),
+		Goroutines:        runtime.NumGoroutine(),
+		HeapAllocBytes:    mem.HeapAlloc,
+		ConfigFingerprint: d.eng.Config().Fingerprint(),
+		Config:            d.cfgMgr.Status(),
+		RulesLoadedAt:     d.eng.LoadedAt(),
+		Reload:            d.eng.Progress(),
+		Upstreams:         d.srv.Upstreams(),
+		UpstreamLatency:   d.srv.UpstreamLatency(),
+		Privacy:           d.srv.PrivacyReport(),
+		Caches:            d.srv.CacheStats(),
+		Standby:           d.srv.Standby(),
+		StatsReset:        d.srv.StatsReset(),
+		Profile:           d.eng.Profile(),
+		Overrides:         d.eng.Overrides(),
+		Guests:            d.eng.Guests(),
+		Canaries:          d.eng.Canaries(),
+		Stats:             d.srv.Stats.Snapshot(),
+	}
+}
+
+// write dumps the state and the stacks of all goroutines to a new file in
+// the data directory and returns its path.
+func (d *diagnostics) write() (string, error) {
+	path := filepath.Join(d.dataDir, "diagnostics-"+time.Now().Format("20060102-150405.000")+".txt")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create diagnostics file: %w", err)
+	}
+	defer f.Close()
+
+	// 1. State, given up on when a hung lock blocks it; the stacks show which
+	w := bufio.NewWriter(f)
+	states := make(chan diagnosticState, 1)
+	go func() { states <- d.state() }()
+	select {
+	case state := <-states:
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(w, "== state ==\n%s\n", data)
+	case <-time.After(diagnosticStateTimeout):
+		fmt.Fprintf(w, "== state ==\nnot collected within %v, see the goroutines for what blocks it\n", diagnosticStateTimeout)
+	}
+
+	// 2. Stacks in the format of an unrecovered panic
+	fmt.Fprintf(w, "\n== goroutines ==\n")
+	if err := pprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		return "", err
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// watchSignal writes a dump on every SIGQUIT instead of the runtime's
+// default of printing stacks and exiting.
+func (d *diagnostics) watchSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGQUIT)
+	go func() {
+		for range ch {
+			path, err := d.write()
+			if err != nil {
+				log.Printf("[DIAG] Failed to write diagnostics: %v", err)
+				continue
+			}
+			log.Printf("[DIAG] Wrote diagnostics to %s", path)
+		}
+	}()
+}
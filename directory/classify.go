@@ -0,0 +1,78 @@
+package directory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"adblocker/config"
+)
+
+// clientClass is a compiled config.ClientClass.
+type clientClass struct {
+	userGroup   string
+	hostname    *regexp.Regexp // nil matches any
+	vendorClass *regexp.Regexp // nil matches any
+}
+
+// compileClasses validates the classes of a directory. Patterns are globs
+// (*-tv) unless written as /regex/; both match case-insensitively.
+func compileClasses(classes []config.ClientClass) ([]clientClass, error) {
+	var compiled []clientClass
+	for i, c := range classes {
+		if c.UserGroup == "" {
+			return nil, fmt.Errorf("classes[%d]: user_group is required", i)
+		}
+		if c.Hostname == "" && c.VendorClass == "" {
+			return nil, fmt.Errorf("classes[%d]: hostname or vendor_class is required", i)
+		}
+		cc := clientClass{userGroup: c.UserGroup}
+		var err error
+		if cc.hostname, err = compilePattern(c.Hostname); err != nil {
+			return nil, fmt.Errorf("classes[%d].hostname: %w", i, err)
+		}
+		if cc.vendorClass, err = compilePattern(c.VendorClass); err != nil {
+			return nil, fmt.Errorf("classes[%d].vendor_class: %w", i, err)
+		}
+		compiled = append(compiled, cc)
+	}
+	return compiled, nil
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexp.Compile("(?i)" + p[1:len(p)-1])
+	}
+	// Translate the glob: * and ? only, matched against the whole value
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for _, r := range p {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// classify returns the UserGroup of the first class matching the client, or "".
+func classify(classes []clientClass, hostname, vendorClass string) string {
+	for _, c := range classes {
+		if c.hostname != nil && !c.hostname.MatchString(hostname) {
+			continue
+		}
+		if c.vendorClass != nil && !c.vendorClass.MatchString(vendorClass) {
+			continue
+		}
+		return c.userGroup
+	}
+	return ""
+}
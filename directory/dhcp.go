@@ -0,0 +1,147 @@
+package directory
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"adblocker/config"
+)
+
+// DHCP lease record fields, used as the default mapping for "dhcp" directories.
+const (
+	dhcpName        = "name" // Hostname, or the MAC address for clients that sent none
+	dhcpHostname    = "hostname"
+	dhcpIP          = "ip"
+	dhcpMAC         = "mac"
+	dhcpVendorClass = "vendor_class"
+)
+
+// DHCPFetcher reads clients from a DHCP server's lease file. Both dnsmasq
+// leases ("expiry mac ip hostname clientid" per line) and ISC dhcpd.leases
+// blocks are understood; only the latter record vendor class identifiers.
+type DHCPFetcher struct {
+	dir config.UserDirectory
+}
+
+func NewDHCPFetcher(dir config.UserDirectory) *DHCPFetcher {
+	return &DHCPFetcher{dir: dir}
+}
+
+// dhcpMapping fills the mapping fields left empty with the lease record fields.
+func dhcpMapping(m config.DirectoryMapping) config.DirectoryMapping {
+	if m.Name == "" {
+		m.Name = dhcpName
+	}
+	if m.IPs == "" {
+		m.IPs = dhcpIP
+	}
+	if m.MACs == "" {
+		m.MACs = dhcpMAC
+	}
+	if m.VendorClass == "" {
+		m.VendorClass = dhcpVendorClass
+	}
+	return m
+}
+
+func (f *DHCPFetcher) Fetch() ([]map[string][]string, error) {
+	data, err := os.ReadFile(f.dir.Path)
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+	var records []map[string][]string
+	if strings.Contains(text, "lease ") && strings.Contains(text, "{") {
+		if records, err = parseISCLeases(text); err != nil {
+			return nil, err
+		}
+	} else {
+		records = parseDnsmasqLeases(text)
+	}
+
+	for _, rec := range records {
+		if name := first(rec[dhcpHostname]); name != "" {
+			rec[dhcpName] = []string{name}
+		} else {
+			rec[dhcpName] = rec[dhcpMAC]
+		}
+	}
+	return records, nil
+}
+
+func parseDnsmasqLeases(text string) []map[string][]string {
+	var records []map[string][]string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rec := map[string][]string{dhcpMAC: {fields[1]}, dhcpIP: {fields[2]}}
+		if fields[3] != "*" {
+			rec[dhcpHostname] = []string{fields[3]}
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// parseISCLeases reads dhcpd.leases. Later blocks for the same address
+// supersede earlier ones; released and expired leases are skipped.
+func parseISCLeases(text string) ([]map[string][]string, error) {
+	byIP := make(map[string]map[string][]string)
+	var order []string
+	var rec map[string][]string
+	active := true
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "lease ") && strings.HasSuffix(line, "{"):
+			ip := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "lease "), "{"))
+			rec = map[string][]string{dhcpIP: {ip}}
+			active = true
+		case rec == nil:
+			continue
+		case line == "}":
+			ip := rec[dhcpIP][0]
+			if _, seen := byIP[ip]; !seen {
+				order = append(order, ip)
+			}
+			if active {
+				byIP[ip] = rec
+			} else {
+				byIP[ip] = nil
+			}
+			rec = nil
+		case strings.HasPrefix(line, "binding state "):
+			active = strings.TrimSuffix(strings.TrimPrefix(line, "binding state "), ";") == "active"
+		case strings.HasPrefix(line, "hardware ethernet "):
+			rec[dhcpMAC] = []string{leaseValue(line, "hardware ethernet ")}
+		case strings.HasPrefix(line, "client-hostname "):
+			rec[dhcpHostname] = []string{leaseValue(line, "client-hostname ")}
+		case strings.HasPrefix(line, "set vendor-class-identifier = "):
+			rec[dhcpVendorClass] = []string{leaseValue(line, "set vendor-class-identifier = ")}
+		}
+	}
+	if rec != nil {
+		return nil, fmt.Errorf("unterminated lease block for %s", rec[dhcpIP][0])
+	}
+
+	var records []map[string][]string
+	for _, ip := range order {
+		if rec := byIP[ip]; rec != nil {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// leaseValue strips the keyword, the trailing ';' and quotes from a lease statement.
+func leaseValue(line, keyword string) string {
+	v := strings.TrimSuffix(strings.TrimPrefix(line, keyword), ";")
+	return strings.Trim(v, `"`)
+}
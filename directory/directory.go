@@ -0,0 +1,201 @@
+package directory
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+)
+
+const defaultInterval = 15 * time.Minute
+
+// Fetcher retrieves raw records from an external directory.
+// Each record maps attribute/field names to their values.
+type Fetcher interface {
+	Fetch() ([]map[string][]string, error)
+}
+
+// Syncer periodically pulls Users from external directories into the engine.
+type Syncer struct {
+	engine      *engine.Engine
+	directories []config.UserDirectory
+	fetchers    []Fetcher
+	classes     [][]clientClass // Per directory
+
+	mu    sync.Mutex
+	users map[string][]config.User // Directory name -> last good result
+
+	stop chan struct{}
+}
+
+// NewSyncer creates a Syncer for the configured directories.
+func NewSyncer(dirs []config.UserDirectory, eng *engine.Engine) (*Syncer, error) {
+	s := &Syncer{
+		engine:      eng,
+		directories: dirs,
+		users:       make(map[string][]config.User),
+		stop:        make(chan struct{}),
+	}
+
+	for _, d := range dirs {
+		var f Fetcher
+		switch strings.ToLower(d.Type) {
+		case "rest":
+			f = NewRESTFetcher(d)
+		case "ldap":
+			f = NewLDAPFetcher(d)
+		case "dhcp":
+			if d.Path == "" {
+				return nil, fmt.Errorf("path is required for user directory '%s'", d.Name)
+			}
+			f = NewDHCPFetcher(d)
+		default:
+			return nil, fmt.Errorf("unknown type '%s' for user directory '%s'", d.Type, d.Name)
+		}
+		if d.Mapping.Name == "" && !strings.EqualFold(d.Type, "dhcp") {
+			return nil, fmt.Errorf("mapping.name is required for user directory '%s'", d.Name)
+		}
+		classes, err := compileClasses(d.Classes)
+		if err != nil {
+			return nil, fmt.Errorf("user directory '%s': %w", d.Name, err)
+		}
+		s.fetchers = append(s.fetchers, f)
+		s.classes = append(s.classes, classes)
+	}
+
+	return s, nil
+}
+
+// Run syncs every directory in the background, once right away and then
+// periodically. Until the first sync of a directory completes, its users
+// get the default user group.
+func (s *Syncer) Run() {
+	for i := range s.directories {
+		interval := s.directories[i].Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+
+		go func(idx int, interval time.Duration) {
+			s.sync(idx)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.sync(idx)
+				case <-s.stop:
+					return
+				}
+			}
+		}(i, interval)
+	}
+}
+
+func (s *Syncer) Stop() {
+	close(s.stop)
+}
+
+// sync fetches one directory and pushes the merged user list to the engine.
+// On failure the previous result for that directory is kept.
+func (s *Syncer) sync(idx int) {
+	dir := s.directories[idx]
+
+	records, err := s.fetchers[idx].Fetch()
+	if err != nil {
+		log.Printf("User directory '%s' sync failed: %v", dir.Name, err)
+		return
+	}
+
+	users := knownGroups(dir, s.engine.Config(), mapUsers(dir, s.classes[idx], records))
+
+	s.mu.Lock()
+	s.users[dir.Name] = users
+	var all []config.User
+	for _, d := range s.directories {
+		all = append(all, s.users[d.Name]...)
+	}
+	s.mu.Unlock()
+
+	if err := s.engine.SetExternalUsers(all); err != nil {
+		log.Printf("User directory '%s' produced invalid users: %v", dir.Name, err)
+		return
+	}
+
+	log.Printf("Synced %d users from directory '%s'", len(users), dir.Name)
+}
+
+// mapUsers converts raw records to Users, skipping entries without a name or address.
+// The UserGroup comes from the mapped field, then the first matching class, then the default.
+func mapUsers(dir config.UserDirectory, classes []clientClass, records []map[string][]string) []config.User {
+	m := dir.Mapping
+	if strings.EqualFold(dir.Type, "dhcp") {
+		m = dhcpMapping(m)
+	}
+	var users []config.User
+
+	for _, rec := range records {
+		user := config.User{
+			Name:      first(rec[m.Name]),
+			UserGroup: first(rec[m.UserGroup]),
+		}
+		if user.UserGroup == "" {
+			user.UserGroup = classify(classes, user.Name, first(rec[m.VendorClass]))
+		}
+		if user.UserGroup == "" {
+			user.UserGroup = m.DefaultUserGroup
+		}
+
+		for _, ip := range rec[m.IPs] {
+			ip = strings.TrimSpace(ip)
+			if _, err := netip.ParsePrefix(ip); err == nil {
+				user.IPs = append(user.IPs, ip)
+			} else if _, err := netip.ParseAddr(ip); err == nil {
+				user.IPs = append(user.IPs, ip)
+			}
+		}
+		for _, mac := range rec[m.MACs] {
+			if mac = strings.ToLower(strings.TrimSpace(mac)); mac != "" {
+				user.MACs = append(user.MACs, mac)
+			}
+		}
+
+		if user.Name == "" || (len(user.IPs) == 0 && len(user.MACs) == 0) {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// knownGroups drops the users whose UserGroup is not in user_groups, which
+// would otherwise go unfiltered, and logs them.
+func knownGroups(dir config.UserDirectory, cfg *config.Config, users []config.User) []config.User {
+	groups := make(map[string]bool, len(cfg.UserGroups))
+	for _, ug := range cfg.UserGroups {
+		groups[ug.Name] = true
+	}
+
+	kept := users[:0]
+	for _, u := range users {
+		if u.UserGroup != "" && !groups[u.UserGroup] {
+			log.Printf("User directory '%s': user '%s' has unknown user group '%s', skipped", dir.Name, u.Name, u.UserGroup)
+			continue
+		}
+		kept = append(kept, u)
+	}
+	return kept
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
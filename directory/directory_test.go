@@ -0,0 +1,124 @@
+package directory
+
+import (
+	"reflect"
+	"testing"
+
+	"adblocker/config"
+)
+
+func TestMapUsers(t *testing.T) {
+	ldapDir := config.UserDirectory{
+		Type: "ldap",
+		Mapping: config.DirectoryMapping{
+			Name:             "cn",
+			IPs:              "ipHostNumber",
+			MACs:             "macAddress",
+			UserGroup:        "description",
+			VendorClass:      "vendor",
+			DefaultUserGroup: "adults",
+		},
+	}
+	classes, err := compileClasses([]config.ClientClass{
+		{UserGroup: "tv", Hostname: "*-tv"},
+		{UserGroup: "phones", VendorClass: "android-dhcp-*"},
+	})
+	if err != nil {
+		t.Fatalf("compileClasses: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		dir    config.UserDirectory
+		record map[string][]string
+		want   []config.User // nil when the record is skipped
+	}{
+		{
+			name:   "mapped group",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {" laptop "}, "ipHostNumber": {"10.0.0.5"}, "description": {"kids"}},
+			want:   []config.User{{Name: "laptop", IPs: []string{"10.0.0.5"}, UserGroup: "kids"}},
+		},
+		{
+			name:   "prefixes and MACs",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"lab"}, "ipHostNumber": {"10.1.0.0/16", " 2001:db8::1 "}, "macAddress": {"AA:BB:CC:DD:EE:FF", " "}},
+			want:   []config.User{{Name: "lab", IPs: []string{"10.1.0.0/16", "2001:db8::1"}, MACs: []string{"aa:bb:cc:dd:ee:ff"}, UserGroup: "adults"}},
+		},
+		{
+			name:   "invalid addresses dropped",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"pc"}, "ipHostNumber": {"not-an-ip", "10.0.0.7"}},
+			want:   []config.User{{Name: "pc", IPs: []string{"10.0.0.7"}, UserGroup: "adults"}},
+		},
+		{
+			name:   "class by hostname",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"Living-TV"}, "ipHostNumber": {"10.0.0.8"}},
+			want:   []config.User{{Name: "Living-TV", IPs: []string{"10.0.0.8"}, UserGroup: "tv"}},
+		},
+		{
+			name:   "class by vendor class",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"phone"}, "ipHostNumber": {"10.0.0.9"}, "vendor": {"android-dhcp-14"}},
+			want:   []config.User{{Name: "phone", IPs: []string{"10.0.0.9"}, UserGroup: "phones"}},
+		},
+		{
+			name:   "mapped group before classes",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"kids-tv"}, "ipHostNumber": {"10.0.0.10"}, "description": {"kids"}},
+			want:   []config.User{{Name: "kids-tv", IPs: []string{"10.0.0.10"}, UserGroup: "kids"}},
+		},
+		{
+			name:   "no name",
+			dir:    ldapDir,
+			record: map[string][]string{"ipHostNumber": {"10.0.0.5"}},
+		},
+		{
+			name:   "no address",
+			dir:    ldapDir,
+			record: map[string][]string{"cn": {"ghost"}, "ipHostNumber": {"bogus"}},
+		},
+		{
+			name:   "dhcp default mapping",
+			dir:    config.UserDirectory{Type: "DHCP"},
+			record: map[string][]string{dhcpName: {"tablet"}, dhcpIP: {"192.168.1.20"}, dhcpMAC: {"00:11:22:33:44:55"}},
+			want:   []config.User{{Name: "tablet", IPs: []string{"192.168.1.20"}, MACs: []string{"00:11:22:33:44:55"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mapUsers(tt.dir, classes, []map[string][]string{tt.record})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapUsers = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKnownGroups(t *testing.T) {
+	cfg := &config.Config{UserGroups: []config.UserGroup{{Name: "kids"}, {Name: "adults"}}}
+
+	tests := []struct {
+		name  string
+		users []config.User
+		want  []string // Names of the users kept
+	}{
+		{"known", []config.User{{Name: "a", UserGroup: "kids"}, {Name: "b", UserGroup: "adults"}}, []string{"a", "b"}},
+		{"no group", []config.User{{Name: "a"}}, []string{"a"}},
+		{"unknown", []config.User{{Name: "a", UserGroup: "kids"}, {Name: "b", UserGroup: "guests"}, {Name: "c", UserGroup: "adults"}}, []string{"a", "c"}},
+		{"case matters", []config.User{{Name: "a", UserGroup: "Kids"}}, nil},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, u := range knownGroups(config.UserDirectory{Name: "test"}, cfg, tt.users) {
+				got = append(got, u.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("knownGroups kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package directory
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"adblocker/config"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout bounds the connect and each LDAP operation, so an unresponsive
+// server cannot stall the sync of its directory for good.
+const ldapTimeout = 30 * time.Second
+
+// LDAPFetcher reads users from an LDAP directory search.
+type LDAPFetcher struct {
+	dir config.UserDirectory
+}
+
+func NewLDAPFetcher(dir config.UserDirectory) *LDAPFetcher {
+	return &LDAPFetcher{dir: dir}
+}
+
+func (f *LDAPFetcher) Fetch() ([]map[string][]string, error) {
+	conn, err := ldap.DialURL(f.dir.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if f.dir.BindDN != "" {
+		if err := conn.Bind(f.dir.BindDN, f.dir.BindPassword); err != nil {
+			return nil, fmt.Errorf("bind failed: %w", err)
+		}
+	}
+
+	filter := f.dir.Filter
+	if filter == "" {
+		filter = "(objectClass=*)"
+	}
+
+	m := f.dir.Mapping
+	var attrs []string
+	for _, a := range []string{m.Name, m.IPs, m.MACs, m.UserGroup, m.VendorClass} {
+		if a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+
+	req := ldap.NewSearchRequest(
+		f.dir.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, attrs, nil,
+	)
+	res, err := conn.SearchWithPaging(req, 500)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+
+	records := make([]map[string][]string, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		rec := make(map[string][]string, len(attrs))
+		for _, a := range attrs {
+			rec[a] = entry.GetAttributeValues(a)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
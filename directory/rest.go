@@ -0,0 +1,90 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"adblocker/config"
+)
+
+// RESTFetcher reads users from a JSON endpoint.
+// The body is either an array of objects or an object holding the array in the `items` field.
+type RESTFetcher struct {
+	Client *http.Client
+	dir    config.UserDirectory
+}
+
+func NewRESTFetcher(dir config.UserDirectory) *RESTFetcher {
+	return &RESTFetcher{
+		Client: &http.Client{Timeout: 30 * time.Second},
+		dir:    dir,
+	}
+}
+
+func (f *RESTFetcher) Fetch() ([]map[string][]string, error) {
+	req, err := http.NewRequest(http.MethodGet, f.dir.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range f.dir.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	var items []map[string]any
+	if f.dir.Items == "" {
+		err = json.NewDecoder(resp.Body).Decode(&items)
+	} else {
+		var body map[string]json.RawMessage
+		if err = json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			raw, ok := body[f.dir.Items]
+			if !ok {
+				return nil, fmt.Errorf("field '%s' not found in response", f.dir.Items)
+			}
+			err = json.Unmarshal(raw, &items)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	records := make([]map[string][]string, 0, len(items))
+	for _, item := range items {
+		rec := make(map[string][]string, len(item))
+		for k, v := range item {
+			rec[k] = toStrings(v)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// toStrings flattens a JSON value into a list of strings.
+func toStrings(v any) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []any:
+		var out []string
+		for _, item := range val {
+			out = append(out, toStrings(item)...)
+		}
+		return out
+	case nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(val)}
+	}
+}
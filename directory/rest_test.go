@@ -0,0 +1,82 @@
+package directory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"adblocker/config"
+)
+
+func TestRESTFetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   string
+		status  int
+		body    string
+		want    []map[string][]string
+		wantErr bool
+	}{
+		{
+			name:   "array",
+			status: http.StatusOK,
+			body:   `[{"name": "laptop", "ips": ["10.0.0.5", "10.0.0.6"], "port": 8080, "group": null}]`,
+			want:   []map[string][]string{{"name": {"laptop"}, "ips": {"10.0.0.5", "10.0.0.6"}, "port": {"8080"}, "group": nil}},
+		},
+		{
+			name:   "items field",
+			items:  "devices",
+			status: http.StatusOK,
+			body:   `{"total": 1, "devices": [{"name": "tv", "macs": [["aa:bb:cc:dd:ee:ff"]]}]}`,
+			want:   []map[string][]string{{"name": {"tv"}, "macs": {"aa:bb:cc:dd:ee:ff"}}},
+		},
+		{
+			name:    "items field missing",
+			items:   "devices",
+			status:  http.StatusOK,
+			body:    `{"results": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad status",
+			status:  http.StatusUnauthorized,
+			body:    `[]`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			status:  http.StatusOK,
+			body:    `<html></html>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+					t.Errorf("Authorization = %q", got)
+				}
+				if got := r.Header.Get("Accept"); got != "application/json" {
+					t.Errorf("Accept = %q", got)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			f := NewRESTFetcher(config.UserDirectory{
+				URL:     srv.URL,
+				Items:   tt.items,
+				Headers: map[string]string{"Authorization": "Bearer secret"},
+			})
+			got, err := f.Fetch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fetch error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fetch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
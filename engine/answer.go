@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/parser"
+)
+
+// AnswerFilter is the block_answers setting of a rule group active for a
+// query. It is applied to the upstream answer when no rule decided.
+type AnswerFilter struct {
+	RuleGroup string
+	config.AnswerFilter
+}
+
+// answerFilterSource is the source reported for rules of answer filters.
+const answerFilterSource = "block_answers"
+
+// Match returns the synthetic rule blocking an address with the country and
+// ASN (either may be empty), or nil.
+func (f AnswerFilter) Match(country string, asn uint32) *parser.Rule {
+	var text string
+	switch {
+	case country != "" && slices.ContainsFunc(f.Countries, func(c string) bool { return strings.EqualFold(c, country) }):
+		text = "answer:country=" + strings.ToUpper(country)
+	case asn != 0 && slices.Contains(f.ASNs, asn):
+		text = fmt.Sprintf("answer:asn=%d", asn)
+	default:
+		return nil
+	}
+	return &parser.Rule{Text: text, Pattern: text, Type: parser.RuleTypeExact, Source: answerFilterSource}
+}
+
+// answerFilters returns the answer filters of the rule groups, in order.
+func answerFilters(ruleGroups []config.RuleGroup, groupIDs []int) []AnswerFilter {
+	var filters []AnswerFilter
+	for _, gid := range groupIDs {
+		rg := ruleGroups[gid-1]
+		if len(rg.BlockAnswers.Countries) > 0 || len(rg.BlockAnswers.ASNs) > 0 {
+			filters = append(filters, AnswerFilter{RuleGroup: rg.Name, AnswerFilter: rg.BlockAnswers})
+		}
+	}
+	return filters
+}
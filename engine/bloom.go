@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"strings"
+
+	"adblocker/parser"
+)
+
+// bloomHashes is the number of bit positions set per key. With 16 bits per
+// key this gives a false positive rate well below 1%.
+const (
+	bloomHashes     = 6
+	bloomBitsPerKey = 16
+)
+
+// bloomFilter is a fixed-size Bloom filter over trie patterns. It lets Resolve
+// skip the trie walk for names that no rule can match, which is most traffic.
+type bloomFilter struct {
+	seed maphash.Seed
+	bits []uint64
+	mask uint64 // Number of bits - 1 (a power of two)
+	all  bool   // A wildcard pattern can match any name
+}
+
+// newBloomFilter sizes a filter for n keys.
+func newBloomFilter(n int) *bloomFilter {
+	size := uint64(max(n*bloomBitsPerKey, 1024))
+	size = 1 << bits.Len64(size-1) // Round up to a power of two
+	return &bloomFilter{
+		seed: maphash.MakeSeed(),
+		bits: make([]uint64, size/64),
+		mask: size - 1,
+	}
+}
+
+func (b *bloomFilter) add(key string) {
+	h := maphash.String(b.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) & b.mask
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h := maphash.String(b.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) & b.mask
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayMatch reports whether any suffix of domain may hold trie rules.
+// A nil filter matches everything.
+func (b *bloomFilter) mayMatch(domain string) bool {
+	if b == nil || b.all {
+		return true
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	for {
+		if b.mayContain(domain) {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// buildBloom indexes the patterns of all trie rules in groupRules.
+func buildBloom(groupRules map[int][]*parser.Rule) *bloomFilter {
+	n := 0
+	for _, rules := range groupRules {
+		n += len(rules)
+	}
+	b := newBloomFilter(n)
+	for _, rules := range groupRules {
+		for _, r := range rules {
+			if r.Type != parser.RuleTypeExact && r.Type != parser.RuleTypeDistinguish {
+				continue
+			}
+			// A wildcard label matches anything, so index the literal suffix after it
+			pattern := r.Pattern
+			if i := strings.LastIndex(pattern, wildcardLabel); i >= 0 {
+				pattern = strings.TrimPrefix(pattern[i+1:], ".")
+				if pattern == "" {
+					b.all = true
+					continue
+				}
+			}
+			b.add(pattern)
+		}
+	}
+	return b
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"time"
+
+	"adblocker/config"
+)
+
+// Built-in cache policy values.
+var defaultCachePolicy = config.CachePolicy{
+	MinTTL:      20 * time.Second,
+	MaxTTL:      30 * time.Minute,
+	BlockTTL:    60 * time.Second,
+	DecisionTTL: 20 * time.Second,
+}
+
+// CachePolicy returns the cache policy of the named UserGroup with unset
+// fields filled from defaults.cache and the built-in values.
+func (e *Engine) CachePolicy(userGroup string) config.CachePolicy {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+
+	var p config.CachePolicy
+	for _, ug := range e.cfg.UserGroups {
+		if ug.Name == userGroup {
+			p = ug.Cache
+			break
+		}
+	}
+	p = mergeCachePolicy(p, e.cfg.Defaults.Cache)
+	return mergeCachePolicy(p, defaultCachePolicy)
+}
+
+// ResponsePrivacy returns the response_privacy setting of the named UserGroup.
+func (e *Engine) ResponsePrivacy(userGroup string) config.ResponsePrivacy {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+
+	for _, ug := range e.cfg.UserGroups {
+		if ug.Name == userGroup {
+			return ug.ResponsePrivacy
+		}
+	}
+	return config.ResponsePrivacy{}
+}
+
+// mergeCachePolicy fills the zero fields of p from fallback.
+func mergeCachePolicy(p, fallback config.CachePolicy) config.CachePolicy {
+	if p.MinTTL == 0 {
+		p.MinTTL = fallback.MinTTL
+	}
+	if p.MaxTTL == 0 {
+		p.MaxTTL = fallback.MaxTTL
+	}
+	if p.BlockTTL == 0 {
+		p.BlockTTL = fallback.BlockTTL
+	}
+	if p.DecisionTTL == 0 {
+		p.DecisionTTL = fallback.DecisionTTL
+	}
+	return p
+}
@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"hash/fnv"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"adblocker/config"
+	"adblocker/parser"
+)
+
+// defaultCanarySoak is how long new rules stay with the canary clients.
+const defaultCanarySoak = 24 * time.Hour
+
+// canary is the rollout state of one RuleGroup's rules.
+type canary struct {
+	hash    uint64         // Of the newest rules, see hashRules
+	stable  []*parser.Rule // Rules the other clients keep, nil once rolled out
+	rules   int            // Newest rules
+	percent int
+	since   time.Time
+	until   time.Time
+	sid     int // GroupID of the stable rules, see stableID
+}
+
+// active reports whether the other clients still get the stable rules.
+func (c *canary) active(now time.Time) bool {
+	return c.stable != nil && now.Before(c.until)
+}
+
+// CanaryStatus describes a running rollout, see Canaries.
+type CanaryStatus struct {
+	RuleGroup   string    `json:"rule_group"`
+	Percent     int       `json:"percent"`      // Share of clients with the new rules
+	Since       time.Time `json:"since"`        // When the new rules were loaded
+	Until       time.Time `json:"until"`        // When every client gets them
+	Rules       int       `json:"rules"`        // New rules
+	StableRules int       `json:"stable_rules"` // Previous rules, still used by the other clients
+}
+
+// Canaries returns the rule groups whose new rules only reach part of the
+// clients yet, in config order.
+func (e *Engine) Canaries() []CanaryStatus {
+	cfg := e.Config()
+	now := e.clock.Now()
+
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+	out := []CanaryStatus{}
+	for _, rg := range cfg.RuleGroups {
+		c := e.canaries[rg.Name]
+		if c == nil || !c.active(now) {
+			continue
+		}
+		out = append(out, CanaryStatus{
+			RuleGroup:   rg.Name,
+			Percent:     c.percent,
+			Since:       c.since,
+			Until:       c.until,
+			Rules:       c.rules,
+			StableRules: len(c.stable),
+		})
+	}
+	return out
+}
+
+// planCanaries starts a rollout for each canary RuleGroup whose rules rs
+// changes, and adds the rules the other clients keep to rs under their
+// stable ID (see stableID). A rollout still running for the same rules
+// continues; new rules during one replace the candidate, but the stable
+// rules stay the ones that were fully rolled out last.
+func (e *Engine) planCanaries(cfg *config.Config, groupIDs map[string]int, rs *ruleSet) {
+	e.cfgMu.RLock()
+	oldIDs := e.groupIDs
+	e.cfgMu.RUnlock()
+	e.trieMu.RLock()
+	loaded, live, running := !e.loadedAt.IsZero(), e.groupRules, e.canaries
+	e.trieMu.RUnlock()
+
+	now := e.clock.Now()
+	rs.canaries = make(map[string]*canary)
+	for _, rg := range cfg.RuleGroups {
+		if rg.Canary.Percent <= 0 {
+			continue
+		}
+		gid := groupIDs[rg.Name]
+		hash := hashRules(rs.groupRules[gid])
+
+		// 1. Same rules as the running rollout, or as before
+		c := running[rg.Name]
+		switch {
+		case c != nil && c.hash == hash:
+			// Keep it, with the current config
+			c = &canary{hash: hash, stable: c.stable, rules: c.rules, percent: rg.Canary.Percent, since: c.since, until: c.until}
+		case !loaded || oldIDs[rg.Name] == 0:
+			c = &canary{hash: hash} // New group, nothing to compare with
+		default:
+			stable := live[oldIDs[rg.Name]]
+			if c != nil && c.active(now) {
+				stable = c.stable
+			}
+			if hashRules(stable) == hash {
+				c = &canary{hash: hash} // A candidate was reverted
+				break
+			}
+
+			// 2. Changed: a new rollout
+			soak := rg.Canary.Soak
+			if soak <= 0 {
+				soak = defaultCanarySoak
+			}
+			c = &canary{hash: hash, stable: stable, rules: len(rs.groupRules[gid]), percent: rg.Canary.Percent, since: now, until: now.Add(soak)}
+			log.Printf("[CANARY] Rule group '%s' changed (%d rules, was %d): new rules for %d%% of clients until %s",
+				rg.Name, c.rules, len(stable), c.percent, c.until.Format(time.DateTime))
+		}
+		rs.canaries[rg.Name] = c
+		if !c.active(now) {
+			continue
+		}
+
+		// 3. The stable rules, copied since the live set references them under their old ID
+		sid := stableID(cfg, gid)
+		c.sid = sid
+		for _, old := range c.stable {
+			r := *old
+			r.GroupID = sid
+			rs.stable[sid] = append(rs.stable[sid], &r)
+			switch r.Type {
+			case parser.RuleTypeExact, parser.RuleTypeDistinguish:
+				rs.trie.Insert(&r)
+			case parser.RuleTypeRegex:
+				if r.Regex != nil {
+					rs.regexRules = append(rs.regexRules, newRegexRule(&r, rg.Name, rg.Paranoid))
+				}
+			}
+		}
+		rs.stableIDs[gid] = c
+	}
+}
+
+// stableID returns the GroupID the stable rules of a canary RuleGroup are
+// loaded under, past the IDs of the configured groups.
+func stableID(cfg *config.Config, gid int) int {
+	return len(cfg.RuleGroups) + gid
+}
+
+// hashRules fingerprints a rule list regardless of order, as sources load concurrently.
+func hashRules(rules []*parser.Rule) uint64 {
+	var sum uint64
+	for _, r := range rules {
+		h := fnv.New64a()
+		h.Write([]byte(r.Text))
+		sum += h.Sum64()
+	}
+	return sum
+}
+
+// canaryBucket places a client in 0-99; clients below a group's percent get
+// its new rules.
+func canaryBucket(user *config.User, clientIP netip.Addr) int {
+	h := fnv.New32a()
+	if user != nil {
+		h.Write([]byte(user.Name))
+	} else {
+		h.Write([]byte(clientIP.String()))
+	}
+	return int(h.Sum32() % 100)
+}
+
+// matchIDs returns the GroupIDs whose rules decide for the client, in the
+// order of gids: the stable ID of a rule group in rollout for clients
+// outside its canary. Caller holds trieMu.
+func (e *Engine) matchIDs(gids []int, user *config.User, clientIP netip.Addr) []int {
+	if len(e.stableIDs) == 0 {
+		return gids
+	}
+	now := e.clock.Now()
+	bucket := -1
+	var ids []int
+	for i, gid := range gids {
+		c := e.stableIDs[gid]
+		if c == nil || !c.active(now) {
+			continue
+		}
+		if bucket < 0 {
+			bucket = canaryBucket(user, clientIP)
+		}
+		if bucket < c.percent {
+			continue
+		}
+		if ids == nil {
+			ids = append([]int(nil), gids...)
+		}
+		ids[i] = c.sid
+	}
+	if ids == nil {
+		return gids
+	}
+	return ids
+}
+
+// CanaryKey returns the running rollouts that give the client new rules,
+// for cache keys: clients sharing a decision cache must see the same rules.
+// It is empty when there are none.
+func (e *Engine) CanaryKey(user *config.User, clientIP netip.Addr) string {
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+	if len(e.canaries) == 0 {
+		return ""
+	}
+	now := e.clock.Now()
+	bucket := canaryBucket(user, clientIP)
+	var groups []string
+	for name, c := range e.canaries {
+		if c.active(now) && bucket < c.percent {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	return strings.Join(groups, ",")
+}
@@ -0,0 +1,25 @@
+package engine
+
+import "time"
+
+// Clock tells the time for schedules, overrides, guests, canaries and
+// profiles. It has the method set of server.Clock, so one clock drives both.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SetClock replaces the clock of e, e.g. with a manual one in tests. It must
+// be called before e resolves queries.
+func (e *Engine) SetClock(c Clock) {
+	e.clock = c
+}
+
+// Now returns the time of the clock of e, for callers that set guests or
+// overrides relative to it.
+func (e *Engine) Now() time.Time {
+	return e.clock.Now()
+}
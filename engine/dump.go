@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"adblocker/parser"
+)
+
+// RuleDump is one loaded rule as the engine holds it after parsing.
+type RuleDump struct {
+	RuleGroup string `json:"rule_group"`
+	Source    string `json:"source"`
+	Type      string `json:"type"`
+	Pattern   string `json:"pattern"`
+	Exception bool   `json:"exception,omitempty"` // @@ rule
+	Modifiers string `json:"modifiers,omitempty"` // Normalized, see parser.Modifiers.String
+	IP        string `json:"ip,omitempty"`        // Hosts-style answer address
+	Text      string `json:"text"`                // As written in the list
+}
+
+// DumpRules returns the loaded rules of group (all groups if empty),
+// limited to those matching domain or a parent when domain is set. The
+// order is stable across runs: rule group, source, type, pattern, text.
+func (e *Engine) DumpRules(group, domain string) ([]RuleDump, error) {
+	e.cfgMu.RLock()
+	ruleGroups := e.cfg.RuleGroups
+	gid := e.groupIDs[group]
+	e.cfgMu.RUnlock()
+	if group != "" && gid == 0 {
+		return nil, fmt.Errorf("unknown rule group '%s'", group)
+	}
+	groupName := func(gid int) string {
+		if gid >= 1 && gid <= len(ruleGroups) {
+			return ruleGroups[gid-1].Name
+		}
+		return ""
+	}
+
+	var rules []*parser.Rule
+	e.trieMu.RLock()
+	switch {
+	case domain != "":
+		fqdn := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".") + "."
+		for _, r := range append(e.trie.SearchTrace(fqdn), e.regexMatches(fqdn)...) {
+			if gid == 0 || r.GroupID == gid {
+				rules = append(rules, r)
+			}
+		}
+	case gid != 0:
+		rules = e.groupRules[gid]
+	default:
+		for _, groupRules := range e.groupRules {
+			rules = append(rules, groupRules...)
+		}
+	}
+	e.trieMu.RUnlock()
+
+	dump := make([]RuleDump, 0, len(rules))
+	seen := make(map[*parser.Rule]bool)
+	for _, r := range rules {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		d := RuleDump{
+			RuleGroup: groupName(r.GroupID),
+			Source:    r.Source,
+			Type:      r.Type.String(),
+			Pattern:   r.Pattern,
+			Exception: r.IsWhitelist,
+			Modifiers: r.Modifiers.String(),
+			Text:      r.Text,
+		}
+		if r.IP.IsValid() {
+			d.IP = r.IP.String()
+		}
+		dump = append(dump, d)
+	}
+
+	sort.Slice(dump, func(i, j int) bool {
+		a, b := dump[i], dump[j]
+		switch {
+		case a.RuleGroup != b.RuleGroup:
+			return a.RuleGroup < b.RuleGroup
+		case a.Source != b.Source:
+			return a.Source < b.Source
+		case a.Type != b.Type:
+			return a.Type < b.Type
+		case a.Pattern != b.Pattern:
+			return a.Pattern < b.Pattern
+		default:
+			return a.Text < b.Text
+		}
+	})
+	return dump, nil
+}
@@ -1,47 +1,114 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/netip"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"adblocker/config"
 	"adblocker/parser"
 
 	"regexp"
-
-	"github.com/miekg/dns"
 )
 
 // RegexRule compiled wrapper
 type RegexRule struct {
 	Rule  *parser.Rule
 	Regex *regexp.Regexp
+	guard *regexGuard // Set for rules from paranoid rule groups
 }
 
 // Engine combines User, Schedule, and Trie matching to make filtering decisions.
 type Engine struct {
+	// Config protection (cfg, matchers, groupIDs)
+	cfgMu           sync.RWMutex
 	cfg             *config.Config
 	userMatcher     *UserMatcher
 	scheduleMatcher *ScheduleMatcher
+	profiles        *profileSet
+	rewrites        rewriteSet
+	protected       protectedSet
+	profileOverride string // Profile selected at runtime, see SetProfile
+
+	// Users synced from external directories
+	externalUsers []config.User
+
+	// Temporary Users, see SetGuest; guests and guestList are protected by cfgMu
+	guests      map[string]Guest
+	guestList   []config.User
+	guestExpiry atomic.Int64 // Earliest Until in UnixNano, 0 without guests
+	guestMu     sync.Mutex   // Serializes writes of guestFile
+	guestFile   string
+
+	overrideMu sync.Mutex
+	overrides  map[string]DeviceOverride // By User name, see SetOverride
+
+	presenceMu sync.RWMutex
+	presence   map[string]bool // By Schedule name, see SetPresent
+
+	// Next schedule-driven policy change per UserGroup
+	transitionMu sync.Mutex
+	transitions  map[string]cachedTransition
+
+	// Serializes ReloadRules and ApplyConfig
+	reloadMu sync.Mutex
+
+	// Progress of the running or last reload
+	progressMu    sync.Mutex
+	progress      ReloadProgress
+	report        *ReloadReport // Last finished reload
+	appliedReport *ReloadReport // Last reload whose rules were swapped in
+
 	// Trie protection
 	trieMu sync.RWMutex
 	trie   *DomainTrie
+	bloom  *bloomFilter // Pre-check for trie patterns, nil before the first load
 
 	// Regex Rules
 	regexRules []RegexRule
+	regexMemo  *regexMemo // Regex matches of recent names, reset with each rule set
+
+	// Loaded rules per GroupID, kept for export and inspection
+	groupRules map[int][]*parser.Rule
+
+	// Rule groups in canary rollout, by name and by GroupID, see planCanaries
+	canaries  map[string]*canary
+	stableIDs map[int]*canary
+
+	// Time of the last completed rule reload
+	loadedAt time.Time
+
+	// Domains found dead by the pruning job: Domain -> Expiry
+	deadMu      sync.Mutex
+	deadDomains map[string]time.Time
 
 	// File Rule Cache: Path -> Rules
-	fileRuleCache map[string][]*parser.Rule
+	fileMu        sync.Mutex
+	fileRuleCache map[string]cachedFile
 
 	// Map RuleGroup Name -> GroupID
 	groupIDs map[string]int
 
 	// Default default user group Name
 	defaultUserGroupName string
+
+	clock Clock // See SetClock
+}
+
+type cachedFile struct {
+	modTime time.Time
+	strict  bool // Parsed with strict mode
+	format  parser.Format
+	rules   []*parser.Rule
+	stats   parser.LoadStats
 }
 
 // NewEngine initializes the matching engine.
@@ -56,107 +123,528 @@ func NewEngine(cfg *config.Config) (*Engine, error) {
 		return nil, fmt.Errorf("schedule matcher init failed: %w", err)
 	}
 
+	ps, err := newProfileSet(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("profiles init failed: %w", err)
+	}
+
+	rw, err := newRewriteSet(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("rewrites init failed: %w", err)
+	}
+
+	pr, err := newProtectedSet(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("protected domains init failed: %w", err)
+	}
+
 	e := &Engine{
 		cfg:                  cfg,
 		userMatcher:          um,
 		scheduleMatcher:      sm,
+		profiles:             ps,
+		rewrites:             rw,
+		protected:            pr,
 		trie:                 NewDomainTrie(),
-		fileRuleCache:        make(map[string][]*parser.Rule),
-		groupIDs:             make(map[string]int),
+		fileRuleCache:        make(map[string]cachedFile),
+		deadDomains:          make(map[string]time.Time),
+		transitions:          make(map[string]cachedTransition),
+		groupIDs:             assignGroupIDs(cfg),
 		defaultUserGroupName: cfg.Defaults.UserGroup,
+		clock:                systemClock{},
 	}
+	sm.present = e.Present
 
-	// 1. Assign IDs to RuleGroups
+	return e, nil
+}
+
+// assignGroupIDs maps RuleGroup names to 1-based IDs in config order.
+func assignGroupIDs(cfg *config.Config) map[string]int {
+	ids := make(map[string]int)
 	for i, rg := range cfg.RuleGroups {
-		e.groupIDs[rg.Name] = i + 1 // 1-based index
+		ids[rg.Name] = i + 1 // 1-based index
 	}
+	return ids
+}
 
-	return e, nil
+// GetUser identifies the user based on client ID, MAC and IP.
+func (e *Engine) GetUser(clientIP netip.Addr, clientMAC, clientID string) *config.User {
+	e.expireGuests(e.clock.Now())
+
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	return e.userMatcher.Match(clientIP, clientMAC, clientID)
+}
+
+// UserGroupName returns the UserGroup that applies to user, falling back to the default group.
+func (e *Engine) UserGroupName(user *config.User) string {
+	if user != nil {
+		return user.UserGroup
+	}
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	return e.defaultUserGroupName
+}
+
+// SetExternalUsers replaces the users synced from external directories.
+// Users from the config file and guests keep precedence over external ones.
+func (e *Engine) SetExternalUsers(users []config.User) error {
+	e.cfgMu.Lock()
+	defer e.cfgMu.Unlock()
+
+	um, err := newMergedUserMatcher(e.cfg, append(slices.Clip(e.guestList), users...))
+	if err != nil {
+		return err
+	}
+
+	e.userMatcher = um
+	e.externalUsers = users
+	return nil
+}
+
+// newMergedUserMatcher builds the matcher of cfg and adds the external
+// users (guests, then directories) where no configured user matches.
+func newMergedUserMatcher(cfg *config.Config, external []config.User) (*UserMatcher, error) {
+	um, err := NewUserMatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := um.add(slices.Clone(external), false); err != nil {
+		return nil, err
+	}
+	return um, nil
 }
 
-// GetUser identifies the user based on IP and MAC.
-func (e *Engine) GetUser(clientIP netip.Addr, clientMAC string) *config.User {
-	return e.userMatcher.Match(clientIP, clientMAC)
+// Config returns the configuration the engine is currently running with.
+func (e *Engine) Config() *config.Config {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	return e.cfg
+}
+
+// ApplyConfig validates a new configuration, loads its rules and swaps
+// everything in at once. On error the running configuration is kept.
+func (e *Engine) ApplyConfig(cfg *config.Config, loader *parser.Loader) error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	// 1. Build matchers first, they validate the config
+	um, err := NewUserMatcher(cfg)
+	if err != nil {
+		return fmt.Errorf("user matcher init failed: %w", err)
+	}
+	sm, err := NewScheduleMatcher(cfg)
+	if err != nil {
+		return fmt.Errorf("schedule matcher init failed: %w", err)
+	}
+	sm.present = e.Present
+	ps, err := newProfileSet(cfg)
+	if err != nil {
+		return fmt.Errorf("profiles init failed: %w", err)
+	}
+	rw, err := newRewriteSet(cfg)
+	if err != nil {
+		return fmt.Errorf("rewrites init failed: %w", err)
+	}
+	pr, err := newProtectedSet(cfg)
+	if err != nil {
+		return fmt.Errorf("protected domains init failed: %w", err)
+	}
+	groupIDs := assignGroupIDs(cfg)
+
+	// 2. Load rules off the hot path, keeping the old snapshot if the new one looks broken
+	rs := e.loadRules(cfg, groupIDs, loader)
+	err = e.checkRuleSet(rs, false)
+	e.finishProgress(err)
+	e.finishReport(rs, err, loader.DataDir)
+	if err != nil {
+		return fmt.Errorf("rule set rejected: %w", err)
+	}
+
+	// 3. Swap config and rules together so IDs always match the trie. Guests
+	// and directory users are added under the same lock, so a concurrent
+	// SetExternalUsers or SetGuest is not lost
+	e.cfgMu.Lock()
+	if err := um.add(append(slices.Clone(e.guestList), e.externalUsers...), false); err != nil {
+		e.cfgMu.Unlock()
+		return fmt.Errorf("user matcher init failed: %w", err)
+	}
+	e.trieMu.Lock()
+	e.cfg = cfg
+	e.userMatcher = um
+	e.scheduleMatcher = sm
+	e.profiles = ps
+	e.rewrites = rw
+	e.protected = pr
+	if ps.byName[e.profileOverride] == nil && e.profileOverride != DefaultProfile {
+		e.profileOverride = "" // Profile removed from the config
+	}
+	e.groupIDs = groupIDs
+	e.defaultUserGroupName = cfg.Defaults.UserGroup
+	e.swapRules(rs)
+	e.trieMu.Unlock()
+	e.cfgMu.Unlock()
+	e.resetTransitions()
+
+	log.Printf("Configuration applied (%d users, %d rule groups).", len(cfg.Users), len(cfg.RuleGroups))
+	pruneListCache(cfg, loader)
+	return nil
 }
 
 // ReloadRules reloads all regulations and atomically swaps the trie.
-func (e *Engine) ReloadRules(loader *parser.Loader) {
+// If the new rule set fails validation the current one is kept and an error is returned.
+func (e *Engine) ReloadRules(loader *parser.Loader) error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	e.cfgMu.RLock()
+	cfg, groupIDs := e.cfg, e.groupIDs
+	e.cfgMu.RUnlock()
+
+	rs := e.loadRules(cfg, groupIDs, loader)
+	err := e.checkRuleSet(rs, true)
+	e.finishProgress(err)
+	e.finishReport(rs, err, loader.DataDir)
+	if err != nil {
+		log.Printf("New rule set rejected, rules unchanged: %v", err)
+		return err
+	}
+
+	// Atomic Swap
+	e.trieMu.Lock()
+	e.swapRules(rs)
+	e.trieMu.Unlock()
+
+	log.Printf("Rules reloaded and trie updated (%d rules).", rs.rules)
+	pruneListCache(cfg, loader)
+	return nil
+}
+
+// pruneListCache removes downloaded lists that cfg no longer uses and
+// enforces list_cache.max_size. The rules in memory are not affected.
+func pruneListCache(cfg *config.Config, loader *parser.Loader) {
+	if loader.DataDir == "" {
+		return
+	}
+	var urls []string
+	for _, rg := range cfg.RuleGroups {
+		for _, src := range rg.Sources {
+			if src.URL != "" {
+				urls = append(urls, src.URL)
+			}
+		}
+	}
+	st, err := loader.PruneCache(urls, cfg.ListCache.KeepUnused, int64(cfg.ListCache.MaxSize))
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if st.Unused+st.Evicted+st.Temp > 0 {
+		log.Printf("[CACHE] Pruned %d unused and %d oldest lists and %d partial downloads, freed %s, %s left",
+			st.Unused, st.Evicted, st.Temp, config.ByteSize(st.Freed), config.ByteSize(st.Size))
+	}
+}
+
+// ruleSet holds freshly loaded rules before they are swapped in.
+type ruleSet struct {
+	trie       *DomainTrie
+	bloom      *bloomFilter
+	regexRules []RegexRule
+	groupRules map[int][]*parser.Rule
+
+	// Canary rollouts and the rules the other clients keep, by stable ID
+	canaries  map[string]*canary
+	stableIDs map[int]*canary
+	stable    map[int][]*parser.Rule
+
+	// Load statistics, used to validate the set before swapping
+	sources, failed, rules int
+	report                 []SourceReport // In config order
+
+	budget   int64 // Projected memory allowed for the set, 0 if unlimited
+	skipped  int   // Sources not inserted because the budget was exhausted
+	memoSize int
+
+	limits  config.RuleLimits
+	limited []string // Why sources were not inserted because of limits
+}
+
+// swapRules installs a rule set. Caller must hold trieMu.
+func (e *Engine) swapRules(rs *ruleSet) {
+	e.trie = rs.trie
+	e.bloom = rs.bloom
+	e.regexRules = rs.regexRules
+	e.regexMemo = newRegexMemo(rs.memoSize)
+	e.groupRules = rs.groupRules
+	e.canaries = rs.canaries
+	e.stableIDs = rs.stableIDs
+	e.loadedAt = time.Now()
+	parser.SweepRegexCache() // Patterns of the previous rule set only
+}
+
+// loadRules fetches all sources of cfg concurrently and builds a new rule set.
+func (e *Engine) loadRules(cfg *config.Config, groupIDs map[string]int, loader *parser.Loader) *ruleSet {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 
-	newTrie := NewDomainTrie()
-	var newRegexRules []RegexRule
+	rs := &ruleSet{
+		trie:       NewDomainTrie(),
+		groupRules: make(map[int][]*parser.Rule),
+		stableIDs:  make(map[int]*canary),
+		stable:     make(map[int][]*parser.Rule),
+		budget:     ruleBudget(cfg.Server.MemoryLimit),
+		memoSize:   memoSize(cfg.Server.MemoryLimit),
+		limits:     cfg.RuleLimits,
+	}
+
+	for _, rg := range cfg.RuleGroups {
+		rs.sources += len(rg.LoadSources())
+	}
+	rs.report = make([]SourceReport, 0, rs.sources)
+	e.startProgress(rs.sources)
 
-	log.Printf("Reloading rules for %d groups...", len(e.cfg.RuleGroups))
+	log.Printf("Reloading rules for %d groups (%d sources)...", len(cfg.RuleGroups), rs.sources)
+	loader = loader.WithStrict(cfg.StrictParsing).WithMaxRules(cfg.RuleLimits.PerSource)
+	budget := newBudgetQueue(rs.budget)
 
-	for _, rg := range e.cfg.RuleGroups {
-		groupID := e.groupIDs[rg.Name]
+	for _, rg := range cfg.RuleGroups {
+		groupID := groupIDs[rg.Name]
 
-		for _, source := range rg.Sources {
+		for _, source := range rg.LoadSources() {
 			wg.Add(1)
+			ruleGroup, paranoid := rg.Name, rg.Paranoid
+			seq := len(rs.report) // Config order, for the memory budget
+			rs.report = append(rs.report, SourceReport{RuleGroup: rg.Name, Name: source.Name, Location: source.URL + source.Path})
+			sr := &rs.report[len(rs.report)-1] // Each goroutine fills its own entry
 			go func(src config.Source, gid int) {
 				defer wg.Done()
+				defer budget.pass(seq)
 
 				var rules []*parser.Rule
+				var stats parser.LoadStats
 				var err error
 
-				if src.Path != "" {
-					// Check Cache
-					e.trieMu.RLock()
-					cached, ok := e.fileRuleCache[src.Path]
-					e.trieMu.RUnlock()
-
-					if ok {
-						rules = cached
-						// log.Printf("Using cached rules for '%s'", src.Name)
+				start := time.Now()
+				admit := func(n int) bool { return budget.admit(seq, n) }
+				srcLoader := loader.WithFormat(parser.Format(src.Format)).WithAdmit(admit)
+				if v := src.Verify; v != nil {
+					srcLoader = srcLoader.WithVerify(parser.Verify{Minisign: v.Minisign, PGPKeyRing: v.PGP, Signature: v.Signature, SHA256Sums: v.SHA256Sums})
+				}
+				if src.Inline != nil {
+					if admit(len(src.Inline)) {
+						rules, stats = srcLoader.LoadFromLines(src.Name, src.Inline)
 					} else {
-						rules, err = loader.LoadFromPath(src.Path)
-						if err == nil {
-							// Update Cache
-							e.trieMu.Lock()
-							e.fileRuleCache[src.Path] = rules
-							e.trieMu.Unlock()
-						}
+						err = fmt.Errorf("%w: about %d rules", parser.ErrOverBudget, len(src.Inline))
 					}
+				} else if src.Path != "" {
+					rules, stats, err = e.loadFile(srcLoader, src.Path)
 				} else if src.URL != "" {
-					rules, err = loader.LoadFromURLWithCache(src.URL)
+					rules, stats, err = srcLoader.LoadFromMirrors(src.URLs(), src.MirrorOrder)
+				}
+				sr.Duration = time.Since(start).Seconds()
+				sr.Origin = stats.Origin
+				sr.Mirror = stats.Mirror
+				sr.ParseErrors = stats.Rejected
+				sr.FetchedAt = stats.FetchedAt
+				sr.HTTPStatus = stats.HTTPStatus
+				sr.Bytes = stats.Bytes
+
+				// Inline rules and cached files parsed before the limit was lowered
+				if err == nil && rs.limits.PerSource > 0 && len(rules) > rs.limits.PerSource {
+					err = fmt.Errorf("%w: %d rules", parser.ErrTooManyRules, len(rules))
+				}
+				if errors.Is(err, parser.ErrTooManyRules) {
+					err = fmt.Errorf("%w, over rule_limits.per_source (%d)", err, rs.limits.PerSource)
+				}
+				if errors.Is(err, parser.ErrOverBudget) {
+					mu.Lock()
+					rs.skipped++
+					mu.Unlock()
+					sr.Status = SourceSkipped
+					sr.Error = err.Error()
+					p := e.sourceDone(0, true)
+					log.Printf("Skipped source '%s': %v (%d/%d sources)", src.Name, err, p.SourcesDone, p.SourcesTotal)
+					return
 				}
-
 				if err != nil {
-					log.Printf("Failed to load source '%s': %v", src.Name, err)
+					sr.Status = SourceFailed
+					sr.Error = err.Error()
+					p := e.sourceDone(0, true)
+					log.Printf("Failed to load source '%s': %v (%d/%d sources)", src.Name, err, p.SourcesDone, p.SourcesTotal)
+					mu.Lock()
+					rs.failed++
+					mu.Unlock()
 					return
 				}
 
 				// Insert into New Trie or Regex List
+				now := time.Now()
+				inserted := 0
 				mu.Lock()
-				for _, r := range rules {
+				if reason := rs.overLimit(gid, ruleGroup, len(rules)); reason != "" {
+					rs.limited = append(rs.limited, fmt.Sprintf("source '%s' %s", src.Name, reason))
+					mu.Unlock()
+					sr.Status = SourceSkipped
+					sr.Error = reason
+					p := e.sourceDone(0, true)
+					log.Printf("Skipped source '%s': %s (%d/%d sources)", src.Name, reason, p.SourcesDone, p.SourcesTotal)
+					return
+				}
+				e.deadMu.Lock()
+				for _, cached := range rules {
+					if e.isDead(cached, now) {
+						continue
+					}
+
+					// Copy: file rules are shared through the cache and may be
+					// referenced by the live trie under a different GroupID.
+					r := cached
+					if src.Path != "" {
+						rc := *cached
+						r = &rc
+					}
 					r.GroupID = gid
+					r.Source = src.Name
+					rs.groupRules[gid] = append(rs.groupRules[gid], r)
+					inserted++
+
 					switch r.Type {
 					case parser.RuleTypeExact, parser.RuleTypeDistinguish:
-						newTrie.Insert(r)
+						rs.trie.Insert(r)
 					case parser.RuleTypeRegex:
-						re, err := regexp.Compile(r.Pattern)
-						if err == nil {
-							newRegexRules = append(newRegexRules, RegexRule{Rule: r, Regex: re})
+						if r.Regex != nil {
+							rs.regexRules = append(rs.regexRules, newRegexRule(r, ruleGroup, paranoid))
 						}
 					}
 				}
+				rs.rules += inserted
+				e.deadMu.Unlock()
 				mu.Unlock()
+				sr.Status = SourceOK
+				sr.Rules = inserted
 
-				log.Printf("Loaded %d rules from '%s'", len(rules), src.Name)
+				p := e.sourceDone(inserted, false)
+				log.Printf("Loaded %d rules from '%s' (%d/%d sources, %d rules so far)", len(rules), src.Name, p.SourcesDone, p.SourcesTotal, p.RulesInserted)
 			}(source, groupID)
 		}
 	}
 
 	wg.Wait()
+	e.planCanaries(cfg, groupIDs, rs)
+	all := rs.groupRules
+	if len(rs.stable) > 0 {
+		all = maps.Clone(rs.groupRules)
+		maps.Copy(all, rs.stable)
+	}
+	rs.bloom = buildBloom(all)
+	return rs
+}
 
-	// Atomic Swap
-	e.trieMu.Lock()
-	e.trie = newTrie
-	e.regexRules = newRegexRules
-	e.trieMu.Unlock()
+// overLimit returns why adding n rules to group gid would break a rule
+// limit, or "". Caller holds the lock guarding rs.
+func (rs *ruleSet) overLimit(gid int, group string, n int) string {
+	if l := rs.limits.PerGroup; l > 0 && len(rs.groupRules[gid])+n > l {
+		return fmt.Sprintf("would bring rule group '%s' to %d rules, over rule_limits.per_group (%d)", group, len(rs.groupRules[gid])+n, l)
+	}
+	if l := rs.limits.Total; l > 0 && rs.rules+n > l {
+		return fmt.Sprintf("would bring the total to %d rules, over rule_limits.total (%d)", rs.rules+n, l)
+	}
+	return ""
+}
+
+// loadFile reads a local rule file, reusing the parsed rules while the file is unchanged.
+func (e *Engine) loadFile(loader *parser.Loader, path string) ([]*parser.Rule, parser.LoadStats, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, parser.LoadStats{Origin: parser.OriginFile}, err
+	}
+
+	// Check Cache
+	e.fileMu.Lock()
+	cached, ok := e.fileRuleCache[path]
+	e.fileMu.Unlock()
 
-	log.Printf("Rules reloaded and trie updated.")
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.strict == loader.Strict && cached.format == loader.Format {
+		if loader.Admit != nil && !loader.Admit(len(cached.rules)) {
+			return nil, cached.stats, fmt.Errorf("%w: %d rules", parser.ErrOverBudget, len(cached.rules))
+		}
+		return cached.rules, cached.stats, nil
+	}
+
+	rules, stats, err := loader.LoadFromPathStats(path)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	// Update Cache
+	e.fileMu.Lock()
+	e.fileRuleCache[path] = cachedFile{modTime: info.ModTime(), strict: loader.Strict, format: loader.Format, rules: rules, stats: stats}
+	e.fileMu.Unlock()
+
+	return rules, stats, nil
+}
+
+// RuleGroups returns the configured rule groups in config order.
+func (e *Engine) RuleGroups() []config.RuleGroup {
+	return e.Config().RuleGroups
+}
+
+// GroupRules returns the rules currently loaded for the named RuleGroup.
+// Returns nil if the group is unknown or has no rules.
+func (e *Engine) GroupRules(name string) []*parser.Rule {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+
+	gid := e.groupIDs[name]
+	if gid == 0 {
+		return nil
+	}
+
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+	return e.groupRules[gid]
+}
+
+// RuleGroupStatus summarizes a rule group for the dashboard.
+type RuleGroupStatus struct {
+	Name          string   `json:"name"`
+	Rules         int      `json:"rules"` // Loaded now
+	Sources       int      `json:"sources"`
+	FailedSources int      `json:"failed_sources"` // In the last reload, their previous rules may still be loaded
+	UserGroups    []string `json:"user_groups"`    // With a policy for the group
+}
+
+// RuleGroupStatuses returns the status of the rule groups in config order.
+func (e *Engine) RuleGroupStatuses() []RuleGroupStatus {
+	cfg := e.Config()
+	report := e.Report()
+	list := make([]RuleGroupStatus, 0, len(cfg.RuleGroups))
+	for _, rg := range cfg.RuleGroups {
+		st := RuleGroupStatus{Name: rg.Name, Rules: len(e.GroupRules(rg.Name)), Sources: len(rg.Sources), UserGroups: []string{}}
+		if len(rg.Rules) > 0 {
+			st.Sources++ // Inline rules
+		}
+		if report != nil {
+			for _, src := range report.Sources {
+				if src.RuleGroup == rg.Name && src.Status == SourceFailed {
+					st.FailedSources++
+				}
+			}
+		}
+		for _, ug := range cfg.UserGroups {
+			if slices.ContainsFunc(ug.Policies, func(p config.Policy) bool { return p.RuleGroup == rg.Name }) {
+				st.UserGroups = append(st.UserGroups, ug.Name)
+			}
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// LoadedAt returns the time the current rule set was swapped in.
+func (e *Engine) LoadedAt() time.Time {
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+	return e.loadedAt
 }
 
 // ResolveResult contains the decision for a DNS query.
@@ -165,43 +653,144 @@ type ResolveResult struct {
 	Reason     string
 	Rule       *parser.Rule // The rule that caused the block
 	User       *config.User
+	UserGroup  string // UserGroup the decision was made for
+	RuleGroup  string // RuleGroup of the deciding rule, empty if no rule matched
 	DNSRewrite string // Rewrite destination (IP or CNAME)
+
+	// Upstream of the UserGroup, to forward allowed queries and chase
+	// rewrites to; empty for server.upstream
+	Upstream []string
+
+	// AnswerFilters of the active rule groups, set when no rule decided
+	AnswerFilters []AnswerFilter
+}
+
+// Resolve processes a DNS question. clientID is the DoH client ID of the
+// query, "" for other transports.
+func (e *Engine) Resolve(qName string, qType uint16, clientIP netip.Addr, clientMAC, clientID string) *ResolveResult {
+	res := e.resolve(qName, qType, clientIP, clientMAC, clientID, nil)
+	res.Upstream = e.userGroupUpstream(res.UserGroup)
+	return res
+}
+
+// userGroupUpstream returns the upstream of the named UserGroup, nil when it uses server.upstream.
+func (e *Engine) userGroupUpstream(userGroup string) []string {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	for _, ug := range e.cfg.UserGroups {
+		if ug.Name == userGroup {
+			return ug.Upstream
+		}
+	}
+	return nil
+}
+
+// BlockingMode returns how blocks of the named RuleGroup are answered: its
+// own blocking_mode, else server.blocking_mode.
+func (e *Engine) BlockingMode(ruleGroup string) config.BlockingMode {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	for _, rg := range e.cfg.RuleGroups {
+		if rg.Name == ruleGroup && !rg.BlockingMode.IsZero() {
+			return rg.BlockingMode
+		}
+	}
+	return e.cfg.Server.BlockingMode
 }
 
-// Resolve processes a DNS question.
-func (e *Engine) Resolve(qName string, qType uint16, clientIP netip.Addr, clientMAC string) *ResolveResult {
+// resolve decides a query for Resolve, recording the steps in tr if it is not nil.
+func (e *Engine) resolve(qName string, qType uint16, clientIP netip.Addr, clientMAC, clientID string, tr *Trace) *ResolveResult {
+	e.cfgMu.RLock()
+
 	// 1. Identify User
-	user := e.userMatcher.Match(clientIP, clientMAC)
+	user := e.userMatcher.Match(clientIP, clientMAC, clientID)
+	if tr != nil {
+		tr.add("query: %s type %d from %s, MAC %q, client ID %q", qName, qType, clientIP, clientMAC, clientID)
+		if user != nil {
+			tr.add("user: %s", user.Name)
+		} else {
+			tr.add("user: none, default user group '%s'", e.defaultUserGroupName)
+		}
+	}
 
-	// 2. Determine UserGroup
+	// 2. Determine UserGroup, unless an override decides for the device
 	var userGroupName string
 	if user != nil {
 		userGroupName = user.UserGroup
 	} else {
 		userGroupName = e.defaultUserGroupName
 	}
+	o, overridden := e.activeOverride(user, e.clock.Now())
+	if overridden {
+		if tr != nil {
+			tr.add("override: %s until %s, set by %s", o.Mode, o.Until.Format(time.RFC3339), o.SetBy)
+		}
+		switch o.Mode {
+		case OverrideBlock:
+			e.cfgMu.RUnlock()
+			return overrideResult(o, qName, user)
+		case OverrideUserGroup:
+			userGroupName = o.UserGroup
+		}
+	}
 
-	// 3. Get Active Policies (ordered by config)
-	activeGroupIDs := e.getActiveGroupIDs(userGroupName)
+	// 2b. Administrative rewrites answer before any filtering, also while paused
+	if rule := e.rewrites.match(qName, qType, userGroupName); rule != nil {
+		e.cfgMu.RUnlock()
+		tr.add("rewrite: '%s' answers before filtering", rule.Text)
+		return &ResolveResult{Blocked: true, Reason: "Rewrite", Rule: rule, DNSRewrite: rule.Modifiers.DNSRewrite, User: user, UserGroup: userGroupName, RuleGroup: RewriteSource}
+	}
+	if overridden && o.Mode == OverridePause {
+		e.cfgMu.RUnlock()
+		return overrideResult(o, qName, user)
+	}
+
+	// 3. Get Active Policies (ordered by priority, then config)
+	activeGroupIDs := e.getActiveGroupIDs(userGroupName, user)
+	ruleGroups := e.cfg.RuleGroups
+	protected := e.protected
+
+	e.cfgMu.RUnlock()
+	if tr != nil {
+		names := make([]string, len(activeGroupIDs))
+		for i, gid := range activeGroupIDs {
+			names[i] = ruleGroups[gid-1].Name
+		}
+		tr.add("user group '%s': active rule groups %v", userGroupName, names)
+	}
 
 	if len(activeGroupIDs) == 0 {
-		return &ResolveResult{Blocked: false, Reason: "No active rules", User: user}
+		return &ResolveResult{Blocked: false, Reason: "No active rules", User: user, UserGroup: userGroupName}
 	}
 
 	// 4. Query Trie & Regex
 	e.trieMu.RLock()
-	allMatches := e.trie.SearchTrace(qName)
+	var allMatches []*parser.Rule
+	if e.bloom.mayMatch(qName) {
+		allMatches = e.trie.search(qName, tr)
+	} else {
+		tr.add("bloom filter: no domain rule can match")
+	}
 	// Check Regex
-	for _, rr := range e.regexRules {
-		if rr.Regex.MatchString(qName) {
-			allMatches = append(allMatches, rr.Rule)
+	regexMatches := e.regexMatches(qName)
+	allMatches = append(allMatches, regexMatches...)
+	// Clients outside a canary still see the previous rules of the group
+	matchIDs := e.matchIDs(activeGroupIDs, user, clientIP)
+	if tr != nil {
+		tr.add("regex: %d of %d rules match", len(regexMatches), len(e.regexRules))
+		for i, gid := range activeGroupIDs {
+			if matchIDs[i] != gid {
+				tr.add("canary: rule group '%s' uses its previous rules for this client", ruleGroups[gid-1].Name)
+			}
 		}
 	}
 	e.trieMu.RUnlock()
 
 	// 5. Evaluate Matches in Group Order (first match wins)
 	// Iterate through groups in priority order (as defined in config.yaml policies)
-	for _, gid := range activeGroupIDs {
+	for i, gid := range activeGroupIDs {
+		ruleGroup := ruleGroups[gid-1].Name
+
 		// Filter matches for this group
 		var blockRule *parser.Rule
 		var whitelistRule *parser.Rule
@@ -209,22 +798,20 @@ func (e *Engine) Resolve(qName string, qType uint16, clientIP netip.Addr, client
 		var importantWhitelistRule *parser.Rule
 
 		for _, r := range allMatches {
-			if r.GroupID != gid {
+			if r.GroupID != matchIDs[i] {
 				continue
 			}
 
-			// Enforce Exact Match logic
-			if r.Type == parser.RuleTypeExact {
-				qCheck := strings.TrimSuffix(qName, ".")
-				if r.Pattern != qCheck {
-					continue
-				}
-			}
-
 			// Modifier Checks
-			if !e.checkModifiers(r, user, qType, clientIP, qName) {
+			if reason := e.modifierMismatch(r, user, qType, clientIP, qName); reason != "" {
+				if tr != nil {
+					tr.add("rule group '%s': '%s' skipped, %s", ruleGroup, r.Text, reason)
+				}
 				continue
 			}
+			if tr != nil {
+				tr.add("rule group '%s': '%s' matches", ruleGroup, r.Text)
+			}
 
 			if r.IsWhitelist {
 				if r.Modifiers.Important {
@@ -243,16 +830,21 @@ func (e *Engine) Resolve(qName string, qType uint16, clientIP netip.Addr, client
 
 		// Check if this group has a decisive result (first match wins)
 		if importantWhitelistRule != nil {
-			return &ResolveResult{Blocked: false, Reason: "Important Whitelisted", Rule: importantWhitelistRule, User: user}
+			return &ResolveResult{Blocked: false, Reason: "Important Whitelisted", Rule: importantWhitelistRule, User: user, UserGroup: userGroupName, RuleGroup: ruleGroup}
 		}
 		if importantBlockRule != nil {
-			return &ResolveResult{Blocked: true, Reason: "Important Blocked", Rule: importantBlockRule, User: user}
+			return &ResolveResult{Blocked: true, Reason: "Important Blocked", Rule: importantBlockRule, User: user, UserGroup: userGroupName, RuleGroup: ruleGroup}
 		}
 		if whitelistRule != nil {
-			return &ResolveResult{Blocked: false, Reason: "Whitelisted", Rule: whitelistRule, User: user}
+			return &ResolveResult{Blocked: false, Reason: "Whitelisted", Rule: whitelistRule, User: user, UserGroup: userGroupName, RuleGroup: ruleGroup}
 		}
 		if blockRule != nil {
-			res := &ResolveResult{Blocked: true, Reason: "Blocked", Rule: blockRule, User: user}
+			// Infrastructure domains are only blocked by $important rules
+			if domain := protected.match(qName); domain != "" {
+				tr.add("protected: %s is only blocked by $important rules", domain)
+				return protectedResult(domain, blockRule, user, userGroupName)
+			}
+			res := &ResolveResult{Blocked: true, Reason: "Blocked", Rule: blockRule, User: user, UserGroup: userGroupName, RuleGroup: ruleGroup}
 			if blockRule.Modifiers.DNSRewrite != "" {
 				res.Reason = "Rewrite"
 				res.DNSRewrite = blockRule.Modifiers.DNSRewrite
@@ -262,12 +854,13 @@ func (e *Engine) Resolve(qName string, qType uint16, clientIP netip.Addr, client
 		// No match in this group, continue to next group
 	}
 
-	return &ResolveResult{Blocked: false, Reason: "Not found", User: user}
+	return &ResolveResult{Blocked: false, Reason: "Not found", User: user, UserGroup: userGroupName, AnswerFilters: answerFilters(ruleGroups, activeGroupIDs)}
 }
 
 // getActiveGroupIDs returns an ordered slice of RuleGroup IDs that are currently active for the given UserGroup.
-// Order is preserved from config.yaml policies.
-func (e *Engine) getActiveGroupIDs(userGroupName string) []int {
+// Order follows priority, then config.yaml policy order. Rule groups excluded by the
+// UserGroup or by user (which may be nil) are skipped. Caller must hold cfgMu.
+func (e *Engine) getActiveGroupIDs(userGroupName string, user *config.User) []int {
 	var activeIDs []int
 	seen := make(map[int]bool)
 
@@ -284,9 +877,26 @@ func (e *Engine) getActiveGroupIDs(userGroupName string) []int {
 		return activeIDs
 	}
 
-	now := time.Now()
+	now := e.clock.Now()
+
+	// The active profile may replace the policies of this UserGroup
+	policies := ug.Policies
+	if p, _ := e.activeProfile(now); p != nil {
+		if override, ok := p.policies[userGroupName]; ok {
+			policies = override
+		}
+	}
+
+	excluded := ug.ExcludeRuleGroups
+	if user != nil {
+		excluded = append(excluded[:len(excluded):len(excluded)], user.ExcludeRuleGroups...)
+	}
+
+	for _, policy := range e.byPriority(policies) {
+		if slices.Contains(excluded, policy.RuleGroup) {
+			continue
+		}
 
-	for _, policy := range ug.Policies {
 		// Check Schedule
 		// Logic: If a schedule is defined, it acts as a "Pause" or "Exclude" period.
 		// If current time IS in the schedule, the rule group is INACTIVE.
@@ -304,124 +914,70 @@ func (e *Engine) getActiveGroupIDs(userGroupName string) []int {
 		}
 	}
 
+	// The built-in DoH block list comes last, so allow rules of the policies win
+	if ug.BlockDoH && !slices.Contains(excluded, config.DoHRuleGroup) {
+		if gid := e.groupIDs[config.DoHRuleGroup]; gid != 0 && !seen[gid] {
+			activeIDs = append(activeIDs, gid)
+		}
+	}
+
 	return activeIDs
 }
 
-// checkModifiers evaluates if a rule's modifiers allow it to be applied to the current query.
-func (e *Engine) checkModifiers(r *parser.Rule, user *config.User, qType uint16, clientIP netip.Addr, qName string) bool {
+// modifierMismatch evaluates if a rule's modifiers allow it to be applied to the current query.
+// It returns the modifier that keeps the rule from applying, or "" when it applies.
+func (e *Engine) modifierMismatch(r *parser.Rule, user *config.User, qType uint16, clientIP netip.Addr, qName string) string {
 	// $badfilter modifier (If rule is marked bad, we ignore it)
 	if r.Modifiers.BadFilter {
-		return false
+		return "$badfilter"
 	}
 
 	// $client modifier
-	// Values are either all inclusions (A|B) OR all exclusions (~A|~B), NOT mixed.
+	// Exclusions win; if any inclusions are listed the client must match one (see parser.MatchClients).
 	if len(r.Modifiers.Client) > 0 {
-		// Flatten all values
-		var targets []string
-		for _, raw := range r.Modifiers.Client {
-			targets = append(targets, strings.Split(raw, "|")...)
-		}
-		if len(targets) == 0 {
-			return false
+		if len(r.Modifiers.Clients) == 0 {
+			return "$client has no valid entry" // Nothing parseable
 		}
-
-		// Determine mode from first value
-		isExclusionMode := strings.HasPrefix(strings.TrimSpace(targets[0]), "~")
-		matched := false
-
-		for _, p := range targets {
-			p = strings.TrimSpace(p)
-			target := strings.TrimPrefix(p, "~")
-
-			// Check match
-			isMatch := false
-			if user != nil && target == user.Name {
-				isMatch = true
-			} else if ip, err := netip.ParseAddr(target); err == nil {
-				if ip == clientIP {
-					isMatch = true
-				}
-			} else if prefix, err := netip.ParsePrefix(target); err == nil {
-				if prefix.Contains(clientIP) {
-					isMatch = true
-				}
-			} else if target == clientIP.String() {
-				isMatch = true
-			}
-
-			if isMatch {
-				matched = true
-				break
-			}
+		var name string
+		if user != nil {
+			name = user.Name
 		}
-
-		if isExclusionMode {
-			// ~A|~B: Rule applies if client matches NONE
-			if matched {
-				return false
-			}
-		} else {
-			// A|B: Rule applies if client matches ANY
-			if !matched {
-				return false
-			}
+		if !parser.MatchClients(r.Modifiers.Clients, name, clientIP) {
+			return "$client does not match"
 		}
 	}
 
 	// $dnstype modifier
-	// Values are either all inclusions (A|AAAA) OR all exclusions (~A|~AAAA), NOT mixed.
+	// Values are either all inclusions (A|AAAA) OR all exclusions (~A|~AAAA), checked at parse time.
 	if len(r.Modifiers.DNSType) > 0 {
-		typeName := dns.TypeToString[qType]
-
-		// Flatten all values
-		var targets []string
-		for _, raw := range r.Modifiers.DNSType {
-			targets = append(targets, strings.Split(raw, "|")...)
-		}
-		if len(targets) == 0 {
-			return false
-		}
-
-		// Determine mode from first value
-		isExclusionMode := strings.HasPrefix(strings.TrimSpace(targets[0]), "~")
-		matched := false
-
-		for _, p := range targets {
-			p = strings.TrimSpace(p)
-			target := strings.TrimPrefix(p, "~")
-			if strings.EqualFold(target, typeName) {
-				matched = true
-				break
-			}
-		}
+		matched := slices.Contains(r.Modifiers.DNSTypes, qType)
 
-		if isExclusionMode {
+		if r.Modifiers.DNSTypeExclude {
 			// ~A|~AAAA: Rule applies if type matches NONE
 			if matched {
-				return false
+				return "$dnstype excludes the query type"
 			}
 		} else {
 			// A|AAAA: Rule applies if type matches ANY
 			if !matched {
-				return false
+				return "$dnstype does not include the query type"
 			}
 		}
 	}
 
 	// $denyallow modifier (Only block if domain is NOT in denyallow list)
-	// Usually invalid on whitelist rules, but if present:
 	// "If the domain matches the rule pattern, it is blocked EXCEPT if it also matches one of the denyallow domains."
+	// Like AdGuard, a denyallow domain covers its subdomains, and on @@ rules it
+	// carves the listed domains out of the exception.
 	if len(r.Modifiers.DenyAllow) > 0 {
 		isExcluded := false
-		domain := strings.TrimSuffix(qName, ".")
+		domain := strings.ToLower(strings.TrimSuffix(qName, "."))
 
 		for _, raw := range r.Modifiers.DenyAllow {
 			parts := strings.Split(raw, "|")
 			for _, da := range parts {
-				da = strings.TrimSpace(da)
-				// AdGuard: denyallow matches subdomains too? No
-				if domain == da {
+				da = strings.ToLower(strings.TrimSpace(da))
+				if isSubdomainOf(domain, da) {
 					isExcluded = true
 					break
 				}
@@ -431,9 +987,9 @@ func (e *Engine) checkModifiers(r *parser.Rule, user *config.User, qType uint16,
 			}
 		}
 		if isExcluded {
-			return false // Rule ignored because denyallow matched
+			return "$denyallow lists the domain" // Rule ignored because denyallow matched
 		}
 	}
 
-	return true
+	return ""
 }
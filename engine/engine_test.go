@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"net/netip"
+	"testing"
+
+	"adblocker/config"
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// newTestEngine returns an engine whose only user group applies the given
+// inline rules to every client.
+func newTestEngine(t *testing.T, rules ...string) *Engine {
+	t.Helper()
+	cfg := &config.Config{
+		RuleGroups: []config.RuleGroup{{Name: "test", Rules: rules}},
+		UserGroups: []config.UserGroup{{Name: "all", Policies: []config.Policy{{RuleGroup: "test"}}}},
+	}
+	cfg.Defaults.UserGroup = "all"
+
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	if err := e.ReloadRules(parser.NewLoader(t.TempDir())); err != nil {
+		t.Fatalf("ReloadRules: %v", err)
+	}
+	return e
+}
+
+var testClient = netip.MustParseAddr("192.168.1.10")
+
+// Examples of https://adguard-dns.io/kb/general/dns-filtering-syntax/#denyallow-modifier
+func TestDenyAllow(t *testing.T) {
+	e := newTestEngine(t,
+		"||example.com^$denyallow=good.example.com|partner.org",
+		"*$denyallow=com|net",
+		"||allowed.net^",
+		"@@||allowed.net^$denyallow=ads.allowed.net",
+	)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		// The listed domains and their subdomains are not blocked
+		{"example.com", true},
+		{"www.example.com", true},
+		{"good.example.com", false},
+		{"cdn.good.example.com", false},
+		{"notgood.example.com", true},
+
+		// The AdGuard example: block everything but .com and .net
+		{"example.org", true},
+		{"example.net", false},
+		{"sub.example.co.uk", true},
+
+		// On an exception, $denyallow carves domains out of it
+		{"allowed.net", false},
+		{"www.allowed.net", false},
+		{"ads.allowed.net", true},
+		{"pixel.ads.allowed.net", true},
+	}
+	for _, tt := range tests {
+		res := e.Resolve(tt.name+".", dns.TypeA, testClient, "", "")
+		if res.Blocked != tt.blocked {
+			rule := ""
+			if res.Rule != nil {
+				rule = res.Rule.Text
+			}
+			t.Errorf("Resolve(%q): blocked = %v, want %v (rule %q)", tt.name, res.Blocked, tt.blocked, rule)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"adblocker/config"
+)
+
+// Guest is a temporary User, e.g. a visitor's phone, that is removed once
+// Until has passed. Guests never appear in the config file.
+type Guest struct {
+	Name      string    `json:"name"`
+	IPs       []string  `json:"ips,omitempty"`
+	MACs      []string  `json:"macs,omitempty"`
+	UserGroup string    `json:"user_group"`
+	Until     time.Time `json:"until"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+var ErrNoGuest = errors.New("no guest of that name")
+
+// SetGuest adds g, or replaces the guest of the same name (e.g. to extend
+// the visit). Configured and directory Users keep precedence for their
+// addresses.
+func (e *Engine) SetGuest(g Guest) error {
+	if g.Name == "" {
+		return fmt.Errorf("guest name is required")
+	}
+	if len(g.IPs) == 0 && len(g.MACs) == 0 {
+		return fmt.Errorf("guest needs ips or macs")
+	}
+	if !g.Until.After(e.clock.Now()) {
+		return fmt.Errorf("guest must expire in the future")
+	}
+
+	e.cfgMu.Lock()
+	if e.knownUser(g.Name) {
+		e.cfgMu.Unlock()
+		return fmt.Errorf("'%s' is the name of a configured user", g.Name)
+	}
+	if !e.hasUserGroup(g.UserGroup) {
+		e.cfgMu.Unlock()
+		return fmt.Errorf("unknown user group '%s'", g.UserGroup)
+	}
+	guests := maps.Clone(e.guests)
+	if guests == nil {
+		guests = make(map[string]Guest)
+	}
+	guests[g.Name] = g
+	err := e.setGuestsLocked(guests)
+	e.cfgMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	e.saveGuests()
+	return nil
+}
+
+// RemoveGuest ends a guest binding early.
+func (e *Engine) RemoveGuest(name string) error {
+	e.cfgMu.Lock()
+	if _, ok := e.guests[name]; !ok {
+		e.cfgMu.Unlock()
+		return ErrNoGuest
+	}
+	guests := maps.Clone(e.guests)
+	delete(guests, name)
+	err := e.setGuestsLocked(guests)
+	e.cfgMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	e.saveGuests()
+	return nil
+}
+
+// Guests returns the unexpired guests sorted by name.
+func (e *Engine) Guests() []Guest {
+	e.expireGuests(e.clock.Now())
+	return e.guestSnapshot()
+}
+
+func (e *Engine) guestSnapshot() []Guest {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	out := slices.Collect(maps.Values(e.guests))
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// LoadGuests restores the guests saved in path and keeps saving changes there.
+// A missing file is not an error.
+func (e *Engine) LoadGuests(path string) error {
+	e.guestMu.Lock()
+	e.guestFile = path
+	e.guestMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Guest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	now := e.clock.Now()
+	e.cfgMu.Lock()
+	guests := make(map[string]Guest)
+	for _, g := range saved {
+		if now.Before(g.Until) {
+			guests[g.Name] = g
+		}
+	}
+	err = e.setGuestsLocked(guests)
+	e.cfgMu.Unlock()
+	return err
+}
+
+// expireGuests drops guests whose time is up. It is cheap until the
+// earliest expiry has passed, so it runs on every user lookup.
+func (e *Engine) expireGuests(now time.Time) {
+	if next := e.guestExpiry.Load(); next == 0 || now.UnixNano() < next {
+		return
+	}
+
+	e.cfgMu.Lock()
+	guests := maps.Clone(e.guests)
+	var expired []string
+	for name, g := range guests {
+		if !now.Before(g.Until) {
+			delete(guests, name)
+			expired = append(expired, name)
+		}
+	}
+	if len(expired) == 0 {
+		e.cfgMu.Unlock()
+		return
+	}
+	err := e.setGuestsLocked(guests)
+	e.cfgMu.Unlock()
+
+	if err != nil {
+		log.Printf("[GUEST] Failed to remove expired guests: %v", err)
+		return
+	}
+	sort.Strings(expired)
+	log.Printf("[GUEST] Expired: %v", expired)
+	e.saveGuests()
+}
+
+// setGuestsLocked rebuilds the user matcher with guests. Caller holds cfgMu.
+func (e *Engine) setGuestsLocked(guests map[string]Guest) error {
+	users := guestUsers(guests)
+	um, err := newMergedUserMatcher(e.cfg, append(users, e.externalUsers...))
+	if err != nil {
+		return err
+	}
+	e.userMatcher = um
+	e.guests = guests
+	e.guestList = users
+
+	var next int64
+	for _, g := range guests {
+		if until := g.Until.UnixNano(); next == 0 || until < next {
+			next = until
+		}
+	}
+	e.guestExpiry.Store(next)
+	return nil
+}
+
+// guestUsers converts guests to Users in name order, so address conflicts
+// between guests resolve the same way every time.
+func guestUsers(guests map[string]Guest) []config.User {
+	names := slices.Sorted(maps.Keys(guests))
+	users := make([]config.User, 0, len(names))
+	for _, name := range names {
+		g := guests[name]
+		users = append(users, config.User{Name: g.Name, IPs: g.IPs, MACs: g.MACs, UserGroup: g.UserGroup})
+	}
+	return users
+}
+
+// saveGuests writes the guests to the file given to LoadGuests, if any.
+func (e *Engine) saveGuests() {
+	e.guestMu.Lock()
+	defer e.guestMu.Unlock()
+	if e.guestFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(e.guestSnapshot(), "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(e.guestFile), 0755)
+	}
+	if err == nil {
+		tmp := e.guestFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, e.guestFile)
+		}
+	}
+	if err != nil {
+		log.Printf("[GUEST] Failed to save guests: %v", err)
+	}
+}
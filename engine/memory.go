@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"sync"
+
+	"adblocker/config"
+)
+
+// Rough in-memory cost of a loaded rule: the Rule itself, its text and
+// pattern strings, and its share of trie nodes and Bloom filter bits.
+const ruleBytes = 400
+
+// Fractions of memory_limit. The rest is left for the previous snapshot,
+// which stays alive until the swap, and for the DNS caches.
+const (
+	ruleBudgetShare = 0.4
+	memoBudgetShare = 0.01
+	memoEntryBytes  = 256
+)
+
+// ruleBudget returns the memory available to one rule set, 0 if unlimited.
+func ruleBudget(limit config.ByteSize) int64 {
+	return int64(float64(limit) * ruleBudgetShare)
+}
+
+// memoSize returns the regex memo capacity for the memory limit.
+func memoSize(limit config.ByteSize) int {
+	if limit <= 0 {
+		return regexMemoSize
+	}
+	return min(regexMemoSize, max(100, int(float64(limit)*memoBudgetShare)/memoEntryBytes))
+}
+
+// overBudget reports whether n rules are projected to exceed budget.
+func overBudget(n int, budget int64) bool {
+	return budget > 0 && int64(n)*ruleBytes > budget
+}
+
+// budgetQueue admits the sources of a reload against the memory budget from
+// the number of rule lines they have, before they are parsed. Sources load
+// concurrently but are decided in config order, so the same lists always
+// skip the same sources.
+type budgetQueue struct {
+	mu      sync.Mutex
+	turn    *sync.Cond
+	budget  int64
+	next    int          // Sequence number of the source to decide next
+	lines   int          // Rule lines of the admitted sources
+	decided map[int]bool // Decisions by sequence number
+}
+
+func newBudgetQueue(budget int64) *budgetQueue {
+	q := &budgetQueue{budget: budget, decided: make(map[int]bool)}
+	q.turn = sync.NewCond(&q.mu)
+	return q
+}
+
+// admit waits for the sources before seq to be decided and reports whether
+// the source seq with n rule lines fits. A source asked again (a broken
+// cache downloaded anew) keeps its first decision.
+func (q *budgetQueue) admit(seq, n int) bool {
+	if q.budget <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if ok, done := q.decided[seq]; done {
+		return ok
+	}
+	for q.next != seq {
+		q.turn.Wait()
+	}
+	ok := !overBudget(q.lines+n, q.budget)
+	if ok {
+		q.lines += n
+	}
+	q.decided[seq] = ok
+	q.next++
+	q.turn.Broadcast()
+	return ok
+}
+
+// pass gives up the turn of a source that failed before it was decided.
+func (q *budgetQueue) pass(seq int) {
+	if q.budget <= 0 {
+		return
+	}
+	q.mu.Lock()
+	_, done := q.decided[seq]
+	q.mu.Unlock()
+	if !done {
+		q.admit(seq, 0)
+	}
+}
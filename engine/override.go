@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"adblocker/config"
+	"adblocker/parser"
+)
+
+// OverrideMode says how a device override changes filtering.
+type OverrideMode string
+
+const (
+	OverridePause     OverrideMode = "pause"      // No filtering
+	OverrideBlock     OverrideMode = "block"      // Block every query
+	OverrideUserGroup OverrideMode = "user_group" // Use the policies of another UserGroup
+)
+
+// DeviceOverride temporarily changes the filtering of one device (User).
+type DeviceOverride struct {
+	User      string       `json:"user"`
+	Mode      OverrideMode `json:"mode"`
+	UserGroup string       `json:"user_group,omitempty"` // For OverrideUserGroup
+	Until     time.Time    `json:"until"`
+	SetBy     string       `json:"set_by,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+// overrideRule is reported as the deciding rule of OverrideBlock.
+var overrideRule = &parser.Rule{Text: "override:block", Type: parser.RuleTypeExact, Source: "override"}
+
+// SetOverride applies o to its device until o.Until, replacing any previous override.
+func (e *Engine) SetOverride(o DeviceOverride) error {
+	if !o.Until.After(e.clock.Now()) {
+		return fmt.Errorf("override must end in the future")
+	}
+
+	e.cfgMu.RLock()
+	known := e.knownUser(o.User)
+	groupOK := e.hasUserGroup(o.UserGroup)
+	e.cfgMu.RUnlock()
+
+	if !known {
+		return fmt.Errorf("unknown user '%s'", o.User)
+	}
+	switch o.Mode {
+	case OverridePause, OverrideBlock:
+		o.UserGroup = ""
+	case OverrideUserGroup:
+		if !groupOK {
+			return fmt.Errorf("unknown user group '%s'", o.UserGroup)
+		}
+	default:
+		return fmt.Errorf("unknown override mode '%s' (want pause, block or user_group)", o.Mode)
+	}
+
+	e.overrideMu.Lock()
+	if e.overrides == nil {
+		e.overrides = make(map[string]DeviceOverride)
+	}
+	e.overrides[o.User] = o
+	e.overrideMu.Unlock()
+	return nil
+}
+
+// ClearOverride removes the override of a device. Returns false if it had none.
+func (e *Engine) ClearOverride(user string) bool {
+	e.overrideMu.Lock()
+	defer e.overrideMu.Unlock()
+	_, ok := e.overrides[user]
+	delete(e.overrides, user)
+	return ok
+}
+
+// Overrides returns the overrides in effect, by device name.
+func (e *Engine) Overrides() []DeviceOverride {
+	now := e.clock.Now()
+	e.overrideMu.Lock()
+	var out []DeviceOverride
+	for name, o := range e.overrides {
+		if now.Before(o.Until) {
+			out = append(out, o)
+		} else {
+			delete(e.overrides, name)
+		}
+	}
+	e.overrideMu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return out
+}
+
+// activeOverride returns the override in effect for user, if any.
+func (e *Engine) activeOverride(user *config.User, now time.Time) (DeviceOverride, bool) {
+	if user == nil {
+		return DeviceOverride{}, false
+	}
+	e.overrideMu.Lock()
+	defer e.overrideMu.Unlock()
+	o, ok := e.overrides[user.Name]
+	if ok && !now.Before(o.Until) {
+		delete(e.overrides, user.Name)
+		return DeviceOverride{}, false
+	}
+	return o, ok
+}
+
+// overrideResult returns the decision forced by a pause or block override.
+func overrideResult(o DeviceOverride, qName string, user *config.User) *ResolveResult {
+	res := &ResolveResult{User: user, UserGroup: user.UserGroup}
+	if o.Mode == OverrideBlock {
+		rule := *overrideRule
+		rule.Pattern = strings.TrimSuffix(qName, ".")
+		res.Blocked, res.Reason, res.Rule = true, "Override: blocked", &rule
+	} else {
+		res.Reason = "Override: paused"
+	}
+	return res
+}
+
+// knownUser reports whether a configured or directory User has the name. Caller holds cfgMu.
+func (e *Engine) knownUser(name string) bool {
+	for _, users := range [][]config.User{e.cfg.Users, e.externalUsers} {
+		for _, u := range users {
+			if u.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasUserGroup reports whether a UserGroup has the name. Caller holds cfgMu.
+func (e *Engine) hasUserGroup(name string) bool {
+	for _, ug := range e.cfg.UserGroups {
+		if ug.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"log"
+	"regexp/syntax"
+	"sync/atomic"
+	"time"
+
+	"adblocker/metrics"
+	"adblocker/parser"
+)
+
+const (
+	// paranoidRegexLimit is the evaluation time a regex in a paranoid rule group may take per query.
+	paranoidRegexLimit = time.Millisecond
+	// paranoidRegexSteps bounds the work of one evaluation: program
+	// instructions times name length, the cost of Go's linear-time matcher.
+	paranoidRegexSteps = 256 * 1024
+	// paranoidRegexStrikes of the last paranoidRegexWindow evaluations must be
+	// slow or over the step bound to disable a regex. A single slow call (a GC
+	// pause, a busy CPU) is not enough.
+	paranoidRegexStrikes = 10
+	paranoidRegexWindow  = 100
+	// maxNameLen is the longest domain name (RFC 1035); longer input is never evaluated.
+	maxNameLen = 253
+)
+
+var regexDisabled = metrics.NewCounterVec("adblocker_regex_disabled_total",
+	"Regex rules disabled for repeatedly exceeding the paranoid evaluation limit.", "rule_group")
+
+// regexGuard bounds the evaluations of one regex rule from a paranoid rule
+// group and disables the rule when it is consistently slow. A disabled rule
+// stays off until the next rule reload.
+type regexGuard struct {
+	ruleGroup string
+	insts     int // Program size of the regex
+	evals     atomic.Int32
+	strikes   atomic.Int32
+	disabled  atomic.Bool
+}
+
+// match evaluates rr against qName, returning false once the rule is disabled
+// and for names the step bound does not allow to evaluate.
+func (g *regexGuard) match(rr RegexRule, qName string) bool {
+	if g.disabled.Load() || len(qName) > maxNameLen+1 { // With the trailing dot
+		return false
+	}
+
+	matched, strike := false, true
+	if g.insts*(len(qName)+1) <= paranoidRegexSteps {
+		start := time.Now()
+		matched = rr.Regex.MatchString(qName)
+		strike = time.Since(start) > paranoidRegexLimit
+	}
+
+	strikes := g.strikes.Load()
+	if strike {
+		strikes = g.strikes.Add(1)
+	}
+	if g.evals.Add(1) >= paranoidRegexWindow {
+		g.evals.Store(0)
+		g.strikes.Store(0)
+	}
+
+	if strikes >= paranoidRegexStrikes && g.disabled.CompareAndSwap(false, true) {
+		regexDisabled.Inc(g.ruleGroup)
+		log.Printf("[RULES] ALERT: disabled regex '%s' from '%s' in rule group '%s': exceeded %v or %d steps on %d queries within %d",
+			rr.Rule.Pattern, rr.Rule.Source, g.ruleGroup, paranoidRegexLimit, paranoidRegexSteps, strikes, paranoidRegexWindow)
+	}
+	return matched
+}
+
+// newRegexRule wraps a compiled rule, guarding it when its rule group is paranoid.
+func newRegexRule(r *parser.Rule, ruleGroup string, paranoid bool) RegexRule {
+	rr := RegexRule{Rule: r, Regex: r.Regex}
+	if paranoid {
+		rr.guard = &regexGuard{ruleGroup: ruleGroup, insts: programSize(r.Regex.String())}
+	}
+	return rr
+}
+
+// programSize returns the number of instructions pattern compiles to.
+// The parser compiled it already, so errors do not happen.
+func programSize(pattern string) int {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0
+	}
+	return len(prog.Inst)
+}
@@ -0,0 +1,26 @@
+package engine
+
+// SetPresent records the presence signal of a schedule (see
+// config.Presence) and reports whether it changed. Signals survive config
+// reloads; a schedule without presence ignores them.
+func (e *Engine) SetPresent(schedule string, present bool) bool {
+	e.presenceMu.Lock()
+	if e.presence == nil {
+		e.presence = make(map[string]bool)
+	}
+	changed := e.presence[schedule] != present
+	e.presence[schedule] = present
+	e.presenceMu.Unlock()
+
+	if changed {
+		e.resetTransitions()
+	}
+	return changed
+}
+
+// Present reports the last presence signal of a schedule.
+func (e *Engine) Present(schedule string) bool {
+	e.presenceMu.RLock()
+	defer e.presenceMu.RUnlock()
+	return e.presence[schedule]
+}
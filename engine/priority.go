@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"slices"
+
+	"adblocker/config"
+)
+
+// byPriority returns policies in evaluation order: higher priority first,
+// config order among equals. A policy's priority overrides the priority of
+// its rule group. Caller must hold cfgMu.
+func (e *Engine) byPriority(policies []config.Policy) []config.Policy {
+	priority := func(p config.Policy) int {
+		if p.Priority != 0 {
+			return p.Priority
+		}
+		if gid := e.groupIDs[p.RuleGroup]; gid != 0 {
+			return e.cfg.RuleGroups[gid-1].Priority
+		}
+		return 0
+	}
+
+	// Most configs set no priorities; keep their order without copying
+	if !slices.ContainsFunc(policies, func(p config.Policy) bool { return priority(p) != 0 }) {
+		return policies
+	}
+	sorted := slices.Clone(policies)
+	slices.SortStableFunc(sorted, func(a, b config.Policy) int {
+		return priority(b) - priority(a)
+	})
+	return sorted
+}
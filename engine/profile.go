@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"adblocker/config"
+)
+
+// DefaultProfile selects the base policies, overriding active_profile and scheduled profiles.
+const DefaultProfile = "default"
+
+// Profile sources, reported by ProfileStatus.
+const (
+	ProfileSourceManual   = "manual"   // Set through SetProfile (API/CLI)
+	ProfileSourceConfig   = "config"   // active_profile
+	ProfileSourceSchedule = "schedule" // Schedule and date range of the profile
+)
+
+// ProfileStatus describes the active profile.
+type ProfileStatus struct {
+	Active   string   `json:"active"`           // Empty when the base policies apply
+	Source   string   `json:"source,omitempty"` // Why it is active
+	Profiles []string `json:"profiles"`         // All configured profiles
+}
+
+// profile is a parsed config.Profile.
+type profile struct {
+	name     string
+	policies map[string][]config.Policy // UserGroup name -> policies
+	schedule string
+	from     time.Time // Zero if unset
+	until    time.Time // Start of the day after Until, zero if unset
+}
+
+// profileSet holds the configured profiles in config order.
+type profileSet struct {
+	ordered []*profile
+	byName  map[string]*profile
+}
+
+// newProfileSet validates and parses the profiles of cfg.
+func newProfileSet(cfg *config.Config) (*profileSet, error) {
+	ps := &profileSet{byName: make(map[string]*profile)}
+
+	userGroups := make(map[string]bool)
+	for _, ug := range cfg.UserGroups {
+		userGroups[ug.Name] = true
+	}
+	schedules := make(map[string]bool)
+	for _, s := range cfg.Schedules {
+		schedules[s.Name] = true
+	}
+
+	for _, p := range cfg.Profiles {
+		if p.Name == "" || p.Name == DefaultProfile {
+			return nil, fmt.Errorf("invalid profile name '%s'", p.Name)
+		}
+		if ps.byName[p.Name] != nil {
+			return nil, fmt.Errorf("duplicate profile '%s'", p.Name)
+		}
+		if p.Schedule != "" && !schedules[p.Schedule] {
+			return nil, fmt.Errorf("profile '%s': unknown schedule '%s'", p.Name, p.Schedule)
+		}
+
+		pr := &profile{
+			name:     p.Name,
+			policies: make(map[string][]config.Policy),
+			schedule: p.Schedule,
+		}
+		for _, ug := range p.UserGroups {
+			if !userGroups[ug.Name] {
+				return nil, fmt.Errorf("profile '%s': unknown user group '%s'", p.Name, ug.Name)
+			}
+			pr.policies[ug.Name] = ug.Policies
+		}
+
+		var err error
+		if pr.from, err = parseDate(p.From); err != nil {
+			return nil, fmt.Errorf("profile '%s': invalid from: %w", p.Name, err)
+		}
+		if pr.until, err = parseDate(p.Until); err != nil {
+			return nil, fmt.Errorf("profile '%s': invalid until: %w", p.Name, err)
+		}
+		if !pr.until.IsZero() {
+			pr.until = pr.until.AddDate(0, 0, 1)
+		}
+
+		ps.ordered = append(ps.ordered, pr)
+		ps.byName[p.Name] = pr
+	}
+
+	if cfg.ActiveProfile != "" && cfg.ActiveProfile != DefaultProfile && ps.byName[cfg.ActiveProfile] == nil {
+		return nil, fmt.Errorf("unknown active_profile '%s'", cfg.ActiveProfile)
+	}
+
+	return ps, nil
+}
+
+// parseDate parses a "2006-01-02" date in local time. Empty yields the zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// scheduled reports whether the profile activates itself at now.
+func (p *profile) scheduled(sm *ScheduleMatcher, now time.Time) bool {
+	if p.schedule == "" && p.from.IsZero() && p.until.IsZero() {
+		return false // Manual only
+	}
+	if !p.from.IsZero() && now.Before(p.from) {
+		return false
+	}
+	if !p.until.IsZero() && !now.Before(p.until) {
+		return false
+	}
+	return p.schedule == "" || sm.IsActive(p.schedule, now)
+}
+
+// activeProfile returns the profile in effect at now (nil for the base
+// policies) and the reason. Caller must hold cfgMu.
+func (e *Engine) activeProfile(now time.Time) (*profile, string) {
+	// Runtime switch first, then config, then schedules
+	if name := e.profileOverride; name != "" {
+		return e.profiles.byName[name], ProfileSourceManual
+	}
+	if name := e.cfg.ActiveProfile; name != "" {
+		return e.profiles.byName[name], ProfileSourceConfig
+	}
+	for _, p := range e.profiles.ordered {
+		if p.scheduled(e.scheduleMatcher, now) {
+			return p, ProfileSourceSchedule
+		}
+	}
+	return nil, ""
+}
+
+// SetProfile switches the active profile at runtime. DefaultProfile selects
+// the base policies; an empty name hands control back to active_profile and
+// scheduled profiles.
+func (e *Engine) SetProfile(name string) error {
+	e.cfgMu.Lock()
+	defer e.cfgMu.Unlock()
+
+	if name != "" && name != DefaultProfile && e.profiles.byName[name] == nil {
+		return fmt.Errorf("unknown profile '%s'", name)
+	}
+	e.profileOverride = name
+	e.resetTransitions()
+	return nil
+}
+
+// Profile reports the active profile.
+func (e *Engine) Profile() ProfileStatus {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+
+	st := ProfileStatus{Profiles: []string{}}
+	for _, p := range e.profiles.ordered {
+		st.Profiles = append(st.Profiles, p.name)
+	}
+	p, source := e.activeProfile(e.clock.Now())
+	if source != "" {
+		st.Source = source
+		st.Active = DefaultProfile
+	}
+	if p != nil {
+		st.Active = p.name
+	}
+	return st
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"adblocker/config"
+)
+
+// maxRuleDrop is the largest fraction of rules a reload of an unchanged
+// config may lose while sources are failing before the new snapshot is
+// rejected as a likely fetch failure.
+const maxRuleDrop = 0.5
+
+// ReloadProgress reports the state of the running or last rule reload.
+type ReloadProgress struct {
+	Running       bool      `json:"running"`
+	StartedAt     time.Time `json:"started_at,omitzero"`
+	FinishedAt    time.Time `json:"finished_at,omitzero"`
+	SourcesTotal  int       `json:"sources_total"`
+	SourcesDone   int       `json:"sources_done"` // Including failed sources
+	SourcesFailed int       `json:"sources_failed"`
+	RulesInserted int       `json:"rules_inserted"`
+	Error         string    `json:"error,omitempty"` // Why the new snapshot was rejected
+}
+
+// Progress returns the state of the running or last rule reload.
+func (e *Engine) Progress() ReloadProgress {
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	return e.progress
+}
+
+func (e *Engine) startProgress(sources int) {
+	e.progressMu.Lock()
+	e.progress = ReloadProgress{Running: true, StartedAt: time.Now(), SourcesTotal: sources}
+	e.progressMu.Unlock()
+}
+
+// sourceDone records a finished source and returns the updated progress.
+func (e *Engine) sourceDone(rules int, failed bool) ReloadProgress {
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	e.progress.SourcesDone++
+	e.progress.RulesInserted += rules
+	if failed {
+		e.progress.SourcesFailed++
+	}
+	return e.progress
+}
+
+func (e *Engine) finishProgress(err error) {
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	e.progress.Running = false
+	e.progress.FinishedAt = time.Now()
+	if err != nil {
+		e.progress.Error = err.Error()
+	}
+}
+
+// checkRuleSet validates a freshly built snapshot against the live one.
+// sameConfig is true for periodic reloads, where a large drop in rules is
+// more likely a fetch problem than an intended change.
+func (e *Engine) checkRuleSet(rs *ruleSet, sameConfig bool) error {
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+
+	// Refuse partial sets cut short by memory_limit, even on first load
+	if rs.skipped > 0 {
+		return fmt.Errorf("rule set exceeds memory_limit: %d sources skipped after %d rules (budget %s for about %d rules)",
+			rs.skipped, rs.rules, config.ByteSize(rs.budget), rs.budget/ruleBytes)
+	}
+
+	// Likewise for sets cut short by rule_limits
+	if len(rs.limited) > 0 {
+		return fmt.Errorf("rule set exceeds rule_limits: %s", strings.Join(rs.limited, "; "))
+	}
+
+	// Anything beats serving without rules on first load
+	if e.loadedAt.IsZero() {
+		return nil
+	}
+
+	if rs.sources > 0 && rs.failed == rs.sources {
+		return fmt.Errorf("all %d sources failed to load", rs.sources)
+	}
+
+	prev := 0
+	for _, rules := range e.groupRules {
+		prev += len(rules)
+	}
+	if sameConfig && rs.failed > 0 && float64(rs.rules) < float64(prev)*(1-maxRuleDrop) {
+		return fmt.Errorf("%d of %d sources failed and rules dropped from %d to %d", rs.failed, rs.sources, prev, rs.rules)
+	}
+	return nil
+}
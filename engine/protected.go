@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// ProtectedSource is the source and rule group reported when a protected
+// domain overrules a block rule.
+const ProtectedSource = "protected"
+
+// BuiltinProtected are the domains protected unless protected.disable_builtin
+// is set. Blocking them breaks devices in ways that are hard to trace back
+// to the DNS filter: clocks drift (and with them TLS and schedules), phones
+// report "no internet" or keep the Wi-Fi login page open, updates stall.
+var BuiltinProtected = []string{
+	// Time synchronization
+	"pool.ntp.org",
+	"time.apple.com",
+	"time.windows.com",
+	"time.google.com",
+	"time.android.com",
+	"time.cloudflare.com",
+	"ntp.ubuntu.com",
+	"ntp.aliyun.com",
+	"ntp.tencent.com",
+
+	// Captive-portal and connectivity detection
+	"connectivitycheck.gstatic.com",
+	"connectivitycheck.android.com",
+	"clients3.google.com",
+	"captive.apple.com",
+	"www.msftconnecttest.com",
+	"www.msftncsi.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+	"connectivity-check.ubuntu.com",
+	"network-test.debian.org",
+	"connect.rom.miui.com",
+	"connectivitycheck.platform.hicloud.com",
+	"wifi.vivo.com.cn",
+
+	// Operating system updates
+	"windowsupdate.com",
+	"update.microsoft.com",
+	"delivery.mp.microsoft.com",
+	"mesu.apple.com",
+	"swscan.apple.com",
+	"swcdn.apple.com",
+	"updates.cdn-apple.com",
+	"archive.ubuntu.com",
+	"security.ubuntu.com",
+	"deb.debian.org",
+	"security.debian.org",
+}
+
+// protectedSet holds the protected domains, lowercase without the trailing
+// dot. Each entry also protects its subdomains.
+type protectedSet map[string]bool
+
+func newProtectedSet(cfg *config.Config) (protectedSet, error) {
+	set := make(protectedSet)
+	if !cfg.Protected.DisableBuiltin {
+		for _, d := range BuiltinProtected {
+			set[d] = true
+		}
+	}
+	for _, d := range cfg.Protected.Unprotect {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if !slices.Contains(BuiltinProtected, d) {
+			return nil, fmt.Errorf("protected.unprotect: '%s' is not a built-in protected domain", d)
+		}
+		delete(set, d)
+	}
+	for _, d := range cfg.Protected.Domains {
+		if _, ok := dns.IsDomainName(d); !ok || d == "" {
+			return nil, fmt.Errorf("protected.domains: invalid domain '%s'", d)
+		}
+		set[strings.ToLower(strings.TrimSuffix(d, "."))] = true
+	}
+	return set, nil
+}
+
+// match returns the protected domain covering qName, or "".
+func (p protectedSet) match(qName string) string {
+	name := strings.ToLower(strings.TrimSuffix(qName, "."))
+	for {
+		if p[name] {
+			return name
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return ""
+		}
+		name = parent
+	}
+}
+
+// protectedResult lets a protected domain through despite blockRule, which
+// was not $important.
+func protectedResult(domain string, blockRule *parser.Rule, user *config.User, userGroup string) *ResolveResult {
+	rule := &parser.Rule{
+		Text:        fmt.Sprintf("@@||%s^ (protected, overrules %s)", domain, blockRule.Text),
+		Pattern:     domain,
+		Type:        parser.RuleTypeDistinguish,
+		IsWhitelist: true,
+		Source:      ProtectedSource,
+	}
+	return &ResolveResult{Blocked: false, Reason: "Protected", Rule: rule, User: user, UserGroup: userGroup, RuleGroup: ProtectedSource}
+}
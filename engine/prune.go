@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"adblocker/parser"
+)
+
+// deadDomainTTL is how long a domain found dead stays excluded from reloads.
+const deadDomainTTL = 7 * 24 * time.Hour
+
+// isPrunable reports whether a rule is a plain domain block that can be dropped if the domain is dead.
+func isPrunable(r *parser.Rule) bool {
+	if r.IsWhitelist || r.Modifiers.DNSRewrite != "" || r.Modifiers.Important {
+		return false
+	}
+	if strings.Contains(r.Pattern, wildcardLabel) {
+		return false // Not a resolvable name
+	}
+	return r.Type == parser.RuleTypeExact || r.Type == parser.RuleTypeDistinguish
+}
+
+// SampleBlockedDomains returns up to n random domains from plain block rules.
+func (e *Engine) SampleBlockedDomains(n int) []string {
+	e.trieMu.RLock()
+	defer e.trieMu.RUnlock()
+
+	var all [][]*parser.Rule
+	total := 0
+	for _, rules := range e.groupRules {
+		all = append(all, rules)
+		total += len(rules)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var domains []string
+	// Bounded attempts: lists may be mostly regexes or exceptions
+	for attempts := 0; len(domains) < n && attempts < n*4; attempts++ {
+		idx := rand.IntN(total)
+		for _, rules := range all {
+			if idx < len(rules) {
+				r := rules[idx]
+				if isPrunable(r) && !seen[r.Pattern] {
+					seen[r.Pattern] = true
+					domains = append(domains, r.Pattern)
+				}
+				break
+			}
+			idx -= len(rules)
+		}
+	}
+	return domains
+}
+
+// PruneDomains drops plain block rules for the given dead domains from memory.
+// The domains stay excluded from future reloads for a week, in case they come back.
+// Returns the number of rules removed.
+func (e *Engine) PruneDomains(domains []string) int {
+	if len(domains) == 0 {
+		return 0
+	}
+
+	dead := make(map[string]bool, len(domains))
+	expires := time.Now().Add(deadDomainTTL)
+
+	e.deadMu.Lock()
+	for _, d := range domains {
+		dead[d] = true
+		e.deadDomains[d] = expires
+	}
+	e.deadMu.Unlock()
+
+	e.trieMu.Lock()
+	defer e.trieMu.Unlock()
+
+	removed := 0
+	for d := range dead {
+		removed += e.trie.Remove(d, isPrunable)
+	}
+
+	// Replace the slices instead of filtering in place: they may be shared with readers
+	for gid, rules := range e.groupRules {
+		kept := make([]*parser.Rule, 0, len(rules))
+		for _, r := range rules {
+			if dead[r.Pattern] && isPrunable(r) {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		e.groupRules[gid] = kept
+	}
+
+	return removed
+}
+
+// isDead reports whether a rule was pruned earlier and should be skipped on reload.
+// Caller must hold deadMu.
+func (e *Engine) isDead(r *parser.Rule, now time.Time) bool {
+	expires, ok := e.deadDomains[r.Pattern]
+	if !ok {
+		return false
+	}
+	if now.After(expires) {
+		delete(e.deadDomains, r.Pattern)
+		return false
+	}
+	return isPrunable(r)
+}
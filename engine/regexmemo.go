@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+
+	"adblocker/parser"
+)
+
+// regexMemoSize bounds the number of query names remembered per rule set.
+const regexMemoSize = 10000
+
+// regexMemo is an LRU of query name -> matching regex rules. It belongs to a
+// single rule set, so swapping in new rules invalidates it.
+type regexMemo struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type regexMemoEntry struct {
+	qName   string
+	matches []*parser.Rule
+}
+
+func newRegexMemo(size int) *regexMemo {
+	return &regexMemo{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the remembered matches for qName.
+func (m *regexMemo) get(qName string) ([]*parser.Rule, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[qName]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(el)
+	return el.Value.(*regexMemoEntry).matches, true
+}
+
+// put remembers matches for qName, evicting the least recently used entry when full.
+func (m *regexMemo) put(qName string, matches []*parser.Rule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[qName]; ok {
+		el.Value.(*regexMemoEntry).matches = matches
+		m.ll.MoveToFront(el)
+		return
+	}
+
+	m.items[qName] = m.ll.PushFront(&regexMemoEntry{qName: qName, matches: matches})
+	if m.ll.Len() > m.size {
+		oldest := m.ll.Back()
+		m.ll.Remove(oldest)
+		delete(m.items, oldest.Value.(*regexMemoEntry).qName)
+	}
+}
+
+// regexMatches returns the regex rules matching qName, consulting the memo
+// first. Caller must hold trieMu.
+func (e *Engine) regexMatches(qName string) []*parser.Rule {
+	if len(e.regexRules) == 0 {
+		return nil
+	}
+	if matches, ok := e.regexMemo.get(qName); ok {
+		return matches
+	}
+
+	var matches []*parser.Rule
+	for _, rr := range e.regexRules {
+		if rr.guard != nil {
+			if rr.guard.match(rr, qName) {
+				matches = append(matches, rr.Rule)
+			}
+			continue
+		}
+		if rr.Regex.MatchString(qName) {
+			matches = append(matches, rr.Rule)
+		}
+	}
+	e.regexMemo.put(qName, matches)
+	return matches
+}
@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// reportFile is the name of the last reload report in the data dir.
+const reportFile = "reload-report.json"
+
+// Source statuses in a ReloadReport
+const (
+	SourceOK      = "ok"
+	SourceFailed  = "failed"
+	SourceSkipped = "skipped" // Over the memory budget or a rule limit
+)
+
+// ReloadReport describes the outcome of a rule reload, source by source.
+type ReloadReport struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Applied    bool           `json:"applied"`         // False if the new rule set was rejected
+	Error      string         `json:"error,omitempty"` // Why the new rule set was rejected
+	Rules      int            `json:"rules"`
+	Sources    []SourceReport `json:"sources"`
+}
+
+// SourceReport describes how a single source loaded.
+type SourceReport struct {
+	RuleGroup   string  `json:"rule_group"`
+	Name        string  `json:"name"`
+	Location    string  `json:"location"` // URL or path
+	Status      string  `json:"status"`   // One of the Source constants
+	Origin      string  `json:"origin,omitempty"`
+	Mirror      string  `json:"mirror,omitempty"` // URL that served the rules of a URL source
+	Error       string  `json:"error,omitempty"`
+	Duration    float64 `json:"duration_seconds"`
+	Rules       int     `json:"rules"` // Rules inserted
+	ParseErrors int     `json:"parse_errors"`
+	Delta       int     `json:"delta"` // Rules compared to the last applied reload
+
+	FetchedAt  time.Time `json:"fetched_at,omitzero"`   // Download of a URL source (also when served from cache), modification of a file
+	HTTPStatus int       `json:"http_status,omitempty"` // Status of the download in this reload, absent when served from cache
+	Bytes      int64     `json:"bytes"`                 // Size of the list
+}
+
+// Report returns the report of the last finished reload, nil before the first one.
+func (e *Engine) Report() *ReloadReport {
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	return e.report
+}
+
+// finishReport completes the report of a reload, computes deltas against the
+// last applied one and stores it in dataDir.
+func (e *Engine) finishReport(rs *ruleSet, err error, dataDir string) {
+	p := e.Progress()
+	report := &ReloadReport{
+		StartedAt:  p.StartedAt,
+		FinishedAt: p.FinishedAt,
+		Applied:    err == nil,
+		Rules:      rs.rules,
+		Sources:    rs.report,
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	e.progressMu.Lock()
+	prev := e.appliedReport
+	if prev == nil {
+		prev = readReport(dataDir) // Deltas across restarts
+	}
+	previous := make(map[string]int)
+	if prev != nil {
+		for _, s := range prev.Sources {
+			previous[s.RuleGroup+"\xff"+s.Name] = s.Rules
+		}
+	}
+	for i := range report.Sources {
+		s := &report.Sources[i]
+		s.Delta = s.Rules - previous[s.RuleGroup+"\xff"+s.Name]
+	}
+	e.report = report
+	if report.Applied {
+		e.appliedReport = report
+	}
+	e.progressMu.Unlock()
+
+	failed := 0
+	for _, s := range report.Sources {
+		if s.Status != SourceOK {
+			failed++
+		}
+	}
+	log.Printf("[RELOAD] %d sources, %d not loaded, %d rules, applied: %v", len(report.Sources), failed, report.Rules, report.Applied)
+
+	if dataDir == "" {
+		return
+	}
+	if err := writeReport(dataDir, report); err != nil {
+		log.Printf("Failed to write reload report: %v", err)
+	}
+}
+
+func readReport(dataDir string) *ReloadReport {
+	data, err := os.ReadFile(filepath.Join(dataDir, reportFile))
+	if err != nil {
+		return nil
+	}
+	var report ReloadReport
+	if json.Unmarshal(data, &report) != nil || !report.Applied {
+		return nil
+	}
+	return &report
+}
+
+// writeReport replaces the report file atomically.
+func writeReport(dataDir string, report *ReloadReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data dir: %w", err)
+	}
+	tmp := filepath.Join(dataDir, reportFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dataDir, reportFile))
+}
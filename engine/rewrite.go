@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteSource is the source reported for rules of the rewrites section.
+const RewriteSource = "rewrites"
+
+// rewrite is a compiled entry of the rewrites section.
+type rewrite struct {
+	rule       *parser.Rule
+	suffix     string         // For "*.domain": ".domain"
+	regex      *regexp.Regexp // For "/regex/"
+	addr       netip.Addr     // Valid when the answer is an IP
+	userGroups []string       // Empty applies to all
+}
+
+// rewriteSet holds the administrative rewrites in config order.
+type rewriteSet []rewrite
+
+func newRewriteSet(cfg *config.Config) (rewriteSet, error) {
+	var set rewriteSet
+	for _, rw := range cfg.Rewrites {
+		pattern := strings.ToLower(strings.TrimSuffix(rw.Domain, "."))
+		c := rewrite{
+			rule: &parser.Rule{
+				Text:      fmt.Sprintf("%s -> %s", rw.Domain, rw.Answer),
+				Pattern:   pattern,
+				Type:      parser.RuleTypeExact,
+				Modifiers: parser.Modifiers{DNSRewrite: rw.Answer},
+				Source:    RewriteSource,
+			},
+			userGroups: rw.UserGroups,
+		}
+		switch {
+		case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+			re, err := regexp.Compile("(?i)" + rw.Domain[1:len(rw.Domain)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite '%s': %w", rw.Domain, err)
+			}
+			c.regex = re
+			c.rule.Type, c.rule.Regex = parser.RuleTypeRegex, re
+		case strings.HasPrefix(pattern, "*."):
+			c.suffix = pattern[1:]
+			c.rule.Type = parser.RuleTypeDistinguish
+		}
+		if addr, err := netip.ParseAddr(rw.Answer); err == nil {
+			c.addr = addr
+		} else if _, ok := dns.IsDomainName(rw.Answer); !ok {
+			return nil, fmt.Errorf("rewrite '%s': answer '%s' is neither an IP nor a domain", rw.Domain, rw.Answer)
+		}
+		set = append(set, c)
+	}
+	return set, nil
+}
+
+// match returns the rule of the first rewrite for name and userGroup whose
+// answer fits qType. When rewrites match the name but none fits (e.g. AAAA
+// for an IPv4 rewrite), the first one is returned so the name is answered
+// locally with no records instead of leaking upstream.
+func (set rewriteSet) match(qName string, qType uint16, userGroup string) *parser.Rule {
+	name := strings.ToLower(strings.TrimSuffix(qName, "."))
+	var first *parser.Rule
+	for _, rw := range set {
+		if len(rw.userGroups) > 0 && !slices.Contains(rw.userGroups, userGroup) {
+			continue
+		}
+		if !rw.matches(name) {
+			continue
+		}
+		if rw.fits(qType) {
+			return rw.rule
+		}
+		if first == nil {
+			first = rw.rule
+		}
+	}
+	return first
+}
+
+func (rw rewrite) matches(name string) bool {
+	switch {
+	case rw.regex != nil:
+		return rw.regex.MatchString(name)
+	case rw.suffix != "":
+		// Subdomains only, like AdGuard Home: "*.lab.home" does not match "lab.home"
+		return strings.HasSuffix(name, rw.suffix)
+	default:
+		return name == rw.rule.Pattern
+	}
+}
+
+// fits reports whether the answer has records for qType.
+func (rw rewrite) fits(qType uint16) bool {
+	switch {
+	case !rw.addr.IsValid():
+		return qType == dns.TypeA || qType == dns.TypeAAAA || qType == dns.TypeCNAME
+	case rw.addr.Is4():
+		return qType == dns.TypeA
+	default:
+		return qType == dns.TypeAAAA
+	}
+}
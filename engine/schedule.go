@@ -3,6 +3,7 @@ package engine
 import (
 	"adblocker/config"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +13,10 @@ type Schedule struct {
 	Name string
 	// Map weekday to list of allowed ranges for that day
 	WeekMap map[time.Weekday][]TimeRange
+	// Presence limits the schedule to times the presence signal is on
+	Presence bool
+	// Always means no items: the schedule follows presence alone
+	Always bool
 }
 
 type TimeRange struct {
@@ -21,6 +26,7 @@ type TimeRange struct {
 
 type ScheduleMatcher struct {
 	schedules map[string]*Schedule
+	present   func(schedule string) bool // Presence signals, see Engine.SetPresent
 }
 
 func NewScheduleMatcher(cfg *config.Config) (*ScheduleMatcher, error) {
@@ -30,8 +36,10 @@ func NewScheduleMatcher(cfg *config.Config) (*ScheduleMatcher, error) {
 
 	for _, s := range cfg.Schedules {
 		sch := &Schedule{
-			Name:    s.Name,
-			WeekMap: make(map[time.Weekday][]TimeRange),
+			Name:     s.Name,
+			WeekMap:  make(map[time.Weekday][]TimeRange),
+			Presence: s.Presence != nil,
+			Always:   len(s.Items) == 0,
 		}
 
 		for _, item := range s.Items {
@@ -77,6 +85,16 @@ func (sm *ScheduleMatcher) IsActive(scheduleName string, t time.Time) bool {
 		return false
 	}
 
+	// 0. Presence-driven schedules apply only while the signal is on
+	if sch.Presence {
+		if sm.present == nil || !sm.present(scheduleName) {
+			return false
+		}
+		if sch.Always {
+			return true
+		}
+	}
+
 	// 1. Get ranges for current day
 	ranges := sch.WeekMap[t.Weekday()]
 	if len(ranges) == 0 {
@@ -145,3 +163,32 @@ func parseMinutes(hhmm string) (int, error) {
 	}
 	return h*60 + m, nil
 }
+
+// NextTransition returns the first time after now at which IsActive changes
+// for the named schedule, looking a week ahead. Zero if it never changes.
+func (sm *ScheduleMatcher) NextTransition(scheduleName string, now time.Time) time.Time {
+	sch, ok := sm.schedules[scheduleName]
+	if !ok {
+		return time.Time{}
+	}
+
+	// Ranges start at Start and end after the End minute (inclusive)
+	var candidates []time.Time
+	for d := 0; d <= 7; d++ {
+		day := now.AddDate(0, 0, d)
+		for _, r := range sch.WeekMap[day.Weekday()] {
+			for _, mins := range []int{r.Start, r.End + 1} {
+				candidates = append(candidates, time.Date(day.Year(), day.Month(), day.Day(), 0, mins, 0, 0, now.Location()))
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	active := sm.IsActive(scheduleName, now)
+	for _, c := range candidates {
+		if c.After(now) && sm.IsActive(scheduleName, c) != active {
+			return c
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"adblocker/parser"
+)
+
+// Search modes
+const (
+	SearchDomain    = "domain"    // Rules that match the domain, as Resolve would find them
+	SearchSubstring = "substring" // Rules whose text contains the query
+)
+
+// SearchMatch is one loaded rule found by SearchRules.
+type SearchMatch struct {
+	Rule      string `json:"rule"`
+	RuleGroup string `json:"rule_group"`
+	Source    string `json:"source"`
+	Exception bool   `json:"exception,omitempty"` // @@ rule
+}
+
+// SearchSource counts the matches of one source.
+type SearchSource struct {
+	RuleGroup  string `json:"rule_group"`
+	Source     string `json:"source"`
+	Blocks     int    `json:"blocks"`
+	Exceptions int    `json:"exceptions"`
+}
+
+// SearchResult answers "which of my lists block this domain".
+type SearchResult struct {
+	Query        string         `json:"query"`
+	Mode         string         `json:"mode"`
+	Sources      []SearchSource `json:"sources"`
+	Matches      []SearchMatch  `json:"matches"`
+	Truncated    bool           `json:"truncated,omitempty"` // More than limit matches
+	HasException bool           `json:"has_exception"`
+}
+
+// SearchRules looks up query in all loaded rules regardless of users,
+// schedules and client modifiers. In domain mode it returns the rules that
+// match the domain or a parent; in substring mode those whose text contains
+// query. Matches beyond limit are counted per source but not listed.
+func (e *Engine) SearchRules(query, mode string, limit int) (*SearchResult, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, fmt.Errorf("empty query")
+	}
+	if mode == "" {
+		mode = SearchDomain
+	}
+
+	e.cfgMu.RLock()
+	ruleGroups := e.cfg.RuleGroups
+	e.cfgMu.RUnlock()
+	groupName := func(gid int) string {
+		if gid >= 1 && gid <= len(ruleGroups) {
+			return ruleGroups[gid-1].Name
+		}
+		return ""
+	}
+
+	var rules []*parser.Rule
+	e.trieMu.RLock()
+	switch mode {
+	case SearchDomain:
+		fqdn := strings.TrimSuffix(query, ".") + "."
+		rules = append(e.trie.SearchTrace(fqdn), e.regexMatches(fqdn)...)
+	case SearchSubstring:
+		for _, groupRules := range e.groupRules {
+			for _, r := range groupRules {
+				if strings.Contains(strings.ToLower(r.Text), query) {
+					rules = append(rules, r)
+				}
+			}
+		}
+	default:
+		e.trieMu.RUnlock()
+		return nil, fmt.Errorf("unknown search mode '%s' (want domain or substring)", mode)
+	}
+	e.trieMu.RUnlock()
+
+	res := &SearchResult{Query: query, Mode: mode, Matches: []SearchMatch{}, Sources: []SearchSource{}}
+	bySource := make(map[[2]string]*SearchSource)
+	seen := make(map[*parser.Rule]bool)
+	for _, r := range rules {
+		if seen[r] || r.Modifiers.BadFilter {
+			continue
+		}
+		seen[r] = true
+
+		m := SearchMatch{Rule: r.Text, RuleGroup: groupName(r.GroupID), Source: r.Source, Exception: r.IsWhitelist}
+		key := [2]string{m.RuleGroup, m.Source}
+		src := bySource[key]
+		if src == nil {
+			src = &SearchSource{RuleGroup: m.RuleGroup, Source: m.Source}
+			bySource[key] = src
+		}
+		if m.Exception {
+			src.Exceptions++
+			res.HasException = true
+		} else {
+			src.Blocks++
+		}
+
+		if len(res.Matches) < limit || limit <= 0 {
+			res.Matches = append(res.Matches, m)
+		} else {
+			res.Truncated = true
+		}
+	}
+
+	for _, src := range bySource {
+		res.Sources = append(res.Sources, *src)
+	}
+	sort.Slice(res.Sources, func(i, j int) bool {
+		a, b := res.Sources[i], res.Sources[j]
+		if a.RuleGroup != b.RuleGroup {
+			return a.RuleGroup < b.RuleGroup
+		}
+		return a.Source < b.Source
+	})
+	sort.SliceStable(res.Matches, func(i, j int) bool { return res.Matches[i].RuleGroup < res.Matches[j].RuleGroup })
+	return res, nil
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Trace records step by step how Resolve decided one query, for debugging a
+// single decision without verbose logging. It is only collected by
+// ResolveTrace; a nil Trace records nothing.
+type Trace struct {
+	Steps []string `json:"steps"`
+}
+
+func (t *Trace) add(format string, args ...any) {
+	if t != nil {
+		t.Steps = append(t.Steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// ResolveTrace is Resolve, also returning a trace of the evaluation: the
+// user and UserGroup found, the rule groups active for them, every trie
+// node visited, the regex rules that matched and the modifier checks of
+// every candidate rule.
+func (e *Engine) ResolveTrace(qName string, qType uint16, clientIP netip.Addr, clientMAC, clientID string) (*ResolveResult, *Trace) {
+	tr := &Trace{}
+	res := e.resolve(qName, qType, clientIP, clientMAC, clientID, tr)
+	res.Upstream = e.userGroupUpstream(res.UserGroup)
+	if len(res.Upstream) > 0 {
+		tr.add("upstream of user group '%s': %v", res.UserGroup, res.Upstream)
+	}
+	tr.add("result: blocked=%t reason=%q", res.Blocked, res.Reason)
+	return res, tr
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"time"
+
+	"adblocker/config"
+)
+
+// transitionRecheck bounds how long a "never changes" result is trusted.
+const transitionRecheck = time.Hour
+
+type cachedTransition struct {
+	next       time.Time // Zero if none within the schedules' week
+	computedAt time.Time
+}
+
+// NextTransition returns when the policies of userGroup may next change
+// because a schedule or a scheduled profile flips. Zero if not within a week.
+func (e *Engine) NextTransition(userGroup string, now time.Time) time.Time {
+	e.transitionMu.Lock()
+	if c, ok := e.transitions[userGroup]; ok {
+		if c.next.IsZero() && now.Sub(c.computedAt) < transitionRecheck || now.Before(c.next) {
+			e.transitionMu.Unlock()
+			return c.next
+		}
+	}
+	e.transitionMu.Unlock()
+
+	e.cfgMu.RLock()
+	next := e.nextTransition(userGroup, now)
+	e.cfgMu.RUnlock()
+
+	e.transitionMu.Lock()
+	e.transitions[userGroup] = cachedTransition{next: next, computedAt: now}
+	e.transitionMu.Unlock()
+	return next
+}
+
+// resetTransitions drops cached transitions after a config or profile change.
+func (e *Engine) resetTransitions() {
+	e.transitionMu.Lock()
+	e.transitions = make(map[string]cachedTransition)
+	e.transitionMu.Unlock()
+}
+
+// nextTransition computes NextTransition. Caller must hold cfgMu.
+func (e *Engine) nextTransition(userGroup string, now time.Time) time.Time {
+	var next time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	considerSchedule := func(policies []config.Policy) {
+		for _, p := range policies {
+			if p.Schedule != "" {
+				consider(e.scheduleMatcher.NextTransition(p.Schedule, now))
+			}
+		}
+	}
+
+	for _, ug := range e.cfg.UserGroups {
+		if ug.Name == userGroup {
+			considerSchedule(ug.Policies)
+		}
+	}
+
+	// Profiles replacing this group's policies switch on their own schedule and dates
+	for _, p := range e.profiles.ordered {
+		policies, ok := p.policies[userGroup]
+		if !ok {
+			continue
+		}
+		considerSchedule(policies)
+		if p.schedule != "" {
+			consider(e.scheduleMatcher.NextTransition(p.schedule, now))
+		}
+		consider(p.from)
+		consider(p.until)
+	}
+
+	return next
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"adblocker/parser"
+	"slices"
 	"strings"
 	"sync"
 )
@@ -15,9 +16,12 @@ type TrieNode struct {
 }
 
 // DomainTrie is a thread-safe Trie for domain suffixes.
+// Exact rules (hosts entries, |example.com^) never match subdomains, so they
+// live in a hash map keyed by domain and the trie only holds suffix rules.
 type DomainTrie struct {
-	root *TrieNode
-	mu   sync.RWMutex
+	root  *TrieNode
+	exact map[string][]*parser.Rule
+	mu    sync.RWMutex
 }
 
 // NewDomainTrie creates a new empty Trie.
@@ -26,15 +30,27 @@ func NewDomainTrie() *DomainTrie {
 		root: &TrieNode{
 			children: make(map[string]*TrieNode),
 		},
+		exact: make(map[string][]*parser.Rule),
 	}
 }
 
+// isExactKey reports whether rule is stored in the exact map.
+// Exact rules with wildcard labels still need the trie walk.
+func isExactKey(rule *parser.Rule) bool {
+	return rule.Type == parser.RuleTypeExact && !strings.Contains(rule.Pattern, wildcardLabel)
+}
+
 // Insert adds a rule to the Trie.
 // The domain should be the extracted pattern (e.g. "example.com" for "||example.com^").
 func (t *DomainTrie) Insert(rule *parser.Rule) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	if isExactKey(rule) {
+		t.exact[rule.Pattern] = append(t.exact[rule.Pattern], rule)
+		return
+	}
+
 	parts := strings.Split(rule.Pattern, ".")
 	node := t.root
 
@@ -53,32 +69,158 @@ func (t *DomainTrie) Insert(rule *parser.Rule) {
 	node.rules = append(node.rules, rule)
 }
 
+// Remove deletes the rules stored exactly at domain for which match returns true.
+// Returns the number of rules removed.
+func (t *DomainTrie) Remove(domain string, match func(*parser.Rule) bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	if rules, ok := t.exact[domain]; ok {
+		var n int
+		rules, n = removeRules(rules, match)
+		removed += n
+		if len(rules) == 0 {
+			delete(t.exact, domain)
+		} else {
+			t.exact[domain] = rules
+		}
+	}
+
+	parts := strings.Split(domain, ".")
+	node := t.root
+	for i := len(parts) - 1; i >= 0; i-- {
+		node = node.children[parts[i]]
+		if node == nil {
+			return removed
+		}
+	}
+
+	var n int
+	node.rules, n = removeRules(node.rules, match)
+	return removed + n
+}
+
+// removeRules filters rules in place, returning the kept rules and the number removed.
+func removeRules(rules []*parser.Rule, match func(*parser.Rule) bool) ([]*parser.Rule, int) {
+	kept := rules[:0]
+	removed := 0
+	for _, r := range rules {
+		if match(r) {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	// Clear the tail so removed rules can be collected
+	for i := len(kept); i < len(rules); i++ {
+		rules[i] = nil
+	}
+	return kept, removed
+}
+
+// isSubdomainOf reports whether domain equals parent or lies below it,
+// the suffix relation the trie encodes for ||parent^ rules.
+func isSubdomainOf(domain, parent string) bool {
+	if parent == "" {
+		return false
+	}
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// wildcardLabel is the trie label that matches one or more domain labels.
+const wildcardLabel = "*"
+
 // SearchTrace collects all rules found along the path of the domain.
 // Returns a slice of relevant rules (both whitelist and blocklist).
+// Exact rules are only returned when they match the whole domain.
 // Domain should be FQDN (e.g. "ads.example.com").
 func (t *DomainTrie) SearchTrace(domain string) []*parser.Rule {
+	return t.search(domain, nil)
+}
+
+// search is SearchTrace, recording the nodes visited in tr if it is not nil.
+func (t *DomainTrie) search(domain string, tr *Trace) []*parser.Rule {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	domain = strings.TrimSuffix(domain, ".")
-	parts := strings.Split(domain, ".")
-	var matchedRules []*parser.Rule
-
-	node := t.root
-	// Check matches matching *, or root? AdGuard usually doesn't do global * blocks in this trie way usually.
+	s := &trieSearch{parts: strings.Split(domain, "."), trace: tr}
 
 	// Traverse in reverse: com -> example -> ads
-	for i := len(parts) - 1; i >= 0; i-- {
-		part := parts[i]
-		node = node.children[part]
-		if node == nil {
-			break
-		}
-		// Collect rules at this level
-		if len(node.rules) > 0 {
-			matchedRules = append(matchedRules, node.rules...)
+	s.walk(t.root, len(s.parts)-1, "")
+
+	// Exact rules come last, as they did when stored at the deepest node
+	exact := t.exact[domain]
+	if tr != nil {
+		tr.add("trie: %d exact rules for %s", len(exact), domain)
+	}
+	return append(s.matched, exact...)
+}
+
+// trieSearch holds the state of one SearchTrace call.
+type trieSearch struct {
+	parts   []string
+	matched []*parser.Rule
+	trace   *Trace // Optional, see Engine.ResolveTrace
+
+	// Nodes already collected; a "*" label can reach a node along several paths
+	seen     []*TrieNode
+	seenFull []*TrieNode
+}
+
+// walk consumes parts[i], parts[i-1], ... below node. i < 0 means the whole domain matched.
+// path is the pattern of node, only kept while tracing.
+func (s *trieSearch) walk(node *TrieNode, i int, path string) {
+	if i < 0 {
+		return
+	}
+	if child := node.children[s.parts[i]]; child != nil {
+		s.visit(child, i-1, s.childPath(s.parts[i], path))
+	}
+	if star := node.children[wildcardLabel]; star != nil {
+		// "*" consumes parts[i] down to parts[j]
+		starPath := s.childPath(wildcardLabel, path)
+		for j := i; j >= 0; j-- {
+			s.visit(star, j-1, starPath)
 		}
 	}
+}
+
+func (s *trieSearch) childPath(label, path string) string {
+	if s.trace == nil {
+		return ""
+	}
+	if path == "" {
+		return label
+	}
+	return label + "." + path
+}
 
-	return matchedRules
+// visit collects the rules of a node reached with parts[:i+1] left and continues the walk.
+func (s *trieSearch) visit(node *TrieNode, i int, path string) {
+	if s.trace != nil {
+		s.trace.add("trie: visited %s (%d rules)", path, len(node.rules))
+	}
+	full := i < 0
+	if len(node.rules) > 0 {
+		first := !slices.Contains(s.seen, node)
+		firstFull := full && !slices.Contains(s.seenFull, node)
+		for _, r := range node.rules {
+			if r.Type == parser.RuleTypeExact {
+				if firstFull {
+					s.matched = append(s.matched, r)
+				}
+			} else if first {
+				s.matched = append(s.matched, r)
+			}
+		}
+		if first {
+			s.seen = append(s.seen, node)
+		}
+		if firstFull {
+			s.seenFull = append(s.seenFull, node)
+		}
+	}
+	s.walk(node, i, path)
 }
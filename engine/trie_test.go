@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+
+	"adblocker/parser"
+)
+
+func TestSearchTrace(t *testing.T) {
+	trie := NewDomainTrie()
+	for _, text := range []string{
+		"||example.com^",
+		"@@||good.example.com^",
+		"example.org",
+		"||ads.*.example.net^",
+		"*.cdn.io",
+		"||*.*.dup.test^",
+	} {
+		rule, err := parser.ParseRule(text)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", text, err)
+		}
+		if rule.Type == parser.RuleTypeRegex {
+			t.Fatalf("ParseRule(%q) made a regex rule, want a trie rule", text)
+		}
+		trie.Insert(rule)
+	}
+
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		// Suffix rules match the domain and everything below it
+		{"example.com", []string{"||example.com^"}},
+		{"ads.example.com", []string{"||example.com^"}},
+		{"ads.example.com.", []string{"||example.com^"}},
+		{"good.example.com", []string{"||example.com^", "@@||good.example.com^"}},
+		{"notexample.com", nil},
+		{"example.com.evil", nil},
+
+		// Exact rules match the whole domain only
+		{"example.org", []string{"example.org"}},
+		{"www.example.org", nil},
+
+		// A "*" label stands for one or more labels
+		{"ads.x.example.net", []string{"||ads.*.example.net^"}},
+		{"ads.a.b.example.net", []string{"||ads.*.example.net^"}},
+		{"pixel.ads.x.example.net", []string{"||ads.*.example.net^"}},
+		{"ads.example.net", nil},
+		{"x.ads.example.net", nil},
+		{"a.cdn.io", []string{"*.cdn.io"}},
+		{"a.b.cdn.io", []string{"*.cdn.io"}},
+		{"cdn.io", nil},
+
+		// A node reached along several paths is returned once
+		{"a.b.c.dup.test", []string{"||*.*.dup.test^"}},
+		{"b.dup.test", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range trie.SearchTrace(tt.domain) {
+			got = append(got, r.Text)
+		}
+		slices.Sort(got)
+		slices.Sort(tt.want)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SearchTrace(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
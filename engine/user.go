@@ -6,11 +6,12 @@ import (
 	"net/netip"
 )
 
-// UserMatcher identifies a user based on IP or MAC.
+// UserMatcher identifies a user based on DoH client ID, MAC or IP.
 type UserMatcher struct {
 	// Maps for O(1) lookup
 	byIP  map[netip.Addr]*config.User
 	byMAC map[string]*config.User
+	byID  map[string]*config.User
 
 	// List for CIDR lookups (O(N))
 	cidrs []cidrMapping
@@ -23,47 +24,79 @@ type cidrMapping struct {
 	user   *config.User
 }
 
-// NewUserMatcher builds a matcher from the configuration.
+// NewUserMatcher builds a matcher from the configuration. When users of the
+// config file share an IP, MAC or client ID, the last one listed wins.
 func NewUserMatcher(cfg *config.Config) (*UserMatcher, error) {
 	um := &UserMatcher{
 		byIP:             make(map[netip.Addr]*config.User),
 		byMAC:            make(map[string]*config.User),
+		byID:             make(map[string]*config.User),
 		defaultUserGroup: cfg.Defaults.UserGroup,
 	}
+	if err := um.add(cfg.Users, true); err != nil {
+		return nil, err
+	}
+	return um, nil
+}
 
-	for i := range cfg.Users {
-		user := &cfg.Users[i]
+// add indexes users. With replace unset, IPs, MACs and client IDs already
+// indexed keep their user, so external users never shadow configured ones.
+func (um *UserMatcher) add(users []config.User, replace bool) error {
+	for i := range users {
+		user := &users[i]
 
 		// Index IPs
 		for _, ipStr := range user.IPs {
 			// Try parsing as CIDR first
 			if prefix, err := netip.ParsePrefix(ipStr); err == nil {
-				um.cidrs = append(um.cidrs, cidrMapping{prefix: prefix, user: user})
+				um.cidrs = append(um.cidrs, cidrMapping{prefix: unmapPrefix(prefix), user: user})
 				continue
 			}
 
 			// Try as single IP
 			if addr, err := netip.ParseAddr(ipStr); err == nil {
-				um.byIP[addr] = user
+				addr = addr.Unmap()
+				if _, exists := um.byIP[addr]; replace || !exists {
+					um.byIP[addr] = user
+				}
 				continue
 			}
 
-			return nil, fmt.Errorf("invalid IP/CIDR '%s' for user '%s'", ipStr, user.Name)
+			return fmt.Errorf("invalid IP/CIDR '%s' for user '%s'", ipStr, user.Name)
 		}
 
 		// Index MACs
 		for _, mac := range user.MACs {
 			// Normalize MAC string if needed (e.g. lowercase)
-			um.byMAC[mac] = user
+			if _, exists := um.byMAC[mac]; replace || !exists {
+				um.byMAC[mac] = user
+			}
+		}
+
+		// Index DoH client IDs
+		for _, id := range user.ClientIDs {
+			if _, exists := um.byID[id]; replace || !exists {
+				um.byID[id] = user
+			}
 		}
 	}
 
-	return um, nil
+	return nil
 }
 
-// Match returns the UserConfig for a given client IP and MAC.
+// Match returns the UserConfig for a given client IP, MAC and DoH client ID.
 // Returns nil if no user is found (caller should use default group).
-func (um *UserMatcher) Match(ip netip.Addr, mac string) *config.User {
+func (um *UserMatcher) Match(ip netip.Addr, mac, id string) *config.User {
+	// IPv4 clients of dual-stack listeners arrive mapped (::ffff:a.b.c.d)
+	ip = ip.Unmap()
+
+	// 0. Client ID Match (the device named itself, wherever it is)
+	if id != "" {
+		if u, ok := um.byID[id]; ok {
+			return u
+		}
+	}
+
 	// 1. MAC Match (Highest priority in local networks usually)
 	if mac != "" {
 		if u, ok := um.byMAC[mac]; ok {
@@ -86,5 +119,14 @@ func (um *UserMatcher) Match(ip netip.Addr, mac string) *config.User {
 	return nil
 }
 
+// unmapPrefix turns an IPv4-mapped prefix (::ffff:10.0.0.0/104) into its
+// IPv4 form so it matches unmapped client addresses.
+func unmapPrefix(p netip.Prefix) netip.Prefix {
+	if !p.Addr().Is4In6() || p.Bits() < 96 {
+		return p
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96).Masked()
+}
+
 // Post-Validation: Ensure default user group exists?
 // That logic belongs in validation, not here directly.
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clickhouseSink inserts batches through the ClickHouse HTTP interface as
+// JSONEachRow, creating the table on first use.
+type clickhouseSink struct {
+	url    *url.URL // Without the query parameter
+	table  string
+	client *http.Client
+
+	mu    sync.Mutex
+	ready bool // Schema is up to date
+}
+
+func newClickHouseSink(target, table string) (*clickhouseSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid clickhouse url '%s' (want http://host:8123/?database=...)", target)
+	}
+	table, err = checkTable(table)
+	if err != nil {
+		return nil, err
+	}
+	return &clickhouseSink{url: u, table: table, client: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+func (c *clickhouseSink) name() string { return "clickhouse" }
+
+func (c *clickhouseSink) send(batch []Event) error {
+	if err := c.migrate(); err != nil {
+		return fmt.Errorf("schema: %w", err)
+	}
+	body, err := encodeNDJSON(batch)
+	if err != nil {
+		return err
+	}
+	return c.exec(fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table), string(body))
+}
+
+// migrate creates the table and adds columns it lacks.
+func (c *clickhouseSink) migrate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ready {
+		return nil
+	}
+
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = fmt.Sprintf("`%s` %s", col.name, col.clickhouse)
+	}
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = MergeTree PARTITION BY toYYYYMM(time) ORDER BY (time, domain)",
+		c.table, strings.Join(defs, ", "))
+	if err := c.exec(create, ""); err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if err := c.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS `%s` %s", c.table, col.name, col.clickhouse), ""); err != nil {
+			return err
+		}
+	}
+	c.ready = true
+	return nil
+}
+
+// exec runs query with data as its input. Without data the query is sent
+// as the body, which keeps long DDL out of URLs and error messages.
+func (c *clickhouseSink) exec(query, data string) error {
+	u := *c.url
+	q := u.Query()
+	q.Set("date_time_input_format", "best_effort") // Event times are RFC 3339
+	body := query
+	if data != "" {
+		q.Set("query", query)
+		body = data
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := c.client.Post(u.String(), "text/plain", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
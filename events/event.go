@@ -0,0 +1,26 @@
+// Package events exports per-query decision events to remote collectors.
+package events
+
+import "time"
+
+// Event is one DNS decision as shipped to collectors.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	MAC         string    `json:"mac,omitempty"`
+	User        string    `json:"user,omitempty"`
+	DisplayName string    `json:"display_name,omitempty"` // Nickname of the user from the config
+	Icon        string    `json:"icon,omitempty"`
+	UserGroup   string    `json:"user_group,omitempty"`
+	Domain      string    `json:"domain"`
+	QType       string    `json:"qtype"`
+	Decision    string    `json:"decision"` // blocked, rewritten, whitelisted or allowed
+	RuleGroup   string    `json:"rule_group,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	List        string    `json:"list,omitempty"` // Source of the rule
+	Cached      bool      `json:"cached,omitempty"`
+	SampleRate  float64   `json:"sample_rate,omitempty"` // Set when only this fraction of such events is exported
+	Answers     []string  `json:"answers,omitempty"`     // A/AAAA addresses of the answer, with geoip configured
+	Countries   []string  `json:"countries,omitempty"`   // Distinct countries of Answers
+	ASNs        []uint32  `json:"asns,omitempty"`        // Distinct autonomous systems of Answers
+}
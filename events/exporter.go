@@ -0,0 +1,229 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"adblocker/config"
+	"adblocker/metrics"
+)
+
+// Defaults for config.EventExport
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = 5 * time.Second
+	defaultBufferSize    = 10000
+	defaultMaxSpool      = 64 << 20
+)
+
+// sendAttempts is how often a batch is tried before it is spooled.
+const sendAttempts = 3
+
+var (
+	eventsExported = metrics.NewCounterVec("adblocker_events_exported_total",
+		"Decision events delivered to a collector.", "sink")
+	eventsDropped = metrics.NewCounterVec("adblocker_events_dropped_total",
+		"Decision events lost because the buffer or the spool was full.", "reason")
+)
+
+// Exporter queues decision events and ships them in batches. Sending never
+// blocks the caller; batches that cannot be delivered are spooled to disk
+// and retried before newer ones. Delivery is at least once: with several
+// collectors a batch is resent to all of them if one fails.
+type Exporter struct {
+	sinks     []sink
+	decisions []string
+	batchSize int
+	interval  time.Duration
+	spool     *spool
+
+	events chan Event
+	done   chan struct{}
+}
+
+// NewExporter creates an exporter from the configuration and starts it.
+// Returns nil if no collector is configured.
+func NewExporter(cfg config.EventExport, dataDir string) (*Exporter, error) {
+	if cfg.URL == "" && cfg.Syslog == "" && cfg.ClickHouse == "" {
+		return nil, nil
+	}
+
+	x := &Exporter{
+		decisions: cfg.Decisions,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.FlushInterval,
+		spool:     &spool{dir: cfg.SpoolDir, maxBytes: int64(cfg.MaxSpool)},
+		done:      make(chan struct{}),
+	}
+	if len(x.decisions) == 0 {
+		x.decisions = []string{"blocked", "rewritten"}
+	}
+	if x.batchSize <= 0 {
+		x.batchSize = defaultBatchSize
+	}
+	if x.interval <= 0 {
+		x.interval = defaultFlushInterval
+	}
+	if x.spool.dir == "" {
+		x.spool.dir = filepath.Join(dataDir, "event-spool")
+	}
+	if x.spool.maxBytes <= 0 {
+		x.spool.maxBytes = defaultMaxSpool
+	}
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	x.events = make(chan Event, bufferSize)
+
+	if cfg.URL != "" {
+		x.sinks = append(x.sinks, &httpSink{url: cfg.URL, headers: cfg.Headers, client: &http.Client{Timeout: 30 * time.Second}})
+	}
+	if cfg.Syslog != "" {
+		s, err := newSyslogSink(cfg.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		x.sinks = append(x.sinks, s)
+	}
+	if cfg.ClickHouse != "" {
+		s, err := newClickHouseSink(cfg.ClickHouse, cfg.Table)
+		if err != nil {
+			return nil, err
+		}
+		x.sinks = append(x.sinks, s)
+	}
+
+	metrics.NewGaugeFunc("adblocker_events_spool_bytes", "Size of the undelivered event batches on disk.", func() float64 {
+		return float64(x.spool.size())
+	})
+
+	go x.run()
+	log.Printf("[EVENTS] Exporting %v decisions to %d collector(s), spool in %s", x.decisions, len(x.sinks), x.spool.dir)
+	return x, nil
+}
+
+// Wants reports whether events with the decision are exported, so callers
+// can skip building them.
+func (x *Exporter) Wants(decision string) bool {
+	return x != nil && slices.Contains(x.decisions, decision)
+}
+
+// Send queues an event without blocking; it is dropped if the buffer is full.
+func (x *Exporter) Send(e Event) {
+	select {
+	case x.events <- e:
+	default:
+		eventsDropped.Inc("buffer")
+	}
+}
+
+// Stop flushes the queued events, spooling what cannot be delivered.
+func (x *Exporter) Stop() {
+	if x == nil {
+		return
+	}
+	close(x.events)
+	<-x.done
+}
+
+func (x *Exporter) run() {
+	defer close(x.done)
+
+	ticker := time.NewTicker(x.interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, x.batchSize)
+	flush := func() {
+		x.deliver(batch)
+		batch = make([]Event, 0, x.batchSize)
+	}
+
+	for {
+		select {
+		case e, ok := <-x.events:
+			if !ok {
+				if len(batch) > 0 {
+					x.store(batch) // No time for retries on shutdown
+				}
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= x.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// deliver sends the spooled batches, oldest first, then batch. Anything
+// that cannot be sent is spooled.
+func (x *Exporter) deliver(batch []Event) {
+	files, _ := x.spool.files()
+	pending := false
+	for _, f := range files {
+		spooled, err := readBatch(f.path)
+		if err != nil {
+			log.Printf("[EVENTS] Dropping %s: %v", f.path, err)
+			os.Remove(f.path)
+			continue
+		}
+		if err := x.sendAll(spooled, 1); err != nil {
+			pending = true // Collector still down; keep order by not sending newer batches first
+			break
+		}
+		os.Remove(f.path)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+	if pending {
+		x.store(batch)
+		return
+	}
+	if err := x.sendAll(batch, sendAttempts); err != nil {
+		log.Printf("[EVENTS] Delivery failed, spooling %d events: %v", len(batch), err)
+		x.store(batch)
+	}
+}
+
+// sendAll delivers a batch to every sink, retrying with backoff.
+func (x *Exporter) sendAll(batch []Event, attempts int) error {
+	for _, s := range x.sinks {
+		var err error
+		for i := range attempts {
+			if i > 0 {
+				time.Sleep(time.Duration(1<<(i-1)) * time.Second)
+			}
+			if err = s.send(batch); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name(), err)
+		}
+		eventsExported.Add(float64(len(batch)), s.name())
+	}
+	return nil
+}
+
+func (x *Exporter) store(batch []Event) {
+	dropped, err := x.spool.write(batch)
+	if err != nil {
+		log.Printf("[EVENTS] Failed to spool %d events: %v", len(batch), err)
+		eventsDropped.Add(float64(len(batch)), "spool")
+		return
+	}
+	if dropped > 0 {
+		log.Printf("[EVENTS] Spool over its limit, dropped %d oldest events", dropped)
+		eventsDropped.Add(float64(dropped), "spool")
+	}
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// defaultTable is the table events are written to in ClickHouse.
+const defaultTable = "dns_events"
+
+// tableName accepts plain and schema-qualified identifiers, which are
+// inserted into statements as they are.
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// column is one field of Event as stored in ClickHouse. Columns are
+// only ever added, so tables created by older versions are upgraded in
+// place on startup.
+type column struct {
+	name       string // Same as the JSON field name
+	clickhouse string
+}
+
+var columns = []column{
+	{"time", "DateTime64(3, 'UTC')"},
+	{"client", "String"},
+	{"mac", "String"},
+	{"user", "String"},
+	{"display_name", "String"},
+	{"icon", "String"},
+	{"user_group", "LowCardinality(String)"},
+	{"domain", "String"},
+	{"qtype", "LowCardinality(String)"},
+	{"decision", "LowCardinality(String)"},
+	{"rule_group", "LowCardinality(String)"},
+	{"rule", "String"},
+	{"list", "LowCardinality(String)"},
+	{"cached", "Bool"},
+	{"sample_rate", "Float64"},
+	{"answers", "Array(String)"},
+	{"countries", "Array(LowCardinality(String))"},
+	{"asns", "Array(UInt32)"},
+}
+
+func checkTable(table string) (string, error) {
+	if table == "" {
+		return defaultTable, nil
+	}
+	if !tableName.MatchString(table) {
+		return "", fmt.Errorf("invalid table name '%s'", table)
+	}
+	return table, nil
+}
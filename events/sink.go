@@ -0,0 +1,128 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sink delivers a batch of events. A batch is either fully delivered or the
+// send fails and is retried later as a whole.
+type sink interface {
+	name() string
+	send(batch []Event) error
+}
+
+// httpSink POSTs batches as newline-delimited JSON.
+type httpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (h *httpSink) name() string { return "http" }
+
+func (h *httpSink) send(batch []Event) error {
+	body, err := encodeNDJSON(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogPriority is facility local0, severity info.
+const syslogPriority = 16*8 + 6
+
+// syslogSink sends one RFC 5424 message per event with the event as JSON
+// message. TCP uses octet-counting framing (RFC 6587).
+type syslogSink struct {
+	network, addr string
+	hostname      string
+}
+
+func newSyslogSink(target string) (*syslogSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog target '%s' (want udp://host:port or tcp://host:port)", target)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog scheme '%s'", u.Scheme)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+func (s *syslogSink) name() string { return "syslog" }
+
+func (s *syslogSink) send(batch []Event) error {
+	conn, err := net.DialTimeout(s.network, s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+
+	var buf bytes.Buffer
+	for _, e := range batch {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("<%d>1 %s %s adblocker - dns-decision - %s",
+			syslogPriority, e.Time.UTC().Format(time.RFC3339Nano), s.hostname, data)
+
+		if s.network == "udp" {
+			// One datagram per message
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				return err
+			}
+			continue
+		}
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+	}
+	if buf.Len() > 0 {
+		_, err = conn.Write(buf.Bytes())
+	}
+	return err
+}
+
+func encodeNDJSON(batch []Event) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spool keeps undelivered batches on disk, one NDJSON file per batch, named
+// so that lexical order is delivery order.
+type spool struct {
+	dir      string
+	maxBytes int64
+}
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// write stores a batch, dropping the oldest batches beyond maxBytes.
+// Returns the number of events dropped that way.
+func (s *spool) write(batch []Event) (dropped int, err error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create spool dir: %w", err)
+	}
+	data, err := encodeNDJSON(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	name := fmt.Sprintf("%020d.jsonl", time.Now().UnixNano())
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return 0, err
+	}
+
+	files, total := s.files()
+	for len(files) > 1 && total > s.maxBytes {
+		n, _ := countLines(files[0].path)
+		if os.Remove(files[0].path) == nil {
+			dropped += n
+		}
+		total -= files[0].size
+		files = files[1:]
+	}
+	return dropped, nil
+}
+
+// files lists spooled batches, oldest first, and their total size.
+func (s *spool) files() ([]spoolFile, int64) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, 0
+	}
+	var files []spoolFile
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{path: filepath.Join(s.dir, e.Name()), size: info.Size()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, total
+}
+
+// size returns the bytes currently spooled.
+func (s *spool) size() int64 {
+	_, total := s.files()
+	return total
+}
+
+func readBatch(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var batch []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt spool file: %w", err)
+		}
+		batch = append(batch, e)
+	}
+	return batch, scanner.Err()
+}
+
+func countLines(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strings.Count(string(data), "\n"), nil
+}
@@ -0,0 +1,193 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// Format identifies an output syntax understood by other resolvers.
+type Format string
+
+const (
+	FormatRPZ     Format = "rpz"     // BIND/PowerDNS Response Policy Zone
+	FormatHosts   Format = "hosts"   // /etc/hosts style: 0.0.0.0 example.com
+	FormatDnsmasq Format = "dnsmasq" // address=/example.com/#
+)
+
+// ParseFormat validates a format name given on the command line.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatRPZ, FormatHosts, FormatDnsmasq:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format '%s' (want rpz, hosts or dnsmasq)", s)
+}
+
+// Entry is a single merged decision for a domain.
+type Entry struct {
+	Domain     string // Lowercase domain without trailing dot
+	Subdomains bool   // Applies to subdomains too (||example.com^)
+	Allow      bool   // Exception (@@) rather than block
+	Rewrite    string // Rewrite destination (IP or CNAME), empty for plain blocks
+}
+
+// Compile merges rules into a deduplicated, sorted list of entries.
+// Rules that other resolvers cannot express (regexes, $client, $dnstype,
+// $denyallow, $badfilter) are skipped and counted.
+func Compile(rules []*parser.Rule) ([]Entry, int) {
+	type key struct {
+		domain string
+		allow  bool
+	}
+	merged := make(map[key]Entry)
+	important := make(map[string]bool)
+	skipped := 0
+
+	for _, r := range rules {
+		if !expressible(r) {
+			skipped++
+			continue
+		}
+
+		e := Entry{
+			Domain:     strings.ToLower(strings.TrimSuffix(r.Pattern, ".")),
+			Subdomains: r.Type == parser.RuleTypeDistinguish,
+			Allow:      r.IsWhitelist,
+			Rewrite:    r.Modifiers.DNSRewrite,
+		}
+		if e.Domain == "" {
+			skipped++
+			continue
+		}
+
+		k := key{domain: e.Domain, allow: e.Allow}
+		if prev, ok := merged[k]; ok {
+			// Broader scope wins; the first rewrite seen is kept
+			e.Subdomains = e.Subdomains || prev.Subdomains
+			if prev.Rewrite != "" {
+				e.Rewrite = prev.Rewrite
+			}
+		}
+		merged[k] = e
+
+		if !r.IsWhitelist && r.Modifiers.Important {
+			important[e.Domain] = true
+		}
+	}
+
+	var entries []Entry
+	for k, e := range merged {
+		// A block shadowed by an exception for the same domain is dropped,
+		// unless the block is $important.
+		if !k.allow && !important[k.domain] {
+			if _, ok := merged[key{domain: k.domain, allow: true}]; ok {
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Domain != entries[j].Domain {
+			return entries[i].Domain < entries[j].Domain
+		}
+		return !entries[i].Allow && entries[j].Allow
+	})
+
+	return entries, skipped
+}
+
+func expressible(r *parser.Rule) bool {
+	if r.Type != parser.RuleTypeExact && r.Type != parser.RuleTypeDistinguish {
+		return false
+	}
+	if strings.Contains(r.Pattern, "*") {
+		return false // Wildcard labels have no equivalent in the output formats
+	}
+	m := r.Modifiers
+	return len(m.Client) == 0 && len(m.DNSType) == 0 && len(m.DenyAllow) == 0 && !m.BadFilter
+}
+
+// WriteStats reports how Write rendered the entries.
+type WriteStats struct {
+	Written      int // Entries in the output, approximated ones included
+	Skipped      int // Entries the format cannot express
+	Approximated int // Entries written for the domain alone, without their subdomains
+}
+
+// Write renders entries in the given format.
+// zone is the RPZ origin (e.g. "rpz.adblocker.") and is ignored by other formats.
+func Write(w io.Writer, format Format, entries []Entry, zone string, serial uint32) (WriteStats, error) {
+	bw := bufio.NewWriter(w)
+	var stats WriteStats
+
+	switch format {
+	case FormatRPZ:
+		fmt.Fprintf(bw, "$ORIGIN %s\n$TTL %d\n", dns.Fqdn(zone), defaultTTL)
+		for _, rr := range RPZRecords(entries, zone, serial) {
+			fmt.Fprintln(bw, rr.String())
+		}
+		stats.Written = len(entries)
+	case FormatHosts:
+		for _, e := range entries {
+			// Hosts files can express neither exceptions nor CNAMEs
+			if e.Allow {
+				stats.Skipped++
+				continue
+			}
+			ip := "0.0.0.0"
+			if e.Rewrite != "" {
+				addr, err := netip.ParseAddr(e.Rewrite)
+				if err != nil {
+					stats.Skipped++
+					continue
+				}
+				ip = addr.String()
+			}
+			// Nor subdomains, so only the host itself is covered
+			if e.Subdomains {
+				stats.Approximated++
+			}
+			fmt.Fprintf(bw, "%s %s\n", ip, e.Domain)
+			stats.Written++
+		}
+	case FormatDnsmasq:
+		for _, e := range entries {
+			// address= and server= always match subdomains, so exact rules
+			// would cover more than they say. cname= is exact and cannot
+			// cover subdomains.
+			addr, err := netip.ParseAddr(e.Rewrite)
+			isCNAME := e.Rewrite != "" && err != nil
+			if !e.Subdomains && (e.Allow || !isCNAME) {
+				stats.Skipped++
+				continue
+			}
+			switch {
+			case e.Allow:
+				fmt.Fprintf(bw, "server=/%s/#\n", e.Domain)
+			case isCNAME:
+				if e.Subdomains {
+					stats.Approximated++
+				}
+				fmt.Fprintf(bw, "cname=%s,%s\n", e.Domain, strings.TrimSuffix(e.Rewrite, "."))
+			case e.Rewrite != "":
+				fmt.Fprintf(bw, "address=/%s/%s\n", e.Domain, addr)
+			default:
+				fmt.Fprintf(bw, "address=/%s/#\n", e.Domain)
+			}
+			stats.Written++
+		}
+	default:
+		return stats, fmt.Errorf("unsupported format '%s'", format)
+	}
+
+	return stats, bw.Flush()
+}
@@ -0,0 +1,66 @@
+package export
+
+import (
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTTL = 300
+
+// RPZRecords builds the full set of records for a Response Policy Zone,
+// starting with the SOA and NS records required at the apex.
+func RPZRecords(entries []Entry, zone string, serial uint32) []dns.RR {
+	zone = dns.Fqdn(zone)
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: defaultTTL}
+	}
+
+	rrs := []dns.RR{
+		SOA(zone, serial),
+		&dns.NS{Hdr: hdr(zone, dns.TypeNS), Ns: "localhost."},
+	}
+
+	for _, e := range entries {
+		owners := []string{e.Domain + "." + zone}
+		if e.Subdomains {
+			owners = append(owners, "*."+e.Domain+"."+zone)
+		}
+
+		for _, owner := range owners {
+			switch {
+			case e.Allow:
+				rrs = append(rrs, &dns.CNAME{Hdr: hdr(owner, dns.TypeCNAME), Target: "rpz-passthru."})
+			case e.Rewrite != "":
+				if addr, err := netip.ParseAddr(e.Rewrite); err == nil {
+					if addr.Is4() {
+						rrs = append(rrs, &dns.A{Hdr: hdr(owner, dns.TypeA), A: addr.AsSlice()})
+					} else {
+						rrs = append(rrs, &dns.AAAA{Hdr: hdr(owner, dns.TypeAAAA), AAAA: addr.AsSlice()})
+					}
+				} else {
+					rrs = append(rrs, &dns.CNAME{Hdr: hdr(owner, dns.TypeCNAME), Target: dns.Fqdn(e.Rewrite)})
+				}
+			default:
+				// CNAME to the root means NXDOMAIN in RPZ semantics
+				rrs = append(rrs, &dns.CNAME{Hdr: hdr(owner, dns.TypeCNAME), Target: "."})
+			}
+		}
+	}
+
+	return rrs
+}
+
+// SOA returns the apex SOA record for an RPZ zone.
+func SOA(zone string, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: defaultTTL},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  defaultTTL,
+	}
+}
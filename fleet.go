@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"adblocker/config"
+	"adblocker/stats"
+)
+
+// defaultPushInterval is how often instances push statistics to the aggregator.
+const defaultPushInterval = 60 * time.Second
+
+// newStatsFleet wraps the local statistics in a fleet view and, when a push
+// target is configured, starts pushing them there. The pusher is nil otherwise.
+func newStatsFleet(cfg config.StatsFleet, local *stats.Store) (*stats.Fleet, *stats.Pusher) {
+	instance := cfg.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	interval := cfg.PushInterval
+	if interval <= 0 {
+		interval = defaultPushInterval
+	}
+
+	// Instances that miss a few pushes drop out of the totals
+	fleet := stats.NewFleet(local, instance, max(3*interval, 5*time.Minute))
+
+	if cfg.PushURL == "" {
+		return fleet, nil
+	}
+	p := stats.NewPusher(local, instance, cfg.PushURL, cfg.Token, interval)
+	p.Run()
+	log.Printf("[STATS] Pushing statistics as '%s' to %s every %s", instance, cfg.PushURL, interval)
+	return fleet, p
+}
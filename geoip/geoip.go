@@ -0,0 +1,102 @@
+// Package geoip looks up the country and autonomous system of IP addresses
+// in local MaxMind DB files (GeoLite2/GeoIP2 Country or City, and ASN).
+package geoip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+
+	"adblocker/config"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what the databases know about an address. Fields are empty when
+// the address is not found or the database is not configured.
+type Info struct {
+	Country string // ISO 3166-1 alpha-2, e.g. "DE"
+	ASN     uint32
+	ASOrg   string
+}
+
+// DB holds the opened databases.
+type DB struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	Number       uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Open opens the configured databases. Returns nil if none is configured.
+func Open(cfg config.GeoIP) (*DB, error) {
+	if cfg.CountryDB == "" && cfg.ASNDB == "" {
+		return nil, nil
+	}
+
+	d := &DB{}
+	var err error
+	if cfg.CountryDB != "" {
+		if d.country, err = maxminddb.Open(cfg.CountryDB); err != nil {
+			return nil, fmt.Errorf("failed to open country database: %w", err)
+		}
+		log.Printf("[GEOIP] Country database %s (%s, built %d)", cfg.CountryDB, d.country.Metadata.DatabaseType, d.country.Metadata.BuildEpoch)
+	}
+	if cfg.ASNDB != "" {
+		if d.asn, err = maxminddb.Open(cfg.ASNDB); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("failed to open ASN database: %w", err)
+		}
+		log.Printf("[GEOIP] ASN database %s (%s, built %d)", cfg.ASNDB, d.asn.Metadata.DatabaseType, d.asn.Metadata.BuildEpoch)
+	}
+	return d, nil
+}
+
+// Lookup returns what the databases know about ip.
+func (d *DB) Lookup(ip netip.Addr) Info {
+	var info Info
+	addr := net.IP(ip.Unmap().AsSlice())
+	if d.country != nil {
+		var rec countryRecord
+		if err := d.country.Lookup(addr, &rec); err == nil {
+			info.Country = rec.Country.ISOCode
+			if info.Country == "" {
+				info.Country = rec.RegisteredCountry.ISOCode // e.g. anycast ranges
+			}
+		}
+	}
+	if d.asn != nil {
+		var rec asnRecord
+		if err := d.asn.Lookup(addr, &rec); err == nil {
+			info.ASN = rec.Number
+			info.ASOrg = rec.Organization
+		}
+	}
+	return info
+}
+
+// Close releases the databases.
+func (d *DB) Close() {
+	if d == nil {
+		return
+	}
+	if d.country != nil {
+		d.country.Close()
+	}
+	if d.asn != nil {
+		d.asn.Close()
+	}
+}
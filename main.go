@@ -1,28 +1,79 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
+	"adblocker/audit"
 	"adblocker/config"
+	"adblocker/directory"
 	"adblocker/engine"
+	"adblocker/events"
+	"adblocker/geoip"
+	"adblocker/metrics"
 	"adblocker/parser"
+	"adblocker/presence"
+	"adblocker/registry"
 	"adblocker/server"
+	"adblocker/tokens"
 	"adblocker/updater"
+	"adblocker/web"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "profile":
+			runProfile(os.Args[2:])
+			return
+		case "check-config":
+			runCheckConfig(os.Args[2:])
+			return
+		case "migrate-config":
+			runMigrateConfig(os.Args[2:])
+			return
+		case "search":
+			runSearch(os.Args[2:])
+			return
+		case "dump-rules":
+			runDumpRules(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		}
+	}
+
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
 	dataDir := flag.String("data", "data", "Path to data directory for caching")
+	k8s := flag.Bool("k8s", false, "Kubernetes mode: JSON logs to stdout, config watch, health endpoints")
+	watch := flag.Bool("watch", false, "Apply changes to the config file automatically, polling it every 5s (always on with -k8s)")
 	flag.Parse()
 
+	if *k8s {
+		setupLogging("json")
+	}
+
+	startedAt := time.Now()
 	log.Printf("Starting AdBlocker DNS Server...")
 
-	// 1. Load Config
+	// 1. Load Config (list references resolved through the registry)
 	cfgMgr := config.NewManager(*configPath)
+	reg := registry.New(*dataDir)
+	cfgMgr.LoadCallback = reg.Apply
 	if err := cfgMgr.Load(); err != nil {
 		log.Printf("Warning: Failed to load config: %v. Using defaults.", err)
 	} else {
@@ -30,38 +81,195 @@ func main() {
 	}
 
 	cfg := cfgMgr.Get()
+	if !*k8s {
+		setupLogging(cfg.Server.LogFormat)
+	}
+	setMemoryLimit(cfg.Server.MemoryLimit)
 
 	// 2. Initialize Matcher Engine
 	eng, err := engine.NewEngine(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize engine: %v", err)
 	}
+	if err := eng.LoadGuests(filepath.Join(*dataDir, "guests.json")); err != nil {
+		log.Printf("Warning: Failed to restore guests: %v", err)
+	}
+
+	metrics.NewGaugeFunc("adblocker_config_rejected", "Whether the config file was rejected at the last attempt to load it (1), so an older config runs.", func() float64 {
+		if cfgMgr.Status().Error != "" {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGaugeFunc("adblocker_rules_loaded_timestamp_seconds", "Time of the last completed rule reload.", func() float64 {
+		if t := eng.LoadedAt(); !t.IsZero() {
+			return float64(t.Unix())
+		}
+		return 0
+	})
+
+	// Listeners are restarted with backoff instead of taking the process down
+	sv := newSupervisor()
+
+	// 2b. Start Admin Server (health, metrics) early so probes answer while rules load
+	adminAddr := cfg.Server.AdminAddr
+	if adminAddr == "" && *k8s {
+		adminAddr = ":8080"
+	}
+	var admin *web.Server
+	if adminAddr != "" {
+		if *k8s {
+			setInstanceLabels()
+		}
+		admin = web.NewServer(adminAddr)
+		admin.SetReadOnly(func() bool { return eng.Config().Server.ReadOnly })
+		admin.SetTokens(tokens.NewStore(filepath.Join(*dataDir, "tokens.json")))
+		admin.SetParentControl(func() config.ParentControl { return eng.Config().ParentControl })
+		admin.AddReadinessCheck("rules", func() error {
+			if eng.LoadedAt().IsZero() {
+				return errNotLoaded
+			}
+			return nil
+		})
+		admin.RegisterReloadProgress(eng)
+		admin.RegisterConfigStatus(cfgMgr)
+		sv.run("admin", admin.Start)
+	}
 
 	// 3. Load Rules (Initial)
 	loader := parser.NewLoader(*dataDir)
-	eng.ReloadRules(loader)
+	if err := eng.ReloadRules(loader); err != nil {
+		log.Fatalf("Failed to load rules: %v", err)
+	}
+
+	// 3b. Sync Users from external directories (optional)
+	var dirSync *directory.Syncer
+	if len(cfg.UserDirectories) > 0 {
+		dirSync, err = directory.NewSyncer(cfg.UserDirectories, eng)
+		if err != nil {
+			log.Fatalf("Failed to initialize user directories: %v", err)
+		}
+		dirSync.Run()
+	}
 
 	// 4. Start Updater
-	upd := updater.NewUpdater(cfg, eng, loader)
+	upd := updater.NewUpdater(eng, loader)
 	upd.RunSimple()
 
-	// 5. Start DNS Server
-	upstream := cfg.Server.Upstream
-	if upstream == "" {
-		upstream = "8.8.8.8:53"
+	deadCheck := updater.NewDeadRuleChecker(eng)
+	deadCheck.Run()
+	if admin != nil {
+		admin.RegisterDeadRules(deadCheck)
+		admin.RegisterSources(upd)
+		admin.RegisterRuleSearch(eng)
+		admin.RegisterCanaries(eng)
 	}
+
+	// 5. Start DNS Server
 	listen := cfg.Server.ListenAddr
 	if listen == "" {
 		listen = ":53"
 	}
 
-	srv := server.NewServer(listen, upstream, eng)
+	srv := server.NewServer(listen, upstreamAddrs(cfg), eng)
+	sizeCaches(cfg.Server.MemoryLimit, srv)
+	srv.Events, err = events.NewExporter(cfg.EventExport, *dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize event export: %v", err)
+	}
+	srv.GeoIP, err = geoip.Open(cfg.GeoIP)
+	if err != nil {
+		log.Fatalf("Failed to open GeoIP databases: %v", err)
+	}
+	defer srv.GeoIP.Close()
+	fleet, pusher := newStatsFleet(cfg.StatsFleet, srv.Stats)
+	if admin != nil {
+		admin.AddReadinessCheck("dns", srv.Ready)
+		admin.RegisterStats(fleet)
+		if cfg.StatsFleet.Accept {
+			admin.RegisterStatsPush(fleet, cfg.StatsFleet.Token)
+		}
+		admin.RegisterCacheStats(srv.CacheStats)
+		admin.RegisterPrivacyReport(srv.PrivacyReport)
+		admin.RegisterUpstreamLatency(srv.UpstreamLatency)
+		admin.RegisterStandby(srv, func() string { return eng.Config().Server.Standby.Token })
+		admin.RegisterProfiles(eng, srv.UserGroupCache.Flush)
+		auditLog := audit.NewLog(filepath.Join(*dataDir, "audit.log"))
+		admin.RegisterParentOverride(eng, func() config.ParentControl { return eng.Config().ParentControl },
+			auditLog, srv.UserGroupCache.Flush)
+		admin.RegisterGuests(eng, func() config.Guests { return eng.Config().Guests }, auditLog)
+		admin.RegisterStatsReset(srv, auditLog)
+		admin.RegisterTraces(srv)
+		admin.RegisterDashboard(srv, eng)
+	}
+
+	// 5b. Drive presence schedules from ping, MQTT and webhook signals (optional)
+	presenceTracker, err := presence.NewTracker(cfg.Schedules, eng)
+	if err != nil {
+		log.Fatalf("Failed to initialize presence: %v", err)
+	}
+	presenceTracker.OnChange = srv.UserGroupCache.Flush
+	presenceTracker.Run()
+	if admin != nil && presenceTracker.Enabled() {
+		admin.RegisterPresence(presenceTracker)
+	}
+
+	sv.run("dns", srv.Start)
 
-	go func() {
-		if err := srv.Start(); err != nil {
-			log.Fatalf("DNS Server failed: %v", err)
+	// 5c. Encrypted listeners for clients that speak DoT or DoH (optional)
+	if cfg.Server.ListenTLS != "" {
+		sv.run("dot", srv.StartTLS)
+		if admin != nil {
+			admin.AddReadinessCheck("dot", sv.check("dot"))
+		}
+	}
+	if cfg.Server.ListenHTTPS != "" {
+		sv.run("doh", srv.StartHTTPS)
+		if admin != nil {
+			admin.AddReadinessCheck("doh", sv.check("doh"))
+		}
+	}
+	if cfg.Server.ListenHTTP != "" {
+		sv.run("doh_http", srv.StartHTTP)
+		if admin != nil {
+			admin.AddReadinessCheck("doh_http", sv.check("doh_http"))
 		}
-	}()
+	}
+
+	// 6. Start Zone Transfer Server (optional)
+	var xfr *server.ZoneTransferServer
+	if cfg.Server.ZoneTransfer.ListenAddr != "" {
+		xfr, err = server.NewZoneTransferServer(cfg.Server.ZoneTransfer, eng)
+		if err != nil {
+			log.Fatalf("Failed to initialize zone transfer server: %v", err)
+		}
+		sv.run("zone_transfer", xfr.Start)
+		if admin != nil {
+			admin.AddReadinessCheck("zone_transfer", sv.check("zone_transfer"))
+		}
+	}
+
+	// 7. Reload Config when the file changes (edits, Kubernetes ConfigMap updates), on SIGHUP or from the admin API
+	r := &reloader{cfgMgr: cfgMgr, eng: eng, loader: loader, srv: srv}
+	r.watchSignal()
+	reg.SetOnUpdate(func() { r.reload() })
+	if admin != nil {
+		admin.RegisterConfigReload(cfgMgr, r.reload)
+		admin.RegisterConfigEditor(cfgMgr, r.apply)
+		admin.RegisterAllowWizard(eng, cfgMgr, r.apply)
+		admin.RegisterCustomRules(cfgMgr, r.apply)
+	}
+	if *watch || *k8s {
+		stopWatch := cfgMgr.Watch(5*time.Second, func() { r.reload() })
+		defer stopWatch()
+	}
+
+	// 8. Diagnostics dumps for bug reports, on SIGQUIT or from the admin API
+	diag := &diagnostics{dataDir: *dataDir, started: startedAt, cfgMgr: cfgMgr, eng: eng, srv: srv}
+	diag.watchSignal()
+	if admin != nil {
+		admin.RegisterDiagnostics(diag.write)
+	}
 
 	log.Printf("AdBlocker is running on %s", listen)
 
@@ -71,6 +279,48 @@ func main() {
 	s := <-sigChan
 	log.Printf("Received signal %v, shutting down...", s)
 
+	// Graceful termination: fail readiness, let endpoints drain, then stop within the timeout
+	timeout := eng.Config().Server.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if admin != nil {
+		admin.AddReadinessCheck("shutdown", func() error { return errShuttingDown })
+		if *k8s {
+			time.Sleep(min(5*time.Second, timeout/4))
+		}
+	}
+
+	sv.shutdown()
 	upd.Stop()
-	srv.Stop()
+	deadCheck.Stop()
+	if pusher != nil {
+		pusher.Stop()
+	}
+	if dirSync != nil {
+		dirSync.Stop()
+	}
+	presenceTracker.Stop()
+	if err := srv.Stop(ctx); err != nil {
+		log.Printf("DNS Server shutdown: %v", err)
+	}
+	if xfr != nil {
+		xfr.Stop()
+	}
+	srv.Events.Stop()
+	if admin != nil {
+		admin.Stop(ctx)
+	}
+	sv.wait(ctx)
+}
+
+// upstreamAddrs returns the configured upstreams or the default.
+func upstreamAddrs(cfg *config.Config) []string {
+	if len(cfg.Server.Upstream) == 0 {
+		return []string{"8.8.8.8:53"}
+	}
+	return cfg.Server.Upstream
 }
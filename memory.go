@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+
+	"adblocker/config"
+	"adblocker/server"
+)
+
+// Share of memory_limit given to each DNS response cache, and the rough
+// cost of one cached message.
+const (
+	cacheBudgetShare = 0.1
+	cacheEntryBytes  = 1024
+)
+
+// setMemoryLimit sets the Go runtime soft memory limit, the equivalent of
+// GOMEMLIMIT. Rule sets are capped by the engine, which reads the same setting.
+func setMemoryLimit(limit config.ByteSize) {
+	if limit <= 0 {
+		return
+	}
+	debug.SetMemoryLimit(int64(limit))
+	log.Printf("Memory limit set to %s", limit)
+}
+
+// sizeCaches bounds the DNS caches in proportion to the memory limit.
+func sizeCaches(limit config.ByteSize, srv *server.Server) {
+	if limit <= 0 {
+		return
+	}
+	entries := max(1000, int(float64(limit)*cacheBudgetShare)/cacheEntryBytes)
+	srv.UserGroupCache.SetMaxEntries(entries)
+	srv.UpstreamCache.SetMaxEntries(entries)
+	log.Printf("DNS caches limited to %d entries each", entries)
+}
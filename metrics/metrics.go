@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Label is a single metric label pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector renders one metric family in the Prometheus text exposition format.
+// constLabels are the registry-wide labels to attach to every sample.
+type Collector interface {
+	Write(w io.Writer, constLabels []Label)
+}
+
+// Registry holds collectors and serves them over HTTP.
+type Registry struct {
+	mu          sync.RWMutex
+	constLabels []Label
+	collectors  []Collector
+}
+
+// Default is the registry used by the package-level constructors.
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// SetConstLabels sets labels attached to every sample (e.g. pod and namespace).
+func (r *Registry) SetConstLabels(labels map[string]string) {
+	var list []Label
+	for k, v := range labels {
+		if v != "" {
+			list = append(list, Label{Name: k, Value: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	r.mu.Lock()
+	r.constLabels = list
+	r.mu.Unlock()
+}
+
+// Register adds a collector to the registry.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// ServeHTTP renders all collectors.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Render(w)
+}
+
+// Render writes all collectors to w.
+func (r *Registry) Render(w io.Writer) {
+	r.mu.RLock()
+	collectors := append([]Collector{}, r.collectors...)
+	constLabels := r.constLabels
+	r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.Write(bw, constLabels)
+	}
+	bw.Flush()
+}
+
+// GaugeFunc reports the value returned by a function at scrape time.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc creates a GaugeFunc and registers it with the Default registry.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	Default.Register(g)
+	return g
+}
+
+func (g *GaugeFunc) Write(w io.Writer, constLabels []Label) {
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, constLabels, nil, g.fn())
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name string, constLabels, labels []Label, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(constLabels, labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func formatLabels(sets ...[]Label) string {
+	var parts []string
+	for _, set := range sets {
+		for _, l := range set {
+			parts = append(parts, l.Name+`="`+escape(l.Value)+`"`)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefQuantiles are the quantiles reported by summaries unless configured otherwise.
+var DefQuantiles = []float64{0.5, 0.95, 0.99}
+
+// SummaryWindow is the number of recent observations per series that
+// quantiles are computed from, so they follow changes in latency.
+const SummaryWindow = 1024
+
+// SummaryVec is a set of summaries partitioned by label values. Quantiles
+// cover the last SummaryWindow observations; sum and count cover all.
+type SummaryVec struct {
+	name, help string
+	quantiles  []float64
+	series     seriesSet
+
+	mu     sync.Mutex
+	values map[string]*summary
+}
+
+type summary struct {
+	window []float64 // Ring buffer of recent observations
+	next   int
+	sum    float64
+	count  uint64
+}
+
+// NewSummaryVec creates a SummaryVec and registers it with the Default registry.
+func NewSummaryVec(name, help string, quantiles []float64, labelNames ...string) *SummaryVec {
+	s := &SummaryVec{
+		name:      name,
+		help:      help,
+		quantiles: quantiles,
+		series:    seriesSet{labelNames: labelNames, maxSeries: DefaultMaxSeries},
+		values:    make(map[string]*summary),
+	}
+	Default.Register(s)
+	return s
+}
+
+// Observe records a value for the given label values.
+func (s *SummaryVec) Observe(v float64, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := s.series.key(values, func(k string) bool { _, ok := s.values[k]; return ok }, len(s.values))
+	sum := s.values[k]
+	if sum == nil {
+		sum = &summary{}
+		s.values[k] = sum
+	}
+	if len(sum.window) < SummaryWindow {
+		sum.window = append(sum.window, v)
+	} else {
+		sum.window[sum.next] = v
+		sum.next = (sum.next + 1) % SummaryWindow
+	}
+	sum.sum += v
+	sum.count++
+}
+
+// Quantiles returns the configured quantiles of the series in order, or
+// nil when it has no observations.
+func (s *SummaryVec) Quantiles(values ...string) []float64 {
+	s.mu.Lock()
+	k := s.series.key(values, func(k string) bool { _, ok := s.values[k]; return ok }, len(s.values))
+	sum := s.values[k]
+	var sorted []float64
+	if sum != nil {
+		sorted = slices.Clone(sum.window)
+	}
+	s.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.Float64s(sorted)
+	out := make([]float64, len(s.quantiles))
+	for i, q := range s.quantiles {
+		out[i] = quantile(sorted, q)
+	}
+	return out
+}
+
+func (s *SummaryVec) Write(w io.Writer, constLabels []Label) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	snapshot := make([]summary, len(keys))
+	for i, k := range keys {
+		v := s.values[k]
+		snapshot[i] = summary{window: slices.Clone(v.window), sum: v.sum, count: v.count}
+	}
+	s.mu.Unlock()
+
+	writeHeader(w, s.name, s.help, "summary")
+	for i, k := range keys {
+		labels := s.series.labels(k)
+		sum := snapshot[i]
+		sort.Float64s(sum.window)
+		for _, q := range s.quantiles {
+			ql := Label{Name: "quantile", Value: strconv.FormatFloat(q, 'g', -1, 64)}
+			writeSample(w, s.name, constLabels, append(labels[:len(labels):len(labels)], ql), quantile(sum.window, q))
+		}
+		writeSample(w, s.name+"_sum", constLabels, labels, sum.sum)
+		writeSample(w, s.name+"_count", constLabels, labels, float64(sum.count))
+	}
+}
+
+// quantile returns the q-quantile of sorted values (nearest rank), NaN if empty.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	if q < 0 || q > 1 {
+		panic(fmt.Sprintf("metrics: quantile %g out of range", q))
+	}
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OverflowValue replaces label values once a vector reaches its series limit.
+const OverflowValue = "_other"
+
+// DefaultMaxSeries bounds the number of label combinations per vector.
+const DefaultMaxSeries = 1000
+
+// DefBuckets are latency buckets (seconds) suited to DNS resolution.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// seriesSet tracks label combinations and enforces the cardinality limit.
+type seriesSet struct {
+	labelNames []string
+	maxSeries  int
+}
+
+// key returns the series key for values, collapsing to OverflowValue when the limit is hit.
+func (s *seriesSet) key(values []string, exists func(string) bool, count int) string {
+	if len(values) != len(s.labelNames) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(s.labelNames), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if exists(k) || count < s.maxSeries {
+		return k
+	}
+	overflow := make([]string, len(values))
+	for i := range overflow {
+		overflow[i] = OverflowValue
+	}
+	return strings.Join(overflow, "\xff")
+}
+
+func (s *seriesSet) labels(key string) []Label {
+	values := strings.Split(key, "\xff")
+	labels := make([]Label, len(s.labelNames))
+	for i, name := range s.labelNames {
+		labels[i] = Label{Name: name, Value: values[i]}
+	}
+	return labels
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	name, help string
+	series     seriesSet
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates a CounterVec and registers it with the Default registry.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		series: seriesSet{labelNames: labelNames, maxSeries: DefaultMaxSeries},
+		values: make(map[string]float64),
+	}
+	Default.Register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta to the counter for the given label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.series.key(values, func(k string) bool { _, ok := c.values[k]; return ok }, len(c.values))
+	c.values[k] += delta
+}
+
+// Reset drops all series.
+func (c *CounterVec) Reset() {
+	c.mu.Lock()
+	c.values = make(map[string]float64)
+	c.mu.Unlock()
+}
+
+// DeleteMatching drops the series whose label has the value and returns how many were dropped.
+func (c *CounterVec) DeleteMatching(label, value string) int {
+	i := slices.Index(c.series.labelNames, label)
+	if i < 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.values {
+		if strings.Split(k, "\xff")[i] == value {
+			delete(c.values, k)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *CounterVec) Write(w io.Writer, constLabels []Label) {
+	c.mu.Lock()
+	keys, snapshot := sortedValues(c.values)
+	c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for i, k := range keys {
+		writeSample(w, c.name, constLabels, c.series.labels(k), snapshot[i])
+	}
+}
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct {
+	name, help string
+	series     seriesSet
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGaugeVec creates a GaugeVec and registers it with the Default registry.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:   name,
+		help:   help,
+		series: seriesSet{labelNames: labelNames, maxSeries: DefaultMaxSeries},
+		values: make(map[string]float64),
+	}
+	Default.Register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	k := g.series.key(values, func(k string) bool { _, ok := g.values[k]; return ok }, len(g.values))
+	g.values[k] = v
+}
+
+func (g *GaugeVec) Write(w io.Writer, constLabels []Label) {
+	g.mu.Lock()
+	keys, snapshot := sortedValues(g.values)
+	g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for i, k := range keys {
+		writeSample(w, g.name, constLabels, g.series.labels(k), snapshot[i])
+	}
+}
+
+// VecFunc is a single-label family whose values are read from a function at
+// scrape time, for state that is already counted elsewhere.
+type VecFunc struct {
+	name, help, typ string
+	labelName       string
+	fn              func() map[string]float64
+}
+
+// NewCounterVecFunc creates a counter VecFunc and registers it with the Default registry.
+func NewCounterVecFunc(name, help, labelName string, fn func() map[string]float64) *VecFunc {
+	v := &VecFunc{name: name, help: help, typ: "counter", labelName: labelName, fn: fn}
+	Default.Register(v)
+	return v
+}
+
+// NewGaugeVecFunc creates a gauge VecFunc and registers it with the Default registry.
+func NewGaugeVecFunc(name, help, labelName string, fn func() map[string]float64) *VecFunc {
+	v := &VecFunc{name: name, help: help, typ: "gauge", labelName: labelName, fn: fn}
+	Default.Register(v)
+	return v
+}
+
+func (v *VecFunc) Write(w io.Writer, constLabels []Label) {
+	keys, snapshot := sortedValues(v.fn())
+
+	writeHeader(w, v.name, v.help, v.typ)
+	for i, k := range keys {
+		writeSample(w, v.name, constLabels, []Label{{Name: v.labelName, Value: k}}, snapshot[i])
+	}
+}
+
+// sortedValues returns the series keys in order with their values. Caller holds the lock.
+func sortedValues(values map[string]float64) ([]string, []float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	snapshot := make([]float64, len(keys))
+	for i, k := range keys {
+		snapshot[i] = values[k]
+	}
+	return keys, snapshot
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	name, help string
+	buckets    []float64
+	series     seriesSet
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, non-cumulative; last entry is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates a HistogramVec and registers it with the Default registry.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		series:  seriesSet{labelNames: labelNames, maxSeries: DefaultMaxSeries},
+		values:  make(map[string]*histogram),
+	}
+	Default.Register(h)
+	return h
+}
+
+// Observe records a value for the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.series.key(values, func(k string) bool { _, ok := h.values[k]; return ok }, len(h.values))
+	hist := h.values[k]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[k] = hist
+	}
+
+	idx := sort.SearchFloat64s(h.buckets, v)
+	hist.counts[idx]++
+	hist.sum += v
+	hist.count++
+}
+
+// Reset drops all series.
+func (h *HistogramVec) Reset() {
+	h.mu.Lock()
+	h.values = make(map[string]*histogram)
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) Write(w io.Writer, constLabels []Label) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, k := range keys {
+		hist := h.values[k]
+		labels := h.series.labels(k)
+
+		var cumulative uint64
+		bounds := append(append([]float64{}, h.buckets...), math.Inf(1))
+		for i, upper := range bounds {
+			cumulative += hist.counts[i]
+			le := Label{Name: "le", Value: formatBound(upper)}
+			writeSample(w, h.name+"_bucket", constLabels, append(labels[:len(labels):len(labels)], le), float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", constLabels, labels, hist.sum)
+		writeSample(w, h.name+"_count", constLabels, labels, float64(hist.count))
+	}
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(v)
+}
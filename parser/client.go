@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ClientRef is one entry of a $client value.
+//
+// AdGuard grammar: entries are separated by '|', may be prefixed with '~' to
+// exclude, and names containing special characters are quoted ('Frank\'s
+// laptop') or escaped (Mary\, John). IP entries may carry an IPv6 zone
+// (fe80::1%eth0) or be CIDR ranges.
+type ClientRef struct {
+	Name    string       // Unquoted client name (also set for IPs and CIDRs)
+	Addr    netip.Addr   // Set when the entry is an IP address
+	Prefix  netip.Prefix // Set when the entry is a CIDR range
+	Exclude bool         // Entry starts with ~
+}
+
+// Matches reports whether the entry refers to the client.
+// A zone on the entry must match the client's zone; an entry without one
+// matches the address on any interface.
+func (c ClientRef) Matches(name string, ip netip.Addr) bool {
+	switch {
+	case c.Prefix.IsValid():
+		return c.Prefix.Contains(ip.WithZone("").Unmap())
+	case c.Addr.IsValid():
+		if c.Addr.Zone() != "" && c.Addr.Zone() != ip.Zone() {
+			return false
+		}
+		return c.Addr.WithZone("").Unmap() == ip.WithZone("").Unmap()
+	default:
+		return name != "" && c.Name == name
+	}
+}
+
+// MatchClients applies a $client list: exclusions win, and when the list
+// has inclusions the client must match one of them (~Mom|~Dad|Kids applies
+// to Kids only; ~Mom|~Dad applies to everyone but Mom and Dad).
+func MatchClients(refs []ClientRef, name string, ip netip.Addr) bool {
+	hasInclusions := false
+	included := false
+	for _, c := range refs {
+		if c.Exclude {
+			if c.Matches(name, ip) {
+				return false
+			}
+			continue
+		}
+		hasInclusions = true
+		if !included && c.Matches(name, ip) {
+			included = true
+		}
+	}
+	return !hasInclusions || included
+}
+
+// QuoteClient formats name as a $client entry: IP addresses and CIDR ranges
+// as they are, anything else quoted so it is always taken as a name.
+func QuoteClient(name string) string {
+	if _, err := netip.ParseAddr(name); err == nil {
+		return name
+	}
+	if _, err := netip.ParsePrefix(name); err == nil {
+		return name
+	}
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + r.Replace(name) + "'"
+}
+
+// parseClientList parses a $client value. It returns the entries parsed
+// before the first error so the lenient parser can still use them.
+func parseClientList(val string) ([]ClientRef, error) {
+	var refs []ClientRef
+	rest := val
+	for {
+		ref, next, err := parseClientRef(rest)
+		if err != nil {
+			return refs, fmt.Errorf("$client: %w", err)
+		}
+		refs = append(refs, ref)
+		if next == "" {
+			return refs, nil
+		}
+		rest = next[1:] // Skip the '|'
+	}
+}
+
+// parseClientRef parses one entry from s and returns the remainder, which is
+// empty or starts with the separating '|'.
+func parseClientRef(s string) (ClientRef, string, error) {
+	var ref ClientRef
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, "~") {
+		ref.Exclude = true
+		s = strings.TrimLeft(s[1:], " ")
+	}
+
+	var b strings.Builder
+	quoted := len(s) > 0 && (s[0] == '\'' || s[0] == '"')
+	if quoted {
+		quote := s[0]
+		i := 1
+		for ; i < len(s) && s[i] != quote; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return ref, "", fmt.Errorf("unterminated quote in '%s'", s)
+		}
+		s = strings.TrimLeft(s[i+1:], " ")
+		if s != "" && s[0] != '|' {
+			return ref, "", fmt.Errorf("unexpected '%s' after quoted name", s)
+		}
+	} else {
+		i := 0
+		for ; i < len(s) && s[i] != '|'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		s = s[i:]
+	}
+
+	ref.Name = b.String()
+	if !quoted {
+		ref.Name = strings.TrimSpace(ref.Name)
+	}
+	if ref.Name == "" {
+		return ref, "", fmt.Errorf("empty value")
+	}
+
+	// Quoted entries are always names
+	if !quoted {
+		addr := strings.TrimSuffix(strings.TrimPrefix(ref.Name, "["), "]")
+		if ip, err := netip.ParseAddr(addr); err == nil {
+			ref.Addr = ip
+		} else if prefix, err := netip.ParsePrefix(addr); err == nil {
+			ref.Prefix = prefix.Masked()
+		}
+	}
+	return ref, s, nil
+}
+
+// splitModifiers splits a modifier list on commas that are neither escaped
+// nor inside a quoted $client name. Escapes are kept for the value parsers.
+func splitModifiers(raw string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			// Quotes only open at the start of a value or list entry
+			if i > 0 && strings.ContainsRune("=|~", rune(raw[i-1])) {
+				quote = c
+			}
+		case c == ',':
+			parts = append(parts, raw[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, raw[start:])
+}
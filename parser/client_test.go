@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseClientList(t *testing.T) {
+	zoned := netip.MustParseAddr("fe80::1%eth0")
+	tests := []struct {
+		val     string
+		want    []ClientRef
+		wantErr bool
+	}{
+		{val: "Frank", want: []ClientRef{{Name: "Frank"}}},
+		{val: `'Frank\'s laptop'`, want: []ClientRef{{Name: "Frank's laptop"}}},
+		{val: `"Mom|Dad"`, want: []ClientRef{{Name: "Mom|Dad"}}},
+		{val: `Mary\, John`, want: []ClientRef{{Name: "Mary, John"}}},
+		{val: `'1.2.3.4'`, want: []ClientRef{{Name: "1.2.3.4"}}}, // Quoted, so a name
+
+		// Addresses, with IPv6 zones, and ranges
+		{val: "192.168.1.5", want: []ClientRef{{Name: "192.168.1.5", Addr: netip.MustParseAddr("192.168.1.5")}}},
+		{val: "fe80::1%eth0", want: []ClientRef{{Name: "fe80::1%eth0", Addr: zoned}}},
+		{val: "[fe80::1%eth0]", want: []ClientRef{{Name: "[fe80::1%eth0]", Addr: zoned}}},
+		{val: "192.168.1.77/24", want: []ClientRef{{Name: "192.168.1.77/24", Prefix: netip.MustParsePrefix("192.168.1.0/24")}}},
+
+		// Mixed lists
+		{val: `~'Kid, 1'|192.168.1.5|~fe80::1%eth0`, want: []ClientRef{
+			{Name: "Kid, 1", Exclude: true},
+			{Name: "192.168.1.5", Addr: netip.MustParseAddr("192.168.1.5")},
+			{Name: "fe80::1%eth0", Addr: zoned, Exclude: true},
+		}},
+		{val: ` ~ Mom | Dad `, want: []ClientRef{{Name: "Mom", Exclude: true}, {Name: "Dad"}}},
+
+		{val: "", wantErr: true},
+		{val: "Mom||Dad", wantErr: true},
+		{val: `'open`, wantErr: true},
+		{val: `'Mom' Dad`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClientList(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClientList(%q) error = %v, wantErr %v", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseClientList(%q) = %+v, want %+v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestMatchClients(t *testing.T) {
+	tests := []struct {
+		val  string
+		name string
+		ip   string
+		want bool
+	}{
+		// Exclusions win; with inclusions the client must be one of them
+		{"~Mom|~Dad|Kids", "Kids", "10.0.0.1", true},
+		{"~Mom|~Dad|Kids", "Mom", "10.0.0.1", false},
+		{"~Mom|~Dad|Kids", "Guest", "10.0.0.1", false},
+		{"~Mom|~Dad", "Guest", "10.0.0.1", true},
+		{"~Mom|~Dad", "Dad", "10.0.0.1", false},
+		{"~192.168.1.5|192.168.1.0/24", "", "192.168.1.5", false},
+		{"~192.168.1.5|192.168.1.0/24", "", "192.168.1.6", true},
+		{"~192.168.1.5|192.168.1.0/24", "", "10.0.0.1", false},
+		{"Kids|~Kids", "Kids", "10.0.0.1", false},
+
+		// A zone on the entry must match; without one any interface does
+		{"fe80::1%eth0", "", "fe80::1%eth0", true},
+		{"fe80::1%eth0", "", "fe80::1%wlan0", false},
+		{"fe80::1", "", "fe80::1%wlan0", true},
+		{"fe80::/64", "", "fe80::1%wlan0", true},
+
+		// IPv4 clients of dual-stack listeners
+		{"192.168.1.5", "", "::ffff:192.168.1.5", true},
+		{"'192.168.1.5'", "", "192.168.1.5", false},
+	}
+	for _, tt := range tests {
+		refs, err := parseClientList(tt.val)
+		if err != nil {
+			t.Fatalf("parseClientList(%q): %v", tt.val, err)
+		}
+		if got := MatchClients(refs, tt.name, netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("MatchClients(%q, %q, %s) = %v, want %v", tt.val, tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleClient(t *testing.T) {
+	rule, err := ParseRuleStrict(`||example.com^$client='Frank\'s, laptop'|~"Mom|Dad",important`)
+	if err != nil {
+		t.Fatalf("ParseRuleStrict: %v", err)
+	}
+	want := []ClientRef{{Name: "Frank's, laptop"}, {Name: "Mom|Dad", Exclude: true}}
+	if !reflect.DeepEqual(rule.Modifiers.Clients, want) || !rule.Modifiers.Important {
+		t.Errorf("clients = %+v, important = %v; want %+v and true", rule.Modifiers.Clients, rule.Modifiers.Important, want)
+	}
+}
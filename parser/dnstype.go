@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseDNSTypes parses a $dnstype value into record types. Entries are
+// names (AAAA), RFC 3597 names (TYPE65) or plain numbers (65), and are
+// either all inclusions (A|AAAA) or all exclusions (~A|~AAAA).
+func parseDNSTypes(val string) ([]uint16, bool, error) {
+	var types []uint16
+	values := strings.Split(val, "|")
+	exclude := strings.HasPrefix(strings.TrimSpace(values[0]), "~")
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, "~") != exclude {
+			return nil, false, fmt.Errorf("$dnstype mixes inclusions and exclusions: '%s'", val)
+		}
+		t, err := parseDNSType(strings.TrimPrefix(v, "~"))
+		if err != nil {
+			return nil, false, fmt.Errorf("$dnstype: %w", err)
+		}
+		types = append(types, t)
+	}
+	return types, exclude, nil
+}
+
+// parseDNSType resolves a single record type name or number.
+func parseDNSType(s string) (uint16, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty record type")
+	}
+	upper := strings.ToUpper(s)
+	if t, ok := dns.StringToType[upper]; ok {
+		return t, nil
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(upper, "TYPE"), 10, 16); err == nil && n > 0 {
+		return uint16(n), nil
+	}
+	return 0, fmt.Errorf("unknown record type '%s'", s)
+}
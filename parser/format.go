@@ -0,0 +1,286 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Format names the syntax of a rule list. The loader parses every line of a
+// source in its format instead of guessing per line.
+type Format string
+
+const (
+	// FormatAuto guesses per line: AdGuard syntax, hosts lines, and bare
+	// domains as exact matches.
+	FormatAuto    Format = ""
+	FormatAdGuard Format = "adguard" // Same as FormatAuto
+	// FormatHosts expects "IP name [name...]"; every name is an exact match,
+	// unspecified and loopback IPs block, other IPs rewrite.
+	FormatHosts Format = "hosts"
+	// FormatDomains expects one domain per line and blocks it with all its
+	// subdomains, which is what plain domain lists intend.
+	FormatDomains Format = "domains"
+	// FormatRPZ expects RPZ zone records: "name CNAME ." blocks,
+	// "*.name CNAME ." blocks subdomains, "CNAME rpz-passthru." allows and
+	// A/AAAA/CNAME targets rewrite. Names are relative to $ORIGIN.
+	FormatRPZ Format = "rpz"
+	// FormatDnsmasq expects address=/domain/[ip] and server=/domain/ lines,
+	// which apply to the domains and their subdomains.
+	FormatDnsmasq Format = "dnsmasq"
+	// FormatRegex expects one regular expression per line, without slashes.
+	FormatRegex Format = "regex"
+)
+
+// ParseFormat validates a format name from the configuration.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatAuto, FormatAdGuard, FormatHosts, FormatDomains, FormatRPZ, FormatDnsmasq, FormatRegex:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format '%s' (want adguard, hosts, domains, rpz, dnsmasq or regex)", name)
+}
+
+// lineParser parses the lines of one source. Formats with state across lines
+// (the RPZ $ORIGIN) keep it here.
+type lineParser struct {
+	format Format
+	strict bool
+	origin string // RPZ only
+}
+
+func newLineParser(format Format, strict bool) *lineParser {
+	return &lineParser{format: format, strict: strict}
+}
+
+// parse returns the rules of one line; comments and empty lines give none.
+func (p *lineParser) parse(line string) ([]*Rule, error) {
+	switch p.format {
+	case FormatHosts:
+		return p.parseHosts(line)
+	case FormatDomains:
+		return p.parseDomain(line)
+	case FormatRPZ:
+		return p.parseRPZ(line)
+	case FormatDnsmasq:
+		return p.parseDnsmasq(line)
+	case FormatRegex:
+		return p.parseRegex(line)
+	}
+	rule, err := parseRule(line, p.strict)
+	if rule == nil {
+		return nil, err
+	}
+	return []*Rule{rule}, nil
+}
+
+// rule parses the AdGuard rule equivalent to a line of another format.
+func (p *lineParser) rule(text string) (*Rule, error) {
+	rule, err := parseRule(text, p.strict)
+	if err == nil && rule == nil {
+		err = fmt.Errorf("empty rule")
+	}
+	return rule, err
+}
+
+// stripComment removes a trailing comment started by any of marks.
+func stripComment(line string, marks string) string {
+	if i := strings.IndexAny(line, marks); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func (p *lineParser) parseHosts(line string) ([]*Rule, error) {
+	fields := strings.Fields(stripComment(line, "#"))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	ip, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("hosts line must start with an IP address")
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("hosts line has no hostname")
+	}
+
+	var rules []*Rule
+	for _, name := range fields[1:] {
+		rule, err := p.rule(ip.String() + " " + name)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (p *lineParser) parseDomain(line string) ([]*Rule, error) {
+	line = stripComment(line, "#!")
+	if line == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(line, " \t/$^|") {
+		return nil, fmt.Errorf("not a domain")
+	}
+	rule, err := p.rule("||" + strings.TrimPrefix(line, "*.") + "^")
+	if err != nil {
+		return nil, err
+	}
+	return []*Rule{rule}, nil
+}
+
+func (p *lineParser) parseRegex(line string) ([]*Rule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule, err := p.rule("/" + line + "/")
+	if err != nil {
+		return nil, err
+	}
+	return []*Rule{rule}, nil
+}
+
+func (p *lineParser) parseDnsmasq(line string) ([]*Rule, error) {
+	line = stripComment(line, "#")
+	if line == "" {
+		return nil, nil
+	}
+	key, val, ok := strings.Cut(line, "=")
+	if !ok {
+		return nil, fmt.Errorf("expected key=value")
+	}
+	switch key {
+	case "address", "server", "local":
+	default:
+		return nil, fmt.Errorf("unsupported dnsmasq option '%s'", key)
+	}
+
+	// /domain[/domain...]/[value]
+	parts := strings.Split(val, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, fmt.Errorf("expected %s=/domain/", key)
+	}
+	domains, value := parts[1:len(parts)-1], parts[len(parts)-1]
+
+	suffix := "^"
+	if key == "address" && value != "" {
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address '%s'", value)
+		}
+		if !ip.IsUnspecified() && !ip.IsLoopback() {
+			suffix = "^$dnsrewrite=" + ip.String()
+		}
+	} else if key == "server" && value != "" {
+		// server=/domain/1.2.3.4 forwards instead of blocking
+		return nil, fmt.Errorf("forwarding to '%s' is not supported", value)
+	}
+
+	var rules []*Rule
+	for _, d := range domains {
+		if d == "" {
+			continue
+		}
+		rule, err := p.rule("||" + d + suffix)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (p *lineParser) parseRPZ(line string) ([]*Rule, error) {
+	// Indented lines continue the previous owner, which is the apex in practice (SOA, NS)
+	indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+	line = stripComment(line, ";")
+	if line == "" {
+		return nil, nil
+	}
+	fields := strings.Fields(line)
+	if strings.HasPrefix(fields[0], "$") {
+		if strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1 {
+			p.origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		}
+		return nil, nil // $TTL and others do not affect rules
+	}
+	if indented || fields[0] == "@" {
+		return nil, nil // Zone apex records
+	}
+
+	// owner [ttl] [class] type rdata
+	owner := strings.ToLower(fields[0])
+	i := 1
+	for i < len(fields)-2 {
+		if f := strings.ToUpper(fields[i]); f == "IN" || strings.Trim(f, "0123456789") == "" {
+			i++
+			continue
+		}
+		break
+	}
+	if i+1 >= len(fields) {
+		return nil, fmt.Errorf("incomplete record")
+	}
+	rrtype, target := strings.ToUpper(fields[i]), fields[i+1]
+
+	switch rrtype {
+	case "SOA", "NS":
+		return nil, nil
+	}
+
+	// Owner names are relative to the origin unless absolute
+	if strings.HasSuffix(owner, ".") {
+		owner = strings.TrimSuffix(owner, ".")
+		if p.origin != "" && owner != p.origin {
+			trimmed, ok := strings.CutSuffix(owner, "."+p.origin)
+			if !ok {
+				return nil, fmt.Errorf("'%s' is outside the zone '%s'", owner, p.origin)
+			}
+			owner = trimmed
+		}
+	}
+
+	pattern := owner
+	wildcard := strings.HasPrefix(pattern, "*.")
+	if wildcard {
+		pattern = pattern[2:]
+	}
+
+	var modifier string
+	whitelist := false
+	switch rrtype {
+	case "CNAME":
+		switch target {
+		case ".", "*.":
+			// NXDOMAIN / NODATA
+		case "rpz-passthru.":
+			whitelist = true
+		case "rpz-drop.", "rpz-tcp-only.":
+			// Closest equivalent is a block
+		default:
+			modifier = "$dnsrewrite=" + strings.TrimSuffix(target, ".")
+		}
+	case "A", "AAAA":
+		modifier = "$dnsrewrite=" + target
+	default:
+		return nil, fmt.Errorf("unsupported RPZ record type %s", rrtype)
+	}
+
+	// "name" alone is exact, "*.name" covers the subdomains; a zone usually
+	// lists both, which together match ||name^
+	text := pattern
+	if wildcard {
+		text = "*." + pattern
+	}
+	text += modifier
+	if whitelist {
+		text = "@@" + text
+	}
+	rule, err := p.rule(text)
+	if err != nil {
+		return nil, err
+	}
+	return []*Rule{rule}, nil
+}
@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// staleTempAge is how old a leftover download must be before it is removed,
+// so a download in progress is never touched.
+const staleTempAge = time.Hour
+
+// cacheFileRe matches the files LoadFromMirrors writes: "<key>.rules.txt",
+// "<key>.meta.json" and temporary "<key>.<random>.tmp".
+var cacheFileRe = regexp.MustCompile(`^([0-9a-f]{16})\.(rules\.txt|meta\.json|[0-9]+\.tmp)$`)
+
+// PruneStats reports what PruneCache removed.
+type PruneStats struct {
+	Unused  int   // Lists of URLs no longer configured
+	Evicted int   // Lists removed to fit the size cap, oldest first
+	Temp    int   // Leftovers of interrupted downloads
+	Freed   int64 // Bytes removed
+	Size    int64 // Bytes of cached lists left
+}
+
+type cacheEntry struct {
+	key     string
+	files   []string
+	size    int64
+	fetched time.Time
+}
+
+// PruneCache removes the cached lists in the data dir that are not the
+// cache of one of the keep URLs (first URL of a source, see
+// LoadFromMirrors), unless keepUnused is set, and leftovers of interrupted
+// downloads. When maxSize > 0 it then evicts the oldest lists until the
+// rest fits; they are downloaded again on the next reload.
+func (l *Loader) PruneCache(keep []string, keepUnused bool, maxSize int64) (PruneStats, error) {
+	var st PruneStats
+	dirEntries, err := os.ReadDir(l.DataDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return st, err
+	}
+
+	wanted := make(map[string]bool, len(keep))
+	for _, url := range keep {
+		wanted[urlToCacheKey(url)] = true
+	}
+
+	var errs []error
+	remove := func(name string, size int64) {
+		if err := os.Remove(filepath.Join(l.DataDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			return
+		}
+		st.Freed += size
+	}
+
+	// 1. Group the files by cache key, dropping stale temporary files
+	byKey := make(map[string]*cacheEntry)
+	for _, de := range dirEntries {
+		m := cacheFileRe.FindStringSubmatch(de.Name())
+		if m == nil || !de.Type().IsRegular() {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		if m[2] != "rules.txt" && m[2] != "meta.json" {
+			if time.Since(info.ModTime()) > staleTempAge {
+				remove(de.Name(), info.Size())
+				st.Temp++
+			}
+			continue
+		}
+		e := byKey[m[1]]
+		if e == nil {
+			e = &cacheEntry{key: m[1]}
+			byKey[m[1]] = e
+		}
+		e.files = append(e.files, de.Name())
+		e.size += info.Size()
+		if m[2] == "rules.txt" {
+			e.fetched = info.ModTime()
+		}
+	}
+
+	// 2. Unused lists
+	var kept []*cacheEntry
+	for _, e := range byKey {
+		if wanted[e.key] || keepUnused {
+			kept = append(kept, e)
+			st.Size += e.size
+			continue
+		}
+		for _, name := range e.files {
+			remove(name, 0)
+		}
+		st.Freed += e.size
+		st.Unused++
+	}
+
+	// 3. Oldest lists beyond the size cap
+	if maxSize > 0 && st.Size > maxSize {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].fetched.Before(kept[j].fetched) })
+		for _, e := range kept {
+			if st.Size <= maxSize {
+				break
+			}
+			for _, name := range e.files {
+				remove(name, 0)
+			}
+			st.Freed += e.size
+			st.Size -= e.size
+			st.Evicted++
+		}
+	}
+
+	if len(errs) > 0 {
+		return st, fmt.Errorf("failed to prune list cache: %w", errors.Join(errs...))
+	}
+	return st, nil
+}
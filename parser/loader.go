@@ -5,26 +5,53 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 // CacheEntry stores cached URL data with timestamp.
 type CacheEntry struct {
 	FetchedAt time.Time `json:"fetched_at"`
-	RulesFile string    `json:"rules_file"` // Relative filename for rules data
+	RulesFile string    `json:"rules_file"`         // Relative filename for rules data
+	SHA256    string    `json:"sha256,omitempty"`   // Hex hash of the rules file, the list as downloaded
+	Mirror    string    `json:"mirror,omitempty"`   // URL the rules were downloaded from, when the source has mirrors
+	Verified  string    `json:"verified,omitempty"` // Checks the download passed, e.g. "minisign"
 }
 
+// maxLineSize bounds a single line of a rule list.
+const maxLineSize = 1024 * 1024
+
 // Loader handles fetching and parsing rules from various sources.
 type Loader struct {
 	Client  *http.Client
 	DataDir string // Directory for caching URL data
+	Strict  bool   // Reject ambiguous rules, see ParseRuleStrict
+	Format  Format // Syntax of the lists loaded, see Format
+
+	// Stop with ErrTooManyRules once a list yields more rules, 0 is unlimited
+	MaxRules int
+
+	// Called with the number of rule lines of a list before it is parsed;
+	// returning false skips the list with ErrOverBudget. See WithAdmit
+	Admit func(lines int) bool
+
+	// Checks a downloaded list must pass before it is accepted, see WithVerify
+	Verify Verify
 }
 
+// ErrTooManyRules is returned when a list exceeds Loader.MaxRules.
+var ErrTooManyRules = errors.New("too many rules")
+
+// ErrOverBudget is returned when Loader.Admit refuses a list.
+var ErrOverBudget = errors.New("memory budget exhausted")
+
 // NewLoader creates a new Loader with a default HTTP client.
 func NewLoader(dataDir string) *Loader {
 	return &Loader{
@@ -35,93 +62,415 @@ func NewLoader(dataDir string) *Loader {
 	}
 }
 
+// Origins reported in LoadStats
+const (
+	OriginFile     = "file"     // Local file source
+	OriginCache    = "cache"    // URL source served from the data dir cache
+	OriginDownload = "download" // URL source fetched from the network
+	OriginConfig   = "config"   // Rules written inline in the config file
+)
+
+// LoadStats describes how a source was loaded.
+type LoadStats struct {
+	Origin     string    // One of the Origin constants
+	Rejected   int       // Lines that failed to parse
+	Mirror     string    // URL that served the rules of a URL source
+	FetchedAt  time.Time // When a URL source was downloaded, or the modification time of a file
+	HTTPStatus int       // Status of the download, 0 when served from the cache
+	Bytes      int64     // Size of the list
+}
+
+// Mirror orders for LoadFromMirrors
+const (
+	MirrorsInOrder   = "order"   // As listed
+	MirrorsByLatency = "latency" // Fastest to answer a HEAD request first
+)
+
 // LoadFromPath reads rules from a local file.
 func (l *Loader) LoadFromPath(path string) ([]*Rule, error) {
+	rules, _, err := l.LoadFromPathStats(path)
+	return rules, err
+}
+
+// LoadFromURLWithCache loads rules from url, preferring a verified cached copy.
+func (l *Loader) LoadFromURLWithCache(url string) ([]*Rule, error) {
+	rules, _, err := l.LoadFromURLStats(url)
+	return rules, err
+}
+
+// LoadFromPathStats reads rules from a local file and reports load statistics.
+func (l *Loader) LoadFromPathStats(path string) ([]*Rule, LoadStats, error) {
+	stats := LoadStats{Origin: OriginFile}
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, stats, err
 	}
 	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		stats.FetchedAt, stats.Bytes = info.ModTime(), info.Size()
+	}
 
-	var rules []*Rule
+	n, err := l.countRuleLines(f)
+	if err != nil {
+		return nil, stats, err
+	}
+	rules, rejected, err := l.parse(path, f, n)
+	stats.Rejected = rejected
+	return rules, stats, err
+}
+
+// countRuleLines counts the rule lines of f for Admit, so a list over the
+// budget is never parsed, and rewinds f. Without Admit it returns 0.
+func (l *Loader) countRuleLines(f *os.File) (int, error) {
+	if l.Admit == nil {
+		return 0, nil
+	}
+	n := 0
 	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
 	for scanner.Scan() {
-		if rule, err := ParseRule(scanner.Text()); err == nil && rule != nil {
-			rules = append(rules, rule)
+		if isRuleLine(scanner.Text()) {
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return n, err
+}
+
+// parse reads the rules of the list name from r once Admit accepts its n
+// rule lines.
+func (l *Loader) parse(name string, r io.Reader, n int) ([]*Rule, int, error) {
+	if l.Admit != nil && !l.Admit(n) {
+		return nil, 0, fmt.Errorf("%w: about %d rules", ErrOverBudget, n)
+	}
+
+	var rules []*Rule
+	lines := newLineParser(l.Format, l.Strict)
+	rejects := newRejectLog(name)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		rules = append(rules, l.parseLine(lines, scanner.Text(), rejects)...)
+		if err := l.checkMaxRules(len(rules)); err != nil {
+			return nil, rejects.count, err
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, rejects.count, err
 	}
-	return rules, nil
+	rejects.summarize()
+	return rules, rejects.count, nil
 }
 
-func (l *Loader) LoadFromURLWithCache(url string) ([]*Rule, error) {
+// isRuleLine reports whether line may hold a rule, for estimates made before
+// parsing: it is neither blank nor a comment.
+func isRuleLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return line != "" && !strings.HasPrefix(line, "!") && !strings.HasPrefix(line, "#")
+}
+
+// LoadFromLines parses rules given directly, e.g. inline in the config file.
+func (l *Loader) LoadFromLines(name string, text []string) ([]*Rule, LoadStats) {
+	var rules []*Rule
+	lines := newLineParser(l.Format, l.Strict)
+	rejects := newRejectLog(name)
+	var size int64
+	for _, line := range text {
+		rules = append(rules, l.parseLine(lines, line, rejects)...)
+		size += int64(len(line)) + 1
+	}
+	rejects.summarize()
+	return rules, LoadStats{Origin: OriginConfig, Rejected: rejects.count, Bytes: size}
+}
+
+// LoadFromURLStats loads rules from url like LoadFromURLWithCache and reports load statistics.
+func (l *Loader) LoadFromURLStats(url string) ([]*Rule, LoadStats, error) {
+	return l.LoadFromMirrors([]string{url}, MirrorsInOrder)
+}
+
+// LoadFromMirrors loads one list published at several URLs. The cache is
+// shared and keyed by the first URL; when it has to be downloaded, the
+// mirrors are tried in the given order until one succeeds.
+func (l *Loader) LoadFromMirrors(urls []string, order string) ([]*Rule, LoadStats, error) {
+	url := urls[0]
 	cacheKey := urlToCacheKey(url)
 	metaFile := filepath.Join(l.DataDir, cacheKey+".meta.json")
 	rulesFile := filepath.Join(l.DataDir, cacheKey+".rules.txt")
 
 	// 1. Try to load from cache first
 	if _, err := os.Stat(rulesFile); err == nil {
-		if rules, loadErr := l.LoadFromPath(rulesFile); loadErr == nil {
+		if meta, err := verifyCache(metaFile, rulesFile); err != nil {
+			log.Printf("Discarding cache for '%s': %v", url, err)
+		} else if l.Verify.Enabled() && meta.Verified != l.Verify.methods() {
+			log.Printf("Discarding cache for '%s': not verified with %s", url, l.Verify.methods())
+		} else if rules, stats, loadErr := l.LoadFromPathStats(rulesFile); loadErr == nil {
 			log.Printf("Using cached rules for '%s'", url)
-			return rules, nil
+			stats.Origin = OriginCache
+			stats.FetchedAt = meta.FetchedAt
+			stats.Mirror = meta.Mirror
+			if stats.Mirror == "" {
+				stats.Mirror = url
+			}
+			return rules, stats, nil
+		} else if errors.Is(loadErr, ErrTooManyRules) || errors.Is(loadErr, ErrOverBudget) {
+			return nil, stats, loadErr // Downloading it again would not help
+		} else {
+			log.Printf("Failed to load cache for '%s': %v", url, loadErr)
+		}
+	}
+
+	// 2. Fallback: Fetch fresh data, from the next mirror if one fails
+	if order == MirrorsByLatency && len(urls) > 1 {
+		urls = l.rankMirrors(urls)
+	}
+	var errs []error
+	var stats LoadStats
+	for _, mirror := range urls {
+		var rules []*Rule
+		var err error
+		rules, stats, err = l.download(mirror, cacheKey)
+		if err == nil || errors.Is(err, ErrTooManyRules) || errors.Is(err, ErrOverBudget) || len(urls) == 1 {
+			return rules, stats, err
 		}
-		log.Printf("Failed to load cache for '%s': %v", url, err)
+		log.Printf("Mirror '%s' failed: %v", mirror, err)
+		errs = append(errs, fmt.Errorf("%s: %w", mirror, err))
 	}
+	return nil, stats, fmt.Errorf("all %d mirrors failed: %w", len(urls), errors.Join(errs...))
+}
+
+// download fetches url into the cache entry cacheKey and parses it from there.
+// The cache holds the list byte for byte as served, which is what signatures
+// and hashes cover. It is parsed only once complete and verified, so Admit
+// sees its size first.
+func (l *Loader) download(url, cacheKey string) ([]*Rule, LoadStats, error) {
+	metaFile := filepath.Join(l.DataDir, cacheKey+".meta.json")
+	rulesFile := filepath.Join(l.DataDir, cacheKey+".rules.txt")
 
-	// 2. Fallback: Fetch fresh data
+	stats := LoadStats{Origin: OriginDownload, Mirror: url}
 	log.Printf("Fetching rules from '%s'...", url)
 	resp, err := l.Client.Get(url)
 	if err != nil {
-		return nil, err
+		return nil, stats, err
 	}
 	defer resp.Body.Close()
+	stats.HTTPStatus = resp.StatusCode
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", resp.Status)
+		return nil, stats, fmt.Errorf("bad status: %s", resp.Status)
 	}
 
 	// Ensure data dir exists
 	if err := os.MkdirAll(l.DataDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data dir: %w", err)
+		return nil, stats, fmt.Errorf("failed to create data dir: %w", err)
 	}
 
-	// Write rules to cache file
-	cacheFile, err := os.Create(rulesFile)
+	// Write rules to a temp file first; it only replaces the cache once complete
+	tmp, err := os.CreateTemp(l.DataDir, cacheKey+".*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cache file: %w", err)
+		return nil, stats, fmt.Errorf("failed to create cache file: %w", err)
 	}
-	defer cacheFile.Close()
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
 
-	var rules []*Rule
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		cacheFile.WriteString(line + "\n")
-		if rule, err := ParseRule(line); err == nil && rule != nil {
-			rules = append(rules, rule)
+	hash := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(tmp, hash))
+	stats.Bytes, err = io.Copy(out, resp.Body)
+	if err != nil {
+		tmp.Close()
+		return nil, stats, fmt.Errorf("download interrupted: %w", err)
+	}
+
+	if err := commitFile(tmp, out); err != nil {
+		return nil, stats, fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if l.Verify.Enabled() {
+		if err := l.verify(url, tmp.Name()); err != nil {
+			return nil, stats, fmt.Errorf("verification failed: %w", err)
 		}
+		log.Printf("Verified rules from '%s' (%s)", url, l.Verify.methods())
+	}
+	if err := os.Rename(tmp.Name(), rulesFile); err != nil {
+		return nil, stats, fmt.Errorf("failed to replace cache file: %w", err)
 	}
 
 	// Write meta file
+	stats.FetchedAt = time.Now()
 	meta := CacheEntry{
-		FetchedAt: time.Now(),
+		FetchedAt: stats.FetchedAt,
 		RulesFile: cacheKey + ".rules.txt",
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		Mirror:    url,
+		Verified:  l.Verify.methods(),
+	}
+	if err := l.writeCacheMeta(metaFile, meta); err != nil {
+		log.Printf("Failed to write cache meta for '%s': %v", url, err)
+	}
+
+	// Parsed from the cache, which keeps a list over the budget for a later
+	// reload with more room
+	f, err := os.Open(rulesFile)
+	if err != nil {
+		return nil, stats, err
+	}
+	defer f.Close()
+	n, err := l.countRuleLines(f)
+	if err != nil {
+		return nil, stats, err
+	}
+	rules, rejected, err := l.parse(url, f, n)
+	stats.Rejected = rejected
+	if err != nil {
+		return nil, stats, err
 	}
-	l.writeCacheMeta(metaFile, meta)
 
 	log.Printf("Cached %d rules from '%s'", len(rules), url)
-	return rules, nil
+	return rules, stats, nil
+}
+
+// checkMaxRules fails once n rules exceed MaxRules, before the rest of an
+// oversized list is parsed into memory.
+func (l *Loader) checkMaxRules(n int) error {
+	if l.MaxRules > 0 && n > l.MaxRules {
+		return fmt.Errorf("%w: more than %d", ErrTooManyRules, l.MaxRules)
+	}
+	return nil
+}
+
+// WithMaxRules returns a copy of the loader with the rule limit set.
+func (l *Loader) WithMaxRules(n int) *Loader {
+	c := *l
+	c.MaxRules = n
+	return &c
+}
+
+// WithAdmit returns a copy of the loader asking admit before parsing a list.
+func (l *Loader) WithAdmit(admit func(lines int) bool) *Loader {
+	c := *l
+	c.Admit = admit
+	return &c
+}
+
+// WithStrict returns a copy of the loader with strict parsing set.
+func (l *Loader) WithStrict(strict bool) *Loader {
+	c := *l
+	c.Strict = strict
+	return &c
+}
+
+// WithFormat returns a copy of the loader parsing lists in format f.
+func (l *Loader) WithFormat(f Format) *Loader {
+	c := *l
+	c.Format = f
+	return &c
+}
+
+// parseLine parses one line, recording rejected rules.
+func (l *Loader) parseLine(lines *lineParser, line string, rejects *rejectLog) []*Rule {
+	rules, err := lines.parse(line)
+	if err != nil {
+		rejects.add(line, err)
+		return nil
+	}
+	return rules
+}
+
+// maxRejectLogs bounds the per-source rejects logged individually.
+const maxRejectLogs = 10
+
+// rejectLog reports rules rejected while loading a single source.
+type rejectLog struct {
+	source string
+	count  int
+}
+
+func newRejectLog(source string) *rejectLog {
+	return &rejectLog{source: source}
+}
+
+func (r *rejectLog) add(line string, err error) {
+	r.count++
+	if r.count <= maxRejectLogs {
+		log.Printf("[RULES] Rejected rule '%s' from '%s': %v", strings.TrimSpace(line), r.source, err)
+	}
+}
+
+func (r *rejectLog) summarize() {
+	if r.count > 0 {
+		log.Printf("[RULES] Rejected %d rules from '%s' (%d not shown)", r.count, r.source, max(0, r.count-maxRejectLogs))
+	}
+}
+
+// commitFile flushes buffered data, fsyncs and closes f.
+func commitFile(f *os.File, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verifyCache checks the rules file against the hash recorded in the meta file
+// and returns the meta data. Caches written before hashes were recorded
+// cannot be checked, so they are not trusted and the list is downloaded again.
+func verifyCache(metaFile, rulesFile string) (CacheEntry, error) {
+	var meta CacheEntry
+	data, err := os.ReadFile(metaFile)
+	if err != nil {
+		return meta, fmt.Errorf("missing meta file: %w", err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("corrupt meta file: %w", err)
+	}
+	if meta.SHA256 == "" {
+		return meta, errors.New("no content hash recorded")
+	}
+
+	f, err := os.Open(rulesFile)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return meta, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != meta.SHA256 {
+		return meta, fmt.Errorf("content hash mismatch")
+	}
+	return meta, nil
 }
 
+// writeCacheMeta atomically replaces the meta file.
 func (l *Loader) writeCacheMeta(path string, entry CacheEntry) error {
 	data, err := json.MarshalIndent(entry, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.Write(data)
+	if err := commitFile(tmp, w); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func urlToCacheKey(url string) string {
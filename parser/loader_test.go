@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A cache without a recorded hash, as written by older versions, may be
+// truncated: it is downloaded again instead of used.
+func TestCacheWithoutHash(t *testing.T) {
+	list := "||ads.example^\n||tracker.example^\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+	url := srv.URL + "/list.txt"
+
+	dir := t.TempDir()
+	key := urlToCacheKey(url)
+	if err := os.WriteFile(filepath.Join(dir, key+".rules.txt"), []byte("||ads.example^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"fetched_at": "2024-01-01T00:00:00Z", "rules_file": "` + key + `.rules.txt"}`
+	if err := os.WriteFile(filepath.Join(dir, key+".meta.json"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, stats, err := NewLoader(dir).LoadFromURLStats(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Origin != OriginDownload || len(rules) != 2 {
+		t.Errorf("origin %s with %d rules, want %s with 2", stats.Origin, len(rules), OriginDownload)
+	}
+
+	// The new cache records its hash and is used from now on
+	if _, stats, err := NewLoader(dir).LoadFromURLStats(url); err != nil || stats.Origin != OriginCache {
+		t.Errorf("second load: origin %s, err %v; want %s", stats.Origin, err, OriginCache)
+	}
+}
@@ -0,0 +1,71 @@
+package parser
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mirrorProbeTimeout bounds the HEAD request used to rank a mirror.
+const mirrorProbeTimeout = 5 * time.Second
+
+// rankMirrors orders urls by how fast they answer a HEAD request. Mirrors
+// that do not answer keep their relative order at the end, so they are
+// still tried when all others fail.
+func (l *Loader) rankMirrors(urls []string) []string {
+	latency := make([]time.Duration, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency[i] = l.probeMirror(url)
+		}()
+	}
+	wg.Wait()
+
+	idx := make([]int, len(urls))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		la, lb := latency[idx[a]], latency[idx[b]]
+		if (la < 0) != (lb < 0) {
+			return lb < 0
+		}
+		return la < lb
+	})
+
+	ranked := make([]string, len(urls))
+	for i, j := range idx {
+		ranked[i] = urls[j]
+	}
+	log.Printf("Mirrors by latency: %v", ranked)
+	return ranked
+}
+
+// probeMirror returns the time url took to answer a HEAD request, or -1
+// when it failed or the list is gone. Other error statuses count as an
+// answer, as some hosts refuse HEAD but serve GET.
+func (l *Loader) probeMirror(url string) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return -1
+	}
+	start := time.Now()
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone, resp.StatusCode >= 500:
+		return -1
+	}
+	return time.Since(start)
+}
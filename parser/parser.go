@@ -10,6 +10,16 @@ import (
 // ParseRule parses a single line of AdGuard rule text.
 // Returns nil if the line is empty or a comment.
 func ParseRule(text string) (*Rule, error) {
+	return parseRule(text, false)
+}
+
+// ParseRuleStrict parses a rule like ParseRule but rejects ambiguous or
+// malformed rules (see strict.go) instead of guessing their meaning.
+func ParseRuleStrict(text string) (*Rule, error) {
+	return parseRule(text, true)
+}
+
+func parseRule(text string, strict bool) (*Rule, error) {
 	text = strings.TrimSpace(text)
 	if text == "" || strings.HasPrefix(text, "!") || strings.HasPrefix(text, "#") {
 		return nil, nil // Comment or empty
@@ -33,16 +43,22 @@ func ParseRule(text string) (*Rule, error) {
 		// There might be cases where $ is part of URL, but for domain rules it's usually clear.
 		// A rudimentary check: ensure it's not part of domain chars like example$com (invalid).
 		modifiersStr := text[idx+1:]
-		if err := parseModifiers(modifiersStr, &rule.Modifiers); err != nil {
+		if err := parseModifiers(modifiersStr, &rule.Modifiers, strict); err != nil {
 			return nil, fmt.Errorf("failed to parse modifiers: %w", err)
 		}
 		text = text[:idx]
 	}
 
+	if strict {
+		if err := checkPatternStrict(text); err != nil {
+			return nil, err
+		}
+	}
+
 	rule.Pattern = text
 
 	// 3. Determine Type
-	if strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+	if len(text) > 1 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
 		rule.Type = RuleTypeRegex
 		rule.Pattern = text[1 : len(text)-1]
 	} else if strings.HasPrefix(text, "||") && strings.HasSuffix(text, "^") {
@@ -63,6 +79,9 @@ func ParseRule(text string) (*Rule, error) {
 				rule.IP = ip
 				rule.Pattern = parts[1]   // The domain
 				rule.Type = RuleTypeExact // User requested exact match for hosts syntax (no wildcards)
+				if strict && len(parts) > 2 {
+					return nil, fmt.Errorf("hosts line lists %d hostnames, only the first would be used", len(parts)-1)
+				}
 
 				// If IP is 0.0.0.0 or 127.0.0.1 or ::1 or ::, it's a block.
 				// If it's another IP, it might be a rewrite?
@@ -83,9 +102,17 @@ func ParseRule(text string) (*Rule, error) {
 	// Cleanup pattern
 	rule.Pattern = strings.TrimSuffix(rule.Pattern, "^")
 
+	if strict && rule.Type != RuleTypeRegex {
+		if err := checkDomainStrict(rule.Pattern); err != nil {
+			return nil, err
+		}
+	}
+
 	// 4. Convert wildcard patterns to regex
-	// If pattern contains * and is not already a regex, convert it
-	if rule.Type != RuleTypeRegex && strings.Contains(rule.Pattern, "*") {
+	// If pattern contains * and is not already a regex, convert it.
+	// Patterns whose wildcards are whole labels (ads.*.example.com) stay on
+	// the trie, which matches a "*" label against one or more labels.
+	if rule.Type != RuleTypeRegex && strings.Contains(rule.Pattern, "*") && !wildcardLabelsOnly(rule.Pattern) {
 		originalType := rule.Type
 		rule.Type = RuleTypeRegex
 		// Escape regex special chars except *, then replace * with .*
@@ -104,11 +131,36 @@ func ParseRule(text string) (*Rule, error) {
 		}
 	}
 
+	// 5. Compile regex rules once, here, so bad patterns are rejected with the source
+	if rule.Type == RuleTypeRegex {
+		re, err := compileRegex(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		rule.Regex = re
+
+		if strict {
+			if err := checkRegexStrict(re); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return rule, nil
 }
 
-func parseModifiers(raw string, m *Modifiers) error {
-	parts := strings.Split(raw, ",")
+// wildcardLabelsOnly reports whether every "*" in pattern is a whole label.
+func wildcardLabelsOnly(pattern string) bool {
+	for _, label := range strings.Split(pattern, ".") {
+		if label != "*" && strings.Contains(label, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+func parseModifiers(raw string, m *Modifiers, strict bool) error {
+	parts := splitModifiers(raw)
 	for _, p := range parts {
 		kv := strings.SplitN(p, "=", 2)
 		key := strings.TrimSpace(kv[0])
@@ -117,13 +169,31 @@ func parseModifiers(raw string, m *Modifiers) error {
 			val = kv[1]
 		}
 
+		if strict {
+			if err := checkModifierStrict(key, val, len(kv) > 1); err != nil {
+				return err
+			}
+		}
+
 		switch key {
 		case "client":
-			m.Client = append(m.Client, val) // Logic needed to handle exclusionary 'client=~name' later
+			m.Client = append(m.Client, val)
+			refs, _ := parseClientList(val) // Strict mode already rejected malformed lists
+			m.Clients = append(m.Clients, refs...)
 		case "denyallow":
 			m.DenyAllow = append(m.DenyAllow, val)
 		case "dnstype":
-			m.DNSType = append(m.DNSType, val) // Split by | if needed, but handled at runtime?
+			// Validated here in both modes; a bad list would silently change which types are blocked
+			types, exclude, err := parseDNSTypes(val)
+			if err != nil {
+				return err
+			}
+			if len(m.DNSTypes) > 0 && exclude != m.DNSTypeExclude {
+				return fmt.Errorf("$dnstype mixes inclusions and exclusions")
+			}
+			m.DNSType = append(m.DNSType, val)
+			m.DNSTypes = append(m.DNSTypes, types...)
+			m.DNSTypeExclude = exclude
 		case "dnsrewrite":
 			m.DNSRewrite = val
 		case "important":
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"testing"
+)
+
+// FuzzParseRule feeds arbitrary list lines to both parsing modes. Neither
+// may panic, and a rule strict mode accepts must parse the same leniently
+// and never compile into a regex that matches every name.
+func FuzzParseRule(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"! comment",
+		"# comment",
+		"example.com",
+		"||example.com^",
+		"@@||example.com^$important",
+		"||ads.*.example.com^",
+		"||ad*.example.com^",
+		"/^ads?[0-9]+\\.example\\.com$/",
+		"/(/",
+		"/",
+		"0.0.0.0 ads.example.com",
+		"1.2.3.4 rewrite.example.com",
+		"||example.com^$client=~'Frank\\'s phone'|192.168.0.0/24",
+		"||example.com^$denyallow=good.com|~x.com",
+		"||example.com^$dnstype=A|AAAA",
+		"||example.com^$dnstype=~CNAME,dnsrewrite=NOERROR;A;1.2.3.4",
+		"||exa$mple.com^$important",
+		"*",
+		"||*^",
+		"$$$",
+		"@@",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		lenient, lenientErr := ParseRule(text)
+		strict, err := ParseRuleStrict(text)
+		if err != nil || strict == nil {
+			return
+		}
+
+		if lenientErr != nil {
+			t.Fatalf("strict mode accepted %q, lenient mode rejected it: %v", text, lenientErr)
+		}
+		if lenient == nil || lenient.Type != strict.Type || lenient.Pattern != strict.Pattern {
+			t.Fatalf("modes disagree on %q: lenient %+v, strict %+v", text, lenient, strict)
+		}
+		if strict.Type == RuleTypeRegex {
+			if strict.Regex == nil {
+				t.Fatalf("regex rule %q was not compiled", text)
+			}
+			if strict.Regex.MatchString("") {
+				t.Fatalf("strict rule %q compiled into a regex matching every name: %s", text, strict.Regex)
+			}
+		}
+	})
+}
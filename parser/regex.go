@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+)
+
+// Limits applied to regex rules from third-party lists. Go's regexp is RE2
+// based, so matching time is linear, but program size still drives memory
+// and per-query cost.
+const (
+	maxRegexLen   = 1024 // Pattern length in bytes
+	maxRegexInsts = 4096 // Compiled program instructions
+)
+
+// regexCache interns compiled regexes so identical patterns in several
+// groups or sources share one program. Entries remember the generation
+// they were last used in; SweepRegexCache drops the ones a reload did not
+// use, so patterns removed from the lists do not pile up.
+var regexCache = struct {
+	sync.Mutex
+	m   map[string]*cachedRegex
+	gen uint64
+}{m: make(map[string]*cachedRegex)}
+
+type cachedRegex struct {
+	re  *regexp.Regexp
+	gen uint64
+}
+
+// SweepRegexCache removes the regexes not compiled since the last sweep.
+// Call it when a new rule set replaces the running one; rules keep their
+// compiled programs either way.
+func SweepRegexCache() {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+
+	for pattern, c := range regexCache.m {
+		if c.gen != regexCache.gen {
+			delete(regexCache.m, pattern)
+		}
+	}
+	regexCache.gen++
+}
+
+// compileRegex compiles pattern within the size limits, reusing a previously
+// compiled program for the same pattern.
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.Lock()
+	c, ok := regexCache.m[pattern]
+	if ok {
+		c.gen = regexCache.gen
+	}
+	regexCache.Unlock()
+	if ok {
+		return c.re, nil
+	}
+
+	if len(pattern) > maxRegexLen {
+		return nil, fmt.Errorf("regex too long (%d bytes, limit %d)", len(pattern), maxRegexLen)
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > maxRegexInsts {
+		return nil, fmt.Errorf("regex too complex (%d instructions, limit %d)", len(prog.Inst), maxRegexInsts)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexCache.Lock()
+	if existing, ok := regexCache.m[pattern]; ok {
+		existing.gen = regexCache.gen
+		re = existing.re
+	} else {
+		regexCache.m[pattern] = &cachedRegex{re: re, gen: regexCache.gen}
+	}
+	regexCache.Unlock()
+	return re, nil
+}
@@ -1,6 +1,12 @@
 package parser
 
-import "net/netip"
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
 
 // RuleType distinguishes the matching strategy required for a rule.
 type RuleType int
@@ -13,24 +19,77 @@ const (
 	RuleTypeGeneric              // keyword match (rare in DNS, mostly for hosts)
 )
 
+func (t RuleType) String() string {
+	switch t {
+	case RuleTypeExact:
+		return "exact"
+	case RuleTypeDistinguish:
+		return "distinguish"
+	case RuleTypeRegex:
+		return "regex"
+	case RuleTypeGeneric:
+		return "generic"
+	default:
+		return "unknown"
+	}
+}
+
 // Modifiers holds the parsed rule modifiers.
 type Modifiers struct {
-	Client      []string // $client='...'
-	DenyAllow   []string // $denyallow='...'
-	DNSType     []string // $dnstype='AAAA'
-	DNSRewrite  string   // $dnsrewrite='...'
-	Important   bool     // $important
-	BadFilter   bool     // $badfilter
-	ContentType []string // Ignored, but kept for parsing safety
+	Client         []string    // $client='...'
+	Clients        []ClientRef // Parsed $client entries
+	DenyAllow      []string    // $denyallow='...'
+	DNSType        []string    // $dnstype='AAAA'
+	DNSTypes       []uint16    // Parsed $dnstype types
+	DNSTypeExclude bool        // $dnstype=~A|~AAAA
+	DNSRewrite     string      // $dnsrewrite='...'
+	Important      bool        // $important
+	BadFilter      bool        // $badfilter
+	ContentType    []string    // Ignored, but kept for parsing safety
+}
+
+// String returns the modifiers that affect matching in a fixed order, as
+// parsed rather than as written, e.g. "important,dnstype=A|AAAA". Ignored
+// modifiers are left out.
+func (m Modifiers) String() string {
+	var parts []string
+	if m.Important {
+		parts = append(parts, "important")
+	}
+	if m.BadFilter {
+		parts = append(parts, "badfilter")
+	}
+	if len(m.DNSTypes) > 0 {
+		types := make([]string, len(m.DNSTypes))
+		for i, t := range m.DNSTypes {
+			types[i] = dns.TypeToString[t]
+			if m.DNSTypeExclude {
+				types[i] = "~" + types[i]
+			}
+		}
+		parts = append(parts, "dnstype="+strings.Join(types, "|"))
+	}
+	if len(m.Client) > 0 {
+		parts = append(parts, "client="+strings.Join(m.Client, "|"))
+	}
+	if len(m.DenyAllow) > 0 {
+		parts = append(parts, "denyallow="+strings.Join(m.DenyAllow, "|"))
+	}
+	if m.DNSRewrite != "" {
+		parts = append(parts, "dnsrewrite="+m.DNSRewrite)
+	}
+	return strings.Join(parts, ",")
 }
 
 // Rule represents a parsed AdGuard filtering rule.
 type Rule struct {
-	Text        string     // Original rule text
-	Pattern     string     // Extracted pattern (e.g., "example.com")
-	Type        RuleType   // Type of matching
-	IsWhitelist bool       // True if it starts with @@
-	Modifiers   Modifiers  // Parsed modifiers
-	IP          netip.Addr // For /etc/hosts style rules (0.0.0.0 example.com)
-	GroupID     int        // ID of the RuleGroup this rule belongs to
+	Text        string         // Original rule text
+	Pattern     string         // Extracted pattern (e.g., "example.com")
+	Type        RuleType       // Type of matching
+	IsWhitelist bool           // True if it starts with @@
+	Modifiers   Modifiers      // Parsed modifiers
+	IP          netip.Addr     // For /etc/hosts style rules (0.0.0.0 example.com)
+	Regex       *regexp.Regexp // Compiled Pattern for RuleTypeRegex, shared between identical patterns
+	GroupID     int            // ID of the RuleGroup this rule belongs to
+	Source      string         // Name of the source the rule was loaded from
 }
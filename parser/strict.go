@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Strict mode checks. Each returns an error describing why a rule is
+// ambiguous or malformed; the lenient parser accepts the same rules and
+// guesses their meaning.
+
+// checkPatternStrict validates the rule text left after modifiers are split off.
+func checkPatternStrict(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	if strings.Contains(text, "$") {
+		return fmt.Errorf("ambiguous '$' in pattern '%s'", text)
+	}
+	return nil
+}
+
+// checkDomainStrict validates a domain pattern (exact, ||domain^ or hosts entry).
+func checkDomainStrict(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty domain pattern")
+	}
+	for _, c := range pattern {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_', c == '*':
+		default:
+			return fmt.Errorf("invalid character %q in domain pattern '%s'", c, pattern)
+		}
+	}
+	if strings.HasPrefix(pattern, ".") || strings.Contains(pattern, "..") {
+		return fmt.Errorf("empty label in domain pattern '%s'", pattern)
+	}
+	if strings.Trim(pattern, "*.") == "" {
+		return fmt.Errorf("pattern '%s' matches every domain", pattern)
+	}
+	return nil
+}
+
+// checkRegexStrict rejects regexes that match every name.
+func checkRegexStrict(re *regexp.Regexp) error {
+	if re.MatchString("") {
+		return fmt.Errorf("regex '%s' matches every domain", re)
+	}
+	return nil
+}
+
+// checkModifierStrict validates a single key[=value] modifier.
+func checkModifierStrict(key, val string, hasValue bool) error {
+	switch key {
+	case "client", "denyallow", "dnstype", "dnsrewrite":
+		if strings.TrimSpace(val) == "" {
+			return fmt.Errorf("$%s requires a value", key)
+		}
+	case "important", "badfilter":
+		if hasValue {
+			return fmt.Errorf("$%s does not take a value", key)
+		}
+		return nil
+	case "image", "script", "third-party", "xmlhttprequest", "popup", "generichide":
+		return nil
+	default:
+		return fmt.Errorf("unknown modifier '%s'", key)
+	}
+
+	switch key {
+	case "client":
+		// Mixed inclusions and exclusions are valid for $client
+		_, err := parseClientList(val)
+		return err
+	case "denyallow":
+		for _, v := range strings.Split(val, "|") {
+			v = strings.TrimSpace(v)
+			if strings.HasPrefix(v, "~") {
+				return fmt.Errorf("$denyallow does not support exclusions: '%s'", v)
+			}
+			if strings.Contains(v, "*") {
+				return fmt.Errorf("$denyallow does not support wildcards: '%s'", v)
+			}
+			if err := checkDomainStrict(v); err != nil {
+				return fmt.Errorf("$denyallow: %w", err)
+			}
+		}
+	}
+	return nil
+}
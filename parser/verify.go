@@ -0,0 +1,222 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp" // Frozen upstream, but enough for detached signature checks
+)
+
+// maxSignatureSize bounds downloaded signatures and checksum files.
+const maxSignatureSize = 1024 * 1024
+
+// Verify describes how a downloaded list must be verified before it is
+// accepted. Every configured check has to pass.
+type Verify struct {
+	Minisign   string // Minisign public key, "RW..."
+	PGPKeyRing string // Path to a PGP public key ring, armored or binary
+	Signature  string // URL of the detached signature, default <url>.minisig or <url>.asc
+	SHA256Sums string // URL of a sha256sum file with an entry for the list's file name
+}
+
+// Enabled reports whether any check is configured.
+func (v Verify) Enabled() bool {
+	return v.Minisign != "" || v.PGPKeyRing != "" || v.SHA256Sums != ""
+}
+
+// methods names the configured checks, as recorded in the cache meta data.
+func (v Verify) methods() string {
+	var m []string
+	if v.Minisign != "" {
+		m = append(m, "minisign")
+	}
+	if v.PGPKeyRing != "" {
+		m = append(m, "pgp")
+	}
+	if v.SHA256Sums != "" {
+		m = append(m, "sha256sums")
+	}
+	return strings.Join(m, "+")
+}
+
+// WithVerify returns a copy of the loader verifying downloads with v.
+func (l *Loader) WithVerify(v Verify) *Loader {
+	c := *l
+	c.Verify = v
+	return &c
+}
+
+// verify checks the list downloaded from listURL into file.
+func (l *Loader) verify(listURL, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	v := l.Verify
+	if v.Minisign != "" {
+		sig, err := l.fetchSignature(v.Signature, listURL+".minisig")
+		if err != nil {
+			return err
+		}
+		if err := verifyMinisign(v.Minisign, data, sig); err != nil {
+			return fmt.Errorf("minisign: %w", err)
+		}
+	}
+	if v.PGPKeyRing != "" {
+		sig, err := l.fetchSignature(v.Signature, listURL+".asc")
+		if err != nil {
+			return err
+		}
+		if err := verifyPGP(v.PGPKeyRing, data, sig); err != nil {
+			return fmt.Errorf("pgp: %w", err)
+		}
+	}
+	if v.SHA256Sums != "" {
+		sums, err := l.fetchSignature(v.SHA256Sums, "")
+		if err != nil {
+			return err
+		}
+		if err := verifySHA256Sums(sums, listURL, data); err != nil {
+			return fmt.Errorf("sha256sums: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetchSignature downloads the signature at sigURL, or at def when sigURL is empty.
+func (l *Loader) fetchSignature(sigURL, def string) ([]byte, error) {
+	if sigURL == "" {
+		sigURL = def
+	}
+	resp, err := l.Client.Get(sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch '%s': %w", sigURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch '%s': bad status: %s", sigURL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+}
+
+// verifyMinisign checks a minisign signature file, including the signature
+// over its trusted comment. Both legacy (Ed) and prehashed (ED) signatures
+// are accepted.
+func verifyMinisign(publicKey string, data, sigFile []byte) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != 42 || string(key[:2]) != "Ed" {
+		return errors.New("invalid public key")
+	}
+	keyID, pk := key[2:10], ed25519.PublicKey(key[10:])
+
+	lines := strings.Split(strings.ReplaceAll(string(sigFile), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed signature file")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return errors.New("malformed signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("malformed trusted comment signature")
+	}
+	if !bytes.Equal(sig[2:10], keyID) {
+		return fmt.Errorf("signed with key %X, not the configured key %X", reverse(sig[2:10]), reverse(keyID))
+	}
+
+	message := data
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pk, message, sig[10:]) {
+		return errors.New("signature does not match the list")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(pk, append(sig[10:74:74], trusted...), globalSig) {
+		return errors.New("trusted comment signature is invalid")
+	}
+	return nil
+}
+
+// reverse returns b reversed; minisign prints key IDs little-endian.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// verifyPGP checks a detached PGP signature, armored or binary, against the key ring file.
+func verifyPGP(keyRingFile string, data, sig []byte) error {
+	raw, err := os.ReadFile(keyRingFile)
+	if err != nil {
+		return err
+	}
+	var keyring openpgp.EntityList
+	if bytes.Contains(raw, []byte("-----BEGIN PGP")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid key ring: %w", err)
+	}
+
+	if bytes.Contains(sig, []byte("-----BEGIN PGP SIGNATURE")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	}
+	return err
+}
+
+// verifySHA256Sums looks up the file name of listURL in a sha256sum file
+// ("<hex>  name" or "<hex> *name" per line) and compares the hash. A file
+// with a single bare hash applies to any name.
+func verifySHA256Sums(sums []byte, listURL string, data []byte) error {
+	name := listURL
+	if u, err := url.Parse(listURL); err == nil {
+		name = path.Base(u.Path)
+	}
+
+	want := ""
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 1 && want == "":
+			want = fields[0]
+		case len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name:
+			want = fields[0]
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("no entry for '%s'", name)
+	}
+
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+		return fmt.Errorf("hash %s does not match %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// minisignKey returns a minisign public key and a function signing data
+// with it (legacy Ed signatures).
+func minisignKey(t *testing.T) (string, func(data []byte) string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte("testkey1")
+	publicKey := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+
+	sign := func(data []byte) string {
+		sig := append(append([]byte("Ed"), keyID...), ed25519.Sign(priv, data)...)
+		trusted := "timestamp:0"
+		global := ed25519.Sign(priv, append(sig[10:74:74], trusted...))
+		return "untrusted comment: test\n" +
+			base64.StdEncoding.EncodeToString(sig) + "\n" +
+			"trusted comment: " + trusted + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n"
+	}
+	return publicKey, sign
+}
+
+// Signatures cover the list as served; the line endings of the download
+// must survive until it is verified, and in the cache.
+func TestVerifyRawDownload(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+	}{
+		{"crlf", "! Title: test\r\n||ads.example^\r\n||tracker.example^\r\n"},
+		{"no final newline", "! Title: test\n||ads.example^\n||tracker.example^"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publicKey, sign := minisignKey(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/list.txt", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.list))
+			})
+			mux.HandleFunc("/list.txt.minisig", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(sign([]byte(tt.list))))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			l := NewLoader(t.TempDir()).WithVerify(Verify{Minisign: publicKey})
+			rules, stats, err := l.LoadFromURLStats(srv.URL + "/list.txt")
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if len(rules) != 2 || stats.Origin != OriginDownload || stats.Bytes != int64(len(tt.list)) {
+				t.Errorf("download: %d rules, origin %s, %d bytes; want 2, %s, %d", len(rules), stats.Origin, stats.Bytes, OriginDownload, len(tt.list))
+			}
+
+			// The cached copy is the same bytes and passes its hash check
+			rules, stats, err = l.LoadFromURLStats(srv.URL + "/list.txt")
+			if err != nil {
+				t.Fatalf("cache: %v", err)
+			}
+			if len(rules) != 2 || stats.Origin != OriginCache {
+				t.Errorf("cache: %d rules, origin %s; want 2, %s", len(rules), stats.Origin, OriginCache)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package presence
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"adblocker/config"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultPresentPayloads are the payloads that mean present when mqtt.present is unset.
+var defaultPresentPayloads = []string{"on", "home", "true", "1"}
+
+// mqttSubscriber follows one presence topic. The client reconnects and
+// subscribes again on its own; retained messages restore the state.
+type mqttSubscriber struct {
+	schedule string
+	cfg      config.MQTTSignal
+	client   mqtt.Client
+}
+
+func newMQTTSubscriber(schedule string, cfg config.MQTTSignal, update func(schedule, source string, present bool)) *mqttSubscriber {
+	m := &mqttSubscriber{schedule: schedule, cfg: cfg}
+
+	present := defaultPresentPayloads
+	if len(cfg.Present) > 0 {
+		present = cfg.Present
+	}
+	onMessage := func(_ mqtt.Client, msg mqtt.Message) {
+		payload := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+		update(schedule, SourceMQTT, slices.ContainsFunc(present, func(p string) bool { return strings.EqualFold(p, payload) }))
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(fmt.Sprintf("adblocker-%d-%s", os.Getpid(), schedule)).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			if t := c.Subscribe(cfg.Topic, 1, onMessage); t.Wait() && t.Error() != nil {
+				log.Printf("[PRESENCE] Schedule '%s': subscribing to %s failed: %v", schedule, cfg.Topic, t.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("[PRESENCE] Schedule '%s': lost MQTT broker %s: %v", schedule, cfg.Broker, err)
+		})
+	m.client = mqtt.NewClient(opts)
+	return m
+}
+
+func (m *mqttSubscriber) start() {
+	// With ConnectRetry the token completes only once connected; do not wait for it
+	m.client.Connect()
+}
+
+func (m *mqttSubscriber) close() {
+	m.client.Disconnect(250)
+}
@@ -0,0 +1,94 @@
+package presence
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pingTimeout bounds the wait for one echo reply.
+const pingTimeout = 2 * time.Second
+
+var (
+	errNoReply = errors.New("no echo reply")
+	pingSeq    atomic.Uint32
+)
+
+// echo sends one ICMP echo request to addr and waits for the reply. It
+// prefers unprivileged ICMP sockets (net.ipv4.ping_group_range on Linux)
+// and falls back to raw sockets, which need root or CAP_NET_RAW.
+func echo(addr netip.Addr, timeout time.Duration) error {
+	addr = addr.Unmap()
+	network, rawNetwork, bind, proto := "udp4", "ip4:icmp", "0.0.0.0", 1
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr.Is6() {
+		network, rawNetwork, bind, proto = "udp6", "ip6:ipv6-icmp", "::", 58
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+	c, err := icmp.ListenPacket(network, bind)
+	if err != nil {
+		if c, err = icmp.ListenPacket(rawNetwork, bind); err != nil {
+			return err
+		}
+		dst = &net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+	}
+	defer c.Close()
+
+	// Unprivileged sockets get their ID from the kernel, so replies are matched by sequence
+	seq := int(pingSeq.Add(1) & 0xffff)
+	req := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("adblocker-presence")},
+	}
+	data, err := req.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.WriteTo(data, dst); err != nil {
+		return err
+	}
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return errNoReply
+			}
+			return err
+		}
+		if peerAddr(peer) != addr.WithZone("") {
+			continue
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != replyType {
+			continue
+		}
+		if e, ok := msg.Body.(*icmp.Echo); ok && e.Seq == seq {
+			return nil
+		}
+	}
+}
+
+func peerAddr(a net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
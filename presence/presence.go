@@ -0,0 +1,200 @@
+package presence
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+)
+
+const (
+	defaultInterval  = 30 * time.Second
+	defaultAwayAfter = 10 * time.Minute
+)
+
+// Signal sources of a schedule.
+const (
+	SourcePing    = "ping"
+	SourceMQTT    = "mqtt"
+	SourceWebhook = "webhook"
+)
+
+var (
+	ErrUnknownSchedule = errors.New("no presence-driven schedule of that name")
+	ErrUnauthorized    = errors.New("wrong or missing webhook token")
+)
+
+// Signal is the last report of one source.
+type Signal struct {
+	Present bool      `json:"present"`
+	At      time.Time `json:"at"`
+}
+
+// Status is the presence of one schedule and the sources behind it.
+type Status struct {
+	Schedule string            `json:"schedule"`
+	Present  bool              `json:"present"`
+	Sources  map[string]Signal `json:"sources"`
+}
+
+// Tracker feeds ping, MQTT and webhook signals of presence-driven
+// schedules into the engine.
+type Tracker struct {
+	engine    *engine.Engine
+	schedules map[string]config.Presence
+	ping      map[string][]netip.Addr
+
+	// OnChange runs after a schedule's presence flips (e.g. to flush cached decisions)
+	OnChange func()
+
+	mu      sync.Mutex
+	signals map[string]map[string]Signal // Schedule -> source -> last report
+
+	mqtt []*mqttSubscriber
+	stop chan struct{}
+}
+
+// NewTracker creates a Tracker for the schedules that have presence.
+func NewTracker(schedules []config.Schedule, eng *engine.Engine) (*Tracker, error) {
+	t := &Tracker{
+		engine:    eng,
+		schedules: make(map[string]config.Presence),
+		ping:      make(map[string][]netip.Addr),
+		signals:   make(map[string]map[string]Signal),
+		stop:      make(chan struct{}),
+	}
+	for _, s := range schedules {
+		if s.Presence == nil {
+			continue
+		}
+		t.schedules[s.Name] = *s.Presence
+		t.signals[s.Name] = make(map[string]Signal)
+		for _, a := range s.Presence.Ping {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("schedule '%s': invalid presence.ping address '%s'", s.Name, a)
+			}
+			t.ping[s.Name] = append(t.ping[s.Name], addr)
+		}
+		if m := s.Presence.MQTT; m != nil {
+			t.mqtt = append(t.mqtt, newMQTTSubscriber(s.Name, *m, t.update))
+		}
+	}
+	return t, nil
+}
+
+// Enabled reports whether any schedule is driven by presence.
+func (t *Tracker) Enabled() bool {
+	return len(t.schedules) > 0
+}
+
+// Run starts pinging and the MQTT subscriptions in the background.
+func (t *Tracker) Run() {
+	for name, addrs := range t.ping {
+		p := t.schedules[name]
+		interval := p.Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		awayAfter := p.AwayAfter
+		if awayAfter <= 0 {
+			awayAfter = defaultAwayAfter
+		}
+		go t.pingLoop(name, addrs, interval, awayAfter)
+	}
+	for _, m := range t.mqtt {
+		m.start()
+	}
+}
+
+func (t *Tracker) Stop() {
+	close(t.stop)
+	for _, m := range t.mqtt {
+		m.close()
+	}
+}
+
+// pingLoop probes the addresses of a schedule every interval. The device
+// stays present until none of them answered for awayAfter.
+func (t *Tracker) pingLoop(schedule string, addrs []netip.Addr, interval, awayAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastSeen time.Time
+	for {
+		for _, addr := range addrs {
+			if err := echo(addr, min(interval, pingTimeout)); err == nil {
+				lastSeen = time.Now()
+				break
+			}
+		}
+		t.update(schedule, SourcePing, !lastSeen.IsZero() && time.Since(lastSeen) < awayAfter)
+
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Webhook records a report from POST /api/presence/{schedule}. token is
+// compared with the schedule's webhook_token.
+func (t *Tracker) Webhook(schedule, token string, present bool) error {
+	p, ok := t.schedules[schedule]
+	if !ok {
+		return ErrUnknownSchedule
+	}
+	if p.WebhookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.WebhookToken)) != 1 {
+		return ErrUnauthorized
+	}
+	t.update(schedule, SourceWebhook, present)
+	return nil
+}
+
+// update records a report and pushes the combined presence to the engine.
+func (t *Tracker) update(schedule, source string, present bool) {
+	t.mu.Lock()
+	t.signals[schedule][source] = Signal{Present: present, At: time.Now()}
+	combined := false
+	for _, sig := range t.signals[schedule] {
+		combined = combined || sig.Present
+	}
+	t.mu.Unlock()
+
+	if !t.engine.SetPresent(schedule, combined) {
+		return
+	}
+	state := "away"
+	if combined {
+		state = "present"
+	}
+	log.Printf("[PRESENCE] Schedule '%s' is now %s (%s reported %v)", schedule, state, source, present)
+	if t.OnChange != nil {
+		t.OnChange()
+	}
+}
+
+// Status returns the presence of every presence-driven schedule, sorted by name.
+func (t *Tracker) Status() []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := []Status{}
+	for name, signals := range t.signals {
+		s := Status{Schedule: name, Present: t.engine.Present(name), Sources: make(map[string]Signal)}
+		for source, sig := range signals {
+			s.Sources[source] = sig
+		}
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Schedule < status[j].Schedule })
+	return status
+}
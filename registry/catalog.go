@@ -0,0 +1,20 @@
+package registry
+
+import "time"
+
+const hostlists = "https://adguardteam.github.io/HostlistsRegistry/assets/"
+
+// bundled is the built-in catalog used when the online registry is unavailable.
+// IDs follow the AdGuard HostlistsRegistry filter keys with dashes.
+var bundled = []Entry{
+	{ID: "adguard-dns-filter", Title: "AdGuard DNS filter", URL: hostlists + "filter_1.txt", Homepage: "https://github.com/AdguardTeam/AdGuardSDNSFilter", Interval: 24 * time.Hour},
+	{ID: "adaway-default", Title: "AdAway Default Blocklist", URL: hostlists + "filter_2.txt", Homepage: "https://adaway.org/", Interval: 4 * 24 * time.Hour},
+	{ID: "peter-lowe", Title: "Peter Lowe's Blocklist", URL: hostlists + "filter_3.txt", Homepage: "https://pgl.yoyo.org/adservers/", Interval: 24 * time.Hour},
+	{ID: "dan-pollock", Title: "Dan Pollock's List", URL: hostlists + "filter_4.txt", Homepage: "https://someonewhocares.org/hosts/", Interval: 4 * 24 * time.Hour},
+	{ID: "oisd-small", Title: "OISD Blocklist Small", URL: hostlists + "filter_5.txt", Homepage: "https://oisd.nl/", Interval: 24 * time.Hour},
+	{ID: "anti-ad", Title: "CHN: anti-AD", URL: hostlists + "filter_21.txt", Homepage: "https://github.com/privacy-protection-tools/anti-AD", Interval: 24 * time.Hour},
+	{ID: "1hosts-lite", Title: "1Hosts (Lite)", URL: hostlists + "filter_24.txt", Homepage: "https://github.com/badmojr/1Hosts", Interval: 24 * time.Hour},
+	{ID: "oisd-big", Title: "OISD Blocklist Big", URL: hostlists + "filter_27.txt", Homepage: "https://oisd.nl/", Interval: 24 * time.Hour},
+	{ID: "adrules-dns", Title: "CHN: AdRules DNS List", URL: hostlists + "filter_29.txt", Homepage: "https://github.com/Cats-Team/AdRules", Interval: 24 * time.Hour},
+	{ID: "steven-black", Title: "Steven Black's List", URL: hostlists + "filter_33.txt", Homepage: "https://github.com/StevenBlack/hosts", Interval: 24 * time.Hour},
+}
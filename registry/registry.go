@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+)
+
+// DefaultURL is the AdGuard HostlistsRegistry index.
+const DefaultURL = hostlists + "filters.json"
+
+// Entry describes a well-known filter list.
+type Entry struct {
+	ID       string        `json:"id"`
+	Title    string        `json:"title"`
+	URL      string        `json:"url"`
+	Homepage string        `json:"homepage"`
+	Interval time.Duration `json:"interval"` // Recommended update interval
+}
+
+// Registry resolves `list:` references in sources to full list metadata.
+// Lookups check the online registry (cached in the data dir) first, then the bundled catalog.
+// The online index is fetched in the background when a config references a list
+// neither knows, so loading the config never waits for the network.
+type Registry struct {
+	Client  *http.Client
+	URL     string
+	DataDir string
+	Wait    bool // Fetch the index during Apply instead, for one-shot commands
+
+	mu       sync.Mutex
+	online   map[string]Entry
+	fetching bool
+	fetched  bool
+	updated  bool   // Fetched while no OnUpdate was set
+	onUpdate func() // See SetOnUpdate
+}
+
+// New creates a Registry that caches the online index in dataDir.
+func New(dataDir string) *Registry {
+	r := &Registry{
+		Client:  &http.Client{Timeout: 30 * time.Second},
+		URL:     DefaultURL,
+		DataDir: dataDir,
+	}
+	if data, err := os.ReadFile(r.cacheFile()); err == nil {
+		if entries, err := parseIndex(data); err == nil {
+			r.online = entries
+		}
+	}
+	return r
+}
+
+// Apply fills URL, Name, Homepage and Interval for every source that references a list.
+// Explicitly configured fields are kept. It is meant to be used as config.Manager.LoadCallback.
+func (r *Registry) Apply(cfg *config.Config) error {
+	for i := range cfg.RuleGroups {
+		rg := &cfg.RuleGroups[i]
+		for j := 0; j < len(rg.Sources); j++ {
+			src := &rg.Sources[j]
+			if src.List == "" {
+				continue
+			}
+
+			entry, ok := r.Lookup(src.List)
+			if !ok && r.Wait && r.claimFetch() {
+				r.fetch()
+				entry, ok = r.Lookup(src.List)
+			}
+			if !ok && !r.Wait && r.fetchAsync() {
+				// Not in the local index yet: skipped until the fetch triggers a reload
+				log.Printf("[REGISTRY] List '%s' in rule group '%s' not in the local index, skipped until the registry is fetched", src.List, rg.Name)
+				rg.Sources = slices.Delete(rg.Sources, j, j+1)
+				j--
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("unknown list '%s' in rule group '%s'", src.List, rg.Name)
+			}
+			if src.URL == "" && src.Path == "" {
+				src.URL = entry.URL
+			}
+			if src.Name == "" {
+				src.Name = entry.Title
+			}
+			if src.Homepage == "" {
+				src.Homepage = entry.Homepage
+			}
+			if src.Interval == 0 {
+				src.Interval = entry.Interval
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup finds a list by ID in the cached index and the bundled catalog.
+// IDs are case-insensitive and `_` equals `-`, so both "adguard-dns-filter"
+// and AdGuard's "adguard_dns_filter" work.
+func (r *Registry) Lookup(id string) (Entry, bool) {
+	id = normalizeID(id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.online[id]; ok {
+		return e, true
+	}
+	for _, e := range bundled {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// SetOnUpdate sets fn to be called after a background fetch of the index,
+// typically a config reload so skipped lists are resolved. If a fetch
+// already completed, fn is called right away.
+func (r *Registry) SetOnUpdate(fn func()) {
+	r.mu.Lock()
+	r.onUpdate = fn
+	updated := r.updated
+	r.updated = false
+	r.mu.Unlock()
+
+	if updated && fn != nil {
+		go fn()
+	}
+}
+
+// claimFetch reports whether the caller should fetch the online index: it
+// is fetched once per process, and again after a failure.
+func (r *Registry) claimFetch() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fetched || r.fetching || r.URL == "" {
+		return false
+	}
+	r.fetching = true
+	return true
+}
+
+// fetchAsync starts fetching the online index in the background unless a
+// fetch is running. It reports whether the index may still learn new IDs,
+// false once it has been fetched.
+func (r *Registry) fetchAsync() bool {
+	if r.claimFetch() {
+		go func() {
+			if !r.fetch() {
+				return
+			}
+			r.mu.Lock()
+			fn := r.onUpdate
+			r.updated = fn == nil
+			r.mu.Unlock()
+			if fn != nil {
+				fn()
+			}
+		}()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.fetched && r.URL != ""
+}
+
+// fetch downloads the online index and reports whether it succeeded.
+func (r *Registry) fetch() bool {
+	entries, err := r.download()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetching = false
+	if err != nil {
+		log.Printf("Failed to fetch list registry: %v", err)
+		return false
+	}
+	r.online = entries
+	r.fetched = true
+	return true
+}
+
+// download fetches and parses the online index and caches it in the data dir.
+func (r *Registry) download() (map[string]Entry, error) {
+	resp, err := r.Client.Get(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode registry: %w", err)
+	}
+	entries, err := parseIndex(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(r.DataDir, 0755); err == nil {
+		os.WriteFile(r.cacheFile(), raw, 0644)
+	}
+	return entries, nil
+}
+
+func (r *Registry) cacheFile() string {
+	return filepath.Join(r.DataDir, "registry.json")
+}
+
+// parseIndex decodes the HostlistsRegistry filters.json format.
+func parseIndex(data []byte) (map[string]Entry, error) {
+	var index struct {
+		Filters []struct {
+			FilterKey   string `json:"filterKey"`
+			FilterID    int    `json:"filterId"`
+			Name        string `json:"name"`
+			Homepage    string `json:"homepage"`
+			DownloadURL string `json:"downloadUrl"`
+			Expires     int64  `json:"expires"` // Seconds
+			Deprecated  bool   `json:"deprecated"`
+		} `json:"filters"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse registry: %w", err)
+	}
+
+	entries := make(map[string]Entry)
+	for _, f := range index.Filters {
+		if f.Deprecated || f.DownloadURL == "" {
+			continue
+		}
+		e := Entry{
+			ID:       normalizeID(f.FilterKey),
+			Title:    f.Name,
+			URL:      f.DownloadURL,
+			Homepage: f.Homepage,
+			Interval: time.Duration(f.Expires) * time.Second,
+		}
+		if e.ID != "" {
+			entries[e.ID] = e
+		}
+		// Numeric IDs are accepted too, e.g. "list: 1"
+		entries[strconv.Itoa(f.FilterID)] = e
+	}
+	return entries, nil
+}
+
+func normalizeID(id string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(id)), "_", "-")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/metrics"
+	"adblocker/parser"
+	"adblocker/server"
+)
+
+var (
+	errNotLoaded    = errors.New("rules not loaded yet")
+	errShuttingDown = errors.New("shutting down")
+)
+
+// reloader re-reads the config file and applies it to the running components.
+type reloader struct {
+	mu     sync.Mutex
+	cfgMgr *config.Manager
+	eng    *engine.Engine
+	loader *parser.Loader
+	srv    *server.Server
+}
+
+// reload re-reads the config file. Queries keep being answered with the
+// previous config until the new one is fully built, and a broken file
+// leaves it running.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.eng.Config()
+
+	// 1. Parse and validate without touching the running config
+	cfg, err := r.cfgMgr.Parse()
+	if err != nil {
+		log.Printf("Config reload failed, keeping previous config: %v", err)
+		return err
+	}
+
+	// 2. Build the engine state; ApplyConfig swaps nothing unless everything compiles
+	if err := r.applyLocked(old, cfg); err != nil {
+		r.cfgMgr.Reject(err)
+		log.Printf("Config reload failed, keeping previous config: %v", err)
+		return err
+	}
+	r.cfgMgr.Set(cfg)
+	log.Printf("Config reloaded from %s", r.cfgMgr.Path())
+	return nil
+}
+
+// watchSignal reloads the config on every SIGHUP, as daemons commonly do.
+func (r *reloader) watchSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Printf("Received SIGHUP, reloading %s", r.cfgMgr.Path())
+			r.reload()
+		}
+	}()
+}
+
+// apply hands a validated config to the engine and server, e.g. after an
+// edit through the admin API. The caller makes it current on success.
+func (r *reloader) apply(cfg *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.applyLocked(r.eng.Config(), cfg)
+}
+
+func (r *reloader) applyLocked(old, cfg *config.Config) error {
+	if err := r.eng.ApplyConfig(cfg, r.loader); err != nil {
+		return err
+	}
+
+	r.srv.SetUpstreams(upstreamAddrs(cfg))
+	r.srv.UserGroupCache.Flush()
+	if cfg.Server.MemoryLimit != old.Server.MemoryLimit {
+		if cfg.Server.MemoryLimit > 0 {
+			setMemoryLimit(cfg.Server.MemoryLimit)
+			sizeCaches(cfg.Server.MemoryLimit, r.srv)
+		} else {
+			log.Printf("Warning: removing memory_limit takes effect after restart")
+		}
+	}
+
+	if cfg.Server.ListenAddr != old.Server.ListenAddr || cfg.Server.DisableTCP != old.Server.DisableTCP || cfg.Server.AdminAddr != old.Server.AdminAddr ||
+		cfg.Server.ListenTLS != old.Server.ListenTLS || cfg.Server.ListenHTTPS != old.Server.ListenHTTPS || cfg.Server.ListenHTTP != old.Server.ListenHTTP {
+		log.Printf("Warning: listen address changes take effect after restart")
+	}
+	return nil
+}
+
+// setupLogging switches the standard logger to structured JSON on stdout when requested.
+func setupLogging(format string) {
+	if format != "json" {
+		return
+	}
+	// slog.SetDefault also routes the log package through the handler
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+}
+
+// setInstanceLabels attaches Downward API values (exposed as env vars) to all metrics.
+func setInstanceLabels() {
+	metrics.Default.SetConstLabels(map[string]string{
+		"pod":       os.Getenv("POD_NAME"),
+		"namespace": os.Getenv("POD_NAMESPACE"),
+		"node":      os.Getenv("NODE_NAME"),
+	})
+}
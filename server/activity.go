@@ -0,0 +1,199 @@
+package server
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"adblocker/config"
+
+	"github.com/miekg/dns"
+)
+
+// Bounds of the activity kept for the dashboard
+const (
+	maxLoggedQueries  = 1000  // Latest queries in the query log
+	maxTrackedDomains = 10000 // Distinct blocked domains counted; later ones are counted as other
+	maxTrackedClients = 4096  // Distinct clients counted
+)
+
+// LoggedQuery is one entry of the query log, see QueryLog.
+type LoggedQuery struct {
+	Seq       uint64    `json:"seq"` // Increases with every entry, for polling with after
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"` // Label of the user, e.g. "🧒 Emma"
+	Domain    string    `json:"domain"`
+	Type      string    `json:"type"`
+	Decision  string    `json:"decision"`
+	UserGroup string    `json:"user_group,omitempty"`
+	RuleGroup string    `json:"rule_group,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Cached    bool      `json:"cached,omitempty"`
+}
+
+// DomainCount is a blocked domain with how often it was blocked.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+// ClientActivity counts the queries of one client. Clients are told apart
+// by their device, so the counts follow it across address changes (DHCP
+// lease renewals, roaming DoH clients): the DoH client ID when it sent one,
+// else the MAC address, else the IP address.
+type ClientActivity struct {
+	ID       string    `json:"id"`     // "id:<client ID>", "mac:<MAC>" or the IP address
+	Client   string    `json:"client"` // Latest IP address
+	MAC      string    `json:"mac,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Queries  uint64    `json:"queries"`
+	Blocked  uint64    `json:"blocked"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// TopBlocked is served at /api/stats/top-blocked.
+type TopBlocked struct {
+	Domains []DomainCount `json:"domains"`
+	Other   uint64        `json:"other"` // Blocks of domains beyond the tracked ones
+}
+
+// activity holds the query log and the counters of the dashboard. The
+// counters start over with ResetStats like the time series.
+type activity struct {
+	mu      sync.Mutex
+	seq     uint64
+	log     []LoggedQuery // Ring of maxLoggedQueries, next is the oldest once full
+	next    int
+	blocked map[string]uint64
+	other   uint64
+	clients map[string]*ClientActivity // By clientKey
+}
+
+// clientKey returns the ID of the device a query came from, see ClientActivity.
+func clientKey(clientIP netip.Addr, clientMAC, clientID string) string {
+	switch {
+	case clientID != "":
+		return "id:" + clientID
+	case clientMAC != "":
+		return "mac:" + clientMAC
+	}
+	return clientIP.String()
+}
+
+// count adds a query to the blocked domain and client counters.
+func (a *activity) count(q dns.Question, clientIP netip.Addr, clientMAC, clientID string, user *config.User, blocked bool, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.blocked == nil {
+		a.blocked = make(map[string]uint64)
+		a.clients = make(map[string]*ClientActivity)
+	}
+
+	if blocked {
+		if _, ok := a.blocked[q.Name]; ok || len(a.blocked) < maxTrackedDomains {
+			a.blocked[q.Name]++
+		} else {
+			a.other++
+		}
+	}
+
+	key := clientKey(clientIP, clientMAC, clientID)
+	c := a.clients[key]
+	if c == nil {
+		if len(a.clients) >= maxTrackedClients {
+			return
+		}
+		c = &ClientActivity{ID: key, MAC: clientMAC}
+		a.clients[key] = c
+	}
+	c.Client = clientIP.String()
+	if user != nil {
+		c.User = user.Label()
+	}
+	c.Queries++
+	if blocked {
+		c.Blocked++
+	}
+	c.LastSeen = now
+}
+
+// add appends an entry to the query log.
+func (a *activity) add(e LoggedQuery) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	if len(a.log) < maxLoggedQueries {
+		a.log = append(a.log, e)
+		return
+	}
+	a.log[a.next] = e
+	a.next = (a.next + 1) % maxLoggedQueries
+}
+
+// reset clears the counters; the query log is kept.
+func (a *activity) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.blocked, a.clients, a.other = nil, nil, 0
+}
+
+// QueryLog returns up to limit of the latest logged queries after seq,
+// newest first. Queries left out by query_log_sample are not in it.
+func (s *Server) QueryLog(after uint64, limit int) []LoggedQuery {
+	a := &s.activity
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]LoggedQuery, 0, min(limit, len(a.log)))
+	for i := range a.log {
+		e := a.log[(a.next+len(a.log)-1-i)%len(a.log)]
+		if e.Seq <= after || len(list) == limit {
+			break
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// TopBlocked returns the n most blocked domains since the last stats reset.
+func (s *Server) TopBlocked(n int) TopBlocked {
+	a := &s.activity
+	a.mu.Lock()
+	top := make([]DomainCount, 0, len(a.blocked))
+	for domain, count := range a.blocked {
+		top = append(top, DomainCount{Domain: domain, Count: count})
+	}
+	other := a.other
+	a.mu.Unlock()
+
+	slices.SortFunc(top, func(x, y DomainCount) int {
+		return cmp.Or(cmp.Compare(y.Count, x.Count), cmp.Compare(x.Domain, y.Domain))
+	})
+	if len(top) > n {
+		for _, d := range top[n:] {
+			other += d.Count
+		}
+		top = top[:n]
+	}
+	return TopBlocked{Domains: top, Other: other}
+}
+
+// Clients returns the query counts per client since the last stats reset,
+// most queries first.
+func (s *Server) Clients() []ClientActivity {
+	a := &s.activity
+	a.mu.Lock()
+	list := make([]ClientActivity, 0, len(a.clients))
+	for _, c := range a.clients {
+		list = append(list, *c)
+	}
+	a.mu.Unlock()
+
+	slices.SortFunc(list, func(x, y ClientActivity) int {
+		return cmp.Or(cmp.Compare(y.Queries, x.Queries), cmp.Compare(x.Client, y.Client))
+	})
+	return list
+}
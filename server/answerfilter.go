@@ -0,0 +1,43 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"time"
+
+	"adblocker/engine"
+
+	"github.com/miekg/dns"
+)
+
+// filterAnswer blocks an upstream answer with an address in the countries
+// or ASNs of an active rule group's block_answers. It writes the blocked
+// response and returns true, or returns false to serve the answer.
+func (s *Server) filterAnswer(w dns.ResponseWriter, r, m *dns.Msg, q dns.Question, res *engine.ResolveResult, answer *dns.Msg, blockTTL uint32, clientIP netip.Addr, clientMAC, clientID string, cached bool, start time.Time) bool {
+	if len(res.AnswerFilters) == 0 || s.GeoIP == nil {
+		return false
+	}
+
+	for _, ip := range answerAddrs(answer) {
+		info := s.GeoIP.Lookup(ip)
+		for _, f := range res.AnswerFilters {
+			rule := f.Match(info.Country, info.ASN)
+			if rule == nil {
+				continue
+			}
+
+			blocked := &engine.ResolveResult{Blocked: true, Reason: "Answer blocked", Rule: rule, User: res.User, UserGroup: res.UserGroup, RuleGroup: f.RuleGroup}
+			s.blockResponse(m, q, blocked, blockTTL)
+			s.signBlocked(r, m, decisionBlocked, blockTTL)
+			s.writeMsg(w, r, m)
+
+			sampled := s.logQuery(decisionBlocked)
+			if sampled && s.logThrottle.allow(clientIP, q.Name, decisionBlocked) {
+				log.Printf("[BLOCK:ANSWER] Domain: %s -> %s, Client: %s, Rule: %s, Group: %s", q.Name, ip, clientLabel(clientIP, res.User), rule.Text, f.RuleGroup)
+			}
+			s.finishQuery(q, clientIP, clientMAC, clientID, decisionBlocked, blocked, answer, cached, sampled, start)
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,14 @@ import (
 	"strings"
 )
 
+func checkARP() error {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func resolveARP(ip netip.Addr) string {
 	f, err := os.Open("/proc/net/arp")
 	if err != nil {
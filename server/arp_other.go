@@ -3,9 +3,14 @@
 package server
 
 import (
+	"errors"
 	"net/netip"
 )
 
+func checkARP() error {
+	return errors.New("MAC lookup is not supported on this platform")
+}
+
 func resolveARP(ip netip.Addr) string {
 	return ""
 }
@@ -28,6 +28,15 @@ type MIB_IPNETROW struct {
 	dwType        uint32
 }
 
+func checkARP() error {
+	var dwSize uint32
+	ret, _, _ := procGetIpNetTable.Call(0, uintptr(unsafe.Pointer(&dwSize)), 0)
+	if ret != 122 && ret != 0 { // ERROR_INSUFFICIENT_BUFFER
+		return fmt.Errorf("GetIpNetTable failed (%d)", ret)
+	}
+	return nil
+}
+
 func resolveARP(ip netip.Addr) string {
 	// First call to get size
 	var dwSize uint32
@@ -2,6 +2,7 @@ package server
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -10,14 +11,33 @@ import (
 // CacheEntry represents a cached DNS response.
 type CacheEntry struct {
 	Msg       *dns.Msg
+	StoredAt  time.Time
 	ExpiresAt time.Time
+	Tag       string // Optional caller metadata stored with the message
 }
 
 // TTLCache is a thread-safe cache with TTL support.
 type TTLCache struct {
-	items map[string]CacheEntry
-	mu    sync.RWMutex
-	stop  chan struct{}
+	items      map[string]CacheEntry
+	maxEntries int // 0 means unlimited
+	mu         sync.RWMutex
+	stop       chan struct{}
+	clock      Clock
+
+	// Effectiveness counters, see Stats
+	hits, misses, evictions, expirations atomic.Uint64
+}
+
+// CacheStats describes how well a TTLCache is doing.
+type CacheStats struct {
+	Entries     int     `json:"entries"`
+	MaxEntries  int     `json:"max_entries"` // 0 means unlimited
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"` // Includes expired and too-old entries
+	HitRatio    float64 `json:"hit_ratio"`
+	Evictions   uint64  `json:"evictions"`   // Live entries dropped to make room
+	Expirations uint64  `json:"expirations"` // Expired entries removed by cleanup
+	AvgAge      float64 `json:"avg_age_seconds"`
 }
 
 // NewTTLCache creates a new cache and starts the cleanup goroutine.
@@ -25,6 +45,7 @@ func NewTTLCache() *TTLCache {
 	c := &TTLCache{
 		items: make(map[string]CacheEntry),
 		stop:  make(chan struct{}),
+		clock: systemClock{},
 	}
 	go c.cleanupLoop()
 	return c
@@ -32,34 +53,125 @@ func NewTTLCache() *TTLCache {
 
 // Set adds a message to the cache with a specific TTL.
 func (c *TTLCache) Set(key string, msg *dns.Msg, ttl time.Duration) {
+	c.SetWithTag(key, msg, ttl, "")
+}
+
+// SetWithTag adds a message together with caller metadata.
+func (c *TTLCache) SetWithTag(key string, msg *dns.Msg, ttl time.Duration, tag string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// Make room by evicting an arbitrary entry when full
+	if _, ok := c.items[key]; !ok && c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		for k := range c.items {
+			delete(c.items, k)
+			c.evictions.Add(1)
+			break
+		}
+	}
+
 	// Clone message to prevent mutation of cached item
 	cachedMsg := msg.Copy()
+	now := c.clock.Now()
 	c.items[key] = CacheEntry{
 		Msg:       cachedMsg,
-		ExpiresAt: time.Now().Add(ttl),
+		StoredAt:  now,
+		ExpiresAt: now.Add(ttl),
+		Tag:       tag,
 	}
 }
 
 // Get retrieves a message if it exists and hasn't expired.
 func (c *TTLCache) Get(key string) *dns.Msg {
+	msg, _ := c.GetWithTag(key)
+	return msg
+}
+
+// GetWithTag retrieves a message and its metadata if it exists and hasn't expired.
+func (c *TTLCache) GetWithTag(key string) (*dns.Msg, string) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	entry, ok := c.items[key]
-	if !ok {
-		return nil
+	if !ok || c.clock.Now().After(entry.ExpiresAt) {
+		c.misses.Add(1)
+		return nil, ""
 	}
 
-	if time.Now().After(entry.ExpiresAt) {
+	c.hits.Add(1)
+	return entry.Msg.Copy(), entry.Tag
+}
+
+// GetMaxAge retrieves a message like Get, but only if it was stored less than maxAge ago.
+// Callers with a shorter TTL policy than the one that stored the entry use it.
+func (c *TTLCache) GetMaxAge(key string, maxAge time.Duration) *dns.Msg {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.items[key]
+	now := c.clock.Now()
+	if !ok || now.After(entry.ExpiresAt) || now.Sub(entry.StoredAt) >= maxAge {
+		c.misses.Add(1)
 		return nil
 	}
 
+	c.hits.Add(1)
 	return entry.Msg.Copy()
 }
 
+// DeleteFunc removes the entries for which match returns true and returns how many were removed.
+func (c *TTLCache) DeleteFunc(match func(CacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, entry := range c.items {
+		if match(entry) {
+			delete(c.items, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes all entries.
+func (c *TTLCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]CacheEntry)
+}
+
+// SetMaxEntries bounds the number of cached messages; 0 means unlimited.
+func (c *TTLCache) SetMaxEntries(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = n
+}
+
+// Stats returns the effectiveness counters and the current size and average entry age.
+func (c *TTLCache) Stats() CacheStats {
+	c.mu.RLock()
+	st := CacheStats{Entries: len(c.items), MaxEntries: c.maxEntries}
+	now := c.clock.Now()
+	var age time.Duration
+	for _, entry := range c.items {
+		age += now.Sub(entry.StoredAt)
+	}
+	c.mu.RUnlock()
+
+	if st.Entries > 0 {
+		st.AvgAge = (age / time.Duration(st.Entries)).Seconds()
+	}
+	st.Hits = c.hits.Load()
+	st.Misses = c.misses.Load()
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	st.Evictions = c.evictions.Load()
+	st.Expirations = c.expirations.Load()
+	return st
+}
+
 // Stop stops the background cleanup goroutine.
 func (c *TTLCache) Stop() {
 	close(c.stop)
@@ -83,10 +195,11 @@ func (c *TTLCache) cleanup() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	now := time.Now()
+	now := c.clock.Now()
 	for key, entry := range c.items {
 		if now.After(entry.ExpiresAt) {
 			delete(c.items, key)
+			c.expirations.Add(1)
 		}
 	}
 }
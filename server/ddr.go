@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"adblocker/config"
+
+	"github.com/miekg/dns"
+)
+
+// Names of the Discovery of Designated Resolvers (RFC 9462)
+const (
+	resolverArpa = "resolver.arpa." // Special-use zone, answered by every resolver itself
+	ddrName      = "_dns.resolver.arpa."
+)
+
+// ddrTTL is the TTL of the SVCB records; clients re-query when it expires.
+const ddrTTL = 300
+
+// handleDDR answers queries under resolver.arpa locally, with the SVCB
+// records of the encrypted listeners (RFC 9461) for _dns.resolver.arpa, so
+// clients upgrade to them on their own. _dns.<server name> gets the same
+// records for clients that already know the name (RFC 9462 section 5).
+// Returns false when the question is for neither.
+func (s *Server) handleDDR(w dns.ResponseWriter, m *dns.Msg, q dns.Question) bool {
+	name := dns.CanonicalName(q.Name)
+	cfg := s.Engine.Config().Server
+	target := s.ddrTarget(cfg)
+
+	switch {
+	case name == ddrName, target != "" && name == "_dns."+target:
+	case dns.IsSubDomain(resolverArpa, name):
+		// Never forwarded: upstream resolvers would advertise themselves
+		if name != resolverArpa {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+		return true
+	default:
+		return false
+	}
+
+	if q.Qtype == dns.TypeSVCB {
+		local := localAddr(w)
+		m.Answer = append(m.Answer, ddrRecords(cfg, q.Name, target, local)...)
+		if len(m.Answer) > 0 && name == ddrName {
+			s.ddrCert.checkVerified(cfg.TLSCertFile, local)
+		}
+	}
+	w.WriteMsg(m) // NODATA for other types or without listeners to advertise
+	return true
+}
+
+// ddrTarget returns the name the SVCB records point to, or "" when DDR is
+// disabled or the name is unknown.
+func (s *Server) ddrTarget(cfg config.ServerConfig) string {
+	if cfg.DDR.Disabled {
+		return ""
+	}
+	target := cfg.DDR.ServerName
+	if target == "" {
+		target = s.ddrCert.name(cfg.TLSCertFile)
+	}
+	if target == "" {
+		return ""
+	}
+	return dns.CanonicalName(target)
+}
+
+// ddrRecords returns the SVCB records of the encrypted listeners, DoH
+// first. Addresses of the listeners go into ipv4hint and ipv6hint; for
+// listeners on all addresses, or behind a local proxy, the address the
+// query came in on stands in.
+func ddrRecords(cfg config.ServerConfig, owner, target string, local netip.Addr) []dns.RR {
+	if target == "" {
+		return nil
+	}
+
+	var records []dns.RR
+	svcb := func(alpn string, listen string, port uint16, extra ...dns.SVCBKeyValue) {
+		host, p, err := net.SplitHostPort(listen)
+		if err != nil {
+			return
+		}
+		if port == 0 {
+			n, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return
+			}
+			port = uint16(n)
+		}
+		values := []dns.SVCBKeyValue{&dns.SVCBAlpn{Alpn: []string{alpn}}, &dns.SVCBPort{Port: port}}
+		hint := local
+		if ip, err := netip.ParseAddr(host); err == nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			hint = ip
+		}
+		switch {
+		case !hint.IsValid() || hint.IsUnspecified():
+		case hint.Is4():
+			values = append(values, &dns.SVCBIPv4Hint{Hint: []net.IP{hint.AsSlice()}})
+		default:
+			values = append(values, &dns.SVCBIPv6Hint{Hint: []net.IP{hint.AsSlice()}})
+		}
+		records = append(records, &dns.SVCB{
+			Hdr:      dns.RR_Header{Name: owner, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: ddrTTL},
+			Priority: uint16(len(records) + 1),
+			Target:   target,
+			Value:    append(values, extra...),
+		})
+	}
+	doh := &dns.SVCBDoHPath{Template: dohPath + "{?dns}"}
+	switch {
+	case cfg.ListenHTTPS != "":
+		svcb("h2", cfg.ListenHTTPS, cfg.DDR.HTTPSPort, doh)
+	case cfg.ListenHTTP != "" && cfg.DDR.HTTPSPort != 0:
+		svcb("h2", cfg.ListenHTTP, cfg.DDR.HTTPSPort, doh)
+	}
+	if cfg.ListenTLS != "" {
+		svcb("dot", cfg.ListenTLS, 0)
+	}
+	return records
+}
+
+// localAddr returns the address a query came in on, invalid when unknown.
+func localAddr(w dns.ResponseWriter) netip.Addr {
+	if w.LocalAddr() == nil {
+		return netip.Addr{}
+	}
+	addrPort, err := netip.ParseAddrPort(w.LocalAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// ddrCert remembers the first DNS name of tls_cert_file, the default
+// target of the DDR records, and its IP addresses until the file changes.
+type ddrCert struct {
+	mu      sync.Mutex
+	file    string
+	modTime time.Time
+	dnsName string
+	ips     []netip.Addr
+	warned  []netip.Addr // Local addresses missing from the certificate, logged once
+}
+
+// load reads file if it changed. Caller holds mu.
+func (c *ddrCert) load(file string) {
+	info, err := os.Stat(file)
+	if err != nil || file == c.file && info.ModTime().Equal(c.modTime) {
+		return
+	}
+	c.file, c.modTime, c.dnsName, c.ips, c.warned = file, info.ModTime(), "", nil, nil
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Printf("[DDR] Failed to parse %s: %v", file, err)
+		return
+	}
+	if len(cert.DNSNames) > 0 {
+		c.dnsName = cert.DNSNames[0]
+	} else {
+		log.Printf("[DDR] %s has no DNS name to advertise, set server.ddr.server_name", file)
+	}
+	for _, ip := range cert.IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			c.ips = append(c.ips, addr.Unmap())
+		}
+	}
+}
+
+func (c *ddrCert) name(file string) string {
+	if file == "" {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load(file)
+	return c.dnsName
+}
+
+// checkVerified logs once per address when the certificate does not cover
+// local, the address clients asked. Clients that verify the discovery (RFC
+// 9462 section 4.2), like Windows and Apple systems, then stay unencrypted.
+func (c *ddrCert) checkVerified(file string, local netip.Addr) {
+	if file == "" || !local.IsValid() || local.IsUnspecified() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load(file)
+	if slices.Contains(c.ips, local) || slices.Contains(c.warned, local) {
+		return
+	}
+	c.warned = append(c.warned, local)
+	log.Printf("[DDR] %s does not list IP address %s, so clients verifying the discovery will not upgrade to the encrypted listeners", file, local)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends a query to an upstream and returns the answer and the
+// transport it went over (see encryptedTransport).
+type Exchanger interface {
+	Exchange(r *dns.Msg, upstream string) (*dns.Msg, string, error)
+}
+
+// ExchangerFunc adapts a function to the Exchanger interface.
+type ExchangerFunc func(r *dns.Msg, upstream string) (*dns.Msg, string, error)
+
+func (f ExchangerFunc) Exchange(r *dns.Msg, upstream string) (*dns.Msg, string, error) {
+	return f(r, upstream)
+}
+
+// MACLookup resolves the MAC address of a client on the local network, or
+// "" when it is unknown. *MacResolver implements it.
+type MACLookup interface {
+	GetMAC(ip netip.Addr) string
+}
+
+// Clock tells the time for query handling, cache expiry, schedules and
+// the background work of the server.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// swapClock is the clock of the server. SetClock replaces the clock inside,
+// so the goroutines NewServer starts can read it meanwhile.
+type swapClock struct {
+	c atomic.Pointer[Clock]
+}
+
+func newSwapClock(c Clock) *swapClock {
+	sc := &swapClock{}
+	sc.c.Store(&c)
+	return sc
+}
+
+func (sc *swapClock) Now() time.Time { return (*sc.c.Load()).Now() }
+
+// SetClock replaces the clock of the server, its caches and its engine. It
+// must be called before the server starts.
+func (s *Server) SetClock(c Clock) {
+	s.clock.c.Store(&c)
+	s.UserGroupCache.clock = c
+	s.UpstreamCache.clock = c
+	s.Engine.SetClock(c)
+}
@@ -1,12 +1,24 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"adblocker/config"
 	"adblocker/engine"
+	"adblocker/events"
+	"adblocker/geoip"
+	"adblocker/stats"
 
 	"time"
 
@@ -16,136 +28,430 @@ import (
 // Server handles incoming DNS queries.
 type Server struct {
 	Engine         *engine.Engine
-	Upstream       string
-	Server         *dns.Server
-	MacResolver    *MacResolver
+	Server         *dns.Server // Template for the listeners; its Addr is served over UDP and, unless disable_tcp, TCP
+	MacResolver    MACLookup
+	Exchanger      Exchanger // Sends queries upstream, default plain DNS with TCP retry, DoT for tls:// or DoH for https:// upstreams
 	UserGroupCache *TTLCache
 	UpstreamCache  *TTLCache
+	Stats          *stats.Store
+	Events         *events.Exporter // Optional, ships decision events to collectors
+	GeoIP          *geoip.DB        // Optional, annotates exported answers with country and ASN
+
+	clock         *swapClock // See SetClock
+	logThrottle   *logThrottle
+	upstreamUsage upstreamUsage // Queries sent per upstream and transport
+	fallback      fallbackState // Whether the fallback upstream tier is engaged
+
+	upstreamOutcomes upstreamOutcomes // Recent errors per upstream, see UpstreamLatency
+	standby          standbyState     // Hot standby promotion, see SetPromoted
+	statsReset       statsResetState  // Last reset, see ResetStats
+	ecsScopes        ecsScopes        // Subnet scope of cached answers, see cachedForSubnet
+	traces           traceLog         // Latest traces requested with server.trace_option
+	activity         activity         // Query log and counters of the dashboard
+	ddrCert          ddrCert          // Default DDR target, see ddrRecords
+
+	upstreamMu sync.RWMutex
+	upstreams  []string // Tried in order, see exchange
+
+	serverMu    sync.Mutex    // Guards Server and the listeners
+	servers     []*dns.Server // Listeners, replaced on every Start
+	tlsServer   *dns.Server   // DNS-over-TLS listener, replaced on every StartTLS
+	httpsServer *http.Server  // DNS-over-HTTPS listener, replaced on every StartHTTPS
+	httpServer  *http.Server  // Plain-HTTP DoH listener, replaced on every StartHTTP
+
+	flights      flightGroup                  // Deduplicates concurrent upstream exchanges
+	queryLimiter atomic.Pointer[queryLimiter] // See limiter
+
+	stop chan struct{} // Stops background work started by NewServer
+
+	invalidClientLogged atomic.Bool // See acceptInvalidClient
+
+	started atomic.Bool
 }
 
 // NewServer creates a new DNS server instance.
-func NewServer(addr string, upstream string, engine *engine.Engine) *Server {
+func NewServer(addr string, upstreams []string, engine *engine.Engine) *Server {
 	srv := &Server{
 		Engine:         engine,
-		Upstream:       upstream,
+		upstreams:      upstreams,
 		MacResolver:    NewMacResolver(5 * time.Minute), // Cache for 5 minutes
 		UserGroupCache: NewTTLCache(),
 		UpstreamCache:  NewTTLCache(),
+		Stats:          stats.NewStore(),
+		clock:          newSwapClock(systemClock{}),
+		stop:           make(chan struct{}),
 	}
+	srv.Exchanger = newUpstreamPool(func(upstream string) config.UpstreamTLS {
+		return srv.Engine.Config().Server.UpstreamTLS[upstream]
+	})
+	srv.upstreamUsage.since = time.Now()
+	srv.upstreamUsage.usage = make(map[usageKey]*UpstreamUsage)
+	srv.logThrottle = newLogThrottle(func() config.LogThrottle { return srv.Engine.Config().Server.LogThrottle }, srv.clock)
+	go srv.watchTransitions(srv.stop)
+	go srv.watchPromoteFile(srv.stop)
+	go srv.watchStatsReset(srv.stop)
+	registerCacheMetrics(srv)
+	registerUpstreamMetrics(srv)
+	registerStandbyMetrics(srv)
 
 	srv.Server = &dns.Server{
 		Addr:    addr,
 		Net:     "udp",
 		Handler: dns.HandlerFunc(srv.handleRequest),
 	}
+	srv.Server.NotifyStartedFunc = func() { srv.started.Store(true) }
 
 	return srv
 }
 
+// Start binds the UDP and TCP listeners and serves until one of them fails
+// or Stop is called, then stops the other. It may be called again after it
+// returned with an error.
 func (s *Server) Start() error {
-	log.Printf("DNS Server listening on %s (Upstream: %s)", s.Server.Addr, s.Upstream)
-	return s.Server.ListenAndServe()
+	s.serverMu.Lock()
+	tmpl := s.Server
+	s.serverMu.Unlock()
+
+	// 1. Bind all sockets up front so a failure leaves nothing half-started
+	pc, err := net.ListenPacket("udp", tmpl.Addr)
+	if err != nil {
+		return err
+	}
+	closers := []io.Closer{pc}
+	networks := "udp"
+	// A dns.Server cannot be restarted after its listener failed, so serve on fresh copies
+	servers := []*dns.Server{{Addr: tmpl.Addr, Net: "udp", PacketConn: pc, Handler: tmpl.Handler, NotifyStartedFunc: tmpl.NotifyStartedFunc}}
+	if !s.Engine.Config().Server.DisableTCP {
+		l, err := net.Listen("tcp", tmpl.Addr)
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		closers = append(closers, l)
+		networks += "+tcp"
+		servers = append(servers, &dns.Server{Addr: tmpl.Addr, Net: "tcp", Listener: l, Handler: tmpl.Handler})
+	}
+	s.serverMu.Lock()
+	s.servers = servers
+	s.serverMu.Unlock()
+
+	// 2. Serve until one listener fails; closing the sockets ends the others
+	log.Printf("DNS Server listening on %s %s (Upstream: %s)", networks, tmpl.Addr, strings.Join(s.Upstreams(), ", "))
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			errCh <- srv.ActivateAndServe()
+		}(srv)
+	}
+	err = <-errCh
+	s.started.Store(false)
+	for _, c := range closers {
+		c.Close()
+	}
+	for range len(servers) - 1 {
+		<-errCh
+	}
+	return err
 }
 
-func (s *Server) Stop() error {
+// Stop shuts the listener down, waiting for in-flight queries until ctx expires.
+func (s *Server) Stop(ctx context.Context) error {
+	s.started.Store(false)
+	close(s.stop)
 	s.UserGroupCache.Stop()
 	s.UpstreamCache.Stop()
-	return s.Server.Shutdown()
+
+	s.serverMu.Lock()
+	servers := s.servers
+	if s.tlsServer != nil {
+		servers = append(servers[:len(servers):len(servers)], s.tlsServer)
+	}
+	httpServers := []*http.Server{s.httpsServer, s.httpServer}
+	s.serverMu.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.ShutdownContext(ctx))
+	}
+	for _, srv := range httpServers {
+		if srv != nil {
+			errs = append(errs, srv.Shutdown(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ready reports whether the listener is accepting queries.
+func (s *Server) Ready() error {
+	if !s.started.Load() {
+		return errors.New("dns listener not started")
+	}
+	return nil
+}
+
+// CacheStats reports the effectiveness of the group and upstream caches,
+// keyed like the cache label of adblocker_cache_hits_total.
+func (s *Server) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"group":    s.UserGroupCache.Stats(),
+		"upstream": s.UpstreamCache.Stats(),
+	}
+}
+
+// Upstreams returns the current upstream resolver addresses, in the order they are tried.
+func (s *Server) Upstreams() []string {
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	return s.upstreams
+}
+
+// SetUpstreams switches the upstream resolvers and drops answers cached from the old ones.
+func (s *Server) SetUpstreams(upstreams []string) {
+	s.upstreamMu.Lock()
+	changed := !slices.Equal(s.upstreams, upstreams)
+	s.upstreams = upstreams
+	s.upstreamMu.Unlock()
+
+	if changed {
+		s.UpstreamCache.Flush()
+	}
+}
+
+// upstreamsFor returns the upstreams res is forwarded to: those of its
+// UserGroup, or server.upstream.
+func (s *Server) upstreamsFor(res *engine.ResolveResult) []string {
+	if len(res.Upstream) > 0 {
+		return res.Upstream
+	}
+	return s.Upstreams()
+}
+
+// acceptInvalidClient decides what happens to a query whose client address
+// cannot be parsed. Unless server.invalid_client is "refuse", it is answered
+// with a zero address, which no user matches, so the default group applies.
+// Only the first failure is logged; the metric counts all of them.
+func (s *Server) acceptInvalidClient(addr net.Addr, err error) bool {
+	action := s.Engine.Config().Server.InvalidClient
+	if action == "" {
+		action = "default"
+	}
+	clientAddrInvalid.Inc(action)
+	if s.invalidClientLogged.CompareAndSwap(false, true) {
+		log.Printf("[CLIENT] Cannot parse client address %q (%v), handling as %s; further failures are only counted in adblocker_client_addr_invalid_total",
+			addr, err, action)
+	}
+	return action != "refuse"
+}
+
+// ServeDNS answers one query, so the server can be driven in process
+// (see package servertest).
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.handleRequest(w, r)
 }
 
 func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	// An unpromoted standby resolves as usual to keep its caches warm,
+	// but withholds the answer
+	clientID := queryClientID(w)
+	if s.standbyActive() {
+		action := s.Engine.Config().Server.Standby.Action
+		if action == "" {
+			action = "drop"
+		}
+		w = standbyWriter{ResponseWriter: w, action: action}
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = true
 	m.Authoritative = true // We are authoritative for blocks
+	start := s.clock.Now()
 
 	// 1. Get Client Info
 	rAddr := w.RemoteAddr()
-	clientIP, _ := netip.ParseAddrPort(rAddr.String())
-	clientMAC := s.MacResolver.GetMAC(clientIP.Addr())
+	addrPort, err := netip.ParseAddrPort(rAddr.String())
+	if err != nil && !s.acceptInvalidClient(rAddr, err) {
+		m.Rcode = dns.RcodeRefused
+		s.writeMsg(w, r, m)
+		return
+	}
+	// Dual-stack listeners deliver IPv4 clients as ::ffff:a.b.c.d
+	clientIP := addrPort.Addr().Unmap()
+
+	// Concurrency limits come before any work is done for the query
+	if l := s.limiter(); l != nil {
+		release, limit, ok := l.acquire(clientIP)
+		if !ok {
+			queriesLimited.Inc(limit)
+			dns.HandleFailed(w, r)
+			return
+		}
+		defer release()
+	}
+
+	var clientMAC string
+	if clientIP.IsValid() {
+		clientMAC = s.MacResolver.GetMAC(clientIP)
+	}
 
 	// 2. Determine User Group (for Caching)
-	user := s.Engine.GetUser(clientIP.Addr(), clientMAC)
+	user := s.Engine.GetUser(clientIP, clientMAC, clientID)
 	userGroupName := s.getUserGroupName(user)
+	// Clients in a canary rollout see other rules than the rest of their group
+	if key := s.Engine.CanaryKey(user, clientIP); key != "" {
+		userGroupName += " [canary: " + key + "]"
+	}
+	policyGroup := s.Engine.UserGroupName(user)
+	cachePolicy := s.Engine.CachePolicy(policyGroup)
+	// Clients should not keep answers past the next schedule change either
+	blockTTL := uint32(s.untilTransition(policyGroup, cachePolicy.BlockTTL).Seconds())
+	clientMaxTTL := s.untilTransition(policyGroup, cachePolicy.MaxTTL)
+
+	// Queries asking for a trace with server.trace_option are always evaluated
+	traced := s.wantsTrace(r, clientIP)
 
 	for _, q := range r.Question {
+		// Explanations for the why_zone are answered locally and never cached
+		if s.handleWhy(w, m, q, clientIP, clientMAC, clientID) {
+			return
+		}
+		// Designated resolver discovery is answered locally too
+		if s.handleDDR(w, m, q) {
+			return
+		}
+		// Special-use domains (localhost, invalid, ...) never leave the resolver
+		if s.handleSpecialUse(w, r, m, q) {
+			return
+		}
+
 		// 3. Check UserGroup Cache (Internal blocks/rewrites)
 		// Key: Group:Type:Name
 		ugKey := fmt.Sprintf("%s:%d:%s", userGroupName, q.Qtype, q.Name)
-		if cached := s.UserGroupCache.Get(ugKey); cached != nil {
+		var cached *dns.Msg
+		var tag string
+		if !traced {
+			cached, tag = s.UserGroupCache.GetWithTag(ugKey)
+		}
+		if cached != nil {
 			cached.Id = r.Id // Restore ID
-			w.WriteMsg(cached)
-			log.Printf("[CACHE:GROUP] Hit for %s (%s)", q.Name, userGroupName)
+			_, ruleGroup, decision := parseCacheTag(tag)
+			s.signBlocked(r, cached, decision, blockTTL)
+			s.writeMsg(w, r, cached)
+			sampled := s.logQuery(decision)
+			printed := sampled && s.logThrottle.allow(clientIP, q.Name, decision)
+			if printed {
+				log.Printf("[CACHE:GROUP] Hit for %s (%s)", q.Name, userGroupName)
+			}
+			cacheHits.Inc("group")
+			// The cache tag keeps the rule group, not the rule
+			res := &engine.ResolveResult{User: user, UserGroup: policyGroup, RuleGroup: ruleGroup}
+			s.finishQuery(q, clientIP, clientMAC, clientID, decision, res, nil, true, sampled, start)
 			return
 		}
 
 		// 4. Query Engine (Rule Check)
-		res := s.Engine.Resolve(q.Name, q.Qtype, clientIP.Addr(), clientMAC)
+		var res *engine.ResolveResult
+		if traced {
+			var t QueryTrace
+			res, t = s.traceResolve(q.Name, q.Qtype, clientIP, clientMAC, clientID)
+			s.recordTrace(t, clientIP)
+		} else {
+			res = s.Engine.Resolve(q.Name, q.Qtype, clientIP, clientMAC, clientID)
+		}
+
+		// Sampled once per query so the log and the events agree; repeats are only throttled in the log
+		decision := decisionOf(res)
+		sampled := s.logQuery(decision)
+		printed := sampled && s.logThrottle.allow(clientIP, q.Name, decision)
 
 		if res.Blocked {
-			// Construct Block/Rewrite Response
-			m.RecursionAvailable = true
-
-			if res.DNSRewrite != "" {
-				log.Printf("[REWRITE] Domain: %s -> %s, Client: %s, Rule: %s", q.Name, res.DNSRewrite, clientIP.Addr(), res.Rule.Pattern)
-				rewriteDest := res.DNSRewrite
-				rrHeader := fmt.Sprintf("%s 20 IN", q.Name)
-
-				if destIP, err := netip.ParseAddr(rewriteDest); err == nil {
-					if q.Qtype == dns.TypeA && destIP.Is4() {
-						rr, _ := dns.NewRR(fmt.Sprintf("%s A %s", rrHeader, destIP.String()))
-						m.Answer = append(m.Answer, rr)
-					} else if q.Qtype == dns.TypeAAAA && destIP.Is6() {
-						rr, _ := dns.NewRR(fmt.Sprintf("%s AAAA %s", rrHeader, destIP.String()))
-						m.Answer = append(m.Answer, rr)
-					}
+			if printed {
+				if res.DNSRewrite != "" {
+					log.Printf("[REWRITE] Domain: %s -> %s, Client: %s, Rule: %s", q.Name, res.DNSRewrite, clientLabel(clientIP, res.User), res.Rule.Pattern)
 				} else {
-					if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-						rr, _ := dns.NewRR(fmt.Sprintf("%s CNAME %s.", rrHeader, rewriteDest))
-						m.Answer = append(m.Answer, rr)
-					}
-				}
-			} else {
-				log.Printf("[BLOCK] Domain: %s, Client: %s (MAC: %s), Rule: %s, Group: %s", q.Name, clientIP.Addr(), clientMAC, res.Rule.Pattern, userGroupName)
-				switch q.Qtype {
-				case dns.TypeA:
-					rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 0.0.0.0", q.Name))
-					m.Answer = append(m.Answer, rr)
-				case dns.TypeAAAA:
-					rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN AAAA ::", q.Name))
-					m.Answer = append(m.Answer, rr)
+					log.Printf("[BLOCK] Domain: %s, Client: %s (MAC: %s), Rule: %s, Group: %s", q.Name, clientLabel(clientIP, res.User), clientMAC, res.Rule.Pattern, userGroupName)
 				}
 			}
+			s.blockResponse(m, q, res, blockTTL)
+			s.chaseRewrite(m, q, res)
 
-			// Cache UserGroup Result (20s)
-			s.UserGroupCache.Set(ugKey, m, 20*time.Second)
-			w.WriteMsg(m)
+			// Cache UserGroup Result, never past the next schedule change
+			if ttl := s.untilTransition(policyGroup, cachePolicy.DecisionTTL); ttl > 0 {
+				s.UserGroupCache.SetWithTag(ugKey, m, ttl, cacheTag(policyGroup, res.RuleGroup, decision))
+			}
+			s.signBlocked(r, m, decision, blockTTL)
+			s.writeMsg(w, r, m)
+			s.finishQuery(q, clientIP, clientMAC, clientID, decision, res, nil, false, sampled, start)
 			return
 
 		} else {
 			// 5. Allowed -> Check Upstream Cache
-			log.Printf("[ALLOW] Domain: %s, Client: %s (MAC: %s)", q.Name, clientIP.Addr(), clientMAC)
+			if printed {
+				log.Printf("[ALLOW] Domain: %s, Client: %s (MAC: %s)", q.Name, clientLabel(clientIP, res.User), clientMAC)
+			}
 
-			// Key: Type:Name (Global)
+			// LAN names are not for the public upstream, see server.local_names
+			if resp := s.answerLocalName(w, r, m, q); resp != nil {
+				s.finishQuery(q, clientIP, clientMAC, clientID, decision, res, resp, false, sampled, start)
+				return
+			}
+
+			// Key: Type:Name (Global), with server.ecs also per client subnet scope
+			// and, for UserGroups with their own upstream, per upstream
 			upstreamKey := fmt.Sprintf("%d:%s", q.Qtype, q.Name)
-			if cached := s.UpstreamCache.Get(upstreamKey); cached != nil {
+			if len(res.Upstream) > 0 {
+				upstreamKey = strings.Join(res.Upstream, ",") + "|" + upstreamKey
+			}
+			subnet := s.ecsSubnet(r, clientIP)
+			if cached := s.cachedForSubnet(upstreamKey, subnet, func(key string) *dns.Msg {
+				return s.UpstreamCache.GetMaxAge(key, cachePolicy.MaxTTL)
+			}); cached != nil {
 				cached.Id = r.Id
-				w.WriteMsg(cached)
-				log.Printf("[CACHE:UPSTREAM] Hit for %s", q.Name)
+				ecsReply(cached, r)
+				if s.filterAnswer(w, r, m, q, res, cached, blockTTL, clientIP, clientMAC, clientID, true, start) {
+					return
+				}
+				capTTL(cached, clientMaxTTL)
+				minimizeResponse(cached, s.Engine.ResponsePrivacy(policyGroup))
+				s.writeMsg(w, r, cached)
+				if printed {
+					log.Printf("[CACHE:UPSTREAM] Hit for %s", q.Name)
+				}
+				cacheHits.Inc("upstream")
+				s.finishQuery(q, clientIP, clientMAC, clientID, decision, res, cached, true, sampled, start)
 				return
 			}
 
-			// 6. Query Upstream
-			resp, err := dns.Exchange(r, s.Upstream)
+			// 6. Query Upstream (concurrent identical queries share one exchange)
+			upstreams := s.upstreamsFor(res)
+			flightKey, query := upstreamKey, r
+			if subnet.IsValid() {
+				flightKey, query = ecsKey(upstreamKey, subnet), withECS(r, subnet)
+			}
+			var used string // Upstream that answered, set by the exchange this query ran
+			resp, err, shared := s.flights.do(flightKey, func() (*dns.Msg, error) {
+				resp, u, err := s.exchange(query, upstreams)
+				used = u
+				return resp, err
+			})
+			if shared {
+				upstreamShared.Inc(upstreams[0])
+				if resp != nil {
+					resp.Id = r.Id
+				}
+			}
 			if err != nil {
-				log.Printf("Upstream error: %v", err)
+				if !shared { // Counted once per exchange
+					log.Printf("Upstream error: %v", err)
+					upstreamErrors.Inc(used)
+				}
 				dns.HandleFailed(w, r)
 				return
 			}
 
 			// 7. Calculate TTL & Cache
-			minTTL := uint32(20)      // 20s
-			maxTTL := uint32(30 * 60) // 30m
+			minTTL := uint32(cachePolicy.MinTTL.Seconds())
+			maxTTL := uint32(cachePolicy.MaxTTL.Seconds())
 
 			// Find smallest TTL in response
 			recordTTL := maxTTL // Default start high
@@ -178,17 +484,100 @@ func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 				finalTTL = maxTTL
 			}
 
-			// Cache Upstream Result
-			s.UpstreamCache.Set(upstreamKey, resp, time.Duration(finalTTL)*time.Second)
+			// Cache Upstream Result, for the subnet scope upstream returned if any
+			cacheKey := upstreamKey
+			if subnet.IsValid() {
+				if scope := ecsScope(resp, subnet); scope.IsValid() {
+					cacheKey = ecsKey(upstreamKey, scope)
+					s.ecsScopes.set(upstreamKey, scope.Bits())
+				}
+			}
+			s.UpstreamCache.Set(cacheKey, resp, time.Duration(finalTTL)*time.Second)
+			ecsReply(resp, r)
+
+			// 8. Check the addresses against the answer filters of the active rule groups
+			if s.filterAnswer(w, r, m, q, res, resp, blockTTL, clientIP, clientMAC, clientID, false, start) {
+				return
+			}
 
-			w.WriteMsg(resp)
+			capTTL(resp, clientMaxTTL)
+			minimizeResponse(resp, s.Engine.ResponsePrivacy(policyGroup))
+			s.writeMsg(w, r, resp)
+			s.finishQuery(q, clientIP, clientMAC, clientID, decision, res, resp, false, sampled, start)
 			return
 		}
 	}
 
 	// Should allow empty queries? Usually r.Question has 1 item.
 	// If loops finishes without return (empty question), existing m is sent (empty).
-	w.WriteMsg(m)
+	s.writeMsg(w, r, m)
+}
+
+// blockResponse fills m with the blocked or rewritten answer for q.
+func (s *Server) blockResponse(m *dns.Msg, q dns.Question, res *engine.ResolveResult, blockTTL uint32) {
+	m.RecursionAvailable = true
+
+	if res.DNSRewrite != "" {
+		rewriteDest := res.DNSRewrite
+		rrHeader := fmt.Sprintf("%s %d IN", q.Name, blockTTL)
+
+		if destIP, err := netip.ParseAddr(rewriteDest); err == nil {
+			if q.Qtype == dns.TypeA && destIP.Is4() {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s A %s", rrHeader, destIP.String()))
+				m.Answer = append(m.Answer, rr)
+			} else if q.Qtype == dns.TypeAAAA && destIP.Is6() {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s AAAA %s", rrHeader, destIP.String()))
+				m.Answer = append(m.Answer, rr)
+			}
+		} else {
+			if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s CNAME %s.", rrHeader, rewriteDest))
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	} else {
+		// Answered as server.blocking_mode or the rule group's own
+		mode := s.Engine.BlockingMode(res.RuleGroup)
+		v4, v6 := netip.IPv4Unspecified(), netip.IPv6Unspecified()
+		switch mode.Mode {
+		case "nxdomain":
+			m.Rcode = dns.RcodeNameError
+			v4, v6 = netip.Addr{}, netip.Addr{}
+		case "refused":
+			m.Rcode = dns.RcodeRefused
+			return // Nothing to cache negatively, no SOA
+		case "custom_ip":
+			v4, v6 = mode.Addrs()
+		}
+
+		switch {
+		case q.Qtype == dns.TypeA && v4.IsValid():
+			rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A %s", q.Name, blockTTL, v4))
+			m.Answer = append(m.Answer, rr)
+		case q.Qtype == dns.TypeAAAA && v6.IsValid():
+			rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN AAAA %s", q.Name, blockTTL, v6))
+			m.Answer = append(m.Answer, rr)
+		case (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeNS) && m.Rcode == dns.RcodeSuccess:
+			m.Answer = append(m.Answer, s.apexAnswer(q, res.Rule, blockTTL)...)
+		}
+	}
+
+	// No records for this type (e.g. MX of a blocked domain) or nxdomain mode: answer NODATA or NXDOMAIN with an SOA
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, s.blockedSOA(q.Name, blockTTL))
+	}
+}
+
+// capTTL lowers record TTLs above max so clients do not cache longer than the group allows.
+func capTTL(msg *dns.Msg, max time.Duration) {
+	limit := uint32(max.Seconds())
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > limit {
+				rr.Header().Ttl = limit
+			}
+		}
+	}
 }
 
 func (s *Server) getUserGroupName(u *config.User) string {
@@ -0,0 +1,212 @@
+package server_test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/parser"
+	"adblocker/server"
+	"adblocker/server/servertest"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	_ dns.ResponseWriter = (*servertest.ResponseWriter)(nil)
+	_ server.Exchanger   = (*servertest.Upstream)(nil)
+	_ server.MACLookup   = servertest.MACs(nil)
+	_ server.Clock       = (*servertest.Clock)(nil)
+)
+
+// newTestServer returns a server for cfg whose upstream serves records. The
+// default user group "all" blocks the given rules.
+func newTestServer(t *testing.T, cfg *config.Config, rules []string, records ...string) (*server.Server, *servertest.Upstream) {
+	t.Helper()
+	cfg.RuleGroups = append(cfg.RuleGroups, config.RuleGroup{Name: "test", Rules: rules})
+	cfg.UserGroups = append(cfg.UserGroups, config.UserGroup{Name: "all", Policies: []config.Policy{{RuleGroup: "test"}}})
+	cfg.Defaults.UserGroup = "all"
+
+	eng, err := engine.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	if err := eng.ReloadRules(parser.NewLoader(t.TempDir())); err != nil {
+		t.Fatalf("ReloadRules: %v", err)
+	}
+	up, err := servertest.NewUpstream(records...)
+	if err != nil {
+		t.Fatalf("NewUpstream: %v", err)
+	}
+
+	srv := server.NewServer("127.0.0.1:0", []string{"192.0.2.53:53"}, eng)
+	srv.Exchanger = up
+	srv.MacResolver = servertest.MACs(nil)
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return srv, up
+}
+
+func TestInvalidClient(t *testing.T) {
+	tests := []struct {
+		action string
+		rcode  int
+		answer string // Expected A record, "" for none
+	}{
+		{"", dns.RcodeSuccess, "0.0.0.0"}, // Blocked for the default group
+		{"default", dns.RcodeSuccess, "0.0.0.0"},
+		{"refuse", dns.RcodeRefused, ""},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.action, "unset"), func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Server.InvalidClient = tt.action
+			srv, _ := newTestServer(t, cfg, []string{"||ads.example^"})
+
+			var logs bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&logs)
+
+			for range 2 {
+				// A client address that is no IP address, as from a custom listener
+				w := servertest.NewResponseWriter("192.0.2.1:5353")
+				w.Remote = &net.UnixAddr{Name: "@client", Net: "unixgram"}
+				r := new(dns.Msg)
+				r.SetQuestion("ads.example.", dns.TypeA)
+				srv.ServeDNS(w, r)
+
+				if len(w.Msgs) != 1 {
+					t.Fatalf("got %d replies, want 1", len(w.Msgs))
+				}
+				m := w.Msgs[0]
+				if m.Rcode != tt.rcode {
+					t.Errorf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+				}
+				var answer string
+				if len(m.Answer) > 0 {
+					if a, ok := m.Answer[0].(*dns.A); ok {
+						answer = a.A.String()
+					}
+				}
+				if answer != tt.answer {
+					t.Errorf("answer = %q, want %q", answer, tt.answer)
+				}
+			}
+			if n := strings.Count(logs.String(), "[CLIENT] Cannot parse client address"); n != 1 {
+				t.Errorf("logged %d times, want once:\n%s", n, logs.String())
+			}
+		})
+	}
+}
+
+// answerA returns the address of the first A record of m, or "".
+func answerA(m *dns.Msg) string {
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return ""
+}
+
+func TestBlocking(t *testing.T) {
+	srv, up := newTestServer(t, &config.Config{}, []string{"||ads.example^"},
+		"www.example. 300 IN A 192.0.2.10")
+	client := &servertest.Client{Handler: srv}
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer string
+	}{
+		{"ads.example", dns.RcodeSuccess, "0.0.0.0"},
+		{"cdn.ads.example", dns.RcodeSuccess, "0.0.0.0"},
+		{"www.example", dns.RcodeSuccess, "192.0.2.10"},
+		{"missing.example", dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		m, err := client.Query(tt.name, dns.TypeA)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if m.Rcode != tt.rcode || answerA(m) != tt.answer {
+			t.Errorf("%s: got %s %q, want %s %q", tt.name,
+				dns.RcodeToString[m.Rcode], answerA(m), dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+
+	// Blocked names never reach the upstream
+	if got, want := up.Queries(), []string{"www.example.", "missing.example."}; !slices.Equal(got, want) {
+		t.Errorf("upstream queries = %v, want %v", got, want)
+	}
+}
+
+func TestUpstreamCache(t *testing.T) {
+	srv, up := newTestServer(t, &config.Config{}, nil, "www.example. 300 IN A 192.0.2.10")
+	clock := servertest.NewClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	srv.SetClock(clock)
+	client := &servertest.Client{Handler: srv}
+
+	query := func() {
+		t.Helper()
+		m, err := client.Query("www.example", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answerA(m) != "192.0.2.10" {
+			t.Fatalf("answer = %q, want 192.0.2.10", answerA(m))
+		}
+	}
+
+	query()
+	clock.Advance(299 * time.Second)
+	query() // Cached
+	if n := len(up.Queries()); n != 1 {
+		t.Errorf("upstream asked %d times within the TTL, want 1", n)
+	}
+
+	clock.Advance(2 * time.Second)
+	query() // Expired
+	if n := len(up.Queries()); n != 2 {
+		t.Errorf("upstream asked %d times after the TTL, want 2", n)
+	}
+}
+
+// The clock of the server also drives the engine, here an override.
+func TestOverrideClock(t *testing.T) {
+	cfg := &config.Config{
+		Users: []config.User{{Name: "kid", IPs: []string{"192.0.2.1"}, UserGroup: "all"}},
+	}
+	srv, _ := newTestServer(t, cfg, []string{"||ads.example^"}, "ads.example. 60 IN A 192.0.2.20")
+	clock := servertest.NewClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	srv.SetClock(clock)
+	client := &servertest.Client{Handler: srv, Addr: "192.0.2.1:5353"}
+
+	err := srv.Engine.SetOverride(engine.DeviceOverride{User: "kid", Mode: engine.OverridePause, Until: clock.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("SetOverride: %v", err)
+	}
+	m, err := client.Query("ads.example", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answerA(m) != "192.0.2.20" {
+		t.Errorf("paused: answer = %q, want the upstream's 192.0.2.20", answerA(m))
+	}
+
+	clock.Advance(2 * time.Hour)
+	m, err = client.Query("ads.example", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answerA(m) != "0.0.0.0" {
+		t.Errorf("pause over: answer = %q, want 0.0.0.0", answerA(m))
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// signBlocked adjusts a blocked or rewritten answer m for clients that asked
+// for DNSSEC records (DO bit). The synthesized answer cannot carry valid
+// signatures, and validating stubs (systemd-resolved in strict mode, Android
+// private DNS, getdns) treat an unsigned answer for a signed zone as bogus,
+// which shows up as SERVFAIL and retries. Depending on server.block_dnssec
+// the answer says so:
+//
+//   - unsigned: DO and AD are cleared, so the stub sees an answer from a
+//     resolver without DNSSEC instead of one that failed validation
+//   - nxdomain: blocks become NXDOMAIN with the Filtered extended error
+//     (RFC 8914), which stubs report without retrying; rewrites stay as in
+//     unsigned, their answers are wanted
+//
+// Other clients get m unchanged. m must be a copy, not the cached message.
+func (s *Server) signBlocked(r, m *dns.Msg, decision string, blockTTL uint32) {
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() {
+		return
+	}
+	m.AuthenticatedData = false
+	reply := m.IsEdns0()
+	if reply == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false) // Sized by writeMsg
+		reply = m.IsEdns0()
+	}
+	reply.SetDo(false)
+
+	if s.Engine.Config().Server.BlockDNSSEC != "nxdomain" || decision != decisionBlocked || len(m.Question) == 0 {
+		return
+	}
+	m.Rcode = dns.RcodeNameError
+	m.Answer = nil
+	m.Ns = []dns.RR{s.blockedSOA(m.Question[0].Name, blockTTL)}
+	reply.Option = append(reply.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered})
+}
@@ -0,0 +1,109 @@
+package server_test
+
+import (
+	"cmp"
+	"testing"
+
+	"adblocker/config"
+	"adblocker/server/servertest"
+
+	"github.com/miekg/dns"
+)
+
+// ede returns the extended DNS error code of m, or -1 without one.
+func ede(m *dns.Msg) int {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				return int(e.InfoCode)
+			}
+		}
+	}
+	return -1
+}
+
+func TestSignBlocked(t *testing.T) {
+	tests := []struct {
+		mode   string
+		name   string
+		do     bool
+		rcode  int
+		answer string
+		ede    int
+	}{
+		// Without DO the answer is as usual in every mode
+		{"unsigned", "ads.example", false, dns.RcodeSuccess, "0.0.0.0", -1},
+		{"nxdomain", "ads.example", false, dns.RcodeSuccess, "0.0.0.0", -1},
+
+		// unsigned (also the default) keeps the synthesized answer
+		{"", "ads.example", true, dns.RcodeSuccess, "0.0.0.0", -1},
+		{"unsigned", "ads.example", true, dns.RcodeSuccess, "0.0.0.0", -1},
+		{"unsigned", "rewrite.example", true, dns.RcodeSuccess, "192.0.2.99", -1},
+
+		// nxdomain turns blocks into NXDOMAIN with Filtered, rewrites stay
+		{"nxdomain", "ads.example", true, dns.RcodeNameError, "", int(dns.ExtendedErrorCodeFiltered)},
+		{"nxdomain", "rewrite.example", true, dns.RcodeSuccess, "192.0.2.99", -1},
+	}
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.mode, "default")+"/"+tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Server.BlockDNSSEC = tt.mode
+			srv, _ := newTestServer(t, cfg, []string{"||ads.example^", "||rewrite.example^$dnsrewrite=192.0.2.99"})
+
+			r := new(dns.Msg)
+			r.SetQuestion(tt.name+".", dns.TypeA)
+			r.AuthenticatedData = true
+			r.SetEdns0(dns.DefaultMsgSize, tt.do)
+			m, err := (&servertest.Client{Handler: srv}).Exchange(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.Rcode != tt.rcode || answerA(m) != tt.answer {
+				t.Errorf("got %s %q, want %s %q", dns.RcodeToString[m.Rcode], answerA(m), dns.RcodeToString[tt.rcode], tt.answer)
+			}
+			if got := ede(m); got != tt.ede {
+				t.Errorf("extended error = %d, want %d", got, tt.ede)
+			}
+			if tt.rcode == dns.RcodeNameError && (len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Errorf("authority = %v, want the SOA of the block", m.Ns)
+			}
+			if tt.do {
+				// The synthesized answer is not validated, whatever the query said
+				if m.AuthenticatedData {
+					t.Error("AD set on a synthesized answer")
+				}
+				if opt := m.IsEdns0(); opt == nil || opt.Do() {
+					t.Errorf("reply OPT = %v, want one without DO", opt)
+				}
+			}
+		})
+	}
+}
+
+// Group cache hits are adjusted per query, and a DNSSEC-aware client does
+// not change what the cache serves to the others.
+func TestSignBlockedCache(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.BlockDNSSEC = "nxdomain"
+	srv, _ := newTestServer(t, cfg, []string{"||ads.example^"})
+	client := &servertest.Client{Handler: srv}
+
+	for i, do := range []bool{true, false, true, false} {
+		r := new(dns.Msg)
+		r.SetQuestion("ads.example.", dns.TypeA)
+		r.SetEdns0(dns.DefaultMsgSize, do)
+		m, err := client.Exchange(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantRcode, wantAnswer, wantEDE := dns.RcodeSuccess, "0.0.0.0", -1
+		if do {
+			wantRcode, wantAnswer, wantEDE = dns.RcodeNameError, "", int(dns.ExtendedErrorCodeFiltered)
+		}
+		if m.Rcode != wantRcode || answerA(m) != wantAnswer || ede(m) != wantEDE {
+			t.Errorf("query %d (DO %v): got %s %q EDE %d, want %s %q EDE %d", i+1, do,
+				dns.RcodeToString[m.Rcode], answerA(m), ede(m), dns.RcodeToString[wantRcode], wantAnswer, wantEDE)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"cmp"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Default source prefixes of server.ecs (RFC 7871 section 11.1).
+const (
+	defaultECSPrefix4 = 24
+	defaultECSPrefix6 = 56
+)
+
+// maxECSScopes bounds the names whose answer scope is remembered.
+const maxECSScopes = 10000
+
+// ecsSubnet returns the client subnet to send upstream with r, or an invalid
+// prefix when server.ecs is off or there is none: a subnet the client sent
+// itself (e.g. a forwarder in front of us) wins, otherwise a public client
+// address is truncated to the configured prefix. Private addresses are not
+// sent, upstream would answer for the server's location anyway.
+func (s *Server) ecsSubnet(r *dns.Msg, clientIP netip.Addr) netip.Prefix {
+	cfg := s.Engine.Config().Server.ECS
+	if !cfg.Enabled {
+		return netip.Prefix{}
+	}
+	if opt := findECS(r); opt != nil {
+		addr, ok := netip.AddrFromSlice(opt.Address)
+		if !ok || opt.SourceNetmask == 0 {
+			return netip.Prefix{} // The client opted out (RFC 7871 section 7.1.2)
+		}
+		p, _ := addr.Unmap().Prefix(int(opt.SourceNetmask))
+		return p
+	}
+	if !clientIP.IsGlobalUnicast() || clientIP.IsPrivate() {
+		return netip.Prefix{}
+	}
+	bits := cmp.Or(cfg.IPv4Prefix, defaultECSPrefix4)
+	if clientIP.Is6() {
+		bits = cmp.Or(cfg.IPv6Prefix, defaultECSPrefix6)
+	}
+	p, _ := clientIP.Prefix(bits)
+	return p
+}
+
+// findECS returns the client subnet option of m, or nil.
+func findECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// withECS returns a copy of r that carries subnet as its only client subnet option.
+func withECS(r *dns.Msg, subnet netip.Prefix) *dns.Msg {
+	q := r.Copy()
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(dns.DefaultMsgSize, false)
+		opt = q.IsEdns0()
+	}
+	stripECS(q)
+	family := uint16(1)
+	if subnet.Addr().Is6() {
+		family = 2
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(subnet.Bits()),
+		Address:       net.IP(subnet.Addr().AsSlice()),
+	})
+	return q
+}
+
+// ecsScope returns the subnet an upstream answer to a query for subnet is
+// valid for, or an invalid prefix when it is valid for everyone: the
+// upstream ignored the option or answered with scope 0.
+func ecsScope(resp *dns.Msg, subnet netip.Prefix) netip.Prefix {
+	opt := findECS(resp)
+	if opt == nil || opt.SourceScope == 0 {
+		return netip.Prefix{}
+	}
+	// A scope longer than the source is cached for the source (section 7.3.1)
+	p, _ := subnet.Addr().Prefix(min(int(opt.SourceScope), subnet.Bits()))
+	return p
+}
+
+// ecsKey returns the UpstreamCache key of an answer for scope.
+func ecsKey(key string, scope netip.Prefix) string {
+	return key + "@" + scope.String()
+}
+
+// stripECS removes the client subnet option from m.
+func stripECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// ecsReply makes the client subnet option of an upstream answer match the
+// query it is sent for: removed when the client sent none, otherwise the
+// client's own subnet with the scope upstream returned.
+func ecsReply(m, r *dns.Msg) {
+	got := findECS(m)
+	if got == nil {
+		return
+	}
+	sent := findECS(r)
+	if sent == nil {
+		stripECS(m)
+		return
+	}
+	scope := got.SourceScope
+	*got = *sent
+	got.SourceScope = scope
+}
+
+// ecsScopes remembers the scope prefix upstream last returned per query, so
+// a lookup knows which subnet key to try. It is cleared when it grows past
+// maxECSScopes; a forgotten scope only costs an upstream query.
+type ecsScopes struct {
+	mu   sync.Mutex
+	bits map[string]int
+}
+
+func (e *ecsScopes) get(key string) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	bits, ok := e.bits[key]
+	return bits, ok
+}
+
+func (e *ecsScopes) set(key string, bits int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.bits == nil || len(e.bits) >= maxECSScopes {
+		e.bits = make(map[string]int)
+	}
+	e.bits[key] = bits
+}
+
+// cachedForSubnet returns the cached upstream answer for key that is valid
+// for subnet, trying the scope upstream returned last before the shared one.
+func (s *Server) cachedForSubnet(key string, subnet netip.Prefix, get func(string) *dns.Msg) *dns.Msg {
+	if subnet.IsValid() {
+		if bits, ok := s.ecsScopes.get(key); ok {
+			scope, _ := subnet.Addr().Prefix(min(bits, subnet.Bits()))
+			if cached := get(ecsKey(key, scope)); cached != nil {
+				return cached
+			}
+		}
+	}
+	return get(key)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"adblocker/config"
+
+	"github.com/miekg/dns"
+)
+
+// defaultEDNSUDPSize is the DNS Flag Day 2020 recommendation, small enough to avoid IP fragmentation.
+const defaultEDNSUDPSize = 1232
+
+// ednsUDPSize returns the largest UDP response the server sends.
+func (s *Server) ednsUDPSize() int {
+	if size := s.Engine.Config().Server.EDNSUDPSize; size >= dns.MinMsgSize {
+		return int(size)
+	}
+	return defaultEDNSUDPSize
+}
+
+// writeMsg sends m as the reply to r. The OPT record follows the client's
+// request, and UDP replies are truncated to the smaller of the client's
+// advertised buffer and edns_udp_size, with TC set so the client retries
+// over TCP.
+func (s *Server) writeMsg(w dns.ResponseWriter, r, m *dns.Msg) error {
+	limit := s.ednsUDPSize()
+
+	// Without EDNS the client can take 512 bytes and must not see an OPT record
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = min(max(int(opt.UDPSize()), dns.MinMsgSize), limit)
+		if reply := m.IsEdns0(); reply != nil {
+			reply.SetUDPSize(uint16(limit))
+		} else {
+			m.SetEdns0(uint16(limit), opt.Do())
+		}
+	} else {
+		stripOPT(m)
+	}
+
+	if w.RemoteAddr().Network() == "udp" {
+		// Truncate clears TC when the message fits; keep it if it was already set
+		tc := m.Truncated
+		m.Truncate(size)
+		m.Truncated = m.Truncated || tc
+	}
+	return w.WriteMsg(m)
+}
+
+// exchangeUpstream forwards r over UDP and retries over TCP when the upstream
+// truncated its answer, so the cache never holds a truncated reply. It also
+// returns the transport of the last exchange (see encryptedTransport).
+func exchangeUpstream(r *dns.Msg, upstream string) (*dns.Msg, string, error) {
+	resp, err := dns.Exchange(r, upstream)
+	if err != nil || !resp.Truncated {
+		return resp, "udp", err
+	}
+	c := &dns.Client{Net: "tcp"}
+	resp, _, err = c.Exchange(r, upstream)
+	return resp, "tcp", err
+}
+
+// minimizeResponse applies a UserGroup's response_privacy to an upstream
+// answer. m must be a copy, not the cached message.
+func minimizeResponse(m *dns.Msg, p config.ResponsePrivacy) {
+	if p.StripEDNS {
+		if opt := m.IsEdns0(); opt != nil {
+			opt.Option = nil
+		}
+	}
+	if p.StripExtra {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+	}
+}
+
+// stripOPT removes OPT pseudo-records from the additional section.
+func stripOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
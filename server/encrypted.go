@@ -0,0 +1,351 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+
+	"github.com/miekg/dns"
+)
+
+// dohPath is where DNS-over-HTTPS queries are answered (RFC 8484 section 6).
+const dohPath = "/dns-query"
+
+// dohContentType is the media type of DNS messages over HTTPS.
+const dohContentType = "application/dns-message"
+
+// StartTLS serves DNS over TLS (RFC 7858) on listen_tls until it fails or
+// Stop is called. It may be called again after it returned with an error.
+func (s *Server) StartTLS() error {
+	cfg := s.Engine.Config().Server
+	tlsConfig, err := newServerTLSConfig(cfg, []string{"dot"})
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", cfg.ListenTLS, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	s.serverMu.Lock()
+	srv := &dns.Server{Addr: cfg.ListenTLS, Net: "tcp-tls", Listener: l, Handler: s.Server.Handler}
+	s.tlsServer = srv
+	s.serverMu.Unlock()
+
+	log.Printf("DNS-over-TLS listening on %s", cfg.ListenTLS)
+	err = srv.ActivateAndServe()
+	l.Close()
+	return err
+}
+
+// StartHTTPS serves DNS over HTTPS (RFC 8484) on listen_https until it fails
+// or Stop is called. It may be called again after it returned with an error.
+func (s *Server) StartHTTPS() error {
+	cfg := s.Engine.Config().Server
+	tlsConfig, err := newServerTLSConfig(cfg, []string{"h2", "http/1.1"})
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", cfg.ListenHTTPS)
+	if err != nil {
+		return err
+	}
+
+	srv := s.newDoHServer()
+	srv.TLSConfig = tlsConfig
+	s.serverMu.Lock()
+	s.httpsServer = srv
+	s.serverMu.Unlock()
+
+	log.Printf("DNS-over-HTTPS listening on %s%s", cfg.ListenHTTPS, dohPath)
+	if err := srv.ServeTLS(l, "", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// StartHTTP serves DNS over HTTPS without TLS on listen_http, for a reverse
+// proxy in front that terminates TLS with a certificate browsers trust. It
+// may be called again after it returned with an error.
+func (s *Server) StartHTTP() error {
+	cfg := s.Engine.Config().Server
+	l, err := net.Listen("tcp", cfg.ListenHTTP)
+	if err != nil {
+		return err
+	}
+
+	srv := s.newDoHServer()
+	s.serverMu.Lock()
+	s.httpServer = srv
+	s.serverMu.Unlock()
+
+	log.Printf("DNS-over-HTTP (for a TLS-terminating proxy) listening on %s%s", cfg.ListenHTTP, dohPath)
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// newDoHServer returns an HTTP server answering queries at dohPath, and at
+// dohPath/<client ID> for devices that identify themselves (users.client_ids).
+func (s *Server) newDoHServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.serveDoH)
+	mux.HandleFunc(dohPath+"/{client_id}", s.serveDoH)
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// serveDoH answers one DNS-over-HTTPS query, sent with GET as the base64url
+// dns parameter or with POST as the body.
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	// 1. Decode the query
+	clientID := r.PathValue("client_id")
+	if clientID != "" && !config.ValidClientID(clientID) {
+		http.Error(w, "invalid client ID", http.StatusBadRequest)
+		return
+	}
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid DNS query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Answer it like any other query
+	dw := &dohWriter{remote: s.dohClient(r), clientID: clientID}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dw.local = local
+	}
+	s.handleRequest(dw, req)
+	if dw.msg == nil {
+		// An unpromoted standby dropped the answer
+		http.Error(w, "no answer", http.StatusServiceUnavailable)
+		return
+	}
+	out, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 3. HTTP caches must not keep the answer longer than its records
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := lowestTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(out)
+}
+
+// lowestTTL returns the smallest TTL in the answer and authority sections.
+func lowestTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rr := range append(m.Answer[:len(m.Answer):len(m.Answer)], m.Ns...) {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return ttl, found
+}
+
+// dohClient returns the client address of a DoH request. Behind one of
+// server.trusted_proxies it is the last address in X-Forwarded-For that is
+// not a trusted proxy itself, since earlier entries may be forged.
+func (s *Server) dohClient(r *http.Request) net.Addr {
+	remote := httpAddr(r.RemoteAddr)
+	trusted := trustedProxies(s.Engine.Config().Server.TrustedProxies)
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok || !trusted(addr.AddrPort().Addr().Unmap()) {
+		return remote
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return invalidAddr(hops[i])
+		}
+		if !trusted(ip.Unmap()) || i == 0 {
+			return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+		}
+	}
+	return remote
+}
+
+// trustedProxies returns whether an address is one of the proxies, given
+// as addresses or CIDRs as checked by config validation.
+func trustedProxies(proxies []string) func(netip.Addr) bool {
+	return func(ip netip.Addr) bool {
+		for _, p := range proxies {
+			if prefix, err := netip.ParsePrefix(p); err == nil && prefix.Contains(ip) {
+				return true
+			}
+			if addr, err := netip.ParseAddr(p); err == nil && addr.Unmap() == ip {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// httpAddr returns the client address of an HTTP request as a TCP address.
+func httpAddr(remote string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return invalidAddr(remote)
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// invalidAddr is a client address that could not be parsed, left to
+// invalid_client like on the other listeners.
+type invalidAddr string
+
+func (a invalidAddr) Network() string { return "tcp" }
+func (a invalidAddr) String() string  { return string(a) }
+
+// dohWriter collects the answer of a DNS-over-HTTPS query.
+type dohWriter struct {
+	local, remote net.Addr
+	clientID      string
+	msg           *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m.Copy()
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// ClientID returns the client ID in the path of the query.
+func (w *dohWriter) ClientID() string { return w.clientID }
+
+// queryClientID returns the DoH client ID a query was sent with, "" for
+// other transports and DoH without one.
+func queryClientID(w dns.ResponseWriter) string {
+	if c, ok := w.(interface{ ClientID() string }); ok {
+		return c.ClientID()
+	}
+	return ""
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// newServerTLSConfig returns the TLS configuration of an encrypted listener.
+// The certificate is loaded up front so a bad one fails the start.
+func newServerTLSConfig(cfg config.ServerConfig, protos []string) (*tls.Config, error) {
+	c := &certLoader{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		GetCertificate: c.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     protos,
+	}, nil
+}
+
+// certLoader serves a certificate from files, reading them again when they
+// change so that a renewed certificate is used without a restart.
+type certLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	modTime time.Time // Of the newer file when cert was loaded
+	cert    *tls.Certificate
+}
+
+func (c *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var modTime time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return c.keep(err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	// Retry only after the next change, not on every handshake
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Printf("[TLS] Failed to reload certificate, keeping the previous one: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Printf("[TLS] Reloaded certificate from %s", c.certFile)
+	}
+	c.cert = &cert
+	return c.cert, nil
+}
+
+// keep returns the loaded certificate, if any, when the files cannot be read.
+func (c *certLoader) keep(err error) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == nil {
+		return nil, err
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/events"
+	"adblocker/geoip"
+
+	"github.com/miekg/dns"
+)
+
+// clientLabel formats a client for logs, e.g. "192.168.1.37 (Emma's iPad)"
+// when the user has a display name.
+func clientLabel(ip netip.Addr, user *config.User) string {
+	if user == nil || (user.DisplayName == "" && user.Icon == "") {
+		return ip.String()
+	}
+	return ip.String() + " (" + user.Label() + ")"
+}
+
+// finishQuery records an answered query in the metrics and, when it was
+// sampled for the query log, exports it. res carries the user and groups
+// the decision was made for; group cache hits know no rule. answer is the
+// upstream answer of allowed queries.
+func (s *Server) finishQuery(q dns.Question, clientIP netip.Addr, clientMAC, clientID, decision string, res *engine.ResolveResult, answer *dns.Msg, cached, sampled bool, start time.Time) {
+	s.recordQuery(q, clientIP, clientMAC, clientID, res.User, res.UserGroup, res.RuleGroup, decision, cached, start)
+	if sampled {
+		s.exportEvent(q, clientIP, clientMAC, decision, res, answer, cached)
+	}
+}
+
+// exportEvent adds a decision to the query log of the dashboard and hands
+// it to the event exporter if it exports that decision.
+func (s *Server) exportEvent(q dns.Question, clientIP netip.Addr, clientMAC, decision string, res *engine.ResolveResult, answer *dns.Msg, cached bool) {
+	user, userGroup, ruleGroup := res.User, res.UserGroup, res.RuleGroup
+	logged := LoggedQuery{
+		Time:      s.clock.Now(),
+		Client:    clientIP.String(),
+		Domain:    q.Name,
+		Type:      dns.TypeToString[q.Qtype],
+		Decision:  decision,
+		UserGroup: userGroup,
+		RuleGroup: ruleGroup,
+		Cached:    cached,
+	}
+	if user != nil {
+		logged.User = user.Label()
+	}
+	if res.Rule != nil {
+		logged.Rule = res.Rule.Text
+	}
+	s.activity.add(logged)
+
+	if !s.Events.Wants(decision) {
+		return
+	}
+	e := events.Event{
+		Time:      time.Now(),
+		Client:    clientIP.String(),
+		MAC:       clientMAC,
+		UserGroup: userGroup,
+		Domain:    q.Name,
+		QType:     dns.TypeToString[q.Qtype],
+		Decision:  decision,
+		RuleGroup: ruleGroup,
+		Cached:    cached,
+	}
+	if rate := s.sampleRate(decision); rate < 1 {
+		e.SampleRate = rate
+	}
+	if user != nil {
+		e.User = user.Name
+		e.DisplayName = user.DisplayName
+		e.Icon = user.Icon
+	}
+	if res.Rule != nil {
+		e.Rule = res.Rule.Text
+		e.List = res.Rule.Source
+	}
+	if s.GeoIP != nil && answer != nil {
+		annotate(&e, s.GeoIP, answer)
+	}
+	s.Events.Send(e)
+}
+
+// annotate adds the addresses of the answer with their countries and ASNs.
+func annotate(e *events.Event, db *geoip.DB, answer *dns.Msg) {
+	for _, ip := range answerAddrs(answer) {
+		e.Answers = append(e.Answers, ip.String())
+		info := db.Lookup(ip)
+		if info.Country != "" && !slices.Contains(e.Countries, info.Country) {
+			e.Countries = append(e.Countries, info.Country)
+		}
+		if info.ASN != 0 && !slices.Contains(e.ASNs, info.ASN) {
+			e.ASNs = append(e.ASNs, info.ASN)
+		}
+	}
+}
+
+// answerAddrs returns the A and AAAA addresses in the answer section.
+func answerAddrs(m *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range m.Answer {
+		var ip netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(rr.AAAA)
+		}
+		if ip.IsValid() {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
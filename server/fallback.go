@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// errNoUpstream is returned when server.upstream is empty.
+var errNoUpstream = errors.New("no upstream configured")
+
+// defaultFallbackRetry is how long the fallback serves before the primary is tried again.
+const defaultFallbackRetry = 30 * time.Second
+
+var (
+	upstreamFallbacks = metrics.NewCounterVec("adblocker_upstream_fallback_total",
+		"Queries sent to the fallback upstream, by reason (error, timeout, hold).",
+		"upstream", "reason")
+	upstreamFallbackActive = metrics.NewGaugeVec("adblocker_upstream_fallback_active",
+		"1 while the fallback upstream serves instead of the primary.",
+		"upstream")
+	upstreamFailovers = metrics.NewCounterVec("adblocker_upstream_failover_total",
+		"Queries passed on to the next server.upstream entry, by the upstream that failed and reason (error, timeout, servfail).",
+		"upstream", "reason")
+)
+
+// fallbackState tracks whether the fallback tier is engaged.
+type fallbackState struct {
+	mu      sync.Mutex
+	active  bool
+	primary string // Primary that failed, all of server.upstream
+	since   time.Time
+	retryAt time.Time
+	served  uint64 // Queries sent to the fallback since it engaged
+	total   uint64 // Queries sent to the fallback since start
+}
+
+// exchange sends r to the primary upstreams, or to the fallback tier when
+// all of them failed and server.fallback allows it. It returns the
+// upstream that produced the result.
+func (s *Server) exchange(r *dns.Msg, upstreams []string) (*dns.Msg, string, error) {
+	fb := s.Engine.Config().Server.Fallback
+	if fb.Upstream == "" || fb.Policy == "never" {
+		return s.exchangeList(r, upstreams)
+	}
+	primary := strings.Join(upstreams, ", ")
+
+	// 1. While the fallback is engaged, skip the failing primary until retry_after
+	if s.fallback.holding(primary, s.clock.Now()) {
+		upstreamFallbacks.Inc(fb.Upstream, "hold")
+		resp, err := s.exchangeWith(r, fb.Upstream)
+		return resp, fb.Upstream, err
+	}
+
+	// 2. Primary first
+	resp, used, err := s.exchangeList(r, upstreams)
+	reason := fallbackReason(fb.Policy, err)
+	if reason == "" {
+		if err == nil {
+			s.fallback.disengage(primary, fb.Upstream, s.clock.Now())
+		}
+		return resp, used, err
+	}
+
+	// 3. The policy allows the fallback for this failure
+	s.fallback.engage(primary, fb, err, s.clock.Now())
+	upstreamFallbacks.Inc(fb.Upstream, reason)
+	resp, err = s.exchangeWith(r, fb.Upstream)
+	return resp, fb.Upstream, err
+}
+
+// exchangeList tries upstreams in order, passing r on to the next one when
+// an upstream fails or answers SERVFAIL. The last result stands when all
+// of them do. With upstream_mode parallel they are raced instead, see
+// exchangeParallel.
+func (s *Server) exchangeList(r *dns.Msg, upstreams []string) (*dns.Msg, string, error) {
+	if s.Engine.Config().Server.UpstreamMode == "parallel" && len(upstreams) > 1 {
+		return s.exchangeParallel(r, upstreams)
+	}
+	for i, upstream := range upstreams {
+		resp, err := s.exchangeWith(r, upstream)
+		if i == len(upstreams)-1 {
+			return resp, upstream, err
+		}
+		reason := failoverReason(resp, err)
+		if reason == "" {
+			return resp, upstream, nil
+		}
+		upstreamFailovers.Inc(upstream, reason)
+	}
+	return nil, "", errNoUpstream
+}
+
+// failoverReason returns why another server.upstream entry should be asked
+// after an exchange, or "" when its result stands.
+func failoverReason(resp *dns.Msg, err error) string {
+	if err != nil {
+		return fallbackReason("on_error", err)
+	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		return "servfail"
+	}
+	return ""
+}
+
+// exchangeWith forwards r to one upstream and records the exchange.
+func (s *Server) exchangeWith(r *dns.Msg, upstream string) (*dns.Msg, error) {
+	start := s.clock.Now()
+	resp, transport, err := s.Exchanger.Exchange(r, upstream)
+	s.upstreamUsage.record(upstream, transport, err)
+	s.upstreamOutcomes.record(upstream, s.clock.Now().Sub(start), err)
+	if err == nil {
+		err = checkUpstream(r, resp)
+	}
+	return resp, err
+}
+
+// fallbackReason returns why err justifies the fallback under policy, or
+// "" when it does not. Answers with an error rcode (e.g. SERVFAIL from a
+// validating primary) are results, not failures, and never fall back;
+// only another server.upstream entry is asked, see exchangeList.
+func fallbackReason(policy string, err error) string {
+	if err == nil {
+		return ""
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if policy == "on_timeout" {
+		return ""
+	}
+	return "error"
+}
+
+func (f *fallbackState) holding(primary string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.active || f.primary != primary || !now.Before(f.retryAt) {
+		return false
+	}
+	f.served++
+	f.total++
+	return true
+}
+
+func (f *fallbackState) engage(primary string, fb config.FallbackConfig, err error, now time.Time) {
+	retry := fb.RetryAfter
+	if retry <= 0 {
+		retry = defaultFallbackRetry
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.retryAt = now.Add(retry)
+	f.served++
+	f.total++
+	if f.active && f.primary == primary {
+		return // Retry of the primary failed again
+	}
+	f.active = true
+	f.primary = primary
+	f.since = now
+	f.served = 1
+	upstreamFallbackActive.Set(1, fb.Upstream)
+
+	downgrade := ""
+	if config.EncryptedUpstream(primary) && !config.EncryptedUpstream(fb.Upstream) {
+		downgrade = " (plaintext)"
+	}
+	log.Printf("[UPSTREAM] ALERT: primary %s failed (%v), sending queries to fallback %s%s, retrying the primary every %v",
+		primary, err, fb.Upstream, downgrade, retry)
+}
+
+func (f *fallbackState) disengage(primary, fallback string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.active || f.primary != primary {
+		return
+	}
+	f.active = false
+	upstreamFallbackActive.Set(0, fallback)
+	log.Printf("[UPSTREAM] Primary %s answers again after %v; %d queries went to fallback %s",
+		primary, now.Sub(f.since).Round(time.Second), f.served, fallback)
+}
+
+// status reports whether the fallback is engaged and how many queries it served since start.
+func (f *fallbackState) status() (bool, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active, f.total
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"adblocker/metrics"
+)
+
+var (
+	upstreamLatency = metrics.NewSummaryVec("adblocker_upstream_latency_seconds",
+		"Upstream exchange latency over the last 1024 answers per upstream.",
+		metrics.DefQuantiles, "upstream")
+	upstreamExchanges = metrics.NewCounterVec("adblocker_upstream_exchanges_total",
+		"Upstream exchanges by outcome (ok, error, timeout).",
+		"upstream", "outcome")
+)
+
+// UpstreamLatency summarizes the recent exchanges with one upstream.
+// Percentiles cover the last metrics.SummaryWindow answers; timeouts and
+// transport errors count toward the error rate only.
+type UpstreamLatency struct {
+	Upstream    string    `json:"upstream"`
+	Exchanges   uint64    `json:"exchanges"` // Since start
+	Errors      uint64    `json:"errors"`    // Since start, timeouts included
+	Timeouts    uint64    `json:"timeouts"`
+	ErrorRate   float64   `json:"error_rate"` // 0 to 1, over the recent exchanges
+	P50         float64   `json:"p50_ms"`
+	P95         float64   `json:"p95_ms"`
+	P99         float64   `json:"p99_ms"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+}
+
+// upstreamOutcomes tracks per-upstream outcomes; latencies live in upstreamLatency.
+type upstreamOutcomes struct {
+	mu    sync.Mutex
+	stats map[string]*outcomeStats
+}
+
+type outcomeStats struct {
+	UpstreamLatency
+	recent []bool // Ring buffer of recent exchanges, true when failed
+	next   int
+	failed int // Failures in recent
+}
+
+func (o *upstreamOutcomes) record(upstream string, d time.Duration, err error) {
+	outcome := "ok"
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		outcome = "timeout"
+	case err != nil:
+		outcome = "error"
+	default:
+		upstreamLatency.Observe(d.Seconds(), upstream)
+	}
+	upstreamExchanges.Inc(upstream, outcome)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stats == nil {
+		o.stats = make(map[string]*outcomeStats)
+	}
+	st := o.stats[upstream]
+	if st == nil {
+		st = &outcomeStats{UpstreamLatency: UpstreamLatency{Upstream: upstream}}
+		o.stats[upstream] = st
+	}
+	st.Exchanges++
+	failed := err != nil
+	if failed {
+		st.Errors++
+		if outcome == "timeout" {
+			st.Timeouts++
+		}
+		st.LastError = err.Error()
+		st.LastErrorAt = time.Now()
+	}
+
+	// Slide the window the error rate is computed over
+	if len(st.recent) < metrics.SummaryWindow {
+		st.recent = append(st.recent, failed)
+	} else {
+		if st.recent[st.next] {
+			st.failed--
+		}
+		st.recent[st.next] = failed
+		st.next = (st.next + 1) % metrics.SummaryWindow
+	}
+	if failed {
+		st.failed++
+	}
+}
+
+// registerUpstreamMetrics exports the recent error rate of each upstream.
+func registerUpstreamMetrics(s *Server) {
+	metrics.NewGaugeVecFunc("adblocker_upstream_error_ratio",
+		"Share of the last 1024 exchanges per upstream that failed.",
+		"upstream", s.upstreamOutcomes.errorRates)
+}
+
+// errorRates returns the recent error rate per upstream.
+func (o *upstreamOutcomes) errorRates() map[string]float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	rates := make(map[string]float64, len(o.stats))
+	for upstream, st := range o.stats {
+		rates[upstream] = float64(st.failed) / float64(len(st.recent))
+	}
+	return rates
+}
+
+// UpstreamLatency returns the upstreams used since start, slowest first
+// by p95, so users can compare resolvers. Upstreams that never answered
+// sort last.
+func (s *Server) UpstreamLatency() []UpstreamLatency {
+	o := &s.upstreamOutcomes
+	o.mu.Lock()
+	list := make([]UpstreamLatency, 0, len(o.stats))
+	for _, st := range o.stats {
+		e := st.UpstreamLatency
+		e.ErrorRate = float64(st.failed) / float64(len(st.recent))
+		list = append(list, e)
+	}
+	o.mu.Unlock()
+
+	answered := make(map[string]bool, len(list))
+	for i := range list {
+		if q := upstreamLatency.Quantiles(list[i].Upstream); q != nil {
+			list[i].P50, list[i].P95, list[i].P99 = millis(q[0]), millis(q[1]), millis(q[2])
+			answered[list[i].Upstream] = true
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if answered[a.Upstream] != answered[b.Upstream] {
+			return answered[a.Upstream]
+		}
+		if a.P95 != b.P95 {
+			return a.P95 > b.P95
+		}
+		return a.Upstream < b.Upstream
+	})
+	return list
+}
+
+// millis converts seconds to milliseconds with microsecond precision.
+func millis(seconds float64) float64 {
+	return math.Round(seconds*1e6) / 1e3
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"adblocker/config"
+)
+
+const (
+	overflowServfail = "servfail" // Answer SERVFAIL as soon as a limit is reached (default)
+	overflowQueue    = "queue"    // Wait up to queue_timeout for a slot, then SERVFAIL
+
+	defaultQueueTimeout = time.Second
+)
+
+// queryLimiter caps in-flight queries per client and in total.
+// It is replaced when the limits change; queries in flight release into the
+// limiter they acquired from.
+type queryLimiter struct {
+	cfg config.ConcurrencyConfig
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientSlots
+	global  chan struct{} // nil means unlimited
+}
+
+type clientSlots struct {
+	sem    chan struct{} // nil means unlimited
+	users  int           // Queries holding or waiting for a slot
+	warned bool          // Overflow already logged
+}
+
+func newQueryLimiter(cfg config.ConcurrencyConfig) *queryLimiter {
+	l := &queryLimiter{cfg: cfg, clients: make(map[netip.Addr]*clientSlots)}
+	if cfg.MaxTotal > 0 {
+		l.global = make(chan struct{}, cfg.MaxTotal)
+	}
+	return l
+}
+
+// limiter returns the limiter for the current configuration, or nil when no limits are set.
+func (s *Server) limiter() *queryLimiter {
+	cfg := s.Engine.Config().Server.Concurrency
+	if cfg.MaxPerClient <= 0 && cfg.MaxTotal <= 0 {
+		return nil
+	}
+	l := s.queryLimiter.Load()
+	if l == nil || l.cfg != cfg {
+		fresh := newQueryLimiter(cfg)
+		if s.queryLimiter.CompareAndSwap(l, fresh) {
+			l = fresh
+		} else {
+			l = s.queryLimiter.Load()
+		}
+	}
+	return l
+}
+
+// acquire takes a slot for ip. It returns a release function, or false when
+// the query must be refused; limit names the limit that was hit.
+func (l *queryLimiter) acquire(ip netip.Addr) (release func(), limit string, ok bool) {
+	var deadline <-chan time.Time
+	if l.cfg.Overflow == overflowQueue {
+		timeout := l.cfg.QueueTimeout
+		if timeout <= 0 {
+			timeout = defaultQueueTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	l.mu.Lock()
+	cs := l.clients[ip]
+	if cs == nil {
+		cs = &clientSlots{}
+		if l.cfg.MaxPerClient > 0 {
+			cs.sem = make(chan struct{}, l.cfg.MaxPerClient)
+		}
+		l.clients[ip] = cs
+	}
+	cs.users++
+	l.mu.Unlock()
+
+	if !take(cs.sem, deadline) {
+		l.overflow(ip, cs, "client")
+		l.leave(ip, cs)
+		return nil, "client", false
+	}
+	if !take(l.global, deadline) {
+		l.overflow(ip, cs, "global")
+		put(cs.sem)
+		l.leave(ip, cs)
+		return nil, "global", false
+	}
+
+	return func() {
+		put(l.global)
+		put(cs.sem)
+		l.leave(ip, cs)
+	}, "", true
+}
+
+// overflow logs the first refusal for a client until its slots are released.
+func (l *queryLimiter) overflow(ip netip.Addr, cs *clientSlots, limit string) {
+	l.mu.Lock()
+	warn := !cs.warned
+	cs.warned = true
+	l.mu.Unlock()
+	if warn {
+		log.Printf("[LIMIT] Refusing queries from %s: %s concurrency limit reached", ip, limit)
+	}
+}
+
+func (l *queryLimiter) leave(ip netip.Addr, cs *clientSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cs.users--
+	if cs.users == 0 {
+		delete(l.clients, ip)
+	}
+}
+
+// take acquires a slot of sem, waiting until deadline fires (nil: no wait).
+func take(sem chan struct{}, deadline <-chan time.Time) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if deadline == nil {
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+func put(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"adblocker/config"
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsTimeout bounds the wait for an mDNS responder. Hosts answer for
+// their own names at once; silence means the name is not on the link.
+const mdnsTimeout = time.Second
+
+// mdnsGroup is the IPv4 mDNS multicast address (RFC 6762).
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var localNameQueries = metrics.NewCounterVec("adblocker_local_names_total",
+	"Allowed queries for local names kept away from the upstream, by action (nxdomain, forward, mdns, failed).",
+	"action")
+
+// isLocalName reports whether q asks for a LAN host name: a name under one
+// of server.local_names.suffixes, or a single-label address lookup like
+// "nas". Other single-label queries are for top-level domains (e.g. the DS
+// of "com.") and go upstream. Special-use zones ("localhost.", "test.", see
+// handleSpecialUse) are answered before and never get here.
+func isLocalName(cfg config.LocalNamesConfig, q dns.Question) bool {
+	name := dns.CanonicalName(q.Name)
+	if dns.CountLabel(name) == 1 {
+		return q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA
+	}
+	suffixes := cfg.Suffixes
+	if len(suffixes) == 0 {
+		suffixes = []string{"local"}
+	}
+	for _, suffix := range suffixes {
+		if dns.IsSubDomain(dns.CanonicalName(suffix), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerLocalName answers an allowed query for a local name as configured in
+// server.local_names, instead of the upstream. It returns the response
+// written, or nil when the query goes upstream as usual.
+func (s *Server) answerLocalName(w dns.ResponseWriter, r, m *dns.Msg, q dns.Question) *dns.Msg {
+	cfg := s.Engine.Config().Server.LocalNames
+	if cfg.Mode == "" || cfg.Mode == "upstream" || !isLocalName(cfg, q) {
+		return nil
+	}
+
+	var resp *dns.Msg
+	var err error
+	action := cfg.Mode
+	switch {
+	case cfg.Mode == "forward":
+		resp, err = s.exchangeWith(r, cfg.Forward)
+	case cfg.Mode == "mdns" && dns.IsSubDomain("local.", dns.CanonicalName(q.Name)):
+		resp, err = mdnsQuery(r, q)
+	default:
+		action = "nxdomain"
+	}
+
+	switch {
+	case err != nil:
+		log.Printf("[LOCAL] %s %s via %s failed: %v", q.Name, dns.TypeToString[q.Qtype], action, err)
+		action = "failed"
+		m.Rcode = dns.RcodeServerFailure
+		resp = m
+	case resp == nil:
+		m.Rcode = dns.RcodeNameError
+		resp = m
+	default:
+		resp.Id = r.Id
+	}
+	localNameQueries.Inc(action)
+	s.writeMsg(w, r, resp)
+	return resp
+}
+
+// mdnsQuery asks the link for q with a one-shot legacy unicast mDNS query
+// (RFC 6762 section 5.1): responders answer the source port directly, with
+// the question repeated and TTLs of at most 10 seconds. It returns nil when
+// no responder answered in time.
+func mdnsQuery(r *dns.Msg, q dns.Question) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.Id = r.Id
+	query.Question = []dns.Question{{Name: q.Name, Qtype: q.Qtype, Qclass: dns.ClassINET}}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(packed, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mdnsTimeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		resp := new(dns.Msg)
+		if resp.Unpack(buf[:n]) != nil || !resp.Response || resp.Id != query.Id || len(resp.Answer) == 0 {
+			continue // Not an answer to this query
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		reply.Answer = resp.Answer
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Rrtype != dns.TypeNSEC {
+				reply.Extra = append(reply.Extra, rr)
+			}
+		}
+		for _, rr := range append(reply.Answer, reply.Extra...) {
+			rr.Header().Class &^= 1 << 15 // mDNS cache-flush bit
+		}
+		return reply, nil
+	}
+}
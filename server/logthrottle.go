@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/metrics"
+)
+
+var logLinesSuppressed = metrics.NewCounterVec("adblocker_log_lines_suppressed_total",
+	"Query log lines left out by log_throttle.", "reason")
+
+// logThrottle keeps a device retrying a blocked domain many times a second
+// from flooding the query log. The first line of a client, domain and
+// decision is logged, repeats within the window are counted and reported in
+// one summary line once the window has ended. A global rate limit caps what is
+// left. Events and metrics are not affected.
+type logThrottle struct {
+	cfg   func() config.LogThrottle
+	clock Clock
+
+	mu        sync.Mutex
+	seen      map[throttleKey]*throttleEntry
+	lastSweep time.Time
+
+	// Token bucket of the rate limit
+	tokens     float64
+	lastRefill time.Time
+	limited    int // Lines dropped since the last one logged
+}
+
+type throttleKey struct {
+	client   netip.Addr
+	domain   string
+	decision string
+}
+
+type throttleEntry struct {
+	since      time.Time
+	suppressed int
+}
+
+func newLogThrottle(cfg func() config.LogThrottle, clock Clock) *logThrottle {
+	return &logThrottle{cfg: cfg, clock: clock, seen: make(map[throttleKey]*throttleEntry)}
+}
+
+// allow reports whether the query log line for the client, domain and
+// decision should be written.
+func (t *logThrottle) allow(client netip.Addr, domain, decision string) bool {
+	cfg := t.cfg()
+	if cfg.Window <= 0 && cfg.RateLimit <= 0 {
+		return true
+	}
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 1. Deduplicate repeats within the window
+	if cfg.Window > 0 {
+		if now.Sub(t.lastSweep) >= cfg.Window {
+			t.sweep(now, cfg.Window)
+		}
+		key := throttleKey{client, domain, decision}
+		if e := t.seen[key]; e != nil && now.Sub(e.since) < cfg.Window {
+			e.suppressed++
+			logLinesSuppressed.Inc("duplicate")
+			return false
+		} else if e != nil {
+			t.summarize(key, e, cfg.Window)
+		}
+		t.seen[key] = &throttleEntry{since: now}
+	}
+
+	// 2. Cap the overall rate
+	if cfg.RateLimit > 0 {
+		limit := float64(cfg.RateLimit)
+		if t.lastRefill.IsZero() {
+			t.tokens = limit
+		} else {
+			t.tokens = min(limit, t.tokens+now.Sub(t.lastRefill).Seconds()*limit)
+		}
+		t.lastRefill = now
+		if t.tokens < 1 {
+			t.limited++
+			logLinesSuppressed.Inc("rate")
+			return false
+		}
+		t.tokens--
+		if t.limited > 0 {
+			log.Printf("[LOG] Suppressed %d query log lines over the rate limit of %d/s", t.limited, cfg.RateLimit)
+			t.limited = 0
+		}
+	}
+	return true
+}
+
+// sweep reports and forgets the entries whose window has ended. Caller holds mu.
+func (t *logThrottle) sweep(now time.Time, window time.Duration) {
+	for key, e := range t.seen {
+		if now.Sub(e.since) >= window {
+			t.summarize(key, e, window)
+			delete(t.seen, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+func (t *logThrottle) summarize(key throttleKey, e *throttleEntry, window time.Duration) {
+	if e.suppressed > 0 {
+		log.Printf("[LOG] Domain: %s, Client: %s, %s: repeated %d more times within %s", key.domain, key.client, key.decision, e.suppressed, window)
+	}
+}
@@ -54,3 +54,9 @@ func (mr *MacResolver) GetMAC(ip netip.Addr) string {
 
 	return mac
 }
+
+// CheckARP reports whether the neighbor table MAC addresses are read from
+// is accessible on this system.
+func CheckARP() error {
+	return checkARP()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Decision label values
+const (
+	decisionBlocked     = "blocked"
+	decisionRewritten   = "rewritten"
+	decisionWhitelisted = "whitelisted"
+	decisionAllowed     = "allowed"
+)
+
+// Label values come from config (user and rule group names) and a fixed set of
+// decisions; the metrics package additionally caps the number of series.
+var (
+	queriesTotal = metrics.NewCounterVec("adblocker_queries_total",
+		"DNS queries by user group, deciding rule group and decision.",
+		"user_group", "rule_group", "decision")
+	userQueries = metrics.NewCounterVec("adblocker_user_queries_total",
+		"DNS queries of configured users by decision.",
+		"user", "display_name", "decision")
+	queryDuration = metrics.NewHistogramVec("adblocker_query_duration_seconds",
+		"Time taken to answer a DNS query.", metrics.DefBuckets,
+		"user_group", "decision")
+	cacheHits = metrics.NewCounterVec("adblocker_cache_hits_total",
+		"Answers served from cache.", "cache")
+	upstreamErrors = metrics.NewCounterVec("adblocker_upstream_errors_total",
+		"Failed upstream exchanges.", "upstream")
+	queriesLimited = metrics.NewCounterVec("adblocker_queries_limited_total",
+		"Queries refused with SERVFAIL because a concurrency limit was reached.", "limit")
+	clientAddrInvalid = metrics.NewCounterVec("adblocker_client_addr_invalid_total",
+		"Queries whose client address could not be parsed, by action (default, refuse).", "action")
+	upstreamShared = metrics.NewCounterVec("adblocker_upstream_shared_total",
+		"Queries answered by joining an identical in-flight upstream exchange.", "upstream")
+	standbyWithheld = metrics.NewCounterVec("adblocker_standby_withheld_total",
+		"Answers withheld because the instance is an unpromoted standby, by action (drop, refuse).", "action")
+)
+
+// registerCacheMetrics exports the effectiveness counters of the server's caches.
+func registerCacheMetrics(s *Server) {
+	stat := func(get func(CacheStats) float64) func() map[string]float64 {
+		return func() map[string]float64 {
+			values := make(map[string]float64)
+			for name, st := range s.CacheStats() {
+				values[name] = get(st)
+			}
+			return values
+		}
+	}
+	metrics.NewCounterVecFunc("adblocker_cache_misses_total", "Cache lookups that found no usable entry.", "cache",
+		stat(func(st CacheStats) float64 { return float64(st.Misses) }))
+	metrics.NewCounterVecFunc("adblocker_cache_evictions_total", "Live cache entries dropped to make room.", "cache",
+		stat(func(st CacheStats) float64 { return float64(st.Evictions) }))
+	metrics.NewCounterVecFunc("adblocker_cache_expirations_total", "Expired cache entries removed by cleanup.", "cache",
+		stat(func(st CacheStats) float64 { return float64(st.Expirations) }))
+	metrics.NewGaugeVecFunc("adblocker_cache_entries", "Entries currently cached.", "cache",
+		stat(func(st CacheStats) float64 { return float64(st.Entries) }))
+	metrics.NewGaugeVecFunc("adblocker_cache_entry_age_seconds", "Average age of the cached entries.", "cache",
+		stat(func(st CacheStats) float64 { return st.AvgAge }))
+}
+
+// decisionOf maps an engine result to a decision label.
+func decisionOf(res *engine.ResolveResult) string {
+	switch {
+	case res.DNSRewrite != "":
+		return decisionRewritten
+	case res.Blocked:
+		return decisionBlocked
+	case res.Rule != nil:
+		return decisionWhitelisted
+	default:
+		return decisionAllowed
+	}
+}
+
+// recordQuery updates the query counters, latency histogram, time-series
+// stats and the counters of the dashboard.
+func (s *Server) recordQuery(q dns.Question, clientIP netip.Addr, clientMAC, clientID string, user *config.User, userGroup, ruleGroup, decision string, cacheHit bool, start time.Time) {
+	userGroup = labelOrNone(userGroup)
+	queriesTotal.Inc(userGroup, labelOrNone(ruleGroup), decision)
+	if user != nil {
+		userQueries.Inc(user.Name, user.Label(), decision)
+	}
+	queryDuration.Observe(s.clock.Now().Sub(start).Seconds(), userGroup, decision)
+
+	blocked := decision == decisionBlocked || decision == decisionRewritten
+	s.Stats.Record(blocked, cacheHit)
+	s.activity.count(q, clientIP, clientMAC, clientID, user, blocked, s.clock.Now())
+}
+
+func labelOrNone(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return v
+}
+
+// cacheTag packs decision labels into a group-cache entry so hits can be counted
+// correctly and entries can be invalidated per user group.
+func cacheTag(userGroup, ruleGroup, decision string) string {
+	return decision + "|" + userGroup + "|" + ruleGroup
+}
+
+func parseCacheTag(tag string) (userGroup, ruleGroup, decision string) {
+	decision, rest, _ := strings.Cut(tag, "|")
+	userGroup, ruleGroup, _ = strings.Cut(rest, "|")
+	return userGroup, ruleGroup, decision
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+var upstreamRaceWins = metrics.NewCounterVec("adblocker_upstream_race_wins_total",
+	"Queries answered first by an upstream with upstream_mode parallel.",
+	"upstream")
+
+// exchangeParallel sends r to all upstreams at once and returns the first
+// answer that is not a failure or SERVFAIL, like dnsmasq's all-servers. The
+// slower exchanges finish in the background and are only recorded. When
+// every upstream fails, the result of the first in the list stands.
+func (s *Server) exchangeParallel(r *dns.Msg, upstreams []string) (*dns.Msg, string, error) {
+	type result struct {
+		i    int
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(upstreams)) // Buffered so late exchanges never block
+	for i, upstream := range upstreams {
+		q := r.Copy()
+		go func() {
+			resp, err := s.exchangeWith(q, upstream)
+			results <- result{i, resp, err}
+		}()
+	}
+
+	failed := make([]result, len(upstreams))
+	for range upstreams {
+		res := <-results
+		if failoverReason(res.resp, res.err) == "" {
+			upstreamRaceWins.Inc(upstreams[res.i])
+			return res.resp, upstreams[res.i], nil
+		}
+		failed[res.i] = res
+	}
+	return failed[0].resp, upstreams[0], failed[0].err
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"adblocker/metrics"
+)
+
+var upstreamQueries = metrics.NewCounterVec("adblocker_upstream_queries_total",
+	"Queries sent to upstreams by transport (udp, tcp, tls, https).",
+	"upstream", "transport")
+
+// encryptedTransport reports whether queries sent over the transport are
+// hidden from the network path.
+func encryptedTransport(transport string) bool {
+	switch transport {
+	case "tls", "https", "quic":
+		return true
+	default:
+		return false
+	}
+}
+
+// UpstreamUsage counts the queries sent to one upstream over one transport.
+type UpstreamUsage struct {
+	Upstream  string    `json:"upstream"`
+	Transport string    `json:"transport"`
+	Encrypted bool      `json:"encrypted"`
+	Queries   uint64    `json:"queries"`
+	Failures  uint64    `json:"failures"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// PrivacyReport tells how the queries that left this resolver were sent,
+// so users can verify that no plaintext fallback happens. Cache hits and
+// locally answered queries never reach an upstream and are not counted.
+type PrivacyReport struct {
+	Since           time.Time       `json:"since"`
+	Queries         uint64          `json:"queries"`
+	Encrypted       uint64          `json:"encrypted"`
+	Plaintext       uint64          `json:"plaintext"`
+	EncryptedRatio  float64         `json:"encrypted_ratio"`  // 0 to 1, 0 when nothing was sent
+	FallbackActive  bool            `json:"fallback_active"`  // The fallback upstream currently serves instead of the primary
+	FallbackQueries uint64          `json:"fallback_queries"` // Queries sent to the fallback upstream
+	Upstreams       []UpstreamUsage `json:"upstreams"`
+}
+
+type usageKey struct{ upstream, transport string }
+
+// upstreamUsage tracks the exchanges of the server since it started.
+type upstreamUsage struct {
+	mu    sync.Mutex
+	since time.Time
+	usage map[usageKey]*UpstreamUsage
+}
+
+func (u *upstreamUsage) record(upstream, transport string, err error) {
+	upstreamQueries.Inc(upstream, transport)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := usageKey{upstream, transport}
+	e := u.usage[key]
+	if e == nil {
+		e = &UpstreamUsage{Upstream: upstream, Transport: transport, Encrypted: encryptedTransport(transport)}
+		u.usage[key] = e
+	}
+	e.Queries++
+	if err != nil {
+		e.Failures++
+	}
+	e.LastUsed = time.Now()
+}
+
+// PrivacyReport returns the upstream usage since the server started.
+func (s *Server) PrivacyReport() PrivacyReport {
+	u := &s.upstreamUsage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	report := PrivacyReport{Since: u.since, Upstreams: []UpstreamUsage{}}
+	report.FallbackActive, report.FallbackQueries = s.fallback.status()
+	for _, e := range u.usage {
+		report.Upstreams = append(report.Upstreams, *e)
+		report.Queries += e.Queries
+		if e.Encrypted {
+			report.Encrypted += e.Queries
+		} else {
+			report.Plaintext += e.Queries
+		}
+	}
+	if report.Queries > 0 {
+		report.EncryptedRatio = float64(report.Encrypted) / float64(report.Queries)
+	}
+	sort.Slice(report.Upstreams, func(i, j int) bool {
+		a, b := report.Upstreams[i], report.Upstreams[j]
+		if a.Upstream != b.Upstream {
+			return a.Upstream < b.Upstream
+		}
+		return a.Transport < b.Transport
+	})
+	return report
+}
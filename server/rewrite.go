@@ -0,0 +1,34 @@
+package server
+
+import (
+	"log"
+
+	"adblocker/engine"
+
+	"github.com/miekg/dns"
+)
+
+// chaseRewrite completes a CNAME answer of the rewrites section with the
+// records of its target from upstream, since many stub resolvers do not
+// follow a bare CNAME. Answers of $dnsrewrite rules are left as they are.
+func (s *Server) chaseRewrite(m *dns.Msg, q dns.Question, res *engine.ResolveResult) {
+	if res.Rule == nil || res.Rule.Source != engine.RewriteSource || len(m.Answer) != 1 {
+		return
+	}
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+	cname, ok := m.Answer[0].(*dns.CNAME)
+	if !ok {
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(cname.Target, q.Qtype)
+	resp, _, err := s.exchange(req, s.upstreamsFor(res))
+	if err != nil {
+		log.Printf("[REWRITE] Resolving %s for %s failed: %v", cname.Target, q.Name, err)
+		return
+	}
+	m.Answer = append(m.Answer, resp.Answer...)
+}
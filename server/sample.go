@@ -0,0 +1,29 @@
+package server
+
+import (
+	"math/rand/v2"
+
+	"adblocker/metrics"
+)
+
+var queriesUnlogged = metrics.NewCounterVec("adblocker_queries_unlogged_total",
+	"Queries left out of the query log and event export by sampling.", "decision")
+
+// sampleRate returns the fraction of queries with decision that are logged.
+func (s *Server) sampleRate(decision string) float64 {
+	if rate, ok := s.Engine.Config().Server.QueryLogSample[decision]; ok {
+		return rate
+	}
+	return 1
+}
+
+// logQuery decides whether a query with decision goes to the query log and
+// the event export, so that both see the same sample.
+func (s *Server) logQuery(decision string) bool {
+	rate := s.sampleRate(decision)
+	if rate >= 1 || rand.Float64() < rate {
+		return true
+	}
+	queriesUnlogged.Inc(decision)
+	return false
+}
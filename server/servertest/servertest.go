@@ -0,0 +1,175 @@
+// Package servertest drives a DNS handler in process: queries go through a
+// recording ResponseWriter, and the upstream and the clock are fakes that
+// can be handed to server.Server.
+package servertest
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoReply is returned by Client.Query when the handler wrote nothing.
+var ErrNoReply = errors.New("handler wrote no reply")
+
+// ResponseWriter records the messages a handler writes.
+type ResponseWriter struct {
+	Local, Remote net.Addr
+	Msgs          []*dns.Msg
+	Closed        bool
+}
+
+// NewResponseWriter returns a writer for a UDP query from client ("ip:port").
+func NewResponseWriter(client string) *ResponseWriter {
+	return &ResponseWriter{
+		Local:  net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:53")),
+		Remote: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(client)),
+	}
+}
+
+func (w *ResponseWriter) LocalAddr() net.Addr  { return w.Local }
+func (w *ResponseWriter) RemoteAddr() net.Addr { return w.Remote }
+
+func (w *ResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.Msgs = append(w.Msgs, m.Copy())
+	return nil
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.Msgs = append(w.Msgs, m)
+	return len(b), nil
+}
+
+func (w *ResponseWriter) Close() error        { w.Closed = true; return nil }
+func (w *ResponseWriter) TsigStatus() error   { return nil }
+func (w *ResponseWriter) TsigTimersOnly(bool) {}
+func (w *ResponseWriter) Hijack()             {}
+
+// Client sends queries straight to a handler, e.g. a *server.Server.
+type Client struct {
+	Handler dns.Handler
+	Addr    string // Client address as "ip:port", default "192.0.2.1:5353"
+}
+
+// Query asks for name and returns the last message the handler wrote.
+func (c *Client) Query(name string, qtype uint16) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	return c.Exchange(r)
+}
+
+// Exchange hands r to the handler and returns the last message it wrote.
+func (c *Client) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	addr := c.Addr
+	if addr == "" {
+		addr = "192.0.2.1:5353"
+	}
+	w := NewResponseWriter(addr)
+	c.Handler.ServeDNS(w, r)
+	if len(w.Msgs) == 0 {
+		return nil, ErrNoReply
+	}
+	return w.Msgs[len(w.Msgs)-1], nil
+}
+
+// Upstream is a fake upstream resolver serving fixed records. It
+// implements server.Exchanger and answers NXDOMAIN for unknown names.
+type Upstream struct {
+	mu      sync.Mutex
+	records map[string][]dns.RR // By canonical owner name
+	queries []string
+	err     error
+}
+
+// NewUpstream returns an upstream serving records in zone file syntax,
+// e.g. "example.com. 300 IN A 192.0.2.10".
+func NewUpstream(records ...string) (*Upstream, error) {
+	u := &Upstream{records: make(map[string][]dns.RR)}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		name := dns.CanonicalName(rr.Header().Name)
+		u.records[name] = append(u.records[name], rr)
+	}
+	return u, nil
+}
+
+// Fail makes every following exchange return err; nil restores answers.
+func (u *Upstream) Fail(err error) {
+	u.mu.Lock()
+	u.err = err
+	u.mu.Unlock()
+}
+
+// Queries returns the names asked so far, in order.
+func (u *Upstream) Queries() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.queries...)
+}
+
+func (u *Upstream) Exchange(r *dns.Msg, upstream string) (*dns.Msg, string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	q := r.Question[0]
+	u.queries = append(u.queries, q.Name)
+	if u.err != nil {
+		return nil, "udp", u.err
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	rrs, ok := u.records[dns.CanonicalName(q.Name)]
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+		return m, "udp", nil
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		}
+	}
+	return m, "udp", nil
+}
+
+// MACs is a fixed table of client MAC addresses. It implements
+// server.MACLookup; a nil table knows no client.
+type MACs map[netip.Addr]string
+
+func (m MACs) GetMAC(ip netip.Addr) string { return m[ip] }
+
+// Clock is a manual clock for cache expiry and schedules. It implements
+// server.Clock.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock stopped at t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
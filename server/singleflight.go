@@ -0,0 +1,55 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flightGroup shares one upstream exchange between concurrent identical
+// queries, so a burst of clients asking for the same uncached name costs a
+// single round trip.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// do runs fn once per key among concurrent callers. Every caller receives
+// its own copy of the response; shared reports whether another caller's
+// exchange was joined.
+func (g *flightGroup) do(key string, fn func() (*dns.Msg, error)) (resp *dns.Msg, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return copyMsg(c.resp), c.err, true
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+
+	return copyMsg(c.resp), c.err, false
+}
+
+func copyMsg(m *dns.Msg) *dns.Msg {
+	if m == nil {
+		return nil
+	}
+	return m.Copy()
+}
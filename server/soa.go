@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// Defaults of the SOA added to blocked answers without records.
+const (
+	defaultSOAMName   = "adblocker."
+	defaultSOARName   = "hostmaster.adblocker."
+	defaultSOARefresh = 30 * time.Minute
+	defaultSOARetry   = 15 * time.Minute
+	defaultSOAExpire  = 7 * 24 * time.Hour
+)
+
+// blockedSOA returns the SOA for the authority section of a blocked answer
+// without records (RFC 2308 negative answer form). Its TTL is the smaller of
+// ttl and the configured minimum, which bounds the negative caching time.
+func (s *Server) blockedSOA(name string, ttl uint32) *dns.SOA {
+	cfg := s.Engine.Config().Server.BlockSOA
+
+	minimum := ttl
+	if cfg.Minimum > 0 {
+		minimum = uint32(cfg.Minimum.Seconds())
+	}
+	seconds := func(d, def time.Duration) uint32 {
+		if d <= 0 {
+			d = def
+		}
+		return uint32(d.Seconds())
+	}
+	orDefault := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return dns.Fqdn(v)
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: min(ttl, minimum)},
+		Ns:      orDefault(cfg.MName, defaultSOAMName),
+		Mbox:    orDefault(cfg.RName, defaultSOARName),
+		Serial:  uint32(s.Engine.LoadedAt().Unix()),
+		Refresh: seconds(cfg.Refresh, defaultSOARefresh),
+		Retry:   seconds(cfg.Retry, defaultSOARetry),
+		Expire:  seconds(cfg.Expire, defaultSOAExpire),
+		Minttl:  minimum,
+	}
+}
+
+// apexAnswer answers SOA and NS queries for the apex of a zone blocked as a
+// whole (||example.com^) when block_soa.apex is set, so resolvers looking
+// for the zone's servers find the sinkhole instead of looping. Returns nil
+// when the question is not for such an apex.
+func (s *Server) apexAnswer(q dns.Question, rule *parser.Rule, ttl uint32) []dns.RR {
+	if !s.Engine.Config().Server.BlockSOA.Apex || rule == nil || rule.Type != parser.RuleTypeDistinguish {
+		return nil
+	}
+	if strings.Contains(rule.Pattern, "*") || !strings.EqualFold(strings.TrimSuffix(q.Name, "."), rule.Pattern) {
+		return nil
+	}
+
+	soa := s.blockedSOA(q.Name, ttl)
+	soa.Hdr.Ttl = ttl
+	switch q.Qtype {
+	case dns.TypeSOA:
+		return []dns.RR{soa}
+	case dns.TypeNS:
+		return []dns.RR{&dns.NS{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  soa.Ns,
+		}}
+	}
+	return nil
+}
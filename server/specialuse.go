@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// specialUseTTL is the TTL of local answers for special-use domains; they
+// never change.
+const specialUseTTL = 3600
+
+// defaultSpecialUse are the special-use zones no resolver should forward
+// (RFC 6761 section 6, RFC 7686, RFC 9476), see server.special_use.
+var defaultSpecialUse = map[string]string{
+	"localhost.": "loopback",
+	"invalid.":   "nxdomain",
+	"test.":      "nxdomain",
+	"onion.":     "nxdomain",
+	"alt.":       "nxdomain",
+}
+
+var specialUseQueries = metrics.NewCounterVec("adblocker_special_use_total",
+	"Queries for special-use domains answered locally, by zone.",
+	"zone")
+
+// specialZone returns the most specific special-use zone name is in and its
+// policy, or "" when there is none.
+func specialZone(zones map[string]string, name string) (string, string) {
+	var zone, policy string
+	match := func(z, p string) {
+		z = dns.CanonicalName(z)
+		if dns.IsSubDomain(z, name) && dns.CountLabel(z) >= dns.CountLabel(zone) {
+			zone, policy = z, p
+		}
+	}
+	for z, p := range defaultSpecialUse {
+		match(z, p)
+	}
+	for z, p := range zones { // Configured zones win over equal defaults
+		match(z, p)
+	}
+	return zone, policy
+}
+
+// handleSpecialUse answers queries under the special-use zones locally,
+// before any rule: localhost names resolve to the loopback addresses and
+// the others do not exist. Returns false for other names and for zones set
+// to "upstream".
+//
+// Single-label names are left to answerLocalName (server.local_names),
+// which runs after the rules; only the apex of a special-use zone, such as
+// "test.", is answered here.
+func (s *Server) handleSpecialUse(w dns.ResponseWriter, r, m *dns.Msg, q dns.Question) bool {
+	name := dns.CanonicalName(q.Name)
+	zone, policy := specialZone(s.Engine.Config().Server.SpecialUse, name)
+	if zone == "" || policy == "upstream" {
+		return false
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: specialUseTTL}
+	switch {
+	case policy == "nxdomain":
+		m.Rcode = dns.RcodeNameError
+	case q.Qtype == dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+	case q.Qtype == dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+	}
+	if len(m.Answer) == 0 { // NXDOMAIN, or NODATA for other types of localhost
+		m.Ns = append(m.Ns, s.blockedSOA(zone, specialUseTTL))
+	}
+	specialUseQueries.Inc(zone)
+	s.writeMsg(w, r, m)
+	return true
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"adblocker/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// standbyPoll is how often the promote file is checked.
+const standbyPoll = time.Second
+
+// StandbyStatus is the hot standby state served at /api/standby.
+type StandbyStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Promoted    bool      `json:"promoted"`
+	Serving     bool      `json:"serving"` // Answers are sent: standby disabled or promoted
+	PromoteFile string    `json:"promote_file,omitempty"`
+	Since       time.Time `json:"since,omitzero"` // Last promotion or demotion
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// standbyState tracks whether a standby instance has been promoted. The
+// latest event wins, whether it came from the API or the promote file.
+type standbyState struct {
+	mu       sync.Mutex
+	promoted bool
+	since    time.Time
+	reason   string
+	fileSeen bool // Promote file existed at the last poll
+}
+
+func registerStandbyMetrics(s *Server) {
+	metrics.NewGaugeFunc("adblocker_standby_serving",
+		"1 when answers are sent, 0 while the instance is an unpromoted standby.", func() float64 {
+			if s.standbyActive() {
+				return 0
+			}
+			return 1
+		})
+}
+
+// standbyActive reports whether answers must be withheld.
+func (s *Server) standbyActive() bool {
+	if !s.Engine.Config().Server.Standby.Enabled {
+		return false
+	}
+	s.standby.mu.Lock()
+	defer s.standby.mu.Unlock()
+	return !s.standby.promoted
+}
+
+// SetPromoted promotes the standby to answer queries, or demotes it again.
+// Caches are kept either way, so a promoted standby answers from warm caches.
+func (s *Server) SetPromoted(promoted bool, reason string) {
+	s.standby.mu.Lock()
+	changed := s.standby.promoted != promoted
+	s.standby.promoted = promoted
+	if changed {
+		s.standby.since = s.clock.Now()
+		s.standby.reason = reason
+	}
+	s.standby.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if promoted {
+		log.Printf("[STANDBY] Promoted, answering queries (%s)", reason)
+	} else {
+		log.Printf("[STANDBY] Demoted, withholding answers (%s)", reason)
+	}
+}
+
+// Standby returns the hot standby state.
+func (s *Server) Standby() StandbyStatus {
+	cfg := s.Engine.Config().Server.Standby
+
+	s.standby.mu.Lock()
+	defer s.standby.mu.Unlock()
+	return StandbyStatus{
+		Enabled:     cfg.Enabled,
+		Promoted:    s.standby.promoted,
+		Serving:     !cfg.Enabled || s.standby.promoted,
+		PromoteFile: cfg.PromoteFile,
+		Since:       s.standby.since,
+		Reason:      s.standby.reason,
+	}
+}
+
+// watchPromoteFile follows the promote file: creating it promotes, removing
+// it demotes. keepalived's notify_master and notify_backup scripts only have
+// to touch or remove the file.
+func (s *Server) watchPromoteFile(stop <-chan struct{}) {
+	ticker := time.NewTicker(standbyPoll)
+	defer ticker.Stop()
+
+	for {
+		s.pollPromoteFile()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Server) pollPromoteFile() {
+	cfg := s.Engine.Config().Server.Standby
+	if !cfg.Enabled || cfg.PromoteFile == "" {
+		return
+	}
+	_, err := os.Stat(cfg.PromoteFile)
+	exists := err == nil
+
+	s.standby.mu.Lock()
+	changed := s.standby.fileSeen != exists
+	s.standby.fileSeen = exists
+	s.standby.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if exists {
+		s.SetPromoted(true, "promote file "+cfg.PromoteFile+" created")
+	} else {
+		s.SetPromoted(false, "promote file "+cfg.PromoteFile+" removed")
+	}
+}
+
+// standbyWriter is handed to handleRequest while the instance is an
+// unpromoted standby. The query is still resolved, which fills the caches,
+// but the answer is dropped or replaced with REFUSED.
+type standbyWriter struct {
+	dns.ResponseWriter
+	action string
+}
+
+func (w standbyWriter) WriteMsg(m *dns.Msg) error {
+	standbyWithheld.Inc(w.action)
+	if w.action != "refuse" {
+		return nil
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(m, dns.RcodeRefused)
+	return w.ResponseWriter.WriteMsg(reply)
+}
+
+func (w standbyWriter) Write(b []byte) (int, error) {
+	standbyWithheld.Inc(w.action)
+	if w.action != "refuse" {
+		return len(b), nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"adblocker/config"
+)
+
+// statsResetPoll bounds how long a changed stats_reset takes to apply.
+const statsResetPoll = time.Hour
+
+// StatsResetStatus is served at /api/stats/reset.
+type StatsResetStatus struct {
+	LastReset time.Time `json:"last_reset,omitzero"`
+	Reason    string    `json:"reason,omitempty"` // "scheduled" or who reset through the API
+	Next      time.Time `json:"next,omitzero"`    // Next scheduled reset, zero without stats_reset
+}
+
+type statsResetState struct {
+	mu     sync.Mutex
+	last   time.Time
+	reason string
+}
+
+// ResetStats starts the query statistics over: the time series and the
+// query, cache hit and latency metrics. Upstream and health metrics are kept.
+func (s *Server) ResetStats(reason string) {
+	s.Stats.Reset()
+	queriesTotal.Reset()
+	userQueries.Reset()
+	queryDuration.Reset()
+	cacheHits.Reset()
+	s.activity.reset()
+
+	s.statsReset.mu.Lock()
+	s.statsReset.last = s.clock.Now()
+	s.statsReset.reason = reason
+	s.statsReset.mu.Unlock()
+	log.Printf("[STATS] Statistics reset (%s)", reason)
+}
+
+// ResetUserStats drops the per-user query counters of one user and reports
+// whether there were any. The totals keep counting the user's queries.
+func (s *Server) ResetUserStats(user, reason string) bool {
+	if userQueries.DeleteMatching("user", user) == 0 {
+		return false
+	}
+	log.Printf("[STATS] Statistics of user '%s' reset (%s)", user, reason)
+	return true
+}
+
+// StatsReset returns when statistics were last reset and when the next
+// scheduled reset is due.
+func (s *Server) StatsReset() StatsResetStatus {
+	s.statsReset.mu.Lock()
+	defer s.statsReset.mu.Unlock()
+	return StatsResetStatus{
+		LastReset: s.statsReset.last,
+		Reason:    s.statsReset.reason,
+		Next:      nextStatsReset(s.Engine.Config().StatsReset, s.clock.Now()),
+	}
+}
+
+// watchStatsReset runs the resets scheduled by stats_reset.
+func (s *Server) watchStatsReset(stop <-chan struct{}) {
+	for {
+		next := nextStatsReset(s.Engine.Config().StatsReset, s.clock.Now())
+		wait := statsResetPoll
+		if !next.IsZero() {
+			wait = min(wait, next.Sub(s.clock.Now()))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+
+		if !next.IsZero() && !s.clock.Now().Before(next) {
+			s.ResetStats("scheduled")
+		}
+	}
+}
+
+// nextStatsReset returns the first period start after now, or zero when
+// no period is configured. Periods start at local midnight.
+func nextStatsReset(cfg config.StatsReset, now time.Time) time.Time {
+	y, m, d := now.Date()
+	var next time.Time
+	switch cfg.Period {
+	case "daily":
+		next = time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	case "weekly":
+		weekday := time.Monday
+		if cfg.Day != 0 {
+			weekday = time.Weekday(cfg.Day % 7) // 7 is Sunday
+		}
+		days := (int(weekday) - int(now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		next = time.Date(y, m, d+days, 0, 0, 0, 0, now.Location())
+	case "monthly":
+		day := max(cfg.Day, 1)
+		next = time.Date(y, m, day, 0, 0, 0, 0, now.Location())
+		if !next.After(now) {
+			next = time.Date(y, m+1, day, 0, 0, 0, 0, now.Location())
+		}
+	}
+	return next
+}
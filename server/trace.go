@@ -0,0 +1,134 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"adblocker/engine"
+
+	"github.com/miekg/dns"
+)
+
+// maxTraces bounds the query traces kept for Traces.
+const maxTraces = 100
+
+// Traces are expensive, the engine records every step: at most traceBurst
+// at once and traceRate per second on average, for all clients together.
+const (
+	traceRate  = 1
+	traceBurst = 10
+)
+
+// QueryTrace is the evaluation trace of one query, see Trace.
+type QueryTrace struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Decision  string    `json:"decision"`
+	UserGroup string    `json:"user_group,omitempty"`
+	RuleGroup string    `json:"rule_group,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Steps     []string  `json:"steps"`
+}
+
+// Trace resolves a query like a client would and returns how the engine
+// decided it, step by step. Nothing is cached or sent upstream.
+func (s *Server) Trace(name string, qType uint16, clientIP netip.Addr, clientMAC, clientID string) QueryTrace {
+	_, t := s.traceResolve(dns.Fqdn(name), qType, clientIP, clientMAC, clientID)
+	return t
+}
+
+// traceResolve is Engine.Resolve, also returning the trace.
+func (s *Server) traceResolve(qName string, qType uint16, clientIP netip.Addr, clientMAC, clientID string) (*engine.ResolveResult, QueryTrace) {
+	res, tr := s.Engine.ResolveTrace(qName, qType, clientIP, clientMAC, clientID)
+	t := QueryTrace{
+		Time:      s.clock.Now(),
+		Client:    clientIP.String(),
+		Name:      qName,
+		Type:      dns.TypeToString[qType],
+		Decision:  decisionOf(res),
+		UserGroup: res.UserGroup,
+		RuleGroup: res.RuleGroup,
+		Steps:     tr.Steps,
+	}
+	if res.Rule != nil {
+		t.Rule = res.Rule.Text
+	}
+	return res, t
+}
+
+// Traces returns the traces of queries that asked for one with the
+// server.trace_option EDNS option, newest first.
+func (s *Server) Traces() []QueryTrace {
+	s.traces.mu.Lock()
+	defer s.traces.mu.Unlock()
+	list := slices.Clone(s.traces.list)
+	slices.Reverse(list)
+	return list
+}
+
+// wantsTrace reports whether r carries the EDNS option configured as
+// server.trace_option, from a client of server.trace_clients (loopback when
+// unset) and within the trace rate limit.
+func (s *Server) wantsTrace(r *dns.Msg, clientIP netip.Addr) bool {
+	cfg := s.Engine.Config().Server
+	if cfg.TraceOption == 0 {
+		return false
+	}
+	opt := r.IsEdns0()
+	if opt == nil || !slices.ContainsFunc(opt.Option, func(o dns.EDNS0) bool { return o.Option() == cfg.TraceOption }) {
+		return false
+	}
+	if len(cfg.TraceClients) == 0 {
+		if !clientIP.IsLoopback() {
+			return false
+		}
+	} else if !trustedProxies(cfg.TraceClients)(clientIP) {
+		return false
+	}
+	return s.traces.allow(s.clock.Now())
+}
+
+// recordTrace keeps t for Traces.
+func (s *Server) recordTrace(t QueryTrace, clientIP netip.Addr) {
+	if s.logThrottle.allow(clientIP, t.Name, "trace") {
+		log.Printf("[TRACE] %s %s for %s: %s after %d steps, see /api/traces", t.Name, t.Type, t.Client, t.Decision, len(t.Steps))
+	}
+	s.traces.mu.Lock()
+	defer s.traces.mu.Unlock()
+	if len(s.traces.list) >= maxTraces {
+		s.traces.list = slices.Delete(s.traces.list, 0, 1)
+	}
+	s.traces.list = append(s.traces.list, t)
+}
+
+// traceLog holds the latest query traces, oldest first.
+type traceLog struct {
+	mu   sync.Mutex
+	list []QueryTrace
+
+	// Token bucket of the trace rate limit
+	tokens     float64
+	lastRefill time.Time
+}
+
+// allow takes a token for one more trace at now.
+func (l *traceLog) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lastRefill.IsZero() {
+		l.tokens = traceBurst
+	} else {
+		l.tokens = min(traceBurst, l.tokens+now.Sub(l.lastRefill).Seconds()*traceRate)
+	}
+	l.lastRefill = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
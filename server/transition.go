@@ -0,0 +1,58 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// transitionPoll is how often the watcher re-reads schedules when no change is due sooner.
+const transitionPoll = time.Minute
+
+// untilTransition clamps d to the time left before the policies of userGroup
+// next change, so cached decisions do not outlive a schedule boundary.
+func (s *Server) untilTransition(userGroup string, d time.Duration) time.Duration {
+	now := s.clock.Now()
+	next := s.Engine.NextTransition(userGroup, now)
+	if next.IsZero() {
+		return d
+	}
+	return max(0, min(d, next.Sub(now)))
+}
+
+// watchTransitions drops group-cache entries of user groups whose policies
+// just changed because of a schedule, until stop is closed.
+func (s *Server) watchTransitions(stop <-chan struct{}) {
+	for {
+		now := s.clock.Now()
+		due := make(map[string]time.Time)
+		wait := transitionPoll
+		for _, ug := range s.Engine.Config().UserGroups {
+			if next := s.Engine.NextTransition(ug.Name, now); !next.IsZero() {
+				due[ug.Name] = next
+				wait = min(wait, next.Sub(now))
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+
+		now = s.clock.Now()
+		affected := make(map[string]bool)
+		for name, next := range due {
+			if !now.Before(next) {
+				affected[name] = true
+			}
+		}
+		if len(affected) == 0 {
+			continue
+		}
+		removed := s.UserGroupCache.DeleteFunc(func(e CacheEntry) bool {
+			userGroup, _, _ := parseCacheTag(e.Tag)
+			return affected[userGroup]
+		})
+		log.Printf("[SCHEDULE] Policies changed for %d user groups, dropped %d cached decisions", len(affected), removed)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamTimeout bounds one exchange with an encrypted upstream.
+const upstreamTimeout = 5 * time.Second
+
+// dnsMessageType is the media type of DNS-over-HTTPS bodies (RFC 8484).
+const dnsMessageType = "application/dns-message"
+
+// dotIdleConns is the number of idle DNS-over-TLS connections kept per upstream.
+const dotIdleConns = 4
+
+// UpstreamClient sends queries to one upstream resolver and reports the
+// transport each exchange went over (see encryptedTransport).
+type UpstreamClient interface {
+	Exchange(r *dns.Msg) (*dns.Msg, string, error)
+}
+
+// NewUpstreamClient returns the client for an upstream address: "host:port"
+// for plain DNS, "tls://host[:port]" for DNS-over-TLS and
+// "https://host/path" for DNS-over-HTTPS. opts apply to the encrypted ones.
+func NewUpstreamClient(addr string, opts config.UpstreamTLS) (UpstreamClient, error) {
+	switch {
+	case strings.HasPrefix(addr, "tls://"):
+		return newDoTClient(addr, opts)
+	case strings.HasPrefix(addr, "https://"):
+		return newDoHClient(addr, opts)
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("unsupported upstream '%s'", addr)
+	}
+	return plainUpstream(addr), nil
+}
+
+// plainUpstream is a "host:port" resolver spoken to over UDP with TCP retry.
+type plainUpstream string
+
+func (u plainUpstream) Exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	return exchangeUpstream(r, string(u))
+}
+
+// dohClient speaks DNS-over-HTTPS (RFC 8484) to one URL. The HTTP client
+// keeps connections open, so TLS handshakes are paid once, not per query.
+type dohClient struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHClient(rawURL string, opts config.UpstreamTLS) (*dohClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid DoH upstream '%s'", rawURL)
+	}
+	tlsConfig, err := upstreamTLSConfig(u.Hostname(), opts)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = 10
+	return &dohClient{url: rawURL, client: &http.Client{Transport: transport, Timeout: upstreamTimeout}}, nil
+}
+
+func (c *dohClient) Exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	// The ID is 0 on the wire so that identical queries are cacheable (RFC 8484 section 4.1)
+	q := r.Copy()
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, "https", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "https", err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, "https", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "https", fmt.Errorf("DoH upstream %s: %s", c.url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, "https", err
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(data); err != nil {
+		return nil, "https", fmt.Errorf("DoH upstream %s: %w", c.url, err)
+	}
+	if answer.Id == 0 {
+		answer.Id = r.Id
+	}
+	return answer, "https", nil
+}
+
+// dotClient speaks DNS-over-TLS (RFC 7858) to one server. Connections are
+// kept open and reused for later queries, and TLS sessions are resumed when
+// a new connection is needed.
+type dotClient struct {
+	addr   string
+	client *dns.Client
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+func newDoTClient(addr string, opts config.UpstreamTLS) (*dotClient, error) {
+	hostPort := strings.TrimPrefix(addr, "tls://")
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, "853")
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("invalid DoT upstream '%s'", addr)
+	}
+	tlsConfig, err := upstreamTLSConfig(host, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &dotClient{
+		addr: hostPort,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   upstreamTimeout,
+			TLSConfig: tlsConfig,
+		},
+	}, nil
+}
+
+func (c *dotClient) Exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	// An idle connection may have been closed by the server meanwhile;
+	// then the query is repeated once on a fresh connection
+	if conn := c.takeIdle(); conn != nil {
+		resp, _, err := c.client.ExchangeWithConn(r, conn)
+		if err == nil {
+			c.putIdle(conn)
+			return resp, "tls", nil
+		}
+		conn.Close()
+	}
+
+	conn, err := c.client.Dial(c.addr)
+	if err != nil {
+		return nil, "tls", err
+	}
+	resp, _, err := c.client.ExchangeWithConn(r, conn)
+	if err != nil {
+		conn.Close()
+		return nil, "tls", err
+	}
+	c.putIdle(conn)
+	return resp, "tls", nil
+}
+
+func (c *dotClient) takeIdle() *dns.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		return conn
+	}
+	return nil
+}
+
+func (c *dotClient) putIdle(conn *dns.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= dotIdleConns {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// Close closes the idle connections.
+func (c *dotClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
+
+// upstreamTLSConfig verifies the server certificate against host, or the
+// configured server_name, and resumes TLS sessions. ca_file is read here,
+// so a changed bundle applies when the upstream_tls options change.
+func upstreamTLSConfig(host string, opts config.UpstreamTLS) (*tls.Config, error) {
+	serverName := host
+	if opts.ServerName != "" {
+		serverName = opts.ServerName
+	}
+	c := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		MinVersion:         tls.VersionTLS12,
+	}
+	if opts.MinVersion == "1.3" {
+		c.MinVersion = tls.VersionTLS13
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s holds no PEM certificates", opts.CAFile)
+		}
+	}
+	if len(opts.SPKIPins) > 0 {
+		pins := opts.SPKIPins
+		c.VerifyConnection = func(cs tls.ConnectionState) error { return checkSPKIPins(cs, pins) }
+	}
+	return c, nil
+}
+
+// checkSPKIPins accepts the connection when a public key of the verified
+// chain matches one of pins. Without verification (insecure_skip_verify)
+// only the leaf counts, as the server proves to hold no other key.
+func checkSPKIPins(cs tls.ConnectionState, pins []string) error {
+	var certs []*x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		certs = append(certs, cs.PeerCertificates[0])
+	}
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		if slices.Contains(pins, spkiPin(cert)) {
+			return nil
+		}
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate to check spki_pins against")
+	}
+	return fmt.Errorf("no public key in the certificate chain matches spki_pins, the server's is %s", spkiPin(certs[0]))
+}
+
+// spkiPin returns the spki_pins form of the public key of cert, the same as
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upstreamPool is the default Exchanger. It keeps one client per upstream
+// address so connections to encrypted upstreams are reused across queries.
+type upstreamPool struct {
+	tlsOptions func(upstream string) config.UpstreamTLS
+
+	mu      sync.Mutex
+	clients map[string]pooledClient
+}
+
+type pooledClient struct {
+	opts   config.UpstreamTLS // Options the client was built with
+	client UpstreamClient
+}
+
+func newUpstreamPool(tlsOptions func(upstream string) config.UpstreamTLS) *upstreamPool {
+	return &upstreamPool{tlsOptions: tlsOptions, clients: make(map[string]pooledClient)}
+}
+
+func (p *upstreamPool) Exchange(r *dns.Msg, upstream string) (*dns.Msg, string, error) {
+	c, err := p.client(upstream)
+	if err != nil {
+		return nil, "", err
+	}
+	return c.Exchange(r)
+}
+
+// client returns the client for upstream, rebuilding it when its TLS
+// options changed with a config reload.
+func (p *upstreamPool) client(upstream string) (UpstreamClient, error) {
+	opts := p.tlsOptions(upstream)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.clients[upstream]
+	if ok && pc.opts.Equal(opts) {
+		return pc.client, nil
+	}
+	if closer, ok := pc.client.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	c, err := NewUpstreamClient(upstream, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[upstream] = pooledClient{opts: opts, client: c}
+	return c, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkUpstream validates and sanitizes an upstream reply to r in place.
+func checkUpstream(r, resp *dns.Msg) error {
+	if err := validateUpstream(r, resp); err != nil {
+		return fmt.Errorf("invalid upstream answer: %w", err)
+	}
+	if n := sanitizeUpstream(resp); n > 0 {
+		log.Printf("[UPSTREAM] Dropped %d out-of-bailiwick records for %s", n, resp.Question[0].Name)
+	}
+	return nil
+}
+
+// validateUpstream rejects upstream replies that do not answer r: wrong ID,
+// not a response, a different question, or an undefined RCODE. Such replies
+// would otherwise be cached and served to every client.
+func validateUpstream(r, resp *dns.Msg) error {
+	if resp.Id != r.Id {
+		return fmt.Errorf("ID mismatch (%d, expected %d)", resp.Id, r.Id)
+	}
+	if !resp.Response || resp.Opcode != r.Opcode {
+		return fmt.Errorf("not a response to the query")
+	}
+	if len(resp.Question) != 1 {
+		return fmt.Errorf("%d questions in reply", len(resp.Question))
+	}
+	q, rq := r.Question[0], resp.Question[0]
+	if !strings.EqualFold(q.Name, rq.Name) || q.Qtype != rq.Qtype || q.Qclass != rq.Qclass {
+		return fmt.Errorf("reply is for %s %s", rq.Name, dns.TypeToString[rq.Qtype])
+	}
+	if _, ok := dns.RcodeToString[resp.Rcode]; !ok {
+		return fmt.Errorf("unknown rcode %d", resp.Rcode)
+	}
+	return nil
+}
+
+// sanitizeUpstream drops out-of-bailiwick records before a reply is cached.
+// Answer records must belong to the CNAME/DNAME chain starting at the
+// question name; DNAME records (and their signatures) may be owned by an
+// ancestor of a name in the chain, as they apply to the names below them.
+// Authority records must be at or above a name in that chain, except the
+// DNSSEC denial records (NSEC, NSEC3 and their RRSIGs), which are named after
+// other names of the zone: they are kept within the zone of the SOA or of the
+// signer of the answer. Additional records must be named by a kept record
+// (NS, MX, SRV targets). Returns the number of records dropped.
+func sanitizeUpstream(resp *dns.Msg) int {
+	chain := map[string]bool{strings.ToLower(resp.Question[0].Name): true}
+	dropped := 0
+
+	// The chain is ordered in well-formed replies, but follow it until no name is added
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range resp.Answer {
+			if !chain[strings.ToLower(rr.Header().Name)] {
+				continue
+			}
+			var target string
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				target = v.Target
+			case *dns.DNAME:
+				target = v.Target
+			}
+			if target != "" && !chain[strings.ToLower(target)] {
+				chain[strings.ToLower(target)] = true
+				grown = true
+			}
+		}
+	}
+
+	inChain := func(rr dns.RR) bool {
+		return chain[strings.ToLower(rr.Header().Name)]
+	}
+	aboveChain := func(rr dns.RR) bool {
+		for name := range chain {
+			if dns.IsSubDomain(rr.Header().Name, name) {
+				return true
+			}
+		}
+		return false
+	}
+	dname := func(rr dns.RR) bool {
+		sig, ok := rr.(*dns.RRSIG)
+		return (rr.Header().Rrtype == dns.TypeDNAME || (ok && sig.TypeCovered == dns.TypeDNAME)) && aboveChain(rr)
+	}
+	resp.Answer, dropped = filterRRs(resp.Answer, func(rr dns.RR) bool {
+		return inChain(rr) || dname(rr)
+	}, dropped)
+
+	// Zones the denial records may come from
+	var zones []string
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && dns.IsSubDomain(sig.SignerName, sig.Hdr.Name) {
+			zones = append(zones, sig.SignerName)
+		}
+	}
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA && aboveChain(rr) {
+			zones = append(zones, rr.Header().Name)
+		}
+	}
+	inZone := func(rr dns.RR) bool {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+		default:
+			return false
+		}
+		for _, zone := range zones {
+			if dns.IsSubDomain(zone, rr.Header().Name) {
+				return true
+			}
+		}
+		return false
+	}
+	resp.Ns, dropped = filterRRs(resp.Ns, func(rr dns.RR) bool {
+		return aboveChain(rr) || inZone(rr)
+	}, dropped)
+
+	// Names the kept records point at
+	named := make(map[string]bool)
+	for _, rr := range append(resp.Answer[:len(resp.Answer):len(resp.Answer)], resp.Ns...) {
+		switch v := rr.(type) {
+		case *dns.NS:
+			named[strings.ToLower(v.Ns)] = true
+		case *dns.MX:
+			named[strings.ToLower(v.Mx)] = true
+		case *dns.SRV:
+			named[strings.ToLower(v.Target)] = true
+		}
+	}
+	resp.Extra, dropped = filterRRs(resp.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT || named[strings.ToLower(rr.Header().Name)] || inChain(rr)
+	}, dropped)
+
+	return dropped
+}
+
+// filterRRs keeps the records for which keep returns true, adding the rest to dropped.
+func filterRRs(rrs []dns.RR, keep func(dns.RR) bool, dropped int) ([]dns.RR, int) {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if keep(rr) {
+			kept = append(kept, rr)
+		} else {
+			dropped++
+		}
+	}
+	return kept, dropped
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// whyTTL keeps explanations fresh; they depend on schedules and reloads.
+const whyTTL = 5
+
+// handleWhy answers TXT queries under the configured why_zone with the
+// decision the engine makes for the querying client, e.g.
+// "nslookup -type=txt ads.example.com.why.adblocker.internal".
+// Returns false if the question is not for the zone.
+func (s *Server) handleWhy(w dns.ResponseWriter, m *dns.Msg, q dns.Question, clientIP netip.Addr, clientMAC, clientID string) bool {
+	zone := s.Engine.Config().Server.WhyZone
+	if zone == "" {
+		return false
+	}
+	zone = dns.CanonicalName(zone)
+	name := dns.CanonicalName(q.Name)
+	if !dns.IsSubDomain(zone, name) {
+		return false
+	}
+
+	domain := strings.TrimSuffix(strings.TrimSuffix(name, zone), ".")
+	if domain == "" {
+		// Bare zone: explain usage instead of returning NXDOMAIN
+		if q.Qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, whyTXT(q.Name, "query TXT <domain>."+zone))
+		}
+		w.WriteMsg(m)
+		return true
+	}
+	if q.Qtype != dns.TypeTXT {
+		w.WriteMsg(m) // NODATA
+		return true
+	}
+
+	res := s.Engine.Resolve(domain+".", dns.TypeA, clientIP, clientMAC, clientID)
+
+	decision := decisionOf(res)
+	lines := []string{
+		"domain=" + domain,
+		"decision=" + decision,
+		"reason=" + res.Reason,
+		"client=" + clientIP.String(),
+		"user_group=" + labelOrNone(res.UserGroup),
+	}
+	if res.User != nil {
+		lines = append(lines, "user="+res.User.Name)
+		if res.User.DisplayName != "" || res.User.Icon != "" {
+			lines = append(lines, "display_name="+res.User.Label())
+		}
+	}
+	if res.Rule != nil {
+		lines = append(lines,
+			"rule="+res.Rule.Text,
+			"list="+labelOrNone(res.Rule.Source),
+			"rule_group="+res.RuleGroup,
+		)
+	}
+	if res.DNSRewrite != "" {
+		lines = append(lines, "rewrite="+res.DNSRewrite)
+	}
+	for _, line := range lines {
+		m.Answer = append(m.Answer, whyTXT(q.Name, line))
+	}
+
+	log.Printf("[WHY] %s for %s: %s", domain, clientIP, decision)
+	w.WriteMsg(m)
+	return true
+}
+
+// whyTXT builds a TXT record, splitting text into 255-byte strings.
+func whyTXT(name, text string) dns.RR {
+	var parts []string
+	for len(text) > 255 {
+		parts = append(parts, text[:255])
+		text = text[255:]
+	}
+	parts = append(parts, text)
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: whyTTL},
+		Txt: parts,
+	}
+}
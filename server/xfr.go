@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/export"
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// xfrChunkSize is the number of records sent per AXFR envelope.
+const xfrChunkSize = 500
+
+// ZoneTransferServer serves the compiled block list as an RPZ zone over AXFR/IXFR.
+type ZoneTransferServer struct {
+	Engine *engine.Engine
+	cfg    config.ZoneTransferConfig
+	zone   string
+	allow  []netip.Prefix
+
+	tsig    map[string]string
+	srvMu   sync.Mutex
+	servers []*dns.Server // Replaced on every Start
+
+	// Compiled zone, rebuilt when the engine reloads rules. The serial
+	// increases whenever the entries change, never on reloads alone.
+	mu       sync.Mutex
+	loadedAt time.Time // Engine.LoadedAt the zone was compiled for
+	serial   uint32
+	entries  []export.Entry
+	records  []dns.RR
+}
+
+// NewZoneTransferServer creates a zone transfer server from the configuration.
+func NewZoneTransferServer(cfg config.ZoneTransferConfig, eng *engine.Engine) (*ZoneTransferServer, error) {
+	if cfg.Zone == "" {
+		return nil, fmt.Errorf("zone_transfer.zone is required")
+	}
+
+	zs := &ZoneTransferServer{
+		Engine: eng,
+		cfg:    cfg,
+		zone:   dns.CanonicalName(cfg.Zone),
+	}
+
+	for _, s := range cfg.AllowFrom {
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			zs.allow = append(zs.allow, prefix)
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_from entry '%s'", s)
+		}
+		zs.allow = append(zs.allow, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	if len(zs.allow) == 0 && cfg.TSIGSecret == "" {
+		return nil, fmt.Errorf("zone_transfer.allow_from or tsig_secret is required")
+	}
+
+	var tsig map[string]string
+	if cfg.TSIGSecret != "" {
+		if cfg.TSIGKey == "" {
+			return nil, fmt.Errorf("zone_transfer.tsig_key is required with tsig_secret")
+		}
+		tsig = map[string]string{dns.CanonicalName(cfg.TSIGKey): cfg.TSIGSecret}
+	}
+
+	zs.tsig = tsig
+
+	return zs, nil
+}
+
+// Start runs the UDP and TCP listeners. It blocks until one of them fails,
+// then stops the other, so it may be called again to restart both.
+func (zs *ZoneTransferServer) Start() error {
+	// Bind both sockets up front so a failure leaves nothing half-started.
+	// SOA checks from secondaries arrive over UDP, transfers over TCP.
+	pc, err := net.ListenPacket("udp", zs.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", zs.cfg.ListenAddr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: dns.HandlerFunc(zs.handleRequest), TsigSecret: zs.tsig},
+		{Listener: l, Handler: dns.HandlerFunc(zs.handleRequest), TsigSecret: zs.tsig},
+	}
+	zs.srvMu.Lock()
+	zs.servers = servers
+	zs.srvMu.Unlock()
+
+	log.Printf("Zone transfer server listening on %s (Zone: %s)", zs.cfg.ListenAddr, zs.zone)
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			errCh <- srv.ActivateAndServe()
+		}(srv)
+	}
+	err = <-errCh
+
+	// Closing the sockets ends the other serve loop
+	pc.Close()
+	l.Close()
+	<-errCh
+	return err
+}
+
+func (zs *ZoneTransferServer) Stop() error {
+	zs.srvMu.Lock()
+	servers := zs.servers
+	zs.srvMu.Unlock()
+
+	var firstErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (zs *ZoneTransferServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+
+	clientIP, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	if !zs.allowed(clientIP.Addr()) {
+		log.Printf("[XFR] Refused %s from %s (not in allow_from)", dns.TypeToString[q.Qtype], clientIP.Addr())
+		zs.refuse(w, m)
+		return
+	}
+
+	// TSIG is mandatory when a secret is configured
+	if zs.cfg.TSIGSecret != "" {
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			log.Printf("[XFR] Refused %s from %s (TSIG failed)", dns.TypeToString[q.Qtype], clientIP.Addr())
+			zs.refuse(w, m)
+			return
+		}
+	}
+
+	if dns.CanonicalName(q.Name) != zs.zone {
+		m.Rcode = dns.RcodeNotAuth
+		zs.writeMsg(w, r, m)
+		return
+	}
+
+	serial, records := zs.compile()
+
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		// A secondary that is up to date gets the SOA alone (RFC 1995 section 2)
+		if q.Qtype == dns.TypeIXFR && ixfrCurrent(r, serial) {
+			log.Printf("[XFR] IXFR of %s from %s: serial %d is current", zs.zone, clientIP.Addr(), serial)
+			m.Answer = append(m.Answer, records[0])
+			zs.writeMsg(w, r, m)
+			return
+		}
+		if w.RemoteAddr().Network() != "tcp" {
+			m.Truncated = true
+			zs.writeMsg(w, r, m)
+			return
+		}
+
+		if q.Qtype == dns.TypeIXFR {
+			// No history of changes is kept, so the whole zone goes out in
+			// AXFR form, which secondaries accept (RFC 1995 section 4)
+			log.Printf("[XFR] IXFR of %s from %s answered with a full transfer (no incremental history)", zs.zone, clientIP.Addr())
+		}
+		log.Printf("[XFR] %s of %s (serial %d, %d records) to %s", dns.TypeToString[q.Qtype], zs.zone, serial, len(records), clientIP.Addr())
+		ch := make(chan *dns.Envelope)
+		tr := new(dns.Transfer)
+		go func() {
+			defer close(ch)
+			for i := 0; i < len(records); i += xfrChunkSize {
+				end := min(i+xfrChunkSize, len(records))
+				ch <- &dns.Envelope{RR: records[i:end]}
+			}
+			// A transfer ends with the SOA repeated
+			ch <- &dns.Envelope{RR: []dns.RR{records[0]}}
+		}()
+		if err := tr.Out(w, r, ch); err != nil {
+			log.Printf("[XFR] Transfer to %s failed: %v", clientIP.Addr(), err)
+			for range ch {
+				// Drain so the producer exits
+			}
+		}
+		w.Close()
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, records[0])
+		zs.writeMsg(w, r, m)
+	default:
+		m.Ns = append(m.Ns, records[0])
+		zs.writeMsg(w, r, m)
+	}
+}
+
+// compile returns the zone records, rebuilding them if the rules were
+// reloaded. The serial starts at the current Unix time and goes up by at
+// least one for every change of the entries, so two reloads in the same
+// second still give secondaries a newer serial.
+func (zs *ZoneTransferServer) compile() (uint32, []dns.RR) {
+	loadedAt := zs.Engine.LoadedAt()
+
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+
+	if zs.records != nil && zs.loadedAt.Equal(loadedAt) {
+		return zs.serial, zs.records
+	}
+	zs.loadedAt = loadedAt
+
+	var rules []*parser.Rule
+	for _, name := range zs.ruleGroups() {
+		rules = append(rules, zs.Engine.GroupRules(name)...)
+	}
+	entries, _ := export.Compile(rules)
+	if zs.records != nil && slices.Equal(entries, zs.entries) {
+		return zs.serial, zs.records
+	}
+
+	zs.serial = max(zs.serial+1, uint32(time.Now().Unix()))
+	zs.entries = entries
+	zs.records = export.RPZRecords(entries, zs.zone, zs.serial)
+	return zs.serial, zs.records
+}
+
+// ixfrCurrent reports whether the SOA an IXFR request carries in its
+// authority section already has serial, or a later one.
+func ixfrCurrent(r *dns.Msg, serial uint32) bool {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return int32(soa.Serial-serial) >= 0 // Serial number arithmetic (RFC 1982)
+		}
+	}
+	return false
+}
+
+func (zs *ZoneTransferServer) ruleGroups() []string {
+	if len(zs.cfg.RuleGroups) > 0 {
+		return zs.cfg.RuleGroups
+	}
+	var names []string
+	for _, rg := range zs.Engine.RuleGroups() {
+		names = append(names, rg.Name)
+	}
+	return names
+}
+
+// allowed reports whether ip may ask for the zone. Without allow_from any
+// client may, TSIG is checked then; a server with neither refuses all.
+func (zs *ZoneTransferServer) allowed(ip netip.Addr) bool {
+	if len(zs.allow) == 0 {
+		return zs.cfg.TSIGSecret != ""
+	}
+	for _, prefix := range zs.allow {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (zs *ZoneTransferServer) refuse(w dns.ResponseWriter, m *dns.Msg) {
+	m.Rcode = dns.RcodeRefused
+	m.Answer = nil
+	w.WriteMsg(m)
+}
+
+// writeMsg signs the reply when the request carried a valid TSIG.
+func (zs *ZoneTransferServer) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,124 @@
+package server_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/parser"
+	"adblocker/server"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	xfrKey    = "transfer-key."
+	xfrSecret = "c2VjcmV0LWtleQ=="
+)
+
+// startZoneTransfer runs a zone transfer server for cfg on a free local port
+// and returns its address.
+func startZoneTransfer(t *testing.T, cfg config.ZoneTransferConfig) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenAddr = l.Addr().String()
+	l.Close()
+	cfg.Zone = "rpz.test."
+
+	eng, err := engine.NewEngine(&config.Config{RuleGroups: []config.RuleGroup{{Name: "ads", Rules: []string{"||ads.example^"}}}})
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	if err := eng.ReloadRules(parser.NewLoader(t.TempDir())); err != nil {
+		t.Fatalf("ReloadRules: %v", err)
+	}
+	zs, err := server.NewZoneTransferServer(cfg, eng)
+	if err != nil {
+		t.Fatalf("NewZoneTransferServer: %v", err)
+	}
+	go zs.Start()
+	t.Cleanup(func() { zs.Stop() })
+
+	// Wait for the TCP listener
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", cfg.ListenAddr)
+		if err == nil {
+			c.Close()
+			return cfg.ListenAddr
+		}
+		if i == 50 {
+			t.Fatalf("zone transfer server not listening: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestZoneTransferRequiresAccessControl(t *testing.T) {
+	cfg := config.ZoneTransferConfig{ListenAddr: "127.0.0.1:0", Zone: "rpz.test."}
+	if _, err := server.NewZoneTransferServer(cfg, nil); err == nil {
+		t.Fatal("NewZoneTransferServer without allow_from or TSIG succeeded")
+	}
+
+	c := &config.Config{}
+	c.Server.ZoneTransfer = cfg
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "zone_transfer") {
+		t.Errorf("Validate = %v, want a zone_transfer error", err)
+	}
+}
+
+func TestZoneTransferAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		tsig   bool   // Server requires TSIG
+		secret string // Client TSIG secret, "" for none
+		rcode  int    // -1 when the exchange itself must fail
+	}{
+		{"allowed", []string{"127.0.0.1"}, false, "", dns.RcodeSuccess},
+		{"outside allow_from", []string{"192.0.2.0/24"}, false, "", dns.RcodeRefused},
+		{"outside allow_from with TSIG", []string{"192.0.2.0/24"}, true, xfrSecret, dns.RcodeRefused},
+		{"TSIG", nil, true, xfrSecret, dns.RcodeSuccess},
+		{"TSIG missing", nil, true, "", dns.RcodeRefused},
+		{"TSIG wrong", nil, true, "d3Jvbmcta2V5", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.ZoneTransferConfig{AllowFrom: tt.allow}
+			if tt.tsig {
+				cfg.TSIGKey, cfg.TSIGSecret = xfrKey, xfrSecret
+			}
+			addr := startZoneTransfer(t, cfg)
+
+			c := &dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+			r := new(dns.Msg)
+			r.SetQuestion("rpz.test.", dns.TypeSOA)
+			if tt.secret != "" {
+				c.TsigSecret = map[string]string{xfrKey: tt.secret}
+				r.SetTsig(xfrKey, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			m, _, err := c.Exchange(r, addr)
+			if tt.rcode < 0 {
+				// A reply to a bad signature must not be a valid answer
+				if err == nil && m.Rcode == dns.RcodeSuccess {
+					t.Fatalf("wrong TSIG answered with %s", dns.RcodeToString[m.Rcode])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if m.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if soa := len(m.Answer) == 1 && m.Answer[0].Header().Rrtype == dns.TypeSOA; soa != (tt.rcode == dns.RcodeSuccess) {
+				t.Errorf("answer = %v", m.Answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package stats
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Snapshot is the full time series of one instance, as pushed to an aggregator.
+// Each push replaces the previous snapshot of the instance.
+type Snapshot struct {
+	Instance string               `json:"instance"`
+	SentAt   time.Time            `json:"sent_at"`
+	Series   map[Interval][]Point `json:"series"`
+}
+
+// Snapshot returns a copy of all series.
+func (s *Store) Snapshot() map[Interval][]Point {
+	series := make(map[Interval][]Point, len(retention))
+	for interval := range retention {
+		series[interval] = s.Series(interval)
+	}
+	return series
+}
+
+// Instance describes one member of the fleet.
+type Instance struct {
+	Name     string    `json:"name"`
+	Local    bool      `json:"local,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Counts             // Totals of the retained day series
+}
+
+// Fleet combines the local store with snapshots pushed by other instances.
+// Without pushes it reports the local instance only.
+type Fleet struct {
+	local    *Store
+	instance string
+	expire   time.Duration // Snapshots older than this are dropped
+
+	mu     sync.Mutex
+	remote map[string]Snapshot
+	seen   map[string]time.Time // Receive time per instance
+}
+
+// NewFleet creates a fleet view around the local store. Remote instances
+// that stop pushing are forgotten after expire.
+func NewFleet(local *Store, instance string, expire time.Duration) *Fleet {
+	return &Fleet{
+		local:    local,
+		instance: instance,
+		expire:   expire,
+		remote:   make(map[string]Snapshot),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// Accept stores a snapshot pushed by another instance.
+func (f *Fleet) Accept(snap Snapshot) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remote[snap.Instance] = snap
+	f.seen[snap.Instance] = time.Now()
+}
+
+// Series returns the buckets of one instance, or the fleet-wide sums per
+// bucket when instance is empty. Returns nil for unknown instances.
+func (f *Fleet) Series(interval Interval, instance string) []Point {
+	if instance == f.instance {
+		return f.local.Series(interval)
+	}
+
+	f.mu.Lock()
+	f.expireLocked()
+	if instance != "" {
+		snap, ok := f.remote[instance]
+		f.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		return snap.Series[interval]
+	}
+	all := [][]Point{f.local.Series(interval)}
+	for _, snap := range f.remote {
+		all = append(all, snap.Series[interval])
+	}
+	f.mu.Unlock()
+
+	sums := make(map[time.Time]*Counts)
+	for _, points := range all {
+		for _, p := range points {
+			// Instances in other time zones have other day boundaries; bucket by instant
+			key := p.Time.UTC()
+			c := sums[key]
+			if c == nil {
+				c = &Counts{}
+				sums[key] = c
+			}
+			c.Queries += p.Queries
+			c.Blocked += p.Blocked
+			c.CacheHits += p.CacheHits
+		}
+	}
+	out := make([]Point, 0, len(sums))
+	for _, t := range slices.SortedFunc(maps.Keys(sums), time.Time.Compare) {
+		out = append(out, Point{Time: t, Counts: *sums[t]})
+	}
+	return out
+}
+
+// Instances lists the local instance and the remote ones that pushed recently.
+func (f *Fleet) Instances() []Instance {
+	out := []Instance{{Name: f.instance, Local: true, LastSeen: time.Now(), Counts: total(f.local.Series(Day))}}
+
+	f.mu.Lock()
+	f.expireLocked()
+	for name, snap := range f.remote {
+		out = append(out, Instance{Name: name, LastSeen: f.seen[name], Counts: total(snap.Series[Day])})
+	}
+	f.mu.Unlock()
+
+	remote := out[1:]
+	sort.Slice(remote, func(i, j int) bool { return remote[i].Name < remote[j].Name })
+	return out
+}
+
+// Local returns the name of the local instance.
+func (f *Fleet) Local() string {
+	return f.instance
+}
+
+// expireLocked drops instances that stopped pushing. Caller holds f.mu.
+func (f *Fleet) expireLocked() {
+	if f.expire <= 0 {
+		return
+	}
+	for name, t := range f.seen {
+		if time.Since(t) > f.expire {
+			delete(f.seen, name)
+			delete(f.remote, name)
+		}
+	}
+}
+
+func total(points []Point) Counts {
+	var c Counts
+	for _, p := range points {
+		c.Queries += p.Queries
+		c.Blocked += p.Blocked
+		c.CacheHits += p.CacheHits
+	}
+	return c
+}
@@ -0,0 +1,149 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Interval is the resolution of a time series.
+type Interval string
+
+const (
+	Minute Interval = "minute"
+	Hour   Interval = "hour"
+	Day    Interval = "day"
+)
+
+// ParseInterval validates an interval name.
+func ParseInterval(s string) (Interval, error) {
+	switch i := Interval(s); i {
+	case Minute, Hour, Day:
+		return i, nil
+	}
+	return "", fmt.Errorf("unknown interval '%s' (want minute, hour or day)", s)
+}
+
+// Counts holds the counters tracked per bucket.
+type Counts struct {
+	Queries   uint64 `json:"queries"`
+	Blocked   uint64 `json:"blocked"`
+	CacheHits uint64 `json:"cache_hits"`
+}
+
+// Point is one bucket of a time series.
+type Point struct {
+	Time time.Time `json:"time"`
+	Counts
+}
+
+// Store keeps in-process time series at minute, hour and day resolution.
+// Every event is added to all three series, so coarser buckets are exact rollups.
+type Store struct {
+	mu     sync.Mutex
+	series map[Interval]*ring
+}
+
+// Retention per resolution
+var retention = map[Interval]int{
+	Minute: 24 * 60, // 24 hours of minutes
+	Hour:   7 * 24,  // 7 days of hours
+	Day:    90,      // 90 days
+}
+
+// NewStore creates an empty Store.
+func NewStore() *Store {
+	s := &Store{series: make(map[Interval]*ring)}
+	for interval, size := range retention {
+		s.series[interval] = &ring{size: size}
+	}
+	return s
+}
+
+// Record adds a query event at the current time.
+func (s *Store) Record(blocked, cacheHit bool) {
+	s.RecordAt(time.Now(), blocked, cacheHit)
+}
+
+// RecordAt adds a query event at t.
+func (s *Store) RecordAt(t time.Time, blocked, cacheHit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for interval, r := range s.series {
+		p := r.bucket(truncate(t, interval))
+		p.Queries++
+		if blocked {
+			p.Blocked++
+		}
+		if cacheHit {
+			p.CacheHits++
+		}
+	}
+}
+
+// Reset drops all buckets, so the series start over from now.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.series {
+		r.points = nil
+	}
+}
+
+// Series returns the buckets for an interval, oldest first.
+// Buckets without traffic are omitted.
+func (s *Store) Series(interval Interval) []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.series[interval]
+	if !ok {
+		return nil
+	}
+	return append([]Point{}, r.points...)
+}
+
+// truncate returns the bucket start for t. Days follow local midnight.
+func truncate(t time.Time, interval Interval) time.Time {
+	switch interval {
+	case Minute:
+		return t.Truncate(time.Minute)
+	case Hour:
+		return t.Truncate(time.Hour)
+	default:
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// ring is a bounded, time-ordered list of buckets.
+type ring struct {
+	size   int
+	points []Point
+}
+
+// bucket returns the bucket starting at start, creating it if needed.
+func (r *ring) bucket(start time.Time) *Counts {
+	if n := len(r.points); n > 0 {
+		last := &r.points[n-1]
+		if last.Time.Equal(start) {
+			return &last.Counts
+		}
+		// Clock went backwards: search existing buckets
+		if start.Before(last.Time) {
+			for i := n - 1; i >= 0; i-- {
+				if r.points[i].Time.Equal(start) {
+					return &r.points[i].Counts
+				}
+			}
+			return &Counts{} // Too old to keep
+		}
+	}
+
+	r.points = append(r.points, Point{Time: start})
+	if len(r.points) > r.size {
+		r.points = append(r.points[:0], r.points[len(r.points)-r.size:]...)
+	}
+	return &r.points[len(r.points)-1].Counts
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"adblocker/metrics"
+)
+
+// Restart backoff for supervised listeners. A listener that stayed up for
+// backoffReset starts over at minBackoff.
+const (
+	minBackoff   = 1 * time.Second
+	maxBackoff   = 1 * time.Minute
+	backoffReset = 5 * time.Minute
+)
+
+var (
+	listenerUp       = metrics.NewGaugeVec("adblocker_listener_up", "Whether a listener is currently serving (1) or waiting to restart (0).", "listener")
+	listenerRestarts = metrics.NewCounterVec("adblocker_listener_restarts_total", "Listener restarts after an unexpected stop.", "listener")
+)
+
+// supervisor keeps listeners running, restarting them with exponential
+// backoff when they stop (port conflicts, interface flaps, socket errors)
+// instead of exiting the process.
+type supervisor struct {
+	mu       sync.Mutex
+	stopping bool
+	stop     chan struct{}
+	errs     map[string]error // Last error of listeners waiting to restart
+	wg       sync.WaitGroup
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		stop: make(chan struct{}),
+		errs: make(map[string]error),
+	}
+}
+
+// run starts the named listener in the background and keeps it running until shutdown.
+// start must block while serving and be callable again after it returns.
+func (sv *supervisor) run(name string, start func() error) {
+	sv.wg.Add(1)
+	go func() {
+		defer sv.wg.Done()
+
+		backoff := minBackoff
+		for {
+			startedAt := time.Now()
+			sv.setErr(name, nil)
+			err := start()
+			if sv.isStopping() {
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("listener stopped")
+			}
+			if time.Since(startedAt) > backoffReset {
+				backoff = minBackoff
+			}
+			sv.setErr(name, err)
+
+			log.Printf("[SUPERVISOR] %s failed: %v. Restarting in %v", name, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-sv.stop:
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+			listenerRestarts.Inc(name)
+		}
+	}()
+}
+
+// check returns a readiness check that fails while the named listener is down.
+func (sv *supervisor) check(name string) func() error {
+	return func() error {
+		sv.mu.Lock()
+		defer sv.mu.Unlock()
+		if err := sv.errs[name]; err != nil {
+			return fmt.Errorf("listener down: %w", err)
+		}
+		return nil
+	}
+}
+
+// shutdown stops restarting listeners. Callers then stop the listeners themselves.
+func (sv *supervisor) shutdown() {
+	sv.mu.Lock()
+	sv.stopping = true
+	sv.mu.Unlock()
+	close(sv.stop)
+}
+
+// wait blocks until all supervised listeners have returned or ctx expires.
+func (sv *supervisor) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		sv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (sv *supervisor) setErr(name string, err error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.errs[name] = err
+	if err != nil {
+		listenerUp.Set(0, name)
+	} else {
+		listenerUp.Set(1, name)
+	}
+}
+
+func (sv *supervisor) isStopping() bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.stopping
+}
@@ -0,0 +1,229 @@
+// Package tokens keeps the scoped API tokens of the admin server in a JSON
+// file, so that integrations such as a wall-mounted dashboard only hold the
+// access they need. Only hashes of the tokens are stored.
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Revoke for an unknown token name.
+var ErrNotFound = errors.New("no such token")
+
+// Scope is what a token may do.
+type Scope string
+
+const (
+	ScopeStats Scope = "stats" // Read statistics, the dashboard and upstream reports
+	ScopePause Scope = "pause" // ScopeStats, and pausing filtering for a device
+	ScopeAdmin Scope = "admin" // Everything
+)
+
+// Scopes lists the valid scopes, narrowest first.
+var Scopes = []Scope{ScopeStats, ScopePause, ScopeAdmin}
+
+// statsPaths are the endpoints the stats scope may read: what the dashboard
+// shows and the status of rules and upstreams. A path ending in "/" covers
+// the paths below it.
+var statsPaths = []string{
+	"/api/stats",
+	"/api/stats/",
+	"/api/upstream/",
+	"/api/querylog",
+	"/api/rule-groups",
+	"/api/sources",
+	"/api/reload",
+	"/api/reload/report",
+	"/api/config/status",
+	"/api/standby",
+	"/api/canary",
+}
+
+// Allows reports whether a token with scope s may make a request.
+// Pause tokens may list device overrides, set one and end one; the
+// override API limits them to their own pauses.
+func (s Scope) Allows(method, path string) bool {
+	switch s {
+	case ScopeAdmin:
+		return true
+	case ScopePause:
+		switch {
+		case path == "/api/parent/overrides" && (method == http.MethodGet || method == http.MethodHead):
+			return true
+		case strings.HasPrefix(path, "/api/parent/overrides/") && (method == http.MethodPut || method == http.MethodDelete):
+			return true
+		}
+		fallthrough
+	case ScopeStats:
+		if method != http.MethodGet && method != http.MethodHead {
+			return false
+		}
+		for _, p := range statsPaths {
+			if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Token is one API token.
+type Token struct {
+	Name      string    `json:"name"`
+	Scope     Scope     `json:"scope"`
+	SHA256    string    `json:"sha256"` // Of the secret, which is only shown when created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store is the token file. The server reads it again when it changes, so
+// tokens created or revoked with the CLI apply without a restart.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	modTime time.Time // Of the file when tokens was read
+	size    int64
+	tokens  []Token
+}
+
+// NewStore returns the store kept at path. A missing file holds no tokens.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// List returns the tokens, oldest first.
+func (s *Store) List() ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.tokens), nil
+}
+
+// Create adds a token and returns its secret.
+func (s *Store) Create(name string, scope Scope) (string, error) {
+	if name == "" {
+		return "", errors.New("token name is required")
+	}
+	if !slices.Contains(Scopes, scope) {
+		return "", fmt.Errorf("unknown scope '%s' (want stats, pause or admin)", scope)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	if slices.ContainsFunc(s.tokens, func(t Token) bool { return t.Name == name }) {
+		return "", fmt.Errorf("token '%s' already exists", name)
+	}
+
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	secret := "adb_" + hex.EncodeToString(buf)
+	tokens := append(slices.Clone(s.tokens), Token{Name: name, Scope: scope, SHA256: hash(secret), CreatedAt: time.Now()})
+	if err := s.save(tokens); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Revoke removes the named token.
+func (s *Store) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	tokens := slices.DeleteFunc(slices.Clone(s.tokens), func(t Token) bool { return t.Name == name })
+	if len(tokens) == len(s.tokens) {
+		return fmt.Errorf("token '%s': %w", name, ErrNotFound)
+	}
+	return s.save(tokens)
+}
+
+// Check looks up the token with secret. required reports whether any
+// token exists; until one does, the admin API stays open as before.
+func (s *Store) Check(secret string) (t Token, ok, required bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Token{}, false, true, err
+	}
+	if secret == "" {
+		return Token{}, false, len(s.tokens) > 0, nil
+	}
+	sum := hash(secret)
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.SHA256), []byte(sum)) == 1 {
+			return t, true, true, nil
+		}
+	}
+	return Token{}, false, len(s.tokens) > 0, nil
+}
+
+// load reads the file if it changed since the last read. Caller holds mu.
+func (s *Store) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.loaded, s.modTime, s.size, s.tokens = true, time.Time{}, 0, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.loaded && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	s.loaded, s.modTime, s.size, s.tokens = true, info.ModTime(), info.Size(), tokens
+	return nil
+}
+
+// save replaces the file with tokens. Caller holds mu.
+func (s *Store) save(tokens []Token) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.loaded = false // Pick up the new modification time
+	return s.load()
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
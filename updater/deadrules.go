@@ -0,0 +1,178 @@
+package updater
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/server"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultSampleSize = 200
+	deadCheckWorkers  = 8
+)
+
+// DeadRuleReport summarizes the last dead-rule check.
+type DeadRuleReport struct {
+	Time    time.Time `json:"time"`
+	Checked int       `json:"checked"`
+	Dead    []string  `json:"dead"`
+	Pruned  int       `json:"pruned"` // Rules removed from memory, 0 in report-only mode
+}
+
+// DeadRuleChecker periodically samples blocked domains and checks whether they still resolve.
+// Huge legacy hosts lists are full of domains that no longer exist; dropping them shrinks the working set.
+type DeadRuleChecker struct {
+	engine *engine.Engine
+	Client *dns.Client
+	stop   chan struct{}
+
+	mu   sync.Mutex
+	last *DeadRuleReport
+
+	// Client for an encrypted resolver, reused across checks
+	upstreamMu   sync.Mutex
+	upstreamAddr string
+	upstreamOpts config.UpstreamTLS
+	upstream     server.UpstreamClient
+}
+
+// NewDeadRuleChecker creates a checker; it is configured from the engine's current config.
+func NewDeadRuleChecker(eng *engine.Engine) *DeadRuleChecker {
+	return &DeadRuleChecker{
+		engine: eng,
+		Client: &dns.Client{Timeout: 3 * time.Second},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Run starts the background loop. The interval is re-read after every cycle.
+func (c *DeadRuleChecker) Run() {
+	go func() {
+		for {
+			interval := c.engine.Config().DeadRuleCheck.Interval
+			wait := interval
+			if wait <= 0 {
+				wait = time.Hour // Disabled: re-check the config later
+			}
+
+			select {
+			case <-time.After(wait):
+				if interval > 0 {
+					c.Check()
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *DeadRuleChecker) Stop() {
+	close(c.stop)
+}
+
+// Report returns the result of the last check, or nil if none ran yet.
+func (c *DeadRuleChecker) Report() *DeadRuleReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// Check runs one sampling round.
+func (c *DeadRuleChecker) Check() *DeadRuleReport {
+	cfg := c.engine.Config()
+	opts := cfg.DeadRuleCheck
+
+	n := opts.SampleSize
+	if n <= 0 {
+		n = defaultSampleSize
+	}
+	resolver := opts.Resolver
+	if resolver == "" && len(cfg.Server.Upstream) > 0 {
+		resolver = cfg.Server.Upstream[0]
+	}
+	if resolver == "" {
+		resolver = "8.8.8.8:53"
+	}
+
+	domains := c.engine.SampleBlockedDomains(n)
+
+	var mu sync.Mutex
+	var dead []string
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < deadCheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				if c.isDead(domain, resolver) {
+					mu.Lock()
+					dead = append(dead, domain)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, d := range domains {
+		jobs <- d
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := &DeadRuleReport{Time: time.Now(), Checked: len(domains), Dead: dead}
+	if opts.Prune {
+		report.Pruned = c.engine.PruneDomains(dead)
+	}
+
+	log.Printf("Dead rule check: %d of %d sampled domains no longer resolve (%d rules pruned)", len(dead), len(domains), report.Pruned)
+
+	c.mu.Lock()
+	c.last = report
+	c.mu.Unlock()
+	return report
+}
+
+// isDead reports whether domain returns NXDOMAIN. Errors and timeouts count as alive.
+func (c *DeadRuleChecker) isDead(domain, resolver string) bool {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+	resp, err := c.exchange(m, resolver)
+	if err != nil {
+		return false
+	}
+	return resp.Rcode == dns.RcodeNameError
+}
+
+// exchange sends m to a plain resolver through Client, or to an encrypted
+// one (e.g. a DoH URL) through the server's upstream client.
+func (c *DeadRuleChecker) exchange(m *dns.Msg, resolver string) (*dns.Msg, error) {
+	if !strings.Contains(resolver, "://") {
+		resp, _, err := c.Client.Exchange(m, resolver)
+		return resp, err
+	}
+
+	opts := c.engine.Config().Server.UpstreamTLS[resolver]
+	c.upstreamMu.Lock()
+	if c.upstreamAddr != resolver || !c.upstreamOpts.Equal(opts) {
+		u, err := server.NewUpstreamClient(resolver, opts)
+		if err != nil {
+			c.upstreamMu.Unlock()
+			return nil, err
+		}
+		c.upstreamAddr, c.upstreamOpts, c.upstream = resolver, opts, u
+	}
+	u := c.upstream
+	c.upstreamMu.Unlock()
+
+	resp, _, err := u.Exchange(m)
+	return resp, err
+}
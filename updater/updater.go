@@ -2,25 +2,26 @@ package updater
 
 import (
 	"log"
+	"sync"
 	"time"
 
-	"adblocker/config"
 	"adblocker/engine"
 	"adblocker/parser"
 )
 
 // Updater manages periodic updates of rule sources.
 type Updater struct {
-	cfg    *config.Config
 	engine *engine.Engine
 	loader *parser.Loader
 	stop   chan struct{}
+
+	mu   sync.Mutex
+	next time.Time // Next scheduled reload, zero without remote sources
 }
 
 // NewUpdater creates a new Updater.
-func NewUpdater(cfg *config.Config, eng *engine.Engine, loader *parser.Loader) *Updater {
+func NewUpdater(eng *engine.Engine, loader *parser.Loader) *Updater {
 	return &Updater{
-		cfg:    cfg,
 		engine: eng,
 		loader: loader,
 		stop:   make(chan struct{}),
@@ -33,47 +34,106 @@ func (u *Updater) Stop() {
 
 // RunSimple is a simplified version: Reload ALL rules every X minutes (e.g. 1 hour default).
 // If any source has interval < 1 hour, use that.
+// The interval is re-read from the engine's config after every cycle, so config reloads apply.
 func (u *Updater) RunSimple() {
-	minInterval := 24 * time.Hour
-
-	hasRemote := false
-	for _, rg := range u.cfg.RuleGroups {
-		for _, src := range rg.Sources {
-			if src.URL != "" {
-				hasRemote = true
-				break
-			}
-		}
-		if hasRemote {
-			break
-		}
-	}
-
-	// Use global interval, but enforce minimum 24 hours
-	if u.cfg.URLInterval > 0 {
-		minInterval = u.cfg.URLInterval
-	}
-	if minInterval < 24*time.Hour {
-		minInterval = 24 * time.Hour
-	}
+	minInterval, hasRemote := u.interval()
 
 	if !hasRemote {
 		log.Println("No remote sources to update.")
-		return
+	} else {
+		log.Printf("Updater started. Next update in %v", minInterval)
 	}
 
-	log.Printf("Updater started. Next update in %v", minInterval)
-
 	go func() {
 		for {
+			u.setNext(minInterval, hasRemote)
 			select {
 			case <-time.After(minInterval):
-				log.Println("Updater triggered...")
-				u.engine.ReloadRules(u.loader)
-				log.Printf("Update complete. Next in %v", minInterval)
+				if hasRemote {
+					log.Println("Updater triggered...")
+					u.engine.ReloadRules(u.loader)
+				}
+				minInterval, hasRemote = u.interval()
+				if hasRemote {
+					log.Printf("Update complete. Next in %v", minInterval)
+				}
 			case <-u.stop:
 				return
 			}
 		}
 	}()
 }
+
+func (u *Updater) setNext(wait time.Duration, hasRemote bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.next = time.Time{}
+	if hasRemote {
+		u.next = time.Now().Add(wait)
+	}
+}
+
+// NextUpdate returns when URL sources are refreshed next, zero if there are none.
+func (u *Updater) NextUpdate() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.next
+}
+
+// SourceStatus is the state of one rule source after the last reload.
+type SourceStatus struct {
+	engine.SourceReport
+	Applied     bool      `json:"applied"`               // False while the last reload was rejected and older rules are served
+	ReloadedAt  time.Time `json:"reloaded_at"`           // End of the last reload
+	NextRefresh time.Time `json:"next_refresh,omitzero"` // URL sources only
+}
+
+// Sources returns the state of every source of the last reload, nil before the first one.
+func (u *Updater) Sources() []SourceStatus {
+	report := u.engine.Report()
+	if report == nil {
+		return nil
+	}
+	next := u.NextUpdate()
+	sources := make([]SourceStatus, 0, len(report.Sources))
+	for _, sr := range report.Sources {
+		s := SourceStatus{SourceReport: sr, Applied: report.Applied, ReloadedAt: report.FinishedAt}
+		if sr.Origin == parser.OriginCache || sr.Origin == parser.OriginDownload {
+			s.NextRefresh = next
+		}
+		sources = append(sources, s)
+	}
+	return sources
+}
+
+// interval returns the refresh interval and whether any remote source is configured.
+func (u *Updater) interval() (time.Duration, bool) {
+	cfg := u.engine.Config()
+	minInterval := 24 * time.Hour
+
+	hasRemote := false
+	var shortest time.Duration // Shortest per-source recommendation (e.g. from the list registry)
+	for _, rg := range cfg.RuleGroups {
+		for _, src := range rg.Sources {
+			if src.URL == "" {
+				continue
+			}
+			hasRemote = true
+			if src.Interval > 0 && (shortest == 0 || src.Interval < shortest) {
+				shortest = src.Interval
+			}
+		}
+	}
+
+	// Use global interval (or the per-source one), but enforce minimum 24 hours
+	if cfg.URLInterval > 0 {
+		minInterval = cfg.URLInterval
+	} else if shortest > 0 {
+		minInterval = shortest
+	}
+	if minInterval < 24*time.Hour {
+		minInterval = 24 * time.Hour
+	}
+
+	return minInterval, hasRemote
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/events"
+	"adblocker/parser"
+
+	"github.com/miekg/dns"
+)
+
+// Scopes of an exception created by the allow wizard.
+const (
+	allowScopeUser     = "user"     // $client=<user name>
+	allowScopeClient   = "client"   // $client=<client IP>
+	allowScopeEveryone = "everyone" // No $client
+)
+
+var (
+	errNotBlocked      = errors.New("query is not blocked")
+	errNoRuleGroup     = errors.New("query was not blocked by a configured rule group")
+	errMissingDomain   = errors.New("domain is required")
+	errScopeNeedsField = errors.New("scope needs the entry's user or client")
+)
+
+// allowRequest is a query log entry, as exported by the events package, plus
+// who the exception should apply to.
+type allowRequest struct {
+	events.Event
+	Scope string `json:"scope"` // user, client or everyone; default the narrowest known
+}
+
+// RegisterAllowWizard exposes POST /api/rules/allow, the one-click fix for a
+// false positive. Given a blocked query log entry it adds the exception
+// @@||<domain>^$client=<user or client> to the inline rules of the rule
+// group that blocked it (an exception only wins within its own group), then
+// saves and applies the config through m like an edit. Entries without a
+// rule_group are resolved again for their client to find it.
+func (s *Server) RegisterAllowWizard(eng *engine.Engine, m *config.Manager, apply func(*config.Config) error) {
+	s.mux.HandleFunc("POST /api/rules/allow", func(w http.ResponseWriter, r *http.Request) {
+		// A form or plain text POST from another site needs no preflight,
+		// JSON does: only take bodies declared as JSON.
+		if mediaType(r) != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errNotJSON)
+			return
+		}
+		var req allowRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditSize)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ruleGroup, rule, err := allowException(eng, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		added, err := m.AddRule(ruleGroup, rule, apply)
+		if err != nil {
+			writeEditError(w, err)
+			return
+		}
+		if added {
+			log.Printf("[ALLOW] Added '%s' to rule group '%s'", rule, ruleGroup)
+		}
+		writeJSON(w, map[string]any{
+			"rule":       rule,
+			"rule_group": ruleGroup,
+			"added":      added, // false if the exception already existed
+		})
+	})
+}
+
+// allowException returns the rule group and the minimal exception for the entry.
+func allowException(eng *engine.Engine, req allowRequest) (string, string, error) {
+	// 1. The blocked domain
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Domain), "."))
+	if domain == "" {
+		return "", "", errMissingDomain
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return "", "", fmt.Errorf("invalid domain '%s'", req.Domain)
+	}
+
+	// 2. The rule group that blocked it, from the entry or by resolving again
+	client, _ := netip.ParseAddr(req.Client)
+	ruleGroup, decision := req.RuleGroup, req.Decision
+	if ruleGroup == "" {
+		res := eng.Resolve(domain+".", dns.TypeA, client, req.MAC, "")
+		ruleGroup = res.RuleGroup
+		decision = "allowed"
+		if res.Blocked {
+			decision = "blocked"
+		}
+		if req.User == "" && res.User != nil {
+			req.User = res.User.Name
+		}
+	}
+	if decision != "" && decision != "blocked" && decision != "rewritten" {
+		return "", "", errNotBlocked
+	}
+	if !slices.ContainsFunc(eng.Config().RuleGroups, func(rg config.RuleGroup) bool { return rg.Name == ruleGroup }) {
+		return "", "", errNoRuleGroup
+	}
+
+	// 3. Who it applies to
+	scope := req.Scope
+	if scope == "" {
+		switch {
+		case req.User != "":
+			scope = allowScopeUser
+		case client.IsValid():
+			scope = allowScopeClient
+		default:
+			scope = allowScopeEveryone
+		}
+	}
+	rule := "@@||" + domain + "^"
+	switch scope {
+	case allowScopeUser:
+		if req.User == "" {
+			return "", "", errScopeNeedsField
+		}
+		rule += "$client=" + parser.QuoteClient(req.User)
+	case allowScopeClient:
+		if !client.IsValid() {
+			return "", "", errScopeNeedsField
+		}
+		rule += "$client=" + parser.QuoteClient(client.WithZone("").Unmap().String())
+	case allowScopeEveryone:
+	default:
+		return "", "", fmt.Errorf("unknown scope '%s' (want user, client or everyone)", scope)
+	}
+	return ruleGroup, rule, nil
+}
@@ -0,0 +1,410 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"adblocker/audit"
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/presence"
+	"adblocker/server"
+	"adblocker/stats"
+	"adblocker/updater"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errNoReport        = errors.New("no reload has finished yet")
+	errUnknownInstance = errors.New("unknown instance")
+	errBadInstance     = errors.New("push needs an instance name other than the aggregator's")
+	errBadToken        = errors.New("missing or wrong token")
+)
+
+// maxPushSize bounds a stats snapshot pushed by another instance.
+const maxPushSize = 8 << 20
+
+// RegisterStats exposes the time series at /api/stats/timeseries?interval=minute|hour|day,
+// summed over the fleet unless &instance=<name> selects one instance, and the
+// known instances at /api/stats/instances.
+func (s *Server) RegisterStats(f *stats.Fleet) {
+	s.mux.HandleFunc("GET /api/stats/timeseries", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("interval")
+		if name == "" {
+			name = string(stats.Hour)
+		}
+		interval, err := stats.ParseInterval(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		instance := r.URL.Query().Get("instance")
+		points := f.Series(interval, instance)
+		if points == nil && instance != "" && instance != f.Local() {
+			writeError(w, http.StatusNotFound, errUnknownInstance)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"interval": interval,
+			"instance": instance,
+			"points":   points,
+		})
+	})
+	s.mux.HandleFunc("GET /api/stats/instances", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, f.Instances())
+	})
+}
+
+// RegisterStatsPush accepts snapshots from other instances at POST /api/stats/push.
+// When token is set, pushes must carry it as a bearer token; otherwise they
+// need an admin API credential like other changes.
+func (s *Server) RegisterStatsPush(f *stats.Fleet, token string) {
+	s.mux.HandleFunc("POST /api/stats/push", func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errBadToken)
+				return
+			}
+		} else if _, ok := s.authorize(w, r); !ok {
+			return
+		}
+
+		var snap stats.Snapshot
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushSize)).Decode(&snap); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if snap.Instance == "" || snap.Instance == f.Local() {
+			writeError(w, http.StatusBadRequest, errBadInstance)
+			return
+		}
+		f.Accept(snap)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// RegisterStatsReset starts statistics over at POST /api/stats/reset, all of
+// them or, with {"user": "name"}, one user's counters. GET reports the last
+// and next scheduled reset.
+func (s *Server) RegisterStatsReset(srv *server.Server, auditLog *audit.Log) {
+	s.mux.HandleFunc("GET /api/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.StatsReset())
+	})
+	s.mux.HandleFunc("POST /api/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			User string `json:"user"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		reason := "admin API from " + r.RemoteAddr
+		if req.User != "" {
+			if !srv.ResetUserStats(req.User, reason) {
+				writeError(w, http.StatusNotFound, fmt.Errorf("no statistics for user '%s'", req.User))
+				return
+			}
+		} else {
+			srv.ResetStats(reason)
+		}
+		auditLog.Record(audit.Entry{Actor: "admin", Remote: r.RemoteAddr, Action: "stats.reset", Target: req.User})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// RegisterCacheStats exposes the cache effectiveness counters at /api/stats/cache.
+func (s *Server) RegisterCacheStats(fn func() map[string]server.CacheStats) {
+	s.mux.HandleFunc("GET /api/stats/cache", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, fn())
+	})
+}
+
+// RegisterPrivacyReport exposes how queries were sent upstream (plaintext
+// or encrypted, per upstream) at /api/upstream/privacy.
+func (s *Server) RegisterPrivacyReport(fn func() server.PrivacyReport) {
+	s.mux.HandleFunc("GET /api/upstream/privacy", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, fn())
+	})
+}
+
+// RegisterUpstreamLatency exposes per-upstream latency percentiles and
+// error rates, slowest first, at /api/upstream/latency.
+func (s *Server) RegisterUpstreamLatency(fn func() []server.UpstreamLatency) {
+	s.mux.HandleFunc("GET /api/upstream/latency", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, fn())
+	})
+}
+
+// RegisterStandby exposes the hot standby state, for keepalived notify
+// scripts and check scripts:
+//
+//	GET  /api/standby   whether the instance is promoted and answering
+//	POST /api/standby   {"promoted": true}, with "Authorization: Bearer <token>"
+//
+// Changes need standby.token or an admin API token. Without standby.token
+// they need the credentials of any other change (see SetTokens).
+func (s *Server) RegisterStandby(srv *server.Server, token func() string) {
+	s.mux.HandleFunc("GET /api/standby", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Standby())
+	})
+	s.mux.HandleFunc("POST /api/standby", func(w http.ResponseWriter, r *http.Request) {
+		if want := token(); want != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 && !s.adminToken(got) {
+				writeError(w, http.StatusUnauthorized, errBadToken)
+				return
+			}
+		} else if _, ok := s.authorize(w, r); !ok {
+			return
+		}
+
+		var req struct {
+			Promoted *bool `json:"promoted"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.Promoted == nil {
+			writeError(w, http.StatusBadRequest, errors.New(`body must be {"promoted": true|false}`))
+			return
+		}
+		srv.SetPromoted(*req.Promoted, "admin API from "+r.RemoteAddr)
+		writeJSON(w, srv.Standby())
+	})
+}
+
+// RegisterPresence exposes presence-driven schedules:
+//
+//	GET  /api/presence              presence per schedule and the signals behind it
+//	POST /api/presence/{schedule}   {"present": true}, with "Authorization: Bearer <webhook_token>"
+func (s *Server) RegisterPresence(t *presence.Tracker) {
+	s.mux.HandleFunc("GET /api/presence", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, t.Status())
+	})
+	s.mux.HandleFunc("POST /api/presence/{schedule}", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Present *bool `json:"present"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || req.Present == nil {
+			writeError(w, http.StatusBadRequest, errors.New(`body must be {"present": true|false}`))
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch err := t.Webhook(r.PathValue("schedule"), token, *req.Present); {
+		case errors.Is(err, presence.ErrUnknownSchedule):
+			writeError(w, http.StatusNotFound, err)
+		case errors.Is(err, presence.ErrUnauthorized):
+			writeError(w, http.StatusUnauthorized, err)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// RegisterConfigStatus exposes the outcome of the last config load at /api/config/status,
+// including why a reload was rejected while the previous config kept running.
+func (s *Server) RegisterConfigStatus(m *config.Manager) {
+	s.mux.HandleFunc("GET /api/config/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Status())
+	})
+}
+
+// RegisterConfigReload re-reads the config file at POST /api/config/reload,
+// like SIGHUP does, and answers with the resulting status; 422 when the
+// file was rejected and the previous config keeps running.
+func (s *Server) RegisterConfigReload(m *config.Manager, reload func() error) {
+	s.mux.HandleFunc("POST /api/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Config reload requested through the admin API from %s", r.RemoteAddr)
+		if err := reload(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(m.Status())
+			return
+		}
+		writeJSON(w, m.Status())
+	})
+}
+
+// RegisterDeadRules exposes the last dead-rule check report at /api/dead-rules.
+func (s *Server) RegisterDeadRules(c *updater.DeadRuleChecker) {
+	s.mux.HandleFunc("GET /api/dead-rules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Report())
+	})
+}
+
+// RegisterSources exposes the state of every rule source at /api/sources:
+// last fetch, HTTP status, size, rules, parse errors, cache or fresh
+// download, and the next scheduled refresh.
+func (s *Server) RegisterSources(u *updater.Updater) {
+	s.mux.HandleFunc("GET /api/sources", func(w http.ResponseWriter, r *http.Request) {
+		sources := u.Sources()
+		if sources == nil {
+			writeError(w, http.StatusServiceUnavailable, errNoReport)
+			return
+		}
+		writeJSON(w, sources)
+	})
+}
+
+// RegisterRuleSearch exposes /api/rules/search?q=<domain>[&mode=substring][&limit=100],
+// listing the loaded rules, with their group and source, that match q.
+func (s *Server) RegisterRuleSearch(eng *engine.Engine) {
+	s.mux.HandleFunc("GET /api/rules/search", func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit '%s'", v))
+				return
+			}
+			limit = n
+		}
+
+		res, err := eng.SearchRules(r.URL.Query().Get("q"), r.URL.Query().Get("mode"), limit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, res)
+	})
+}
+
+// RegisterTraces exposes step by step traces of rule evaluation:
+//
+//	GET /api/trace?domain=ads.example.com[&client=192.168.1.10][&mac=...][&client_id=...][&type=AAAA]
+//	                 evaluates the query for the client now (type A by default)
+//	GET /api/traces  the latest traces requested by clients with server.trace_option
+func (s *Server) RegisterTraces(srv *server.Server) {
+	s.mux.HandleFunc("GET /api/trace", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		domain := strings.TrimSpace(q.Get("domain"))
+		if domain == "" {
+			writeError(w, http.StatusBadRequest, errMissingDomain)
+			return
+		}
+		var client netip.Addr
+		if v := q.Get("client"); v != "" {
+			var err error
+			if client, err = netip.ParseAddr(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid client '%s'", v))
+				return
+			}
+		}
+		qType := dns.TypeA
+		if v := q.Get("type"); v != "" {
+			t, ok := dns.StringToType[strings.ToUpper(v)]
+			if !ok {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid type '%s'", v))
+				return
+			}
+			qType = t
+		}
+		writeJSON(w, srv.Trace(domain, qType, client, q.Get("mac"), q.Get("client_id")))
+	})
+	s.mux.HandleFunc("GET /api/traces", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Traces())
+	})
+}
+
+// RegisterReloadProgress exposes the progress of the running or last rule reload at /api/reload
+// and the per-source report of the last finished reload at /api/reload/report.
+func (s *Server) RegisterReloadProgress(eng *engine.Engine) {
+	s.mux.HandleFunc("GET /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, eng.Progress())
+	})
+	s.mux.HandleFunc("GET /api/reload/report", func(w http.ResponseWriter, r *http.Request) {
+		report := eng.Report()
+		if report == nil {
+			writeError(w, http.StatusNotFound, errNoReport)
+			return
+		}
+		writeJSON(w, report)
+	})
+}
+
+// RegisterCanaries lists the rule groups whose changed rules only reach
+// their canary clients yet at /api/canary.
+func (s *Server) RegisterCanaries(eng *engine.Engine) {
+	s.mux.HandleFunc("GET /api/canary", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, eng.Canaries())
+	})
+}
+
+// RegisterDiagnostics writes a dump of the process state and goroutine
+// stacks to the data directory at POST /api/debug/dump, like SIGQUIT does,
+// and returns its path.
+func (s *Server) RegisterDiagnostics(dump func() (string, error)) {
+	s.mux.HandleFunc("POST /api/debug/dump", func(w http.ResponseWriter, r *http.Request) {
+		path, err := dump()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("[DIAG] Wrote diagnostics to %s (admin API from %s)", path, r.RemoteAddr)
+		writeJSON(w, map[string]string{"path": path})
+	})
+}
+
+// RegisterProfiles exposes the active profile at /api/profile. PUT with
+// {"name": "vacation"} switches it ("default" for the base policies, "" to
+// return to active_profile and schedules); onSwitch runs after a switch.
+func (s *Server) RegisterProfiles(eng *engine.Engine, onSwitch func()) {
+	s.mux.HandleFunc("GET /api/profile", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, eng.Profile())
+	})
+	s.mux.HandleFunc("PUT /api/profile", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := eng.SetProfile(req.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		onSwitch()
+
+		st := eng.Profile()
+		log.Printf("[PROFILE] Switched to '%s' (%s)", st.Active, st.Source)
+		writeJSON(w, st)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// errNotJSON is returned for write bodies not sent as application/json.
+var errNotJSON = errors.New("body must be sent as application/json")
+
+// mediaType returns the media type of the body of r, lower case, or "" when
+// it has none or it cannot be parsed.
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
@@ -0,0 +1,228 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"adblocker/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxEditSize bounds the body of a config edit.
+const maxEditSize = 1 << 20
+
+var errNameMismatch = errors.New("name in body does not match the URL")
+
+// section describes a named list in the config file editable through the API.
+type section[T any] struct {
+	path    string // e.g. "/api/users"
+	section string // Top-level key, see config.Section*
+	list    func(*config.Config) *[]T
+	name    func(*T) *string
+}
+
+// RegisterConfigEditor exposes Users, UserGroups (with their Policies) and
+// Schedules for editing at runtime:
+//
+//	GET    /api/users                          list
+//	GET    /api/users/{name}                   one entry
+//	PUT    /api/users/{name}                   create or replace
+//	DELETE /api/users/{name}                   delete
+//
+// and the same under /api/user-groups and /api/schedules, plus
+// GET/PUT /api/user-groups/{name}/policies and
+// DELETE /api/user-groups/{name}/policies/{rule_group}.
+//
+// Bodies use the field names of the config file. Every change is validated
+// and applied through apply like a reload before it is saved to the file;
+// invalid changes (e.g. deleting a UserGroup that Users still reference) are
+// rejected with 400 and leave the running config untouched.
+func (s *Server) RegisterConfigEditor(m *config.Manager, apply func(*config.Config) error) {
+	registerSection(s, m, apply, section[config.User]{
+		path: "/api/users", section: config.SectionUsers,
+		list: func(c *config.Config) *[]config.User { return &c.Users },
+		name: func(u *config.User) *string { return &u.Name },
+	})
+	registerSection(s, m, apply, section[config.UserGroup]{
+		path: "/api/user-groups", section: config.SectionUserGroups,
+		list: func(c *config.Config) *[]config.UserGroup { return &c.UserGroups },
+		name: func(g *config.UserGroup) *string { return &g.Name },
+	})
+	registerSection(s, m, apply, section[config.Schedule]{
+		path: "/api/schedules", section: config.SectionSchedules,
+		list: func(c *config.Config) *[]config.Schedule { return &c.Schedules },
+		name: func(sc *config.Schedule) *string { return &sc.Name },
+	})
+
+	// Policies of one UserGroup
+	group := func(c *config.Config, name string) *config.UserGroup {
+		for i := range c.UserGroups {
+			if c.UserGroups[i].Name == name {
+				return &c.UserGroups[i]
+			}
+		}
+		return nil
+	}
+	s.mux.HandleFunc("GET /api/user-groups/{name}/policies", func(w http.ResponseWriter, r *http.Request) {
+		g := group(m.Get(), r.PathValue("name"))
+		if g == nil {
+			writeError(w, http.StatusNotFound, config.ErrNotFound)
+			return
+		}
+		writeConfigJSON(w, g.Policies)
+	})
+	s.mux.HandleFunc("PUT /api/user-groups/{name}/policies", func(w http.ResponseWriter, r *http.Request) {
+		var policies []config.Policy
+		if err := decodeConfigBody(w, r, &policies); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err := m.Edit(config.SectionUserGroups, func(c *config.Config) error {
+			g := group(c, r.PathValue("name"))
+			if g == nil {
+				return config.ErrNotFound
+			}
+			g.Policies = policies
+			return nil
+		}, apply)
+		if err != nil {
+			writeEditError(w, err)
+			return
+		}
+		writeConfigJSON(w, policies)
+	})
+	s.mux.HandleFunc("DELETE /api/user-groups/{name}/policies/{rule_group}", func(w http.ResponseWriter, r *http.Request) {
+		err := m.Edit(config.SectionUserGroups, func(c *config.Config) error {
+			g := group(c, r.PathValue("name"))
+			if g == nil {
+				return config.ErrNotFound
+			}
+			n := len(g.Policies)
+			g.Policies = slices.DeleteFunc(g.Policies, func(p config.Policy) bool { return p.RuleGroup == r.PathValue("rule_group") })
+			if len(g.Policies) == n {
+				return config.ErrNotFound
+			}
+			return nil
+		}, apply)
+		if err != nil {
+			writeEditError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func registerSection[T any](s *Server, m *config.Manager, apply func(*config.Config) error, sec section[T]) {
+	find := func(items []T, name string) int {
+		return slices.IndexFunc(items, func(item T) bool { return *sec.name(&item) == name })
+	}
+
+	s.mux.HandleFunc("GET "+sec.path, func(w http.ResponseWriter, r *http.Request) {
+		writeConfigJSON(w, *sec.list(m.Get()))
+	})
+	s.mux.HandleFunc("GET "+sec.path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		items := *sec.list(m.Get())
+		i := find(items, r.PathValue("name"))
+		if i < 0 {
+			writeError(w, http.StatusNotFound, config.ErrNotFound)
+			return
+		}
+		writeConfigJSON(w, items[i])
+	})
+	s.mux.HandleFunc("PUT "+sec.path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var item T
+		if err := decodeConfigBody(w, r, &item); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if n := sec.name(&item); *n == "" {
+			*n = name
+		} else if *n != name {
+			writeError(w, http.StatusBadRequest, errNameMismatch)
+			return
+		}
+
+		created := false
+		err := m.Edit(sec.section, func(c *config.Config) error {
+			items := sec.list(c)
+			if i := find(*items, name); i >= 0 {
+				(*items)[i] = item
+			} else {
+				*items = append(*items, item)
+				created = true
+			}
+			return nil
+		}, apply)
+		if err != nil {
+			writeEditError(w, err)
+			return
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		writeConfigJSON(w, item)
+	})
+	s.mux.HandleFunc("DELETE "+sec.path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		err := m.Edit(sec.section, func(c *config.Config) error {
+			items := sec.list(c)
+			i := find(*items, r.PathValue("name"))
+			if i < 0 {
+				return config.ErrNotFound
+			}
+			*items = slices.Delete(*items, i, i+1)
+			return nil
+		}, apply)
+		if err != nil {
+			writeEditError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// decodeConfigBody decodes a JSON body into a config type, using its YAML
+// field names and rejecting unknown ones.
+func decodeConfigBody(w http.ResponseWriter, r *http.Request, v any) error {
+	var generic any
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditSize)).Decode(&generic); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+// writeConfigJSON writes a config type as JSON with its YAML field names.
+func writeConfigJSON(w http.ResponseWriter, v any) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, generic)
+}
+
+func writeEditError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, config.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, config.ErrReadOnly):
+		writeError(w, http.StatusForbidden, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
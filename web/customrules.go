@@ -0,0 +1,108 @@
+package web
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/parser"
+)
+
+// RegisterCustomRules exposes the inline rules of a rule group, the
+// hand-written exceptions and blocks kept in the config file, as plain
+// AdGuard rule text so they can be backed up or moved between instances
+// apart from the lists they refine:
+//
+//	GET  /api/rule-groups/{name}/rules  exports them, one rule per line
+//	POST /api/rule-groups/{name}/rules  adds the rules of the body not already there
+//	PUT  /api/rule-groups/{name}/rules  replaces them with the rules of the body
+//
+// Blank lines and comments in the body are skipped. The whole import is
+// rejected if any line is malformed (as with strict_parsing), otherwise saved and applied through m
+// like an edit. The body must not be sent as one of the types a browser posts
+// across sites without a preflight (forms and text/plain): use e.g.
+// "Content-Type: application/octet-stream".
+func (s *Server) RegisterCustomRules(m *config.Manager, apply func(*config.Config) error) {
+	s.mux.HandleFunc("GET /api/rule-groups/{name}/rules", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		for _, rg := range m.Get().RuleGroups {
+			if rg.Name != name {
+				continue
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".txt"))
+			fmt.Fprintf(w, "! Custom rules of rule group '%s'\n", name)
+			for _, rule := range rg.Rules {
+				fmt.Fprintln(w, rule)
+			}
+			return
+		}
+		writeEditError(w, fmt.Errorf("rule group '%s': %w", name, config.ErrNotFound))
+	})
+
+	importRules := func(replace bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("name")
+			if simpleMediaType(mediaType(r)) {
+				writeError(w, http.StatusUnsupportedMediaType, errSimpleBody)
+				return
+			}
+			rules, err := readRuleText(http.MaxBytesReader(w, r.Body, maxEditSize))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			added, err := m.ImportRules(name, rules, replace, apply)
+			if err != nil {
+				writeEditError(w, err)
+				return
+			}
+			if added > 0 || replace {
+				log.Printf("[RULES] Imported %d rules (%d new) into rule group '%s'", len(rules), added, name)
+			}
+			writeJSON(w, map[string]any{
+				"rule_group": name,
+				"rules":      len(rules),
+				"added":      added, // Rules that were not there before
+			})
+		}
+	}
+	s.mux.HandleFunc("POST /api/rule-groups/{name}/rules", importRules(false))
+	s.mux.HandleFunc("PUT /api/rule-groups/{name}/rules", importRules(true))
+}
+
+var errSimpleBody = errors.New("body must not be sent as a form or text/plain, use e.g. application/octet-stream")
+
+// simpleMediaType reports whether mt, as returned by mediaType, is allowed in
+// a cross-site request without a CORS preflight.
+func simpleMediaType(mt string) bool {
+	switch mt {
+	case "", "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+// readRuleText returns the rules of an AdGuard rule list, without blank lines
+// and comments. It fails on the first malformed line.
+func readRuleText(body io.Reader) ([]string, error) {
+	var rules []string
+	sc := bufio.NewScanner(body)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		rule, err := parser.ParseRuleStrict(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d '%s': %w", n, line, err)
+		}
+		if rule != nil {
+			rules = append(rules, line)
+		}
+	}
+	return rules, sc.Err()
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"adblocker/engine"
+	"adblocker/server"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// RegisterDashboard serves the admin dashboard at / and the endpoints it
+// polls:
+//
+//	GET /api/querylog?after=<seq>&limit=100  latest queries, newest first
+//	GET /api/stats/top-blocked?limit=10      most blocked domains since the last stats reset
+//	GET /api/stats/clients                   queries and blocks per device since the last stats reset
+//	GET /api/rule-groups                     loaded rules, sources and user groups per rule group
+func (s *Server) RegisterDashboard(srv *server.Server, eng *engine.Engine) {
+	s.mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+		w.Write(dashboardPage)
+	})
+	s.mux.HandleFunc("GET /api/querylog", func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := intParam(w, r, "limit", 100)
+		if !ok {
+			return
+		}
+		after, ok := intParam(w, r, "after", 0)
+		if !ok {
+			return
+		}
+		writeJSON(w, srv.QueryLog(uint64(after), limit))
+	})
+	s.mux.HandleFunc("GET /api/stats/top-blocked", func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := intParam(w, r, "limit", 10)
+		if !ok {
+			return
+		}
+		writeJSON(w, srv.TopBlocked(limit))
+	})
+	s.mux.HandleFunc("GET /api/stats/clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, srv.Clients())
+	})
+	s.mux.HandleFunc("GET /api/rule-groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, eng.RuleGroupStatuses())
+	})
+}
+
+// intParam returns the non-negative integer query parameter name, or def
+// when it is absent. It writes the error response when it is invalid.
+func intParam(w http.ResponseWriter, r *http.Request, name string, def int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s '%s'", name, v))
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"adblocker/audit"
+	"adblocker/config"
+	"adblocker/engine"
+)
+
+const (
+	defaultGuestDuration    = 24 * time.Hour
+	defaultMaxGuestDuration = 7 * 24 * time.Hour
+)
+
+var errNoGuestGroup = errors.New("user_group is required (or set guests.user_group)")
+
+// RegisterGuests lets visitors' devices be bound to a user group for a
+// while without editing the config file:
+//
+//	GET    /api/guests          guests in effect
+//	PUT    /api/guests/{name}   {"ips": [...], "macs": [...], "user_group": "guest", "duration": "4h"}
+//	DELETE /api/guests/{name}   end a visit early
+//
+// Guests expire on their own and are kept in the data dir across restarts.
+// settings is read per request so defaults change on reload.
+func (s *Server) RegisterGuests(eng *engine.Engine, settings func() config.Guests, auditLog *audit.Log) {
+	s.mux.HandleFunc("GET /api/guests", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, eng.Guests())
+	})
+	s.mux.HandleFunc("PUT /api/guests/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IPs       []string `json:"ips"`
+			MACs      []string `json:"macs"`
+			UserGroup string   `json:"user_group"`
+			Duration  string   `json:"duration"` // e.g. "4h"
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		gc := settings()
+		d := gc.Duration
+		if d <= 0 {
+			d = defaultGuestDuration
+		}
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration '%s'", req.Duration))
+				return
+			}
+		}
+		maxDuration := gc.MaxDuration
+		if maxDuration <= 0 {
+			maxDuration = defaultMaxGuestDuration
+		}
+		if d > maxDuration {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duration exceeds %s", maxDuration))
+			return
+		}
+		if req.UserGroup == "" {
+			req.UserGroup = gc.UserGroup
+		}
+		if req.UserGroup == "" {
+			writeError(w, http.StatusBadRequest, errNoGuestGroup)
+			return
+		}
+
+		g := engine.Guest{
+			Name:      r.PathValue("name"),
+			IPs:       req.IPs,
+			MACs:      req.MACs,
+			UserGroup: req.UserGroup,
+			Until:     eng.Now().Add(d),
+			CreatedBy: r.RemoteAddr,
+		}
+		if err := eng.SetGuest(g); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		detail := fmt.Sprintf("user_group=%s duration=%s ips=%v macs=%v", g.UserGroup, d, g.IPs, g.MACs)
+		auditLog.Record(audit.Entry{Actor: "admin", Remote: r.RemoteAddr, Action: "guest.set", Target: g.Name, Detail: detail})
+		log.Printf("[GUEST] '%s' in user group '%s' until %s", g.Name, g.UserGroup, g.Until.Format(time.RFC3339))
+		writeJSON(w, g)
+	})
+	s.mux.HandleFunc("DELETE /api/guests/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := eng.RemoveGuest(name); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, engine.ErrNoGuest) {
+				status = http.StatusNotFound
+			}
+			writeError(w, status, err)
+			return
+		}
+		auditLog.Record(audit.Entry{Actor: "admin", Remote: r.RemoteAddr, Action: "guest.remove", Target: name})
+		log.Printf("[GUEST] Removed '%s'", name)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,203 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"adblocker/audit"
+	"adblocker/config"
+	"adblocker/engine"
+	"adblocker/tokens"
+)
+
+// defaultMaxOverride caps override durations when parent_control.max_duration is unset.
+const defaultMaxOverride = 24 * time.Hour
+
+var (
+	errParentDisabled = errors.New("parent_control.password is not configured")
+	errUnauthorized   = errors.New("wrong password")
+	errNoOverride     = errors.New("no override for this user")
+)
+
+// RegisterParentOverride lets a parent lift or tighten filtering for one
+// device for a while:
+//
+//	GET    /api/parent/overrides          overrides in effect
+//	PUT    /api/parent/overrides/{user}   {"mode": "pause|block|user_group", "user_group": "...", "duration": "1h", "reason": "..."}
+//	DELETE /api/parent/overrides/{user}   end an override early
+//
+// Requests need the parent_control password (basic auth) or an API token with
+// the pause scope, which may only pause and only replace or end its own
+// pauses (see SetTokens). Every change is
+// written to the audit log, which GET /api/audit?limit=N returns newest first.
+// settings is read per request so password changes apply on reload;
+// onChange runs after every change (e.g. to flush cached decisions).
+func (s *Server) RegisterParentOverride(eng *engine.Engine, settings func() config.ParentControl, auditLog *audit.Log, onChange func()) {
+	auth := func(w http.ResponseWriter, r *http.Request) (pc config.ParentControl, actor string, ok bool) {
+		pc = settings()
+		if t, ok := requestToken(r); ok {
+			return pc, "token:" + t.Name, true
+		}
+		if pc.Password == "" && pc.PasswordSHA256 == "" {
+			writeError(w, http.StatusNotFound, errParentDisabled)
+			return pc, "", false
+		}
+		if !checkPassword(pc, r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="adblocker parent control"`)
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			auditLog.Record(audit.Entry{Actor: "parent", Remote: r.RemoteAddr, Action: "override.auth_failed", Target: r.PathValue("user")})
+			return pc, "", false
+		}
+		return pc, "parent", true
+	}
+
+	s.mux.HandleFunc("GET /api/parent/overrides", func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := auth(w, r); !ok {
+			return
+		}
+		writeJSON(w, eng.Overrides())
+	})
+	s.mux.HandleFunc("PUT /api/parent/overrides/{user}", func(w http.ResponseWriter, r *http.Request) {
+		pc, actor, ok := auth(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Mode      engine.OverrideMode `json:"mode"`
+			UserGroup string              `json:"user_group"`
+			Duration  string              `json:"duration"` // e.g. "30m"
+			Reason    string              `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if t, ok := requestToken(r); ok && t.Scope == tokens.ScopePause {
+			if req.Mode != engine.OverridePause {
+				writeError(w, http.StatusForbidden, fmt.Errorf("token '%s' with scope pause may only pause", t.Name))
+				return
+			}
+			if o, found := findOverride(eng, r.PathValue("user")); found && !ownPause(o, t) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("token '%s' with scope pause may not replace an override set by %s", t.Name, o.SetBy))
+				return
+			}
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration '%s'", req.Duration))
+			return
+		}
+		maxDuration := pc.MaxDuration
+		if maxDuration <= 0 {
+			maxDuration = defaultMaxOverride
+		}
+		if d > maxDuration {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duration exceeds %s", maxDuration))
+			return
+		}
+
+		o := engine.DeviceOverride{
+			User:      r.PathValue("user"),
+			Mode:      req.Mode,
+			UserGroup: req.UserGroup,
+			Until:     eng.Now().Add(d),
+			SetBy:     actor,
+			Reason:    req.Reason,
+		}
+		if err := eng.SetOverride(o); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		onChange()
+
+		detail := fmt.Sprintf("mode=%s duration=%s", o.Mode, d)
+		if o.UserGroup != "" {
+			detail += " user_group=" + o.UserGroup
+		}
+		if o.Reason != "" {
+			detail += " reason=" + strconv.Quote(o.Reason)
+		}
+		auditLog.Record(audit.Entry{Actor: actor, Remote: r.RemoteAddr, Action: "override.set", Target: o.User, Detail: detail})
+		log.Printf("[OVERRIDE] %s for '%s' until %s", o.Mode, o.User, o.Until.Format(time.RFC3339))
+		writeJSON(w, o)
+	})
+	s.mux.HandleFunc("DELETE /api/parent/overrides/{user}", func(w http.ResponseWriter, r *http.Request) {
+		_, actor, ok := auth(w, r)
+		if !ok {
+			return
+		}
+		user := r.PathValue("user")
+		if t, ok := requestToken(r); ok && t.Scope == tokens.ScopePause {
+			if o, found := findOverride(eng, user); found && !ownPause(o, t) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("token '%s' with scope pause may only end its own pauses", t.Name))
+				return
+			}
+		}
+		if !eng.ClearOverride(user) {
+			writeError(w, http.StatusNotFound, errNoOverride)
+			return
+		}
+		onChange()
+		auditLog.Record(audit.Entry{Actor: actor, Remote: r.RemoteAddr, Action: "override.clear", Target: user})
+		log.Printf("[OVERRIDE] Cleared for '%s'", user)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s.mux.HandleFunc("GET /api/audit", func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit '%s'", v))
+				return
+			}
+			limit = n
+		}
+		entries, err := auditLog.Recent(limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, entries)
+	})
+}
+
+// checkPassword reports whether r carries the parent_control password as
+// basic auth.
+func checkPassword(pc config.ParentControl, r *http.Request) bool {
+	want := pc.PasswordSHA256
+	if pc.Password != "" {
+		sum := sha256.Sum256([]byte(pc.Password))
+		want = hex.EncodeToString(sum[:])
+	}
+	_, password, ok := r.BasicAuth()
+	if want == "" || !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(want))) == 1
+}
+
+// findOverride returns the override of user in effect, if any.
+func findOverride(eng *engine.Engine, user string) (engine.DeviceOverride, bool) {
+	for _, o := range eng.Overrides() {
+		if o.User == user {
+			return o, true
+		}
+	}
+	return engine.DeviceOverride{}, false
+}
+
+// ownPause reports whether o is a pause set with the token t.
+func ownPause(o engine.DeviceOverride, t tokens.Token) bool {
+	return o.Mode == engine.OverridePause && o.SetBy == "token:"+t.Name
+}
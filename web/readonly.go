@@ -0,0 +1,46 @@
+package web
+
+import (
+	"net/http"
+
+	"adblocker/config"
+)
+
+// readOnlyAllowed are the endpoints that keep accepting changes in read-only
+// mode: signals from other systems, diagnostics and re-reading the config
+// file, not edits an operator could make drift from the config file with.
+var readOnlyAllowed = []string{
+	"/api/stats/push",
+	"/api/standby",
+	"/api/presence/",
+	"/api/debug/dump",
+	"/api/config/reload", // Applies the file, the source of truth
+}
+
+// SetReadOnly makes the admin server reject requests that change state
+// (any method but GET, HEAD and OPTIONS) while readOnly returns true, for
+// deployments whose config is managed elsewhere, e.g. in git.
+func (s *Server) SetReadOnly(readOnly func() bool) {
+	s.mu.Lock()
+	s.readOnly = readOnly
+	s.mu.Unlock()
+}
+
+// checkReadOnly wraps the mux with the read-only check.
+func (s *Server) checkReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		readOnly := s.readOnly
+		s.mu.RUnlock()
+		if readOnly != nil && mutating(r) && readOnly() {
+			writeError(w, http.StatusForbidden, config.ErrReadOnly)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mutating reports whether r may change state and is not in readOnlyAllowed.
+func mutating(r *http.Request) bool {
+	return isWrite(r) && !matchPath(readOnlyAllowed, r.URL.Path)
+}
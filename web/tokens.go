@@ -0,0 +1,194 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"adblocker/config"
+	"adblocker/tokens"
+)
+
+var (
+	errNoCredentials = errors.New("changes through the admin API need an API token (adblocker token create) or parent_control.password")
+	errCrossOrigin   = errors.New("cross-origin request refused")
+)
+
+// ownAuth are the endpoints that check credentials of their own (stats
+// push, standby and webhook tokens), left alone by API tokens.
+var ownAuth = []string{
+	"/api/stats/push",
+	"/api/standby",
+	"/api/presence/",
+}
+
+type tokenKey struct{}
+
+// SetTokens makes the /api/ endpoints require an "Authorization: Bearer"
+// token from store whose scope allows the request, once store holds any
+// tokens. Health checks and metrics stay open. Requests that change state
+// always need a credential: a token, or the parent_control password as
+// basic auth (see SetParentControl); with neither configured they are
+// refused.
+func (s *Server) SetTokens(store *tokens.Store) {
+	s.mu.Lock()
+	s.tokens = store
+	s.mu.Unlock()
+}
+
+// SetParentControl makes the parent_control password from settings a
+// credential for the whole admin API. settings is read per request so
+// password changes apply on reload.
+func (s *Server) SetParentControl(settings func() config.ParentControl) {
+	s.mu.Lock()
+	s.parentControl = settings
+	s.mu.Unlock()
+}
+
+// checkToken wraps the mux with the API token check.
+func (s *Server) checkToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || matchPath(ownAuth, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if t, ok := s.authorize(w, r); ok {
+			if t.Name != "" {
+				r = r.WithContext(context.WithValue(r.Context(), tokenKey{}, t))
+			}
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorize checks the credentials of r, writing the error response when
+// it returns false. A request authorized with a token returns it.
+//
+//  1. Browsers attach basic auth to any request to the server, so changes
+//     must come from the dashboard itself, not from another site
+//  2. The parent_control password allows everything; a wrong one is left to
+//     the parent override endpoints, which audit failed attempts
+//  3. Reads need a token once any exists, changes need a credential always
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (tokens.Token, bool) {
+	s.mu.RLock()
+	store, parent := s.tokens, s.parentControl
+	s.mu.RUnlock()
+
+	write := isWrite(r)
+	if write && crossOrigin(r) {
+		writeError(w, http.StatusForbidden, errCrossOrigin)
+		return tokens.Token{}, false
+	}
+
+	var password bool // parent_control.password is configured
+	if parent != nil {
+		pc := parent()
+		password = pc.Password != "" || pc.PasswordSHA256 != ""
+		if _, _, basic := r.BasicAuth(); basic {
+			if checkPassword(pc, r) {
+				return tokens.Token{}, true
+			}
+			if strings.HasPrefix(r.URL.Path, "/api/parent/") {
+				return tokens.Token{}, true // Refused and audited there
+			}
+			challenge(w, true, false)
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return tokens.Token{}, false
+		}
+	}
+
+	var t tokens.Token
+	var ok, required bool
+	if store != nil {
+		secret, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var err error
+		if t, ok, required, err = store.Check(secret); err != nil {
+			log.Printf("[TOKEN] Failed to read tokens: %v", err)
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read tokens"))
+			return t, false
+		}
+	}
+	switch {
+	case ok && !t.Scope.Allows(r.Method, r.URL.Path):
+		writeError(w, http.StatusForbidden, fmt.Errorf("token '%s' with scope %s does not allow %s %s", t.Name, t.Scope, r.Method, r.URL.Path))
+		return t, false
+	case ok, !required && !write:
+		return t, true
+	case !required && !password:
+		writeError(w, http.StatusForbidden, errNoCredentials)
+		return t, false
+	default:
+		challenge(w, password, required)
+		writeError(w, http.StatusUnauthorized, errBadToken)
+		return t, false
+	}
+}
+
+// challenge asks for the credentials the server accepts. Browsers prompt
+// for the basic auth password, so the dashboard works with it.
+func challenge(w http.ResponseWriter, password, token bool) {
+	if password {
+		w.Header().Add("WWW-Authenticate", `Basic realm="adblocker"`)
+	}
+	if token {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="adblocker"`)
+	}
+}
+
+// isWrite reports whether r may change state.
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// crossOrigin reports whether a browser sent r from a page of another
+// origin. Requests without an Origin header come from other clients.
+func crossOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// adminToken reports whether secret is an API token with the admin scope.
+func (s *Server) adminToken(secret string) bool {
+	s.mu.RLock()
+	store := s.tokens
+	s.mu.RUnlock()
+	if store == nil || secret == "" {
+		return false
+	}
+	t, ok, _, err := store.Check(secret)
+	if err != nil {
+		log.Printf("[TOKEN] Failed to read tokens: %v", err)
+	}
+	return ok && t.Scope == tokens.ScopeAdmin
+}
+
+// requestToken returns the API token r was authorized with, if any.
+func requestToken(r *http.Request) (tokens.Token, bool) {
+	t, ok := r.Context().Value(tokenKey{}).(tokens.Token)
+	return t, ok
+}
+
+// matchPath reports whether path is one of paths, or below one ending in "/".
+func matchPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
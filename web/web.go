@@ -0,0 +1,101 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"adblocker/config"
+	"adblocker/metrics"
+	"adblocker/tokens"
+)
+
+// Server is the admin HTTP server (health checks, metrics).
+type Server struct {
+	Addr string
+	mux  *http.ServeMux
+	srv  *http.Server
+
+	mu       sync.RWMutex
+	checks   map[string]func() error
+	readOnly func() bool   // See SetReadOnly
+	tokens   *tokens.Store // See SetTokens
+
+	parentControl func() config.ParentControl // See SetParentControl
+}
+
+// NewServer creates an admin server with the built-in endpoints registered.
+func NewServer(addr string) *Server {
+	s := &Server{
+		Addr:   addr,
+		mux:    http.NewServeMux(),
+		checks: make(map[string]func() error),
+	}
+
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	s.mux.Handle("/metrics", metrics.Default)
+
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           s.checkToken(s.checkReadOnly(s.mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Handle registers an additional handler on the admin server.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// AddReadinessCheck registers a named check; /readyz fails while any check returns an error.
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.mu.Lock()
+	s.checks[name] = check
+	s.mu.Unlock()
+}
+
+func (s *Server) Start() error {
+	log.Printf("Admin server listening on %s", s.Addr)
+	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failed []string
+	for _, name := range names {
+		if err := s.checks[name](); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(failed) > 0 {
+		http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}